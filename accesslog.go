@@ -0,0 +1,265 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AccessLog records one read of patient-identifiable data: who viewed
+// which patients' data, when and from where. Entries expire after
+// ACCESS_LOG_RETENTION.
+type AccessLog struct {
+    ID         primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
+    At         time.Time            `json:"at" bson:"at"`
+    Actor      string               `json:"actor,omitempty" bson:"actor,omitempty"`
+    IP         string               `json:"ip" bson:"ip"`
+    UserAgent  string               `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+    Method     string               `json:"method" bson:"method"`
+    Path       string               `json:"path" bson:"path"`
+    Resource   string               `json:"resource" bson:"resource"`
+    ResourceID string               `json:"resourceId,omitempty" bson:"resourceId,omitempty"`
+    PatientIDs []primitive.ObjectID `json:"patientIds" bson:"patientIds"`
+    Status     int                  `json:"status" bson:"status"`
+}
+
+var accessLogCollection *mongo.Collection
+
+func initAccessLogs(ctx context.Context, db *mongo.Database) {
+    accessLogCollection = db.Collection("access_log")
+
+    retention := int32(config.AccessLogRetention / time.Second)
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "patientIds", Value: 1}, {Key: "at", Value: -1}}},
+        {Keys: bson.D{{Key: "actor", Value: 1}, {Key: "at", Value: -1}}},
+        {Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(retention)},
+    }
+    if _, err := accessLogCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        // The TTL index exists with another retention: update it in place
+        err = db.RunCommand(ctx, bson.D{
+            {Key: "collMod", Value: "access_log"},
+            {Key: "index", Value: bson.D{
+                {Key: "keyPattern", Value: bson.D{{Key: "at", Value: 1}}},
+                {Key: "expireAfterSeconds", Value: retention},
+            }},
+        }).Err()
+        if err != nil {
+            log.Printf("Error creating access log indexes: %v\n", err)
+        }
+    }
+}
+
+type accessKey struct{}
+
+// accessRecord collects the patients a request exposes.
+type accessRecord struct {
+    mu         sync.Mutex
+    patientIDs []primitive.ObjectID
+}
+
+// notePatientAccess records that the response of a logged request exposes
+// the data of patients.
+func notePatientAccess(ctx context.Context, patientIDs ...primitive.ObjectID) {
+    record, ok := ctx.Value(accessKey{}).(*accessRecord)
+    if !ok {
+        return
+    }
+    record.mu.Lock()
+    defer record.mu.Unlock()
+    for _, id := range patientIDs {
+        if !id.IsZero() && !containsID(record.patientIDs, id) {
+            record.patientIDs = append(record.patientIDs, id)
+        }
+    }
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+    for _, other := range ids {
+        if other == id {
+            return true
+        }
+    }
+    return false
+}
+
+// statusRecorder captures the status code of a response.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+    if rec.status == 0 {
+        rec.status = status
+    }
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+// logAccess records the reads of a route serving patient data as resource.
+// On /patients/{id}/... routes the path names the patient; other handlers
+// report the patients they return with notePatientAccess. Requests of
+// unauthenticated routes are attributed to the account of their token when
+// they carry one.
+func logAccess(resource string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            next(w, r)
+            return
+        }
+
+        record := &accessRecord{}
+        rec := &statusRecorder{ResponseWriter: w}
+        next(rec, r.WithContext(context.WithValue(r.Context(), accessKey{}, record)))
+
+        entry := AccessLog{
+            At:         time.Now(),
+            Actor:      actorFromContext(r.Context()),
+            IP:         clientIP(r),
+            UserAgent:  r.UserAgent(),
+            Method:     r.Method,
+            Path:       r.URL.Path,
+            Resource:   resource,
+            ResourceID: r.PathValue("id"),
+            PatientIDs: record.patientIDs,
+            Status:     rec.status,
+        }
+        if entry.Actor == "" {
+            if user, _, err := authenticate(r); err == nil {
+                entry.Actor = user.Email
+            }
+        }
+        if strings.HasPrefix(r.Pattern, "/patients/{id}/") {
+            if id, err := primitive.ObjectIDFromHex(entry.ResourceID); err == nil {
+                entry.PatientIDs = append(entry.PatientIDs, id)
+            }
+        }
+        if entry.PatientIDs == nil {
+            entry.PatientIDs = []primitive.ObjectID{}
+        }
+
+        ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+        defer cancel()
+        if _, err := accessLogCollection.InsertOne(ctx, entry); err != nil {
+            log.Printf("Error recording access to %s: %v\n", r.URL.Path, err)
+        }
+    }
+}
+
+// Access log handlers
+
+// exportAccessLogs exports access log entries for compliance reviews,
+// filtered by ?patientId=, ?actor=, ?from= and ?to= (RFC 3339), as JSON or
+// with ?format=csv as CSV. The export itself is logged.
+func exportAccessLogs(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := r.URL.Query()
+    filter := bson.M{}
+    if v := query.Get("patientId"); v != "" {
+        id, err := primitive.ObjectIDFromHex(v)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+            return
+        }
+        filter["patientIds"] = id
+    }
+    if v := query.Get("actor"); v != "" {
+        filter["actor"] = v
+    }
+    at := bson.M{}
+    for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+        v := query.Get(param)
+        if v == "" {
+            continue
+        }
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_time", param)
+            return
+        }
+        at[op] = t
+    }
+    if len(at) > 0 {
+        filter["at"] = at
+    }
+
+    ctx := r.Context()
+
+    cursor, err := accessLogCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "at", Value: 1}}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer cursor.Close(ctx)
+
+    if query.Get("format") != "csv" {
+        entries := []AccessLog{}
+        if err := cursor.All(ctx, &entries); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        notePatientAccess(ctx, filterPatient(filter)...)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(entries)
+        return
+    }
+
+    // Stream large exports
+    notePatientAccess(ctx, filterPatient(filter)...)
+    w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+    w.Header().Set("Content-Disposition", `attachment; filename="access-log.csv"`)
+    out := csv.NewWriter(w)
+    out.Write([]string{"at", "actor", "ip", "userAgent", "method", "path", "resource", "resourceId", "patientIds", "status"})
+    for cursor.Next(ctx) {
+        var entry AccessLog
+        if err := cursor.Decode(&entry); err != nil {
+            log.Printf("Error exporting access log: %v\n", err)
+            break
+        }
+        patients := make([]string, len(entry.PatientIDs))
+        for i, id := range entry.PatientIDs {
+            patients[i] = id.Hex()
+        }
+        out.Write([]string{
+            entry.At.UTC().Format(time.RFC3339), entry.Actor, entry.IP, entry.UserAgent, entry.Method,
+            entry.Path, entry.Resource, entry.ResourceID, strings.Join(patients, " "), strconv.Itoa(entry.Status),
+        })
+    }
+    if err := cursor.Err(); err != nil {
+        log.Printf("Error exporting access log: %v\n", err)
+    }
+    out.Flush()
+}
+
+func filterPatient(filter bson.M) []primitive.ObjectID {
+    if id, ok := filter["patientIds"].(primitive.ObjectID); ok {
+        return []primitive.ObjectID{id}
+    }
+    return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "context"
+
+type actorKey struct{}
+
+// contextWithActor attaches the authenticated user to a request context so
+// repository hooks can attribute writes to them.
+func contextWithActor(ctx context.Context, actor string) context.Context {
+    return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFromContext returns the authenticated user of the request, or "" for
+// anonymous requests.
+func actorFromContext(ctx context.Context) string {
+    actor, _ := ctx.Value(actorKey{}).(string)
+    return actor
+}
+
+type userKey struct{}
+
+// contextWithUser attaches an authenticated account to a request context,
+// making it the actor of the request.
+func contextWithUser(ctx context.Context, user *User) context.Context {
+    ctx = context.WithValue(ctx, userKey{}, user)
+    return contextWithActor(ctx, user.Email)
+}
+
+// userFromContext returns the authenticated account of the request, or nil
+// when the request is anonymous or authenticated by ADMIN_TOKEN.
+func userFromContext(ctx context.Context) *User {
+    user, _ := ctx.Value(userKey{}).(*User)
+    return user
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// requireAdmin guards administrative routes with the ADMIN_TOKEN bearer
+// token or the access token of an admin account. ADMIN_TOKEN is only
+// accepted when configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if config.AdminToken != "" && ok &&
+            subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1 {
+            next(w, r.WithContext(contextWithActor(r.Context(), "admin")))
+            return
+        }
+
+        user, session, err := authenticate(r)
+        if errors.Is(err, errCSRF) {
+            localizedError(w, r, http.StatusForbidden, "csrf_failed")
+            return
+        }
+        if err != nil {
+            w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+            localizedError(w, r, http.StatusUnauthorized, "unauthorized")
+            return
+        }
+        if user.Role != RoleAdmin {
+            localizedError(w, r, http.StatusForbidden, "forbidden")
+            return
+        }
+        next(w, r.WithContext(contextWithSession(contextWithUser(r.Context(), user), session)))
+    }
+}
+
+// AdminSummary holds the counts shown on the overview of the admin app.
+type AdminSummary struct {
+    Actor             string           `json:"actor"`
+    Patients          int64            `json:"patients"`
+    Doctors           int64            `json:"doctors"`
+    Departments       int64            `json:"departments"`
+    AppointmentsToday AppointmentCount `json:"appointmentsToday"`
+}
+
+type AppointmentCount struct {
+    Total    int64            `json:"total"`
+    ByStatus map[string]int64 `json:"byStatus"`
+}
+
+// getAdminSummary counts the live patients, doctors and departments and
+// today's appointments by status: GET /admin/summary
+func getAdminSummary(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    summary := AdminSummary{
+        Actor:             actorFromContext(ctx),
+        AppointmentsToday: AppointmentCount{ByStatus: map[string]int64{}},
+    }
+    live := bson.M{"deletedAt": nil}
+    counts := []struct {
+        coll  *mongo.Collection
+        count *int64
+    }{
+        {patientCollection, &summary.Patients},
+        {doctorCollection, &summary.Doctors},
+        {departmentCollection, &summary.Departments},
+    }
+    for _, c := range counts {
+        n, err := c.coll.CountDocuments(ctx, live)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        *c.count = n
+    }
+
+    start, end := dayBounds(time.Now())
+    cursor, err := appointmentCollection.Aggregate(ctx, mongo.Pipeline{
+        {{Key: "$match", Value: bson.M{"deletedAt": nil, "dateTime": bson.M{"$gte": start, "$lt": end}}}},
+        {{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var groups []struct {
+        Status string `bson:"_id"`
+        Count  int64  `bson:"count"`
+    }
+    if err := cursor.All(ctx, &groups); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    for _, g := range groups {
+        summary.AppointmentsToday.ByStatus[g.Status] = g.Count
+        summary.AppointmentsToday.Total += g.Count
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,54 @@
+// Package adminui serves the administration single page app. The app is a
+// few static files embedded in the binary; it talks to the API with the
+// cookie session of an admin account.
+package adminui
+
+import (
+    "embed"
+    "io/fs"
+    "net/http"
+    "path"
+    "strings"
+)
+
+//go:embed static
+var files embed.FS
+
+// Handler serves the app under prefix, e.g. /admin/. Paths that name no
+// file get the app itself so that the app's own links can be reloaded.
+func Handler(prefix string) http.Handler {
+    static, err := fs.Sub(files, "static")
+    if err != nil {
+        panic(err)
+    }
+    fileServer := http.StripPrefix(prefix, http.FileServerFS(static))
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        name := strings.TrimPrefix(r.URL.Path, prefix)
+        if name == "" || name == "index.html" {
+            serveIndex(w, r, static)
+            return
+        }
+        if _, err := fs.Stat(static, path.Clean(name)); err != nil {
+            serveIndex(w, r, static)
+            return
+        }
+        w.Header().Set("Cache-Control", "no-cache")
+        fileServer.ServeHTTP(w, r)
+    })
+}
+
+func serveIndex(w http.ResponseWriter, r *http.Request, static fs.FS) {
+    index, err := fs.ReadFile(static, "index.html")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Write(index)
+}
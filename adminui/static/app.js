@@ -0,0 +1,308 @@
+'use strict';
+
+// The app signs in with a cookie session; state changing requests carry
+// the session's CSRF token, kept for the lifetime of the tab.
+const csrfKey = 'csrfToken';
+
+class APIError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(method, path, body, contentType = 'application/json') {
+  const headers = { 'Accept': 'application/json' };
+  if (method !== 'GET') {
+    headers['X-CSRF-Token'] = sessionStorage.getItem(csrfKey) || '';
+  }
+  if (body !== undefined) {
+    headers['Content-Type'] = contentType;
+  }
+  const response = await fetch(path, {
+    method,
+    headers,
+    credentials: 'same-origin',
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (!response.ok) {
+    throw new APIError(response.status, (await response.text()).trim());
+  }
+  if (response.status === 204) {
+    return null;
+  }
+  return response.json();
+}
+
+function el(tag, text, attrs = {}) {
+  const node = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    node.textContent = text;
+  }
+  for (const [name, value] of Object.entries(attrs)) {
+    node.setAttribute(name, value);
+  }
+  return node;
+}
+
+function row(cells) {
+  const tr = el('tr');
+  for (const cell of cells) {
+    const td = el('td');
+    if (cell instanceof Node) {
+      td.append(cell);
+    } else {
+      td.textContent = cell ?? '';
+    }
+    tr.append(td);
+  }
+  return tr;
+}
+
+function showError(err) {
+  const box = document.getElementById('error');
+  box.textContent = err ? err.message : '';
+  box.hidden = !err;
+}
+
+function show(id) {
+  for (const section of document.querySelectorAll('main > section')) {
+    section.hidden = section.id !== id;
+  }
+}
+
+function today() {
+  const now = new Date();
+  const pad = (n) => String(n).padStart(2, '0');
+  return `${now.getFullYear()}-${pad(now.getMonth() + 1)}-${pad(now.getDate())}`;
+}
+
+// Views
+
+async function overview() {
+  const summary = await api('GET', '/admin/summary');
+  const list = document.getElementById('summary');
+  list.replaceChildren();
+  const entries = [
+    ['Patients', summary.patients],
+    ['Doctors', summary.doctors],
+    ['Departments', summary.departments],
+    ['Appointments today', summary.appointmentsToday.total],
+  ];
+  for (const [status, count] of Object.entries(summary.appointmentsToday.byStatus)) {
+    entries.push([`Today: ${status}`, count]);
+  }
+  for (const [label, value] of entries) {
+    const item = el('div');
+    item.append(el('dt', label), el('dd', value));
+    list.append(item);
+  }
+}
+
+function formatHours(hours) {
+  return (hours || []).map((h) => `${h.day} ${h.open}-${h.close}`).join(', ');
+}
+
+function parseHours(text) {
+  return text.split(',').map((s) => s.trim()).filter(Boolean).map((s) => {
+    const [day, range] = s.split(/\s+/);
+    const [open, close] = (range || '').split('-');
+    return { day, open, close };
+  });
+}
+
+async function departments() {
+  const list = await api('GET', '/departments');
+  const body = document.querySelector('#departments tbody');
+  body.replaceChildren();
+  for (const department of list) {
+    const edit = el('button', 'Edit hours', { type: 'button' });
+    edit.addEventListener('click', async () => {
+      const text = prompt('Operating hours, e.g. "mon 08:00-17:00, tue 08:00-17:00"', formatHours(department.operatingHours));
+      if (text === null) {
+        return;
+      }
+      try {
+        await api('PUT', `/admin/departments/${department.id}/hours`, parseHours(text));
+        await departments();
+      } catch (err) {
+        showError(err);
+      }
+    });
+    body.append(row([department.name, department.description, formatHours(department.operatingHours), edit]));
+  }
+}
+
+function fillSelect(select, options, current) {
+  select.replaceChildren(el('option', '', { value: '' }));
+  for (const [value, label] of options) {
+    const option = el('option', label, { value });
+    option.selected = value === current;
+    select.append(option);
+  }
+}
+
+async function doctors() {
+  const [list, specializations, departmentList] = await Promise.all([
+    api('GET', '/doctors'),
+    api('GET', '/specializations'),
+    api('GET', '/departments'),
+  ]);
+  const form = document.getElementById('doctor-form');
+  fillSelect(form.elements.specialization, specializations.map((s) => [s.code, s.name]));
+  fillSelect(form.elements.department, departmentList.map((d) => [d.name, d.name]));
+
+  const body = document.querySelector('#doctors tbody');
+  body.replaceChildren();
+  for (const doctor of list) {
+    const edit = el('button', 'Edit', { type: 'button' });
+    edit.addEventListener('click', async () => {
+      const department = prompt('Department', doctor.department);
+      if (department === null) {
+        return;
+      }
+      const contactNo = prompt('Contact number', doctor.contactNo);
+      if (contactNo === null) {
+        return;
+      }
+      try {
+        await api('PATCH', `/doctors/${doctor.id}`, { department, contactNo }, 'application/merge-patch+json');
+        await doctors();
+      } catch (err) {
+        showError(err);
+      }
+    });
+    body.append(row([doctor.name, doctor.email, doctor.specialization, doctor.department, doctor.contactNo, edit]));
+  }
+}
+
+async function appointments() {
+  const list = await api('GET', `/appointments/list?date=${today()}&expand=patient,doctor`);
+  const body = document.querySelector('#appointments tbody');
+  body.replaceChildren();
+  list.sort((a, b) => a.dateTime.localeCompare(b.dateTime));
+  for (const appointment of list) {
+    const time = new Date(appointment.dateTime).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+    body.append(row([
+      time,
+      appointment.patient ? appointment.patient.name : appointment.patientId,
+      appointment.doctor ? appointment.doctor.name : appointment.doctorId,
+      appointment.statusLabel || appointment.status,
+      appointment.description,
+    ]));
+  }
+}
+
+const views = { '': overview, departments, doctors, appointments };
+
+async function route() {
+  const name = location.hash.replace(/^#\/?/, '');
+  const view = views[name] ? name : '';
+  showError(null);
+  show(view === '' ? 'overview' : view);
+  try {
+    await views[view]();
+  } catch (err) {
+    if (err.status === 401) {
+      signedOut();
+      return;
+    }
+    showError(err);
+  }
+}
+
+// Session
+
+function signedIn(user) {
+  document.getElementById('user-email').textContent = user ? user.email : 'admin';
+  document.querySelector('header nav').hidden = false;
+  document.querySelector('header .user').hidden = false;
+  route();
+}
+
+function signedOut() {
+  sessionStorage.removeItem(csrfKey);
+  document.querySelector('header nav').hidden = true;
+  document.querySelector('header .user').hidden = true;
+  show('login');
+}
+
+document.getElementById('login-form').addEventListener('submit', async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  try {
+    const session = await api('POST', '/auth/login', {
+      email: form.elements.email.value,
+      password: form.elements.password.value,
+      code: form.elements.code.value,
+      cookie: true,
+    });
+    if (session.user.role !== 'admin') {
+      throw new Error('This account is not an administrator.');
+    }
+    sessionStorage.setItem(csrfKey, session.csrfToken);
+    form.reset();
+    document.getElementById('code-field').hidden = true;
+    signedIn(session.user);
+  } catch (err) {
+    if (err.status === 401 && form.elements.password.value && !form.elements.code.value) {
+      // Accounts with two-factor authentication need a code
+      document.getElementById('code-field').hidden = false;
+    }
+    showError(err);
+  }
+});
+
+document.getElementById('logout').addEventListener('click', async () => {
+  try {
+    await api('POST', '/auth/logout');
+  } catch (err) {
+    // Signed out anyway
+  }
+  signedOut();
+});
+
+document.getElementById('department-form').addEventListener('submit', async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  try {
+    await api('POST', '/departments', {
+      name: form.elements.name.value,
+      description: form.elements.description.value,
+    });
+    form.reset();
+    await departments();
+  } catch (err) {
+    showError(err);
+  }
+});
+
+document.getElementById('doctor-form').addEventListener('submit', async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  try {
+    await api('POST', '/doctors', {
+      name: form.elements.name.value,
+      email: form.elements.email.value,
+      specialization: form.elements.specialization.value,
+      department: form.elements.department.value,
+      contactNo: form.elements.contactNo.value,
+    });
+    form.reset();
+    await doctors();
+  } catch (err) {
+    showError(err);
+  }
+});
+
+window.addEventListener('hashchange', route);
+
+api('GET', '/auth/me')
+  .then((user) => {
+    if (user.role !== 'admin') {
+      signedOut();
+      return;
+    }
+    signedIn(user);
+  })
+  .catch(signedOut);
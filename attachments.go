@@ -0,0 +1,337 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/gridfs"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Attachment is a file kept with the record of a patient, such as a scan
+// or a referral letter. Its bytes are in the attachments GridFS bucket.
+type Attachment struct {
+    Document    `bson:",inline"`
+    PatientID   primitive.ObjectID `json:"patientId" bson:"patientId"`
+    TenantID    string             `json:"tenantId,omitempty" bson:"tenantId,omitempty"` // charged for its storage
+    Name        string             `json:"name" bson:"name"`
+    ContentType string             `json:"contentType" bson:"contentType"`
+    Size        int64              `json:"size" bson:"size"`
+    SHA256      string             `json:"sha256" bson:"sha256"`
+    FileID      primitive.ObjectID `json:"-" bson:"fileId"`
+}
+
+var (
+    attachmentCollection *mongo.Collection
+    attachmentRepo       *Repository[Attachment, *Attachment]
+    attachmentBucket     *gridfs.Bucket
+)
+
+func initAttachments(ctx context.Context, db *mongo.Database) {
+    attachmentCollection = db.Collection("attachments")
+    attachmentRepo = NewRepository[Attachment](attachmentCollection, defaultHooks)
+
+    var err error
+    attachmentBucket, err = gridfs.NewBucket(db, options.GridFSBucket().SetName("attachments"))
+    if err != nil {
+        log.Fatalf("Error opening attachment bucket: %v", err)
+    }
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "patientId", Value: 1}, {Key: "_id", Value: 1}}}
+    if _, err := attachmentCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating attachment index: %v\n", err)
+    }
+}
+
+// Attachment handlers
+func patientAttachments(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getPatientAttachments(w, r)
+    case http.MethodPost:
+        uploadAttachment(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getPatientAttachments(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    attachments, err := attachmentRepo.List(ctx, bson.M{"patientId": patientID}, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, attachments)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(attachments)
+}
+
+// uploadAttachment stores the raw request body as a file of the patient:
+// POST /patients/{id}/attachments?name=scan.pdf
+//
+// The size is charged to the storage quotas of the patient's tenant and of
+// the uploader once the upload completes; files over quota are discarded.
+func uploadAttachment(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+    name := r.URL.Query().Get("name")
+    if name == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "name")
+        return
+    }
+    if r.ContentLength > config.AttachmentMaxBytes {
+        localizedError(w, r, http.StatusRequestEntityTooLarge, "body_too_large", config.AttachmentMaxBytes)
+        return
+    }
+
+    ctx := r.Context()
+
+    patient, err := patientRepo.GetByID(ctx, patientID)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "patient_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    attachment := Attachment{
+        PatientID:   patientID,
+        TenantID:    patient.TenantID,
+        Name:        name,
+        ContentType: r.Header.Get("Content-Type"),
+        FileID:      primitive.NewObjectID(),
+    }
+    if attachment.ContentType == "" {
+        attachment.ContentType = "application/octet-stream"
+    }
+
+    upload, err := attachmentBucket.OpenUploadStreamWithID(attachment.FileID, name)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    hash := sha256.New()
+    body := http.MaxBytesReader(w, r.Body, config.AttachmentMaxBytes)
+    attachment.Size, err = io.Copy(io.MultiWriter(upload, hash), body)
+    if err != nil {
+        upload.Abort()
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            localizedError(w, r, http.StatusRequestEntityTooLarge, "body_too_large", tooLarge.Limit)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := upload.Close(); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+    err = withTransaction(ctx, func(ctx context.Context) error {
+        if err := chargeQuota(ctx, attachment.TenantID, actorFromContext(ctx), QuotaStorage, attachment.Size); err != nil {
+            return err
+        }
+        return attachmentRepo.Create(ctx, &attachment)
+    })
+    if err != nil {
+        if err := attachmentBucket.DeleteContext(context.WithoutCancel(ctx), attachment.FileID); err != nil {
+            log.Printf("Error deleting attachment file %s: %v\n", attachment.FileID.Hex(), err)
+        }
+        var exceeded *quotaExceeded
+        if errors.As(err, &exceeded) {
+            writeQuotaError(w, r, exceeded)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(attachment)
+}
+
+// attachment serves (GET, HEAD) or deletes (DELETE) the file of an
+// attachment: /attachments/{id}. Files never change, so clients may keep
+// them for ATTACHMENT_CACHE_MAX_AGE, revalidate them by their SHA-256 and
+// resume downloads with Range requests.
+func attachment(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_attachment_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    attachment, err := attachmentRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "attachment_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !checkPatientAccess(w, r, attachment.PatientID) {
+        return
+    }
+
+    if r.Method == http.MethodDelete {
+        deleteAttachment(w, r, attachment)
+        return
+    }
+
+    notePatientAccess(ctx, attachment.PatientID)
+    file := &gridfsFile{bucket: attachmentBucket, id: attachment.FileID, size: attachment.Size}
+    defer file.Close()
+
+    w.Header().Set("Content-Type", attachment.ContentType)
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachment.Name))
+    w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(config.AttachmentCacheMaxAge.Seconds())))
+    w.Header().Set("ETag", strconv.Quote(attachment.SHA256))
+    http.ServeContent(w, r, attachment.Name, attachment.CreatedAt, file)
+}
+
+// gridfsFile reads a GridFS file of a known size from any offset, for
+// http.ServeContent to serve ranges of it. The stream is only opened on
+// the first read; seeking forward skips chunks, seeking back opens it
+// again.
+type gridfsFile struct {
+    bucket *gridfs.Bucket
+    id     primitive.ObjectID
+    size   int64
+    offset int64 // of the next read
+    stream *gridfs.DownloadStream
+    pos    int64 // of the stream
+}
+
+func (f *gridfsFile) Seek(offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekCurrent:
+        offset += f.offset
+    case io.SeekEnd:
+        offset += f.size
+    }
+    if offset < 0 {
+        return 0, errors.New("gridfs: seek before the start of the file")
+    }
+    f.offset = offset
+    return offset, nil
+}
+
+func (f *gridfsFile) Read(p []byte) (int, error) {
+    if f.stream == nil || f.offset < f.pos {
+        f.Close()
+        stream, err := f.bucket.OpenDownloadStream(f.id)
+        if err != nil {
+            return 0, err
+        }
+        f.stream, f.pos = stream, 0
+    }
+    if f.offset > f.pos {
+        skipped, err := f.stream.Skip(f.offset - f.pos)
+        f.pos += skipped
+        if err != nil {
+            return 0, err
+        }
+    }
+    n, err := f.stream.Read(p)
+    f.pos += int64(n)
+    f.offset = f.pos
+    return n, err
+}
+
+func (f *gridfsFile) Close() error {
+    if f.stream == nil {
+        return nil
+    }
+    err := f.stream.Close()
+    f.stream = nil
+    return err
+}
+
+// deleteAttachment deletes the file of an attachment and gives its size
+// back to the storage quotas it was charged to.
+func deleteAttachment(w http.ResponseWriter, r *http.Request, attachment *Attachment) {
+    ctx := r.Context()
+
+    err := withTransaction(ctx, func(ctx context.Context) error {
+        if err := attachmentRepo.SoftDelete(ctx, attachment.ID); err != nil {
+            return err
+        }
+        return chargeQuota(ctx, attachment.TenantID, attachment.CreatedBy, QuotaStorage, -attachment.Size)
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := attachmentBucket.DeleteContext(ctx, attachment.FileID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+        log.Printf("Error deleting attachment file %s: %v\n", attachment.FileID.Hex(), err)
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// deletePatientAttachments deletes the attachments of a patient with their
+// files for the retention policy, giving the sizes of those not deleted yet
+// back to the storage quotas they were charged to.
+func deletePatientAttachments(ctx context.Context, patientID primitive.ObjectID) error {
+    cursor, err := attachmentCollection.Find(ctx, bson.M{"patientId": patientID})
+    if err != nil {
+        return err
+    }
+    var attachments []Attachment
+    if err := cursor.All(ctx, &attachments); err != nil {
+        return err
+    }
+    for _, attachment := range attachments {
+        if attachment.DeletedAt == nil {
+            if err := chargeQuota(ctx, attachment.TenantID, attachment.CreatedBy, QuotaStorage, -attachment.Size); err != nil {
+                return err
+            }
+        }
+        if err := attachmentBucket.DeleteContext(ctx, attachment.FileID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+            return err
+        }
+    }
+    _, err = attachmentCollection.DeleteMany(ctx, bson.M{"patientId": patientID})
+    return err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "golang.org/x/crypto/bcrypt"
+
+    "new/totp"
+)
+
+// tokenClaims is the payload of an access token.
+type tokenClaims struct {
+    Subject   string `json:"sub"`
+    Role      string `json:"role"`
+    Session   string `json:"sid"`
+    IssuedAt  int64  `json:"iat"`
+    ExpiresAt int64  `json:"exp"`
+}
+
+var (
+    authKey []byte
+    // dummyHash is compared against for unknown accounts so that login
+    // takes as long whether or not the email exists.
+    dummyHash []byte
+)
+
+func initAuth(ctx context.Context, db *mongo.Database) {
+    authKey = []byte(config.AuthSecret)
+    if len(authKey) == 0 {
+        log.Println("AUTH_SECRET is not set, tokens will not survive a restart")
+        authKey = make([]byte, 32)
+        rand.Read(authKey)
+    }
+    dummyHash, _ = bcrypt.GenerateFromPassword([]byte(randomToken(16)), bcrypt.DefaultCost)
+
+    initUsers(ctx, db)
+    initPasswordResets(ctx, db)
+    initSessions(ctx, db)
+    initSSO(ctx, db)
+}
+
+// signToken encodes claims as base64url(JSON) "." base64url(HMAC-SHA256).
+func signToken(claims tokenClaims) string {
+    payload, _ := json.Marshal(claims)
+    encoded := base64.RawURLEncoding.EncodeToString(payload)
+    mac := hmac.New(sha256.New, authKey)
+    mac.Write([]byte(encoded))
+    return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseToken verifies the signature and expiry of a token.
+func parseToken(token string) (tokenClaims, error) {
+    var claims tokenClaims
+    encoded, signature, ok := strings.Cut(token, ".")
+    if !ok {
+        return claims, errors.New("malformed token")
+    }
+    sum, err := base64.RawURLEncoding.DecodeString(signature)
+    if err != nil {
+        return claims, err
+    }
+    mac := hmac.New(sha256.New, authKey)
+    mac.Write([]byte(encoded))
+    if !hmac.Equal(sum, mac.Sum(nil)) {
+        return claims, errors.New("invalid token signature")
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(encoded)
+    if err != nil {
+        return claims, err
+    }
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return claims, err
+    }
+    if time.Now().Unix() >= claims.ExpiresAt {
+        return claims, errors.New("token expired")
+    }
+    return claims, nil
+}
+
+// issueToken returns an access token of a session valid for
+// AUTH_TOKEN_TTL.
+func issueToken(user *User, session *Session) (string, time.Time) {
+    now := time.Now()
+    expires := now.Add(config.AuthTokenTTL)
+    return signToken(tokenClaims{
+        Subject:   user.ID.Hex(),
+        Role:      user.Role,
+        Session:   session.ID.Hex(),
+        IssuedAt:  now.Unix(),
+        ExpiresAt: expires.Unix(),
+    }), expires
+}
+
+// authenticate returns the account and session of the bearer token of r,
+// or of its session cookie. Tokens of revoked sessions and tokens issued
+// before the last password change are rejected, as are cookie
+// authenticated writes failing the CSRF check.
+func authenticate(r *http.Request) (*User, *Session, error) {
+    token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    fromCookie := false
+    if !ok {
+        cookie, err := r.Cookie(sessionCookie)
+        if err != nil {
+            return nil, nil, errors.New("missing bearer token")
+        }
+        token, fromCookie = cookie.Value, true
+    }
+    claims, err := parseToken(token)
+    if err != nil {
+        return nil, nil, err
+    }
+    id, err := primitive.ObjectIDFromHex(claims.Subject)
+    if err != nil {
+        return nil, nil, err
+    }
+    sessionID, err := primitive.ObjectIDFromHex(claims.Session)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    ctx := r.Context()
+
+    session, err := activeSession(ctx, bson.M{"_id": sessionID, "userId": id})
+    if err != nil {
+        return nil, nil, err
+    }
+    if fromCookie {
+        if err := checkCSRF(r, session); err != nil {
+            return nil, nil, err
+        }
+    }
+    var user User
+    err = userCollection.FindOne(ctx, bson.M{"_id": id, "deletedAt": nil}).Decode(&user)
+    if err != nil {
+        return nil, nil, err
+    }
+    if claims.IssuedAt < user.PasswordChangedAt.Unix() {
+        return nil, nil, errors.New("token issued before password change")
+    }
+    return &user, session, nil
+}
+
+// requireAuth guards routes with the bearer token of any account.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        user, session, err := authenticate(r)
+        if errors.Is(err, errCSRF) {
+            localizedError(w, r, http.StatusForbidden, "csrf_failed")
+            return
+        }
+        if err != nil {
+            w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+            localizedError(w, r, http.StatusUnauthorized, "unauthorized")
+            return
+        }
+        next(w, r.WithContext(contextWithSession(contextWithUser(r.Context(), user), session)))
+    }
+}
+
+// recordLoginFailure counts a failed login and locks the account for
+// LOGIN_LOCKOUT once LOGIN_MAX_FAILURES is reached.
+func recordLoginFailure(ctx context.Context, user *User) error {
+    var updated User
+    err := userCollection.FindOneAndUpdate(ctx,
+        bson.M{"_id": user.ID},
+        bson.M{"$inc": bson.M{"failedLogins": 1}},
+        options.FindOneAndUpdate().SetReturnDocument(options.After),
+    ).Decode(&updated)
+    if err != nil {
+        return err
+    }
+    if config.LoginMaxFailures <= 0 || updated.FailedLogins < config.LoginMaxFailures {
+        return nil
+    }
+
+    until := time.Now().Add(config.LoginLockout)
+    err = withTransaction(ctx, func(ctx context.Context) error {
+        err := userRepo.UpdateFields(ctx, user.ID,
+            bson.M{"failedLogins": updated.FailedLogins},
+            bson.M{"failedLogins": 0, "lockedUntil": until},
+        )
+        if err != nil {
+            return err
+        }
+        return publishEvent(ctx, "user.locked", user.ID, map[string]interface{}{
+            "userId":      user.ID,
+            "email":       user.Email,
+            "lockedUntil": until,
+        })
+    })
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        // Locked by a concurrent failure
+        return nil
+    }
+    return err
+}
+
+// Auth handlers
+
+// login exchanges credentials for an access token. Accounts with a second
+// factor also need the current code of their authenticator. Browser apps
+// set "cookie" to receive the tokens in cookies instead.
+func login(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var body struct {
+        Email    string `json:"email"`
+        Password string `json:"password"`
+        Code     string `json:"code"`
+        Cookie   bool   `json:"cookie"`
+    }
+    if !decodeJSON(w, r, &body) {
+        return
+    }
+
+    ctx := r.Context()
+
+    user, err := userByEmail(ctx, body.Email)
+    if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if user == nil {
+        bcrypt.CompareHashAndPassword(dummyHash, []byte(body.Password))
+        localizedError(w, r, http.StatusUnauthorized, "invalid_credentials")
+        return
+    }
+
+    now := time.Now()
+    if user.LockedUntil != nil && user.LockedUntil.After(now) {
+        w.Header().Set("Retry-After", strconv.Itoa(int(user.LockedUntil.Sub(now).Seconds())+1))
+        localizedError(w, r, http.StatusLocked, "account_locked")
+        return
+    }
+
+    failure := ""
+    if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(body.Password)) != nil {
+        failure = "invalid_credentials"
+    } else if user.TOTPEnabled && body.Code == "" {
+        // Not a failure: the client asks for the code and retries
+        localizedError(w, r, http.StatusUnauthorized, "mfa_required")
+        return
+    } else if user.TOTPEnabled && !totp.Validate(body.Code, user.TOTPSecret, now) {
+        failure = "invalid_mfa_code"
+    }
+    if failure != "" {
+        if err := recordLoginFailure(ctx, user); err != nil {
+            log.Printf("Error recording login failure of %s: %v\n", user.Email, err)
+        }
+        localizedError(w, r, http.StatusUnauthorized, failure)
+        return
+    }
+
+    err = userRepo.UpdateFields(contextWithUser(ctx, user), user.ID, nil, bson.M{
+        "failedLogins": 0,
+        "lockedUntil":  nil,
+        "lastLoginAt":  now,
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    startSession(w, r, user, body.Cookie)
+}
+
+// getCurrentUser returns the authenticated account: GET /auth/me
+func getCurrentUser(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(userFromContext(r.Context()))
+}
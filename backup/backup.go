@@ -0,0 +1,29 @@
+// Package backup stores database backups in pluggable object stores.
+package backup
+
+import (
+    "context"
+    "errors"
+    "io"
+    "time"
+)
+
+// Object is a stored backup.
+type Object struct {
+    Key      string
+    Size     int64
+    Modified time.Time
+}
+
+// Store keeps backup archives under keys of slash separated names.
+type Store interface {
+    Name() string
+    Put(ctx context.Context, key string, body io.Reader, size int64) error
+    Get(ctx context.Context, key string) (io.ReadCloser, error)
+    Delete(ctx context.Context, key string) error
+    // List returns the objects with keys starting with prefix, sorted by key.
+    List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// ErrNotFound is returned by Get for keys without an object.
+var ErrNotFound = errors.New("backup: object not found")
@@ -0,0 +1,109 @@
+package backup
+
+import (
+    "context"
+    "errors"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// Dir stores backups as files under a directory, typically a mounted
+// volume or network share.
+type Dir struct {
+    Path string
+}
+
+func NewDir(path string) *Dir {
+    return &Dir{Path: path}
+}
+
+func (d *Dir) Name() string { return "dir" }
+
+func (d *Dir) file(key string) (string, error) {
+    name := filepath.FromSlash(key)
+    if !filepath.IsLocal(name) {
+        return "", errors.New("backup: invalid key " + key)
+    }
+    return filepath.Join(d.Path, name), nil
+}
+
+// Put writes the object to a temporary file first, so readers never see a
+// partial backup.
+func (d *Dir) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+    path, err := d.file(key)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := io.Copy(tmp, body); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+func (d *Dir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+    path, err := d.file(key)
+    if err != nil {
+        return nil, err
+    }
+    f, err := os.Open(path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, ErrNotFound
+    }
+    return f, err
+}
+
+func (d *Dir) Delete(ctx context.Context, key string) error {
+    path, err := d.file(key)
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return err
+    }
+    return nil
+}
+
+func (d *Dir) List(ctx context.Context, prefix string) ([]Object, error) {
+    var objects []Object
+    err := filepath.WalkDir(d.Path, func(path string, entry fs.DirEntry, err error) error {
+        if errors.Is(err, fs.ErrNotExist) {
+            return fs.SkipAll
+        }
+        if err != nil || entry.IsDir() {
+            return err
+        }
+        rel, err := filepath.Rel(d.Path, path)
+        if err != nil {
+            return err
+        }
+        key := filepath.ToSlash(rel)
+        if !strings.HasPrefix(key, prefix) || strings.HasPrefix(entry.Name(), ".upload-") {
+            return nil
+        }
+        info, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        objects = append(objects, Object{Key: key, Size: info.Size(), Modified: info.ModTime()})
+        return nil
+    })
+    sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+    return objects, err
+}
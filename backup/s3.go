@@ -0,0 +1,244 @@
+package backup
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+    "time"
+)
+
+// emptyHash is the SHA-256 of an empty payload.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 stores backups in a bucket of Amazon S3 or of a compatible object
+// store such as MinIO, addressed path-style. Requests are signed with AWS
+// Signature Version 4; uploads are streamed unsigned and rely on TLS.
+type S3 struct {
+    Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com
+    Region    string
+    Bucket    string
+    AccessKey string
+    SecretKey string
+
+    client *http.Client
+}
+
+// NewS3 returns an S3 store making its requests through client, or
+// http.DefaultClient if nil.
+func NewS3(endpoint, region, bucket, accessKey, secretKey string, client *http.Client) *S3 {
+    if client == nil {
+        client = http.DefaultClient
+    }
+    if endpoint == "" {
+        endpoint = "https://s3." + region + ".amazonaws.com"
+    }
+    return &S3{
+        Endpoint:  strings.TrimSuffix(endpoint, "/"),
+        Region:    region,
+        Bucket:    bucket,
+        AccessKey: accessKey,
+        SecretKey: secretKey,
+        client:    client,
+    }
+}
+
+func (s *S3) Name() string { return "s3" }
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+    req, err := s.request(ctx, http.MethodPut, key, nil, body)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = size
+    req.Header.Set("Content-Type", "application/octet-stream")
+    resp, err := s.do(req, "UNSIGNED-PAYLOAD")
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+    req, err := s.request(ctx, http.MethodGet, key, nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := s.do(req, emptyHash)
+    if err != nil {
+        return nil, err
+    }
+    return resp.Body, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+    req, err := s.request(ctx, http.MethodDelete, key, nil, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := s.do(req, emptyHash)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+    var objects []Object
+    token := ""
+    for {
+        query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+        if token != "" {
+            query.Set("continuation-token", token)
+        }
+        req, err := s.request(ctx, http.MethodGet, "", query, nil)
+        if err != nil {
+            return nil, err
+        }
+        resp, err := s.do(req, emptyHash)
+        if err != nil {
+            return nil, err
+        }
+
+        var result struct {
+            Contents []struct {
+                Key          string
+                Size         int64
+                LastModified time.Time
+            }
+            IsTruncated           bool
+            NextContinuationToken string
+        }
+        err = xml.NewDecoder(resp.Body).Decode(&result)
+        resp.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+        for _, c := range result.Contents {
+            objects = append(objects, Object{Key: c.Key, Size: c.Size, Modified: c.LastModified})
+        }
+        if !result.IsTruncated {
+            break
+        }
+        token = result.NextContinuationToken
+    }
+    sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+    return objects, nil
+}
+
+func (s *S3) request(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+    path := "/" + uriEscape(s.Bucket)
+    if key != "" {
+        segments := strings.Split(key, "/")
+        for i, segment := range segments {
+            segments[i] = uriEscape(segment)
+        }
+        path += "/" + strings.Join(segments, "/")
+    }
+    rawURL := s.Endpoint + path
+    if query != nil {
+        rawURL += "?" + canonicalQuery(query)
+    }
+    return http.NewRequestWithContext(ctx, method, rawURL, body)
+}
+
+// do signs and sends a request, turning error responses into errors.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+    s.sign(req, payloadHash, time.Now().UTC())
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode < 300 {
+        return resp, nil
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, ErrNotFound
+    }
+    var body struct {
+        Code    string
+        Message string
+    }
+    xml.NewDecoder(resp.Body).Decode(&body)
+    return nil, fmt.Errorf("s3: %s: %s %s", resp.Status, body.Code, body.Message)
+}
+
+// sign adds the Authorization header of AWS Signature Version 4.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+    stamp := now.Format("20060102T150405Z")
+    day := stamp[:8]
+    req.Header.Set("X-Amz-Date", stamp)
+    req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+    signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+    canonical := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        req.URL.RawQuery,
+        "host:" + req.URL.Host,
+        "x-amz-content-sha256:" + payloadHash,
+        "x-amz-date:" + stamp,
+        "",
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+
+    scope := day + "/" + s.Region + "/s3/aws4_request"
+    hash := sha256.Sum256([]byte(canonical))
+    toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+    key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+    for _, part := range []string{s.Region, "s3", "aws4_request"} {
+        key = hmacSHA256(key, part)
+    }
+    signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+// uriEscape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 requires.
+func uriEscape(s string) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+    keys := make([]string, 0, len(query))
+    for k := range query {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    var parts []string
+    for _, k := range keys {
+        for _, v := range query[k] {
+            parts = append(parts, uriEscape(k)+"="+uriEscape(v))
+        }
+    }
+    return strings.Join(parts, "&")
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/backup"
+)
+
+// Backup statuses
+const (
+    BackupRunning   = "running"
+    BackupCompleted = "completed"
+    BackupFailed    = "failed"
+)
+
+// Backup is a catalog entry of a database backup. Archives are gzipped
+// tars of a manifest.json and one <collection>.bson file per collection in
+// mongodump format, so mongorestore can read them too, preceded for time
+// series collections by their options.
+type Backup struct {
+    ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    Key         string             `json:"key" bson:"key"`
+    Store       string             `json:"store" bson:"store"`
+    Status      string             `json:"status" bson:"status"`
+    Trigger     string             `json:"trigger" bson:"trigger"` // manual, scheduled, cli
+    Actor       string             `json:"actor,omitempty" bson:"actor,omitempty"`
+    StartedAt   time.Time          `json:"startedAt" bson:"startedAt"`
+    FinishedAt  *time.Time         `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+    Collections map[string]int64   `json:"collections,omitempty" bson:"collections,omitempty"`
+    SizeBytes   int64              `json:"sizeBytes,omitempty" bson:"sizeBytes,omitempty"`
+    SHA256      string             `json:"sha256,omitempty" bson:"sha256,omitempty"`
+    Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// backupManifest describes the contents of an archive.
+type backupManifest struct {
+    Database    string           `json:"database"`
+    CreatedAt   time.Time        `json:"createdAt"`
+    Collections map[string]int64 `json:"collections"`
+    // Failed documents by collection, when restored
+    Failed map[string]BulkResult `json:"failed,omitempty"`
+}
+
+// backupTimeSeries are the options of a time series collection, such as
+// vitals. They are archived as <name>.timeseries.json ahead of its
+// documents, which restore inserts into a time series created with them.
+type backupTimeSeries struct {
+    TimeField          string `json:"timeField" bson:"timeField"`
+    MetaField          string `json:"metaField,omitempty" bson:"metaField,omitempty"`
+    Granularity        string `json:"granularity,omitempty" bson:"granularity,omitempty"`
+    ExpireAfterSeconds int64  `json:"expireAfterSeconds,omitempty" bson:"-"`
+}
+
+const timeSeriesSuffix = ".timeseries.json"
+
+var (
+    backupCollection *mongo.Collection
+    backupStore      backup.Store // nil without BACKUP_STORE
+    backupMu         sync.Mutex   // one backup at a time
+)
+
+func initBackups(ctx context.Context, db *mongo.Database) {
+    backupCollection = db.Collection("backups")
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "startedAt", Value: -1}}},
+        {Keys: bson.D{{Key: "key", Value: 1}}},
+    }
+    if _, err := backupCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating backup indexes: %v\n", err)
+    }
+
+    switch config.BackupStore {
+    case "dir":
+        backupStore = backup.NewDir(config.BackupDir)
+    case "s3":
+        backupStore = backup.NewS3(config.BackupS3Endpoint, config.BackupS3Region, config.BackupS3Bucket,
+            config.BackupS3AccessKey, config.BackupS3SecretKey, backupPolicy.Client())
+    }
+}
+
+var (
+    errBackupNotConfigured = newAPIError("backup_not_configured")
+    errBackupInProgress    = newAPIError("backup_in_progress")
+)
+
+// startBackup records a running backup in the catalog and returns it with
+// the function completing it. It fails while another backup runs.
+func startBackup(ctx context.Context, trigger string) (*Backup, func(context.Context) error, error) {
+    if backupStore == nil {
+        return nil, nil, errBackupNotConfigured
+    }
+    if !backupMu.TryLock() {
+        return nil, nil, errBackupInProgress
+    }
+
+    now := time.Now().UTC()
+    entry := &Backup{
+        Key:       config.MongoDatabase + "/" + now.Format("20060102T150405Z") + ".tar.gz",
+        Store:     backupStore.Name(),
+        Status:    BackupRunning,
+        Trigger:   trigger,
+        Actor:     actorFromContext(ctx),
+        StartedAt: now,
+    }
+    result, err := backupCollection.InsertOne(ctx, entry)
+    if err != nil {
+        backupMu.Unlock()
+        return nil, nil, err
+    }
+    entry.ID = result.InsertedID.(primitive.ObjectID)
+
+    run := func(ctx context.Context) error {
+        defer backupMu.Unlock()
+        err := writeBackup(ctx, entry)
+        finished := time.Now()
+        entry.FinishedAt = &finished
+        entry.Status = BackupCompleted
+        if err != nil {
+            entry.Status, entry.Error = BackupFailed, err.Error()
+        }
+        if _, err := backupCollection.ReplaceOne(ctx, bson.M{"_id": entry.ID}, entry); err != nil {
+            log.Printf("Error recording backup %s: %v\n", entry.Key, err)
+        }
+        if err != nil {
+            return err
+        }
+        if err := publishEvent(ctx, "backup.completed", entry.ID, entry); err != nil {
+            log.Printf("Error publishing backup %s: %v\n", entry.Key, err)
+        }
+        return pruneBackups(ctx)
+    }
+    return entry, run, nil
+}
+
+// writeBackup dumps the database to a temporary archive and uploads it.
+func writeBackup(ctx context.Context, entry *Backup) error {
+    archive, err := os.CreateTemp("", "backup-*.tar.gz")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(archive.Name())
+    defer archive.Close()
+
+    hash := sha256.New()
+    entry.Collections, err = dumpDatabase(ctx, io.MultiWriter(archive, hash))
+    if err != nil {
+        return err
+    }
+    entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+    if entry.SizeBytes, err = archive.Seek(0, io.SeekCurrent); err != nil {
+        return err
+    }
+    if _, err := archive.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    return backupStore.Put(ctx, entry.Key, archive, entry.SizeBytes)
+}
+
+// dumpDatabase writes an archive of the collections not excluded by
+// BACKUP_EXCLUDE to w and returns their document counts.
+func dumpDatabase(ctx context.Context, w io.Writer) (map[string]int64, error) {
+    db := client.Database(config.MongoDatabase)
+    specs, err := db.ListCollectionSpecifications(ctx, bson.M{"type": bson.M{"$in": bson.A{"collection", "timeseries"}}})
+    if err != nil {
+        return nil, err
+    }
+    sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+
+    gz := gzip.NewWriter(w)
+    archive := tar.NewWriter(gz)
+    manifest := backupManifest{Database: db.Name(), CreatedAt: time.Now().UTC(), Collections: map[string]int64{}}
+    for _, spec := range specs {
+        name := spec.Name
+        if config.BackupExclude[name] || name == backupCollection.Name() || strings.HasPrefix(name, "system.") {
+            continue
+        }
+        if spec.Type == "timeseries" {
+            if err := dumpTimeSeriesOptions(spec, archive); err != nil {
+                return nil, fmt.Errorf("%s: %w", name, err)
+            }
+        }
+        count, err := dumpCollection(ctx, db.Collection(name), archive)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+        manifest.Collections[name] = count
+    }
+
+    data, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    if err := writeTarFile(archive, "manifest.json", int64(len(data)), strings.NewReader(string(data))); err != nil {
+        return nil, err
+    }
+    if err := archive.Close(); err != nil {
+        return nil, err
+    }
+    return manifest.Collections, gz.Close()
+}
+
+// dumpTimeSeriesOptions adds the options of a time series collection to an
+// archive.
+func dumpTimeSeriesOptions(spec *mongo.CollectionSpecification, archive *tar.Writer) error {
+    var stored struct {
+        TimeSeries         backupTimeSeries `bson:"timeseries"`
+        ExpireAfterSeconds int64            `bson:"expireAfterSeconds"`
+    }
+    if err := bson.Unmarshal(spec.Options, &stored); err != nil {
+        return err
+    }
+    stored.TimeSeries.ExpireAfterSeconds = stored.ExpireAfterSeconds
+    data, err := json.Marshal(stored.TimeSeries)
+    if err != nil {
+        return err
+    }
+    return writeTarFile(archive, spec.Name+timeSeriesSuffix, int64(len(data)), strings.NewReader(string(data)))
+}
+
+// dumpCollection adds a collection to an archive. Tar entries need their
+// size up front, so the documents are spooled to a temporary file first.
+func dumpCollection(ctx context.Context, coll *mongo.Collection, archive *tar.Writer) (int64, error) {
+    spool, err := os.CreateTemp("", "backup-"+coll.Name()+"-*.bson")
+    if err != nil {
+        return 0, err
+    }
+    defer os.Remove(spool.Name())
+    defer spool.Close()
+
+    cursor, err := coll.Find(ctx, bson.M{})
+    if err != nil {
+        return 0, err
+    }
+    defer cursor.Close(ctx)
+
+    var count int64
+    for cursor.Next(ctx) {
+        if _, err := spool.Write(cursor.Current); err != nil {
+            return 0, err
+        }
+        count++
+    }
+    if err := cursor.Err(); err != nil {
+        return 0, err
+    }
+
+    size, err := spool.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return 0, err
+    }
+    if _, err := spool.Seek(0, io.SeekStart); err != nil {
+        return 0, err
+    }
+    return count, writeTarFile(archive, coll.Name()+".bson", size, spool)
+}
+
+func writeTarFile(archive *tar.Writer, name string, size int64, r io.Reader) error {
+    header := &tar.Header{Name: name, Mode: 0o600, Size: size, ModTime: time.Now()}
+    if err := archive.WriteHeader(header); err != nil {
+        return err
+    }
+    _, err := io.Copy(archive, r)
+    return err
+}
+
+// pruneBackups deletes the completed backups beyond the BACKUP_KEEP most
+// recent ones, and the catalog entries of failed backups as old.
+func pruneBackups(ctx context.Context) error {
+    if config.BackupKeep <= 0 {
+        return nil
+    }
+
+    var keep Backup
+    err := backupCollection.FindOne(ctx,
+        bson.M{"status": BackupCompleted},
+        options.FindOne().SetSort(bson.D{{Key: "startedAt", Value: -1}}).SetSkip(config.BackupKeep-1),
+    ).Decode(&keep)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    cursor, err := backupCollection.Find(ctx, bson.M{"startedAt": bson.M{"$lt": keep.StartedAt}})
+    if err != nil {
+        return err
+    }
+    var expired []Backup
+    if err := cursor.All(ctx, &expired); err != nil {
+        return err
+    }
+    for _, entry := range expired {
+        if entry.Status == BackupCompleted {
+            if err := backupStore.Delete(ctx, entry.Key); err != nil {
+                return fmt.Errorf("deleting backup %s: %w", entry.Key, err)
+            }
+        }
+        if _, err := backupCollection.DeleteOne(ctx, bson.M{"_id": entry.ID}); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// scheduledBackup is the BACKUP_INTERVAL backup job.
+func scheduledBackup(ctx context.Context) error {
+    if backupStore == nil {
+        return nil
+    }
+    _, run, err := startBackup(contextWithActor(ctx, "backup"), "scheduled")
+    if err != nil {
+        return err
+    }
+    return run(ctx)
+}
+
+// restoreArchive replaces the collections of an archive in db with their
+// contents. Collections missing from the archive are left alone; indexes
+// are kept, except on collections that must become time series.
+func restoreArchive(ctx context.Context, db *mongo.Database, r io.Reader) (*backupManifest, error) {
+    gz, err := gzip.NewReader(r)
+    if err != nil {
+        return nil, err
+    }
+    archive := tar.NewReader(gz)
+
+    restored := map[string]int64{}
+    failed := map[string]BulkResult{}
+    var manifest backupManifest
+    for {
+        header, err := archive.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if header.Name == "manifest.json" {
+            if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+                return nil, fmt.Errorf("manifest: %w", err)
+            }
+            continue
+        }
+        if name, ok := strings.CutSuffix(header.Name, timeSeriesSuffix); ok && !strings.Contains(name, "/") {
+            var timeSeries backupTimeSeries
+            if err := json.NewDecoder(archive).Decode(&timeSeries); err != nil {
+                return nil, fmt.Errorf("%s: %w", header.Name, err)
+            }
+            if err := createTimeSeries(ctx, db, name, timeSeries); err != nil {
+                return nil, fmt.Errorf("%s: %w", name, err)
+            }
+            continue
+        }
+        name, ok := strings.CutSuffix(header.Name, ".bson")
+        if !ok || strings.Contains(name, "/") {
+            continue
+        }
+        result, err := restoreCollection(ctx, db.Collection(name), archive)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+        restored[name] = result.Inserted
+        if result.Failed > 0 {
+            failed[name] = result
+        }
+    }
+    manifest.Collections = restored
+    manifest.Failed = failed
+    return &manifest, nil
+}
+
+// createTimeSeries makes name a time series collection of db with the
+// archived options. A collection of that name that is not a time series is
+// dropped first, as its documents are replaced anyway.
+func createTimeSeries(ctx context.Context, db *mongo.Database, name string, ts backupTimeSeries) error {
+    specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": name})
+    if err != nil {
+        return err
+    }
+    if len(specs) > 0 {
+        if specs[0].Type == "timeseries" {
+            return nil
+        }
+        if err := db.Collection(name).Drop(ctx); err != nil {
+            return err
+        }
+    }
+
+    timeSeries := options.TimeSeries().SetTimeField(ts.TimeField)
+    if ts.MetaField != "" {
+        timeSeries.SetMetaField(ts.MetaField)
+    }
+    if ts.Granularity != "" {
+        timeSeries.SetGranularity(ts.Granularity)
+    }
+    create := options.CreateCollection().SetTimeSeriesOptions(timeSeries)
+    if ts.ExpireAfterSeconds > 0 {
+        create.SetExpireAfterSeconds(ts.ExpireAfterSeconds)
+    }
+    return db.CreateCollection(ctx, name, create)
+}
+
+// restoreCollection replaces the documents of coll with those read from r.
+// Documents that cannot be inserted are reported in the result.
+func restoreCollection(ctx context.Context, coll *mongo.Collection, r io.Reader) (BulkResult, error) {
+    if _, err := coll.DeleteMany(ctx, bson.M{}); err != nil {
+        return BulkResult{}, err
+    }
+
+    inserter := newBulkInserter(coll)
+    for {
+        // Documents are concatenated, each led by its little endian length
+        var length [4]byte
+        if _, err := io.ReadFull(r, length[:]); err == io.EOF {
+            break
+        } else if err != nil {
+            return inserter.Result(), err
+        }
+        doc := make(bson.Raw, binary.LittleEndian.Uint32(length[:]))
+        if len(doc) < 5 {
+            return inserter.Result(), errors.New("corrupt document")
+        }
+        copy(doc, length[:])
+        if _, err := io.ReadFull(r, doc[4:]); err != nil {
+            return inserter.Result(), err
+        }
+        if err := doc.Validate(); err != nil {
+            return inserter.Result(), err
+        }
+        if err := inserter.Add(ctx, doc); err != nil {
+            return inserter.Result(), err
+        }
+    }
+    err := inserter.Flush(ctx)
+    return inserter.Result(), err
+}
+
+// Backup handlers
+
+// adminBackups lists the backup catalog, latest first (GET), or starts a
+// backup in the background (POST): /admin/backups
+func adminBackups(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getBackups(w, r)
+    case http.MethodPost:
+        createBackup(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getBackups(w http.ResponseWriter, r *http.Request) {
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    filter := bson.M{}
+    cursor, err := backupCollection.Find(ctx, filter, findPage(filter, page, listOrder{Key: "startedAt", Desc: true}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    backups := []Backup{}
+    if err := cursor.All(ctx, &backups); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextCursor(w, r, page, len(backups), func() Cursor {
+        last := backups[len(backups)-1]
+        return Cursor{Key: last.StartedAt, ID: last.ID}
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(backups)
+}
+
+func createBackup(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+
+    entry, run, err := startBackup(ctx, "manual")
+    if err != nil {
+        switch {
+        case errors.Is(err, errBackupNotConfigured):
+            writeError(w, r, http.StatusNotImplemented, err)
+        case errors.Is(err, errBackupInProgress):
+            writeError(w, r, http.StatusConflict, err)
+        default:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+        return
+    }
+
+    go func() {
+        ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.BackupTimeout)
+        defer cancel()
+        if err := run(ctx); err != nil {
+            log.Printf("Backup %s failed: %v\n", entry.Key, err)
+        }
+    }()
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(entry)
+}
+
+// getBackup returns a catalog entry: GET /admin/backups/{id}
+func getBackup(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_backup_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    var entry Backup
+    if err := backupCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&entry); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "backup_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(entry)
+}
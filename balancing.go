@@ -0,0 +1,219 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// suggestionDays is the window doctors are suggested for when the request
+// names none.
+const suggestionDays = 7
+
+// DoctorSuggestion is a qualified doctor with room in the requested window:
+// how many appointments they have in it and their first free slot.
+type DoctorSuggestion struct {
+    Doctor    *Doctor   `json:"doctor"`
+    Booked    int64     `json:"booked"`
+    FirstSlot time.Time `json:"firstSlot"`
+}
+
+// DoctorSuggestions balances bookings for "any cardiologist": the pick is
+// the least loaded doctor, the alternatives are the others ranked by
+// earliest availability.
+type DoctorSuggestions struct {
+    Pick         *DoctorSuggestion  `json:"pick"` // nil when nobody has room
+    Alternatives []DoctorSuggestion `json:"alternatives"`
+}
+
+// suggestionQuery is what qualifies a doctor and the window to book in.
+// From and To are YYYY-MM-DD dates or days relative to today, as of
+// parseDay; the window runs from the start of From to the end of To.
+type suggestionQuery struct {
+    Specialization string              `json:"specialization"`
+    Department     string              `json:"department,omitempty"`
+    FacilityID     *primitive.ObjectID `json:"facilityId,omitempty"`
+    From           string              `json:"from,omitempty"`
+    To             string              `json:"to,omitempty"`
+}
+
+// window parses the window of a query: suggestionDays from today by
+// default, at most slotSearchDays long.
+func (q suggestionQuery) window() (time.Time, time.Time, error) {
+    from, _ := dayBounds(time.Now())
+    if q.From != "" {
+        day, err := parseDay(q.From)
+        if err != nil {
+            return time.Time{}, time.Time{}, newAPIError("invalid_date", "from")
+        }
+        from = day
+    }
+    to := from.AddDate(0, 0, suggestionDays)
+    if q.To != "" {
+        day, err := parseDay(q.To)
+        if err != nil {
+            return time.Time{}, time.Time{}, newAPIError("invalid_date", "to")
+        }
+        _, to = dayBounds(day)
+    }
+    if !to.After(from) || to.After(from.AddDate(0, 0, slotSearchDays)) {
+        return time.Time{}, time.Time{}, newAPIError("invalid_window", slotSearchDays)
+    }
+    if now := time.Now(); from.Before(now) {
+        from = now
+    }
+    return from, to, nil
+}
+
+// suggestDoctors ranks the doctors qualified for q by their appointments
+// in its window, skipping those without a free slot in it. Ties go to the
+// doctor free first.
+func suggestDoctors(ctx context.Context, q suggestionQuery) (DoctorSuggestions, error) {
+    suggestions := DoctorSuggestions{Alternatives: []DoctorSuggestion{}}
+    if q.Specialization == "" {
+        return suggestions, newAPIError("field_required", "specialization")
+    }
+    from, to, err := q.window()
+    if err != nil {
+        return suggestions, err
+    }
+
+    filter := bson.M{"specialization": normalizeSpecialization(q.Specialization)}
+    if q.Department != "" {
+        filter["department"] = q.Department
+    }
+    if q.FacilityID != nil {
+        filter["facilityId"] = *q.FacilityID
+    }
+    doctors, err := doctorRepo.List(ctx, filter, Page{Number: 1, Size: maxPageSize})
+    if err != nil || len(doctors) == 0 {
+        return suggestions, err
+    }
+
+    ids := make(bson.A, len(doctors))
+    for i, doctor := range doctors {
+        ids[i] = doctor.ID
+    }
+    booked, err := bookedByDoctor(ctx, ids, from, to)
+    if err != nil {
+        return suggestions, err
+    }
+
+    var ranked []DoctorSuggestion
+    for i := range doctors {
+        slot, ok, err := firstFreeSlot(ctx, &doctors[i], from, to)
+        if err != nil {
+            return suggestions, err
+        }
+        if ok {
+            ranked = append(ranked, DoctorSuggestion{Doctor: &doctors[i], Booked: booked[doctors[i].ID], FirstSlot: slot})
+        }
+    }
+    if len(ranked) == 0 {
+        return suggestions, nil
+    }
+
+    sort.SliceStable(ranked, func(i, j int) bool {
+        if ranked[i].Booked != ranked[j].Booked {
+            return ranked[i].Booked < ranked[j].Booked
+        }
+        return ranked[i].FirstSlot.Before(ranked[j].FirstSlot)
+    })
+    suggestions.Pick = &ranked[0]
+    suggestions.Alternatives = append(suggestions.Alternatives, ranked[1:]...)
+    sort.SliceStable(suggestions.Alternatives, func(i, j int) bool {
+        return suggestions.Alternatives[i].FirstSlot.Before(suggestions.Alternatives[j].FirstSlot)
+    })
+    return suggestions, nil
+}
+
+// bookedByDoctor counts the appointments occupying slots of each doctor of
+// ids between from and to.
+func bookedByDoctor(ctx context.Context, ids bson.A, from, to time.Time) (map[primitive.ObjectID]int64, error) {
+    cursor, err := appointmentCollection.Aggregate(ctx, mongo.Pipeline{
+        {{Key: "$match", Value: bson.M{
+            "doctorId":  bson.M{"$in": ids},
+            "status":    bson.M{"$in": activeStatuses},
+            "deletedAt": nil,
+            "dateTime":  bson.M{"$gte": from, "$lt": to},
+        }}},
+        {{Key: "$group", Value: bson.M{"_id": "$doctorId", "count": bson.M{"$sum": 1}}}},
+    })
+    if err != nil {
+        return nil, err
+    }
+    var counts []struct {
+        DoctorID primitive.ObjectID `bson:"_id"`
+        Count    int64              `bson:"count"`
+    }
+    if err := cursor.All(ctx, &counts); err != nil {
+        return nil, err
+    }
+    booked := map[primitive.ObjectID]int64{}
+    for _, c := range counts {
+        booked[c.DoctorID] = c.Count
+    }
+    return booked, nil
+}
+
+// firstFreeSlot finds the doctor's first free slot starting from from and
+// before to.
+func firstFreeSlot(ctx context.Context, doctor *Doctor, from, to time.Time) (time.Time, bool, error) {
+    for day := from.Local(); day.Before(to); _, day = dayBounds(day) {
+        slots, err := freeSlots(ctx, doctor, day)
+        if err != nil {
+            return time.Time{}, false, err
+        }
+        for _, slot := range slots {
+            if !slot.Before(from) && slot.Before(to) {
+                return slot, true, nil
+            }
+        }
+    }
+    return time.Time{}, false, nil
+}
+
+// getDoctorSuggestions suggests the doctor to book with among those of a
+// specialization: GET /doctors/suggestions?specialization=cardiology&from=&to=&department=&facilityId=
+func getDoctorSuggestions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := r.URL.Query()
+    q := suggestionQuery{
+        Specialization: query.Get("specialization"),
+        Department:     query.Get("department"),
+        From:           query.Get("from"),
+        To:             query.Get("to"),
+    }
+    if facility := query.Get("facilityId"); facility != "" {
+        id, err := primitive.ObjectIDFromHex(facility)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_facility_id")
+            return
+        }
+        q.FacilityID = &id
+    }
+
+    suggestions, err := suggestDoctors(r.Context(), q)
+    var apiErr *apiError
+    if errors.As(err, &apiErr) {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(suggestions)
+}
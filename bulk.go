@@ -0,0 +1,88 @@
+package main
+
+import (
+    "context"
+    "errors"
+
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxReportedFailures bounds the failed documents a BulkResult lists.
+const maxReportedFailures = 100
+
+// BulkFailure is a document a bulk insert could not write.
+type BulkFailure struct {
+    Index   int64  `json:"index"` // position among the documents added
+    Code    int    `json:"code"`
+    Message string `json:"message"`
+}
+
+// BulkResult reports the outcome of a bulk insert. Failures lists the
+// first failed documents; Failed counts them all.
+type BulkResult struct {
+    Inserted int64         `json:"inserted"`
+    Failed   int64         `json:"failed"`
+    Failures []BulkFailure `json:"failures,omitempty"`
+}
+
+// bulkInserter inserts documents into a collection with unordered bulk
+// writes of up to BULK_BATCH_SIZE documents. Documents that fail, such as
+// duplicates, are reported without stopping the others; errors that are
+// not about individual documents stop the insert.
+type bulkInserter struct {
+    coll      *mongo.Collection
+    batchSize int
+    batch     []mongo.WriteModel
+    added     int64 // before the batch
+    result    BulkResult
+}
+
+func newBulkInserter(coll *mongo.Collection) *bulkInserter {
+    size := int(max(config.BulkBatchSize, 1))
+    return &bulkInserter{coll: coll, batchSize: size, batch: make([]mongo.WriteModel, 0, size)}
+}
+
+// Add queues a document, writing the batch once it is full.
+func (b *bulkInserter) Add(ctx context.Context, doc interface{}) error {
+    b.batch = append(b.batch, mongo.NewInsertOneModel().SetDocument(doc))
+    if len(b.batch) < b.batchSize {
+        return nil
+    }
+    return b.Flush(ctx)
+}
+
+// Flush writes the queued documents.
+func (b *bulkInserter) Flush(ctx context.Context) error {
+    if len(b.batch) == 0 {
+        return nil
+    }
+    result, err := b.coll.BulkWrite(ctx, b.batch, options.BulkWrite().SetOrdered(false))
+    if result != nil {
+        b.result.Inserted += result.InsertedCount
+    }
+
+    var bulkErr mongo.BulkWriteException
+    if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+        for _, writeErr := range bulkErr.WriteErrors {
+            b.result.Failed++
+            if len(b.result.Failures) < maxReportedFailures {
+                b.result.Failures = append(b.result.Failures, BulkFailure{
+                    Index:   b.added + int64(writeErr.Index),
+                    Code:    writeErr.Code,
+                    Message: writeErr.Message,
+                })
+            }
+        }
+        err = nil
+    }
+
+    b.added += int64(len(b.batch))
+    b.batch = b.batch[:0]
+    return err
+}
+
+// Result is the outcome of the documents written so far.
+func (b *bulkInserter) Result() BulkResult {
+    return b.result
+}
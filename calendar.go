@@ -0,0 +1,364 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OperatingHours is the opening window of a department on one weekday.
+type OperatingHours struct {
+    Day   string `json:"day" bson:"day"`     // mon, tue, ...
+    Open  string `json:"open" bson:"open"`   // HH:MM
+    Close string `json:"close" bson:"close"` // HH:MM
+}
+
+// Holiday closes the whole facility, or only one department, for a day.
+type Holiday struct {
+    Document     `bson:",inline"`
+    Date         string              `json:"date" bson:"date"` // YYYY-MM-DD
+    Name         string              `json:"name" bson:"name"`
+    DepartmentID *primitive.ObjectID `json:"departmentId,omitempty" bson:"departmentId,omitempty"`
+}
+
+// Unavailability is a period a doctor cannot be booked, such as a busy
+// block imported from their external calendar.
+type Unavailability struct {
+    Document   `bson:",inline"`
+    DoctorID   primitive.ObjectID `json:"doctorId" bson:"doctorId"`
+    Start      time.Time          `json:"start" bson:"start"`
+    End        time.Time          `json:"end" bson:"end"`
+    Source     string             `json:"source" bson:"source"` // google
+    ExternalID string             `json:"externalId,omitempty" bson:"externalId,omitempty"`
+    Summary    string             `json:"summary,omitempty" bson:"summary,omitempty"`
+}
+
+var (
+    holidayCollection        *mongo.Collection
+    holidayRepo              *Repository[Holiday, *Holiday]
+    unavailabilityCollection *mongo.Collection
+)
+
+func initCalendar(ctx context.Context, db *mongo.Database) {
+    holidayCollection = db.Collection("holidays")
+    holidayRepo = NewRepository[Holiday](holidayCollection, defaultHooks)
+    unavailabilityCollection = db.Collection("unavailability")
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "date", Value: 1}}}
+    if _, err := holidayCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating holiday index: %v\n", err)
+    }
+    index = mongo.IndexModel{Keys: bson.D{{Key: "doctorId", Value: 1}, {Key: "start", Value: 1}}}
+    if _, err := unavailabilityCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating unavailability index: %v\n", err)
+    }
+}
+
+func validateOperatingHours(hours []OperatingHours) error {
+    seen := map[string]bool{}
+    for i, h := range hours {
+        h.Day = strings.ToLower(h.Day)
+        if _, ok := weekdays[h.Day]; !ok {
+            return newAPIError("invalid_day", h.Day)
+        }
+        if seen[h.Day] {
+            return newAPIError("duplicate_hours", h.Day)
+        }
+        seen[h.Day] = true
+
+        open, err := parseClock(h.Open)
+        if err != nil {
+            return newAPIError("invalid_opening_time", h.Open)
+        }
+        closing, err := parseClock(h.Close)
+        if err != nil {
+            return newAPIError("invalid_closing_time", h.Close)
+        }
+        if closing <= open {
+            return newAPIError("closes_before_opens", h.Day)
+        }
+        hours[i] = h
+    }
+    return nil
+}
+
+// doctorDepartment returns the department a doctor belongs to, or nil when
+// it is not a managed department.
+func doctorDepartment(ctx context.Context, doctor *Doctor) (*Department, error) {
+    var department Department
+    err := departmentCollection.FindOne(ctx, bson.M{"name": doctor.Department, "deletedAt": nil}).Decode(&department)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &department, nil
+}
+
+// holidayOn returns the holiday closing department (or the whole facility
+// when department is nil) on day, if any.
+func holidayOn(ctx context.Context, department *Department, day time.Time) (*Holiday, error) {
+    scope := bson.A{bson.M{"departmentId": nil}}
+    if department != nil {
+        scope = append(scope, bson.M{"departmentId": department.ID})
+    }
+
+    var holiday Holiday
+    err := holidayCollection.FindOne(ctx, bson.M{
+        "date":      day.Format(time.DateOnly),
+        "deletedAt": nil,
+        "$or":       scope,
+    }).Decode(&holiday)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &holiday, nil
+}
+
+// workingDay is a doctor's bookable window on one day. Open is false when
+// their department is closed, in particular on holidays.
+type workingDay struct {
+    Start    time.Time
+    End      time.Time
+    Open     bool
+    Holiday  *Holiday
+    Capacity Capacity // of the department
+}
+
+// doctorWorkingDay resolves a doctor's working hours on day. Departments
+// without configured hours follow the facility's WORKDAY_* settings.
+func doctorWorkingDay(ctx context.Context, doctor *Doctor, day time.Time) (workingDay, error) {
+    department, err := doctorDepartment(ctx, doctor)
+    if err != nil {
+        return workingDay{}, err
+    }
+
+    holiday, err := holidayOn(ctx, department, day)
+    if err != nil || holiday != nil {
+        return workingDay{Holiday: holiday}, err
+    }
+
+    midnight, _ := dayBounds(day)
+    var capacity Capacity
+    if department != nil && department.Capacity != nil {
+        capacity = *department.Capacity
+    }
+    if department == nil || len(department.OperatingHours) == 0 {
+        if !config.WorkDays[day.Weekday()] {
+            return workingDay{}, nil
+        }
+        return workingDay{Start: midnight.Add(config.WorkdayStart), End: midnight.Add(config.WorkdayEnd), Open: true, Capacity: capacity}, nil
+    }
+
+    for _, h := range department.OperatingHours {
+        if weekdays[h.Day] != day.Weekday() {
+            continue
+        }
+        open, _ := parseClock(h.Open)
+        closing, _ := parseClock(h.Close)
+        return workingDay{Start: midnight.Add(open), End: midnight.Add(closing), Open: true, Capacity: capacity}, nil
+    }
+    return workingDay{}, nil
+}
+
+// unavailableDuring lists a doctor's unavailability overlapping [from, to).
+func unavailableDuring(ctx context.Context, doctorID primitive.ObjectID, from, to time.Time) ([]Unavailability, error) {
+    cursor, err := unavailabilityCollection.Find(ctx, bson.M{
+        "doctorId":  doctorID,
+        "deletedAt": nil,
+        "start":     bson.M{"$lt": to},
+        "end":       bson.M{"$gt": from},
+    })
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    blocks := []Unavailability{}
+    err = cursor.All(ctx, &blocks)
+    return blocks, err
+}
+
+// checkOperatingHours verifies that an appointment's slot lies within the
+// doctor's working hours, not on a holiday and not while the doctor is
+// unavailable.
+func checkOperatingHours(ctx context.Context, doctor *Doctor, at time.Time) error {
+    at = at.Local()
+    day, err := doctorWorkingDay(ctx, doctor, at)
+    if err != nil {
+        return err
+    }
+    if day.Holiday != nil {
+        return newAPIError("holiday_closed", at.Format(time.DateOnly), day.Holiday.Name)
+    }
+    if !day.Open || at.Before(day.Start) || at.Add(config.SlotDuration).After(day.End) {
+        return newAPIError("outside_working_hours")
+    }
+
+    blocks, err := unavailableDuring(ctx, doctor.ID, at, at.Add(config.SlotDuration))
+    if err != nil {
+        return err
+    }
+    if len(blocks) > 0 {
+        return newAPIError("doctor_unavailable")
+    }
+    return nil
+}
+
+// Calendar handlers
+func setDepartmentHours(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPut {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_department_id")
+        return
+    }
+
+    var hours []OperatingHours
+    if !decodeJSON(w, r, &hours) {
+        return
+    }
+    if err := validateOperatingHours(hours); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    err = departmentRepo.UpdateFields(ctx, id, nil, bson.M{"operatingHours": hours})
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "department_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(hours)
+}
+
+func getHolidays(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    filter := bson.M{"deletedAt": nil}
+    if year := r.URL.Query().Get("year"); year != "" {
+        filter["date"] = bson.M{"$regex": "^" + regexp.QuoteMeta(year) + "-"}
+    }
+
+    ctx := r.Context()
+
+    cursor, err := holidayCollection.Find(ctx, filter,
+        options.Find().SetSort(bson.D{{Key: "date", Value: 1}}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer cursor.Close(ctx)
+
+    holidays := []Holiday{}
+    if err = cursor.All(ctx, &holidays); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(holidays)
+}
+
+func createHoliday(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var holiday Holiday
+    if !decodeJSON(w, r, &holiday) {
+        return
+    }
+    if _, err := time.Parse(time.DateOnly, holiday.Date); err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_date", "date")
+        return
+    }
+    if holiday.Name == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "name")
+        return
+    }
+
+    ctx := r.Context()
+
+    if holiday.DepartmentID != nil {
+        if _, err := departmentRepo.GetByID(ctx, *holiday.DepartmentID); err != nil {
+            localizedError(w, r, http.StatusBadRequest, "department_not_found")
+            return
+        }
+    }
+
+    if err := holidayRepo.Create(ctx, &holiday); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(holiday)
+}
+
+func adminHolidays(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getHolidays(w, r)
+    case http.MethodPost:
+        createHoliday(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func deleteHoliday(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_holiday_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := holidayRepo.SoftDelete(ctx, id); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "holiday_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
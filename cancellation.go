@@ -0,0 +1,220 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/i18n"
+)
+
+// Consequences of breaking a cancellation rule
+const (
+    ActionBlock = "block"
+    ActionFee   = "fee"
+)
+
+// CancellationViolation is a cancellation rule broken by a cancellation
+// request and what happens because of it.
+type CancellationViolation struct {
+    Rule     string `json:"rule"`
+    Action   string `json:"action"`
+    Message  string `json:"message"`
+    FeeCents int64  `json:"feeCents,omitempty"`
+}
+
+// cancellationRule checks one policy constraint. check reports whether a
+// cancellation violates it; the violation is described by the catalog
+// message "cancel." + name formatted with args.
+type cancellationRule struct {
+    name   string
+    action string
+    args   []interface{}
+    check  func(ctx context.Context, appointment *Appointment, now time.Time) (bool, error)
+}
+
+// cancellationRules returns the configured policy. Rules with a zero
+// setting are disabled.
+func cancellationRules() []cancellationRule {
+    var rules []cancellationRule
+    if config.CancelMinNotice > 0 {
+        rules = append(rules, cancellationRule{
+            name:   "minimum-notice",
+            action: config.CancelLateAction,
+            args:   []interface{}{config.CancelMinNotice.Hours()},
+            check:  checkCancellationNotice,
+        })
+    }
+    if config.CancelMaxPerMonth > 0 {
+        rules = append(rules, cancellationRule{
+            name:   "monthly-limit",
+            action: config.CancelLimitAction,
+            args:   []interface{}{config.CancelMaxPerMonth},
+            check:  checkMonthlyCancellations,
+        })
+    }
+    return rules
+}
+
+func checkCancellationNotice(ctx context.Context, appointment *Appointment, now time.Time) (bool, error) {
+    return appointment.DateTime.Sub(now) < config.CancelMinNotice, nil
+}
+
+func checkMonthlyCancellations(ctx context.Context, appointment *Appointment, now time.Time) (bool, error) {
+    monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+    count, err := appointmentCollection.CountDocuments(ctx, bson.M{
+        "patientId":   appointment.PatientID,
+        "status":      StatusCancelled,
+        "cancelledAt": bson.M{"$gte": monthStart},
+    })
+    if err != nil {
+        return false, err
+    }
+    return count >= config.CancelMaxPerMonth, nil
+}
+
+// evaluateCancellation runs every rule of the policy against a
+// cancellation of appointment, describing violations in lang.
+func evaluateCancellation(ctx context.Context, appointment *Appointment, now time.Time, lang string) ([]CancellationViolation, error) {
+    violations := []CancellationViolation{}
+    for _, rule := range cancellationRules() {
+        violated, err := rule.check(ctx, appointment, now)
+        if err != nil {
+            return nil, err
+        }
+        if !violated {
+            continue
+        }
+        violation := CancellationViolation{
+            Rule:    rule.name,
+            Action:  rule.action,
+            Message: i18n.Message(lang, "cancel."+rule.name, rule.args...),
+        }
+        if rule.action == ActionFee {
+            violation.FeeCents = config.CancelFeeCents
+        }
+        violations = append(violations, violation)
+    }
+    return violations, nil
+}
+
+type cancelRequest struct {
+    Reason string `json:"reason"`
+}
+
+// CancellationResult is the response to a cancellation: the cancelled
+// appointment, the rules it broke and the invoice any fees were added to.
+type CancellationResult struct {
+    Appointment *Appointment             `json:"appointment"`
+    Violations  []CancellationViolation `json:"violations"`
+    InvoiceID   *primitive.ObjectID      `json:"invoiceId,omitempty"`
+}
+
+// cancelAppointment cancels an appointment subject to the cancellation
+// policy: blocking violations reject it with 409, fee violations are
+// charged to the patient's next invoice.
+func cancelAppointment(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_appointment_id")
+        return
+    }
+
+    var req cancelRequest
+    if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+        return
+    }
+
+    ctx := r.Context()
+
+    appointment, err := appointmentRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "appointment_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    lang := requestLanguage(r)
+    if appointment.Status != StatusScheduled && appointment.Status != StatusCheckedIn {
+        localizedError(w, r, http.StatusConflict, "appointment_status", i18n.StatusLabel(lang, appointment.Status))
+        return
+    }
+
+    now := time.Now()
+    violations, err := evaluateCancellation(ctx, appointment, now, lang)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    result := CancellationResult{Appointment: appointment, Violations: violations}
+    for _, v := range violations {
+        if v.Action == ActionBlock {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusConflict)
+            json.NewEncoder(w).Encode(result)
+            return
+        }
+    }
+
+    // The cancellation and its fees are written together
+    err = withTransaction(ctx, func(ctx context.Context) error {
+        result.InvoiceID = nil
+        err := appointmentRepo.UpdateFields(ctx, id,
+            bson.M{"status": appointment.Status},
+            bson.M{"status": StatusCancelled, "cancelledAt": now, "cancellationReason": req.Reason},
+        )
+        if err != nil {
+            return err
+        }
+        if err := releaseCapacity(ctx, appointment); err != nil {
+            return err
+        }
+
+        // Fees are only charged where billing is rolled out
+        for _, v := range violations {
+            if v.Action != ActionFee || v.FeeCents <= 0 || !featureEnabled(r, FlagBilling) {
+                continue
+            }
+            invoiceID, err := addToNextInvoice(ctx, appointment.PatientID, LineItem{
+                Description:   i18n.Message(lang, "cancel.fee", v.Message),
+                AmountCents:   v.FeeCents,
+                AppointmentID: &appointment.ID,
+            })
+            if err != nil {
+                return err
+            }
+            result.InvoiceID = &invoiceID
+        }
+        return nil
+    })
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusConflict, "appointment_changed")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    appointment.Status = StatusCancelled
+    appointment.CancelledAt = &now
+    appointment.CancellationReason = req.Reason
+    go syncAppointmentCalendar(*appointment)
+    go offerFreedSlot(*appointment)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "slices"
+    "sort"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxOverbookingPercent bounds the overbooking of a department.
+const maxOverbookingPercent = 100
+
+// maxCapacityReportDays bounds the range of the capacity report.
+const maxCapacityReportDays = 31
+
+// capacityCounterRetention keeps the booking counter of a day after it.
+const capacityCounterRetention = 24 * time.Hour
+
+// capacityCounterCollection counts the appointments booked for each doctor
+// and day, so that concurrent bookings cannot both take the last place.
+var capacityCounterCollection *mongo.Collection
+
+func initCapacity(ctx context.Context, db *mongo.Database) {
+    capacityCounterCollection = db.Collection("capacity_counters")
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}
+    if _, err := capacityCounterCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating capacity counter index: %v\n", err)
+    }
+}
+
+// Capacity limits the appointments of the doctors of a department. Slots
+// take one appointment unless the department overbooks: OverbookingPercent
+// more appointments than there are slots may then be booked in a day, with
+// a slot taking a second appointment once booked. MaxDailyPerDoctor caps
+// each doctor's appointments in a day; 0 leaves them uncapped.
+type Capacity struct {
+    OverbookingPercent int64 `json:"overbookingPercent" bson:"overbookingPercent"`
+    MaxDailyPerDoctor  int64 `json:"maxDailyPerDoctor" bson:"maxDailyPerDoctor"`
+}
+
+// Statuses of appointments that count against the daily capacity
+var bookedStatuses = bson.M{"$ne": StatusCancelled}
+
+// perSlot is how many appointments a slot takes.
+func (c Capacity) perSlot() int {
+    if c.OverbookingPercent > 0 {
+        return 2
+    }
+    return 1
+}
+
+// daily is how many appointments a doctor can take on a working day.
+func (c Capacity) daily(day workingDay) int64 {
+    if !day.Open {
+        return 0
+    }
+    slots := int64(day.End.Sub(day.Start) / config.SlotDuration)
+    daily := slots * (100 + c.OverbookingPercent) / 100
+    if c.MaxDailyPerDoctor > 0 {
+        daily = min(daily, c.MaxDailyPerDoctor)
+    }
+    return daily
+}
+
+func validateCapacity(capacity *Capacity) error {
+    if capacity.OverbookingPercent < 0 || capacity.OverbookingPercent > maxOverbookingPercent {
+        return newAPIError("invalid_overbooking", maxOverbookingPercent)
+    }
+    if capacity.MaxDailyPerDoctor < 0 {
+        return newAPIError("invalid_max_daily")
+    }
+    return nil
+}
+
+// bookedOnDay counts the appointments of a doctor on the day of at that
+// count against the capacity, except the appointment except.
+func bookedOnDay(ctx context.Context, doctorID primitive.ObjectID, at time.Time, except primitive.ObjectID) (int64, error) {
+    start, end := dayBounds(at.Local())
+    return appointmentCollection.CountDocuments(ctx, bson.M{
+        "_id":       bson.M{"$ne": except},
+        "doctorId":  doctorID,
+        "status":    bookedStatuses,
+        "deletedAt": nil,
+        "dateTime":  bson.M{"$gte": start, "$lt": end},
+    })
+}
+
+// checkCapacity verifies that the doctor of an appointment has room for it
+// on its day and in its slot, not counting the appointment itself.
+func checkCapacity(ctx context.Context, doctor *Doctor, appointment *Appointment) error {
+    at := appointment.DateTime.Local()
+    day, err := doctorWorkingDay(ctx, doctor, at)
+    if err != nil {
+        return err
+    }
+
+    booked, err := bookedOnDay(ctx, doctor.ID, at, appointment.ID)
+    if err != nil {
+        return err
+    }
+    if booked >= day.Capacity.daily(day) {
+        return newAPIError("doctor_fully_booked", at.Format(time.DateOnly))
+    }
+
+    overlapping, err := appointmentCollection.CountDocuments(ctx, bson.M{
+        "_id":       bson.M{"$ne": appointment.ID},
+        "doctorId":  doctor.ID,
+        "status":    bson.M{"$in": activeStatuses},
+        "deletedAt": nil,
+        "dateTime":  bson.M{"$gt": at.Add(-config.SlotDuration), "$lt": at.Add(config.SlotDuration)},
+    })
+    if err != nil {
+        return err
+    }
+    if overlapping >= int64(day.Capacity.perSlot()) {
+        return newAPIError("slot_unavailable")
+    }
+    return nil
+}
+
+// capacityCounterID identifies the booking counter of a doctor on the day
+// of at.
+func capacityCounterID(doctorID primitive.ObjectID, at time.Time) string {
+    return doctorID.Hex() + ":" + at.Local().Format(time.DateOnly)
+}
+
+// reserveCapacity counts a new appointment against the daily capacity of
+// its doctor. checkCapacity only counts what is booked; the counter is
+// incremented only while below the capacity, and bookings of the same day
+// in concurrent transactions conflict on it. A day's counter starts from
+// the appointments already booked then.
+func reserveCapacity(ctx context.Context, appointment *Appointment) error {
+    doctor, err := doctorRepo.GetByID(ctx, appointment.DoctorID)
+    if err != nil {
+        return err
+    }
+    at := appointment.DateTime.Local()
+    day, err := doctorWorkingDay(ctx, doctor, at)
+    if err != nil {
+        return err
+    }
+    booked, err := bookedOnDay(ctx, doctor.ID, at, appointment.ID)
+    if err != nil {
+        return err
+    }
+
+    id := capacityCounterID(doctor.ID, at)
+    _, end := dayBounds(at)
+    _, err = capacityCounterCollection.UpdateOne(ctx, bson.M{"_id": id},
+        bson.M{"$setOnInsert": bson.M{"doctorId": doctor.ID, "booked": booked, "expiresAt": end.Add(capacityCounterRetention)}},
+        options.Update().SetUpsert(true))
+    if err != nil {
+        return err
+    }
+    result, err := capacityCounterCollection.UpdateOne(ctx,
+        bson.M{"_id": id, "booked": bson.M{"$lt": day.Capacity.daily(day)}},
+        bson.M{"$inc": bson.M{"booked": 1}})
+    if err != nil {
+        return err
+    }
+    if result.MatchedCount == 0 {
+        return newAPIError("doctor_fully_booked", at.Format(time.DateOnly))
+    }
+    return nil
+}
+
+// releaseCapacity gives the place of a cancelled appointment back to its
+// doctor's day.
+func releaseCapacity(ctx context.Context, appointment *Appointment) error {
+    _, err := capacityCounterCollection.UpdateOne(ctx,
+        bson.M{"_id": capacityCounterID(appointment.DoctorID, appointment.DateTime), "booked": bson.M{"$gt": 0}},
+        bson.M{"$inc": bson.M{"booked": -1}})
+    return err
+}
+
+// putDepartmentCapacity sets the capacity of a department:
+// PUT /admin/departments/{id}/capacity
+func putDepartmentCapacity(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPut {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_department_id")
+        return
+    }
+
+    var capacity Capacity
+    if !decodeJSON(w, r, &capacity) {
+        return
+    }
+    if err := validateCapacity(&capacity); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    err = departmentRepo.UpdateFields(ctx, id, nil, bson.M{"capacity": capacity})
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "department_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(capacity)
+}
+
+// CapacityRow compares the appointments booked with the capacity for a
+// day, doctor or department. The fields that are not grouped by are
+// omitted.
+type CapacityRow struct {
+    Day         string              `json:"day,omitempty"`
+    DoctorID    *primitive.ObjectID `json:"doctorId,omitempty"`
+    Department  *string             `json:"department,omitempty"`
+    Capacity    int64               `json:"capacity"`
+    Booked      int64               `json:"booked"`
+    Utilization float64             `json:"utilization"` // booked per capacity, in percent
+}
+
+var capacityGroups = []string{"day", "doctor", "department"}
+
+// getCapacityReport reports utilization against capacity for the days
+// within ?from= and ?to= (YYYY-MM-DD, inclusive, at most 31 days), grouped
+// by ?groupBy=day|doctor|department (day by default). Bookings come from
+// the utilization projection, capacity from the doctors' working days.
+func getCapacityReport(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := r.URL.Query()
+    groupBy := query.Get("groupBy")
+    if groupBy == "" {
+        groupBy = "day"
+    }
+    if !slices.Contains(capacityGroups, groupBy) {
+        localizedError(w, r, http.StatusBadRequest, "invalid_group_by", strings.Join(capacityGroups, ", "))
+        return
+    }
+    from, err := time.ParseInLocation(time.DateOnly, query.Get("from"), time.Local)
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_date", "from")
+        return
+    }
+    to, err := time.ParseInLocation(time.DateOnly, query.Get("to"), time.Local)
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_date", "to")
+        return
+    }
+    if to.Before(from) || to.Sub(from) >= maxCapacityReportDays*24*time.Hour {
+        localizedError(w, r, http.StatusBadRequest, "invalid_report_range", maxCapacityReportDays)
+        return
+    }
+
+    ctx := r.Context()
+
+    cursor, err := projectionCollection.Find(ctx, bson.M{
+        "report": ReportUtilization,
+        "day":    bson.M{"$gte": from.Format(time.DateOnly), "$lte": to.Format(time.DateOnly)},
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var cells []ProjectionCell
+    if err := cursor.All(ctx, &cells); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    booked := map[string]int64{}
+    for _, cell := range cells {
+        booked[cell.Day+"|"+cell.DoctorID.Hex()] += cell.Values["appointments"] - cell.Values[StatusCancelled]
+    }
+
+    doctors, err := doctorRepo.List(ctx, bson.M{}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    rows := map[string]*CapacityRow{}
+    for _, doctor := range doctors {
+        for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+            working, err := doctorWorkingDay(ctx, &doctor, day)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+
+            var row CapacityRow
+            var key string
+            switch groupBy {
+            case "day":
+                row.Day, key = day.Format(time.DateOnly), day.Format(time.DateOnly)
+            case "doctor":
+                row.DoctorID, key = &doctor.ID, doctor.ID.Hex()
+            case "department":
+                row.Department, key = &doctor.Department, doctor.Department
+            }
+            existing, ok := rows[key]
+            if !ok {
+                existing = &row
+                rows[key] = existing
+            }
+            existing.Capacity += working.Capacity.daily(working)
+            existing.Booked += booked[day.Format(time.DateOnly)+"|"+doctor.ID.Hex()]
+        }
+    }
+
+    keys := make([]string, 0, len(rows))
+    for key := range rows {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    result := make([]CapacityRow, 0, len(rows))
+    for _, key := range keys {
+        row := rows[key]
+        if row.Capacity > 0 {
+            row.Utilization = float64(row.Booked) * 100 / float64(row.Capacity)
+        }
+        result = append(result, *row)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
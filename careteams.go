@@ -0,0 +1,412 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Care team roles
+const (
+    CarePrimary    = "primary"    // the doctor in charge, one per patient
+    CareNurse      = "nurse"      // a staff account
+    CareSpecialist = "specialist" // a consulting doctor
+)
+
+var careRoles = []string{CarePrimary, CareNurse, CareSpecialist}
+
+// careRoleAccounts is the account role each care team role takes.
+var careRoleAccounts = map[string]string{
+    CarePrimary:    RoleDoctor,
+    CareNurse:      RoleStaff,
+    CareSpecialist: RoleDoctor,
+}
+
+// CareTeamMember puts an account on the care team of a patient. Members
+// read and write the patient's records; other doctors and staff do not.
+type CareTeamMember struct {
+    Document  `bson:",inline"`
+    PatientID primitive.ObjectID `json:"patientId" bson:"patientId"`
+    UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+    Role      string             `json:"role" bson:"role"`
+}
+
+// careTeamEntry is a member with the account it names, as listed.
+type careTeamEntry struct {
+    CareTeamMember
+    Name  string `json:"name"`
+    Email string `json:"email"`
+}
+
+var (
+    careTeamCollection *mongo.Collection
+    careTeamRepo       *Repository[CareTeamMember, *CareTeamMember]
+)
+
+func initCareTeams(ctx context.Context, db *mongo.Database) {
+    careTeamCollection = db.Collection("care_teams")
+    careTeamRepo = NewRepository[CareTeamMember](careTeamCollection, defaultHooks)
+
+    current := bson.M{"deletedAt": bson.M{"$exists": false}}
+    indexes := []mongo.IndexModel{
+        {
+            Keys:    bson.D{{Key: "patientId", Value: 1}, {Key: "userId", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(current),
+        },
+        {
+            Keys: bson.D{{Key: "patientId", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+                bson.M{"role": CarePrimary, "deletedAt": bson.M{"$exists": false}}),
+        },
+        {Keys: bson.D{{Key: "userId", Value: 1}}},
+    }
+    if _, err := careTeamCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating care team indexes: %v\n", err)
+    }
+}
+
+// careTeamMember returns the membership of an account in the care team of
+// a patient.
+func careTeamMember(ctx context.Context, patientID, userID primitive.ObjectID) (*CareTeamMember, error) {
+    members, err := careTeamRepo.List(ctx, bson.M{"patientId": patientID, "userId": userID}, Page{Number: 1, Size: 1})
+    if err != nil {
+        return nil, err
+    }
+    if len(members) == 0 {
+        return nil, mongo.ErrNoDocuments
+    }
+    return &members[0], nil
+}
+
+// canAccessPatient reports whether an account may work with the records
+// of a patient: admins may, doctors and staff when they are on its care
+// team. With CARE_TEAM_ACCESS=false every account may, as before care
+// teams.
+func canAccessPatient(ctx context.Context, user *User, patientID primitive.ObjectID) (bool, error) {
+    if user == nil {
+        return false, nil
+    }
+    if user.Role == RoleAdmin || !config.CareTeamAccess {
+        return true, nil
+    }
+    _, err := careTeamMember(ctx, patientID, user.ID)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+// canManageCareTeam reports whether an account may change the care team of
+// a patient: admins and the patient's primary doctor may.
+func canManageCareTeam(ctx context.Context, user *User, patientID primitive.ObjectID) (bool, error) {
+    if user.Role == RoleAdmin {
+        return true, nil
+    }
+    member, err := careTeamMember(ctx, patientID, user.ID)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return member.Role == CarePrimary, nil
+}
+
+// checkPatientAccess answers 403 when the account of the request may not
+// access a patient.
+func checkPatientAccess(w http.ResponseWriter, r *http.Request, patientID primitive.ObjectID) bool {
+    ok, err := canAccessPatient(r.Context(), userFromContext(r.Context()), patientID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return false
+    }
+    if !ok {
+        localizedError(w, r, http.StatusForbidden, "not_on_care_team")
+        return false
+    }
+    return true
+}
+
+// requireCareTeam lets the accounts that may access the patient of a
+// /patients/{id}/... route through.
+func requireCareTeam(next http.HandlerFunc) http.HandlerFunc {
+    return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+        patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+            return
+        }
+        if !checkPatientAccess(w, r, patientID) {
+            return
+        }
+        next(w, r)
+    })
+}
+
+// patientCareTeam lists the care team of a patient and adds members to it:
+// GET, POST /patients/{id}/care-team
+func patientCareTeam(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getCareTeam(w, r)
+    case http.MethodPost:
+        addCareTeamMember(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getCareTeam(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+    if !checkPatientAccess(w, r, patientID) {
+        return
+    }
+
+    ctx := r.Context()
+
+    members, err := careTeamRepo.List(ctx, bson.M{"patientId": patientID}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    ids := make([]primitive.ObjectID, len(members))
+    for i, member := range members {
+        ids[i] = member.UserID
+    }
+    users, err := userRepo.List(ctx, bson.M{"_id": bson.M{"$in": ids}}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    byID := make(map[primitive.ObjectID]User, len(users))
+    for _, user := range users {
+        byID[user.ID] = user
+    }
+
+    team := make([]careTeamEntry, len(members))
+    for i, member := range members {
+        user := byID[member.UserID]
+        team[i] = careTeamEntry{CareTeamMember: member, Name: user.Name, Email: user.Email}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(team)
+}
+
+// validateCareRole checks that an account can take a role on a care team.
+func validateCareRole(user *User, role string) error {
+    account, ok := careRoleAccounts[role]
+    if !ok {
+        return newAPIError("invalid_choice", "role", strings.Join(careRoles, ", "))
+    }
+    if user.Role != account {
+        return newAPIError("care_role_mismatch", user.Role, role)
+    }
+    return nil
+}
+
+// writeCareTeamConflict answers the duplicate key errors of memberships.
+func writeCareTeamConflict(w http.ResponseWriter, r *http.Request, role string) {
+    if role == CarePrimary {
+        localizedError(w, r, http.StatusConflict, "primary_doctor_exists")
+        return
+    }
+    localizedError(w, r, http.StatusConflict, "care_team_member_exists")
+}
+
+func addCareTeamMember(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    var member CareTeamMember
+    if !decodeJSON(w, r, &member) {
+        return
+    }
+    member.PatientID = patientID
+
+    ctx := r.Context()
+
+    ok, err := canManageCareTeam(ctx, userFromContext(ctx), patientID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        localizedError(w, r, http.StatusForbidden, "forbidden")
+        return
+    }
+
+    if _, err := patientRepo.GetByID(ctx, patientID); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "patient_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    user, err := userRepo.GetByID(ctx, member.UserID)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusBadRequest, "user_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := validateCareRole(user, member.Role); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    if err := careTeamRepo.Create(ctx, &member); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            if _, err := careTeamMember(ctx, patientID, member.UserID); err == nil {
+                localizedError(w, r, http.StatusConflict, "care_team_member_exists")
+                return
+            }
+            writeCareTeamConflict(w, r, member.Role)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(careTeamEntry{CareTeamMember: member, Name: user.Name, Email: user.Email})
+}
+
+// careTeamMemberHandler changes the role of a member, with a body of
+// {"role": ...}, or takes them off the team:
+// PATCH, DELETE /patients/{id}/care-team/{userId}
+func careTeamMemberHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+    userID, err := primitive.ObjectIDFromHex(r.PathValue("userId"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_user_id")
+        return
+    }
+
+    var change struct {
+        Role string `json:"role"`
+    }
+    if r.Method == http.MethodPatch && !decodeJSON(w, r, &change) {
+        return
+    }
+
+    ctx := r.Context()
+
+    ok, err := canManageCareTeam(ctx, userFromContext(ctx), patientID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        localizedError(w, r, http.StatusForbidden, "forbidden")
+        return
+    }
+
+    member, err := careTeamMember(ctx, patientID, userID)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusNotFound, "care_team_member_not_found")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if r.Method == http.MethodDelete {
+        if err := careTeamRepo.SoftDelete(ctx, member.ID); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    user, err := userRepo.GetByID(ctx, userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := validateCareRole(user, change.Role); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if err := careTeamRepo.UpdateFields(ctx, member.ID, nil, bson.M{"role": change.Role}); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            writeCareTeamConflict(w, r, change.Role)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    member.Role = change.Role
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(careTeamEntry{CareTeamMember: *member, Name: user.Name, Email: user.Email})
+}
+
+// getMyPatients lists the patients on whose care teams the account of the
+// request is: GET /care-team/patients
+func getMyPatients(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+    user := userFromContext(ctx)
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    members, err := careTeamRepo.List(ctx, bson.M{"userId": user.ID}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    ids := make([]primitive.ObjectID, len(members))
+    for i, member := range members {
+        ids[i] = member.PatientID
+    }
+    patients, err := patientRepo.List(ctx, bson.M{"_id": bson.M{"$in": ids}}, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    for _, patient := range patients {
+        notePatientAccess(ctx, patient.ID)
+    }
+
+    setNextPage(w, r, page, patients)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(patients)
+}
@@ -0,0 +1,185 @@
+//go:build chaos
+
+package main
+
+import (
+    "context"
+    "log"
+    "math/rand"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fault injection for resilience testing in staging, built only with
+//
+//	go build -tags chaos
+//
+// so production binaries cannot inject faults. Faults are further only
+// injected for the tenants the chaos feature flag is on for, so they can
+// be switched on and off at runtime with /admin/flags. Each kind is
+// injected on a percentage of requests, and the faults injected are named
+// in the X-Chaos response header:
+//
+//	CHAOS_LATENCY, CHAOS_LATENCY_PERCENT  delay requests by up to the latency
+//	CHAOS_ERROR_PERCENT, CHAOS_ERROR_STATUS  fail requests with a 5xx
+//	CHAOS_DROP_PERCENT                    drop every MongoDB connection
+//	CHAOS_ROUTES                          path prefixes faults apply to, all by default
+//
+// Health checks, metrics, diagnostics and the admin API are never faulted.
+
+// FlagChaos turns fault injection on for a tenant.
+const FlagChaos = "chaos"
+
+type chaosSettings struct {
+    latency        time.Duration
+    latencyPercent float64
+    errorPercent   float64
+    errorStatus    int
+    dropPercent    float64
+    routes         []string
+}
+
+var (
+    chaos       chaosSettings
+    chaosConns  = &chaosConnections{conns: map[*chaosConn]struct{}{}}
+    chaosExempt = []string{"/healthz", "/readyz", "/metrics", "/admin/", "/debug/"}
+)
+
+func init() {
+    knownFlags = append(knownFlags, FlagChaos)
+
+    status, _ := strconv.Atoi(envChoice("CHAOS_ERROR_STATUS", "503", "500", "502", "503", "504"))
+    chaos = chaosSettings{
+        latency:        envDuration("CHAOS_LATENCY", 0),
+        latencyPercent: envPercent("CHAOS_LATENCY_PERCENT"),
+        errorPercent:   envPercent("CHAOS_ERROR_PERCENT"),
+        errorStatus:    status,
+        dropPercent:    envPercent("CHAOS_DROP_PERCENT"),
+    }
+    for route := range envSet("CHAOS_ROUTES") {
+        chaos.routes = append(chaos.routes, route)
+    }
+    log.Printf("Fault injection built in: %v latency on %g%%, %d on %g%%, dropped connections on %g%% of requests\n",
+        chaos.latency, chaos.latencyPercent, chaos.errorStatus, chaos.errorPercent, chaos.dropPercent)
+}
+
+// envPercent reads a percentage from 0 to 100.
+func envPercent(key string) float64 {
+    percent, err := strconv.ParseFloat(envString(key, "0"), 64)
+    if err != nil || percent < 0 || percent > 100 {
+        log.Fatalf("%s must be a percentage from 0 to 100", key)
+    }
+    return percent
+}
+
+// chance reports true on percent of calls.
+func chance(percent float64) bool {
+    return percent > 0 && rand.Float64()*100 < percent
+}
+
+// faulted reports whether faults apply to a request.
+func faulted(r *http.Request) bool {
+    for _, prefix := range chaosExempt {
+        if strings.HasPrefix(r.URL.Path, prefix) {
+            return false
+        }
+    }
+    if len(chaos.routes) > 0 {
+        matched := false
+        for _, prefix := range chaos.routes {
+            matched = matched || strings.HasPrefix(r.URL.Path, prefix)
+        }
+        if !matched {
+            return false
+        }
+    }
+    return featureEnabled(r, FlagChaos)
+}
+
+// withChaos injects faults into requests.
+func withChaos(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !faulted(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        if chance(chaos.dropPercent) {
+            w.Header().Add("X-Chaos", "drop")
+            log.Printf("Chaos: dropped %d MongoDB connections on %s %s\n", chaosConns.drop(), r.Method, r.URL.Path)
+        }
+        if chaos.latency > 0 && chance(chaos.latencyPercent) {
+            delay := time.Duration(rand.Int63n(int64(chaos.latency))) + 1
+            w.Header().Add("X-Chaos", "latency="+delay.Round(time.Millisecond).String())
+            select {
+            case <-time.After(delay):
+            case <-r.Context().Done():
+                return
+            }
+        }
+        if chance(chaos.errorPercent) {
+            w.Header().Add("X-Chaos", "error")
+            http.Error(w, http.StatusText(chaos.errorStatus), chaos.errorStatus)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// MongoDB connections are dialed through chaosConns so they can be dropped
+
+// chaosConnections tracks the open MongoDB connections.
+type chaosConnections struct {
+    dialer net.Dialer
+    mu     sync.Mutex
+    conns  map[*chaosConn]struct{}
+}
+
+type chaosConn struct {
+    net.Conn
+    owner *chaosConnections
+}
+
+func chaosDialer() options.ContextDialer {
+    return chaosConns
+}
+
+func (c *chaosConnections) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    conn, err := c.dialer.DialContext(ctx, network, address)
+    if err != nil {
+        return nil, err
+    }
+    tracked := &chaosConn{Conn: conn, owner: c}
+    c.mu.Lock()
+    c.conns[tracked] = struct{}{}
+    c.mu.Unlock()
+    return tracked, nil
+}
+
+func (c *chaosConn) Close() error {
+    c.owner.mu.Lock()
+    delete(c.owner.conns, c)
+    c.owner.mu.Unlock()
+    return c.Conn.Close()
+}
+
+// drop closes every open connection, as a failover or a network partition
+// would, and returns how many there were. The driver dials again on the
+// next operation.
+func (c *chaosConnections) drop() int {
+    c.mu.Lock()
+    conns := c.conns
+    c.conns = map[*chaosConn]struct{}{}
+    c.mu.Unlock()
+
+    for conn := range conns {
+        conn.Conn.Close()
+    }
+    return len(conns)
+}
@@ -0,0 +1,19 @@
+//go:build !chaos
+
+package main
+
+import (
+    "net/http"
+
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fault injection is only built with the chaos tag; see chaos.go.
+
+func withChaos(next http.Handler) http.Handler {
+    return next
+}
+
+func chaosDialer() options.ContextDialer {
+    return nil
+}
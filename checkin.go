@@ -0,0 +1,141 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/i18n"
+)
+
+// CheckIn is the kiosk response to a check-in: the patient's place in the
+// doctor's queue for the day and the expected wait.
+type CheckIn struct {
+    Appointment          Appointment `json:"appointment"`
+    QueuePosition        int64       `json:"queuePosition"`
+    PatientsAhead        int64       `json:"patientsAhead"`
+    EstimatedWaitMinutes int64       `json:"estimatedWaitMinutes"`
+}
+
+// dayBounds returns the start of t's day and the start of the next day.
+func dayBounds(t time.Time) (time.Time, time.Time) {
+    start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+    return start, start.AddDate(0, 0, 1)
+}
+
+// parseDay parses a YYYY-MM-DD date in server time, or a day relative to
+// today: today, tomorrow, yesterday, or a number of days such as +7 or -1.
+// Relative days let saved searches stay current.
+func parseDay(s string) (time.Time, error) {
+    today, _ := dayBounds(time.Now())
+    switch s {
+    case "today":
+        return today, nil
+    case "tomorrow":
+        return today.AddDate(0, 0, 1), nil
+    case "yesterday":
+        return today.AddDate(0, 0, -1), nil
+    }
+    if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+        days, err := strconv.Atoi(s)
+        if err != nil {
+            return time.Time{}, err
+        }
+        return today.AddDate(0, 0, days), nil
+    }
+    return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
+
+// queuePosition returns the 1-based position of a checked in appointment in
+// its doctor's queue for the day, ordered by arrival.
+func queuePosition(ctx context.Context, appointment *Appointment) (int64, error) {
+    start, end := dayBounds(appointment.DateTime.Local())
+    ahead, err := appointmentCollection.CountDocuments(ctx, bson.M{
+        "doctorId":    appointment.DoctorID,
+        "status":      StatusCheckedIn,
+        "deletedAt":   nil,
+        "dateTime":    bson.M{"$gte": start, "$lt": end},
+        "checkedInAt": bson.M{"$lt": appointment.CheckedInAt},
+    })
+    if err != nil {
+        return 0, err
+    }
+    return ahead + 1, nil
+}
+
+// checkInAppointment records the patient's arrival for today's appointment
+// and places them in the doctor's queue.
+func checkInAppointment(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_appointment_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    appointment, err := appointmentRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "appointment_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if appointment.Status != StatusScheduled {
+        localizedError(w, r, http.StatusConflict, "appointment_status", i18n.StatusLabel(requestLanguage(r), appointment.Status))
+        return
+    }
+    now := time.Now()
+    if start, end := dayBounds(now); appointment.DateTime.Before(start) || !appointment.DateTime.Before(end) {
+        localizedError(w, r, http.StatusConflict, "appointment_not_today")
+        return
+    }
+
+    err = appointmentRepo.UpdateFields(ctx, id,
+        bson.M{"status": StatusScheduled},
+        bson.M{"status": StatusCheckedIn, "checkedInAt": now},
+    )
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusConflict, "appointment_changed")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    appointment.Status = StatusCheckedIn
+    appointment.CheckedInAt = &now
+
+    position, err := queuePosition(ctx, appointment)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    checkIn := CheckIn{
+        Appointment:          *appointment,
+        QueuePosition:        position,
+        PatientsAhead:        position - 1,
+        EstimatedWaitMinutes: int64((time.Duration(position-1) * config.ConsultDuration).Minutes()),
+    }
+    go notifyQueue(checkIn)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(checkIn)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// runCommand runs the maintenance command named by the first argument
+// instead of the server:
+//
+//  backup                             back up the database now, e.g. from cron
+//  backups                            list the backups in the backup store
+//  restore -key K -confirm DB [-db D] restore backup K into database D
+//  rebuild-projections                recompute the projected reports
+//  index-names                        compute the phonetic keys of patient names
+//  loadgen -url U [-duration D] ...   load the server at U and report latencies
+func runCommand(args []string) error {
+    ctx := contextWithActor(context.Background(), "cli")
+    switch args[0] {
+    case "backup":
+        entry, run, err := startBackup(ctx, "cli")
+        if err != nil {
+            return err
+        }
+        if err := run(ctx); err != nil {
+            return err
+        }
+        fmt.Printf("Backed up %d collections to %s (%d bytes, sha256 %s)\n",
+            len(entry.Collections), entry.Key, entry.SizeBytes, entry.SHA256)
+        return nil
+    case "backups":
+        if backupStore == nil {
+            return errors.New("BACKUP_STORE is not set")
+        }
+        objects, err := backupStore.List(ctx, "")
+        if err != nil {
+            return err
+        }
+        for _, object := range objects {
+            fmt.Printf("%s\t%d\t%s\n", object.Key, object.Size, object.Modified.Format(time.RFC3339))
+        }
+        return nil
+    case "restore":
+        return restoreCommand(ctx, args[1:])
+    case "rebuild-projections":
+        entities, err := rebuildProjections(ctx)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Projected %d appointments and invoices\n", entities)
+        return nil
+    case "loadgen":
+        return loadgenCommand(ctx, args[1:])
+    case "index-names":
+        updated, err := indexPatientNames(ctx)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Indexed the names of %d patients\n", updated)
+        return nil
+    default:
+        return fmt.Errorf("unknown command %q", args[0])
+    }
+}
+
+// restoreCommand restores a backup after checking it end to end. It
+// overwrites the collections of the target database, so it requires the
+// name of that database to be repeated with -confirm.
+func restoreCommand(ctx context.Context, args []string) error {
+    flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+    key := flags.String("key", "", "key of the backup to restore")
+    target := flags.String("db", config.MongoDatabase, "database to restore into")
+    confirm := flags.String("confirm", "", "name of the database to restore into, to confirm")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if *key == "" {
+        return errors.New("restore: -key is required")
+    }
+    if *confirm != *target {
+        return fmt.Errorf("restore: overwrites database %q; confirm with -confirm %s", *target, *target)
+    }
+    if backupStore == nil {
+        return errors.New("BACKUP_STORE is not set")
+    }
+
+    // Download and verify before touching the database
+    archive, err := os.CreateTemp("", "restore-*.tar.gz")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(archive.Name())
+    defer archive.Close()
+
+    body, err := backupStore.Get(ctx, *key)
+    if err != nil {
+        return err
+    }
+    hash := sha256.New()
+    _, err = io.Copy(io.MultiWriter(archive, hash), body)
+    body.Close()
+    if err != nil {
+        return err
+    }
+    sum := hex.EncodeToString(hash.Sum(nil))
+
+    var entry Backup
+    err = backupCollection.FindOne(ctx, bson.M{"key": *key, "status": BackupCompleted}).Decode(&entry)
+    switch {
+    case err == nil && entry.SHA256 != sum:
+        return fmt.Errorf("restore: checksum of %s is %s, the catalog says %s", *key, sum, entry.SHA256)
+    case errors.Is(err, mongo.ErrNoDocuments):
+        fmt.Printf("Backup %s is not in the catalog, restoring without checksum verification\n", *key)
+    case err != nil:
+        return err
+    }
+
+    if _, err := archive.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    manifest, err := readManifest(archive)
+    if err != nil {
+        return fmt.Errorf("restore: %s: %w", *key, err)
+    }
+    fmt.Printf("Restoring %s, taken from database %s at %s, into %s\n",
+        *key, manifest.Database, manifest.CreatedAt.Format(time.RFC3339), *target)
+
+    if _, err := archive.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    restored, err := restoreArchive(ctx, client.Database(*target), archive)
+    if err != nil {
+        return err
+    }
+    names := make([]string, 0, len(restored.Collections))
+    for name := range restored.Collections {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Printf("%s\t%d\n", name, restored.Collections[name])
+    }
+    for _, name := range names {
+        failed, ok := restored.Failed[name]
+        if !ok {
+            continue
+        }
+        fmt.Printf("%s: %d documents failed\n", name, failed.Failed)
+        for _, failure := range failed.Failures {
+            fmt.Printf("  #%d\t%d\t%s\n", failure.Index, failure.Code, failure.Message)
+        }
+    }
+    return nil
+}
+
+// readManifest reads the manifest of an archive, checking that the archive
+// is complete on the way.
+func readManifest(r io.Reader) (*backupManifest, error) {
+    gz, err := gzip.NewReader(r)
+    if err != nil {
+        return nil, err
+    }
+    archive := tar.NewReader(gz)
+
+    var manifest *backupManifest
+    for {
+        header, err := archive.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if header.Name == "manifest.json" {
+            manifest = &backupManifest{}
+            if err := json.NewDecoder(archive).Decode(manifest); err != nil {
+                return nil, err
+            }
+        }
+    }
+    if manifest == nil {
+        return nil, errors.New("no manifest")
+    }
+    return manifest, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+// maxOutreachLength bounds the message of an outreach campaign.
+const maxOutreachLength = 1000
+
+// Cohort selects patients by their tags: those carrying all of Tags, at
+// least one of AnyTags when given, and none of ExcludeTags.
+type Cohort struct {
+    TenantID    string   `json:"tenantId,omitempty"`
+    Tags        []string `json:"tags,omitempty"`
+    AnyTags     []string `json:"anyTags,omitempty"`
+    ExcludeTags []string `json:"excludeTags,omitempty"`
+}
+
+// cohortFromQuery reads a cohort from ?tag=, ?anyTag= and ?notTag=, each
+// repeatable, for the tenant of the request.
+func cohortFromQuery(r *http.Request) Cohort {
+    query := r.URL.Query()
+    return Cohort{
+        TenantID:    r.Header.Get(tenantHeader),
+        Tags:        queryList(query, "tag"),
+        AnyTags:     queryList(query, "anyTag"),
+        ExcludeTags: queryList(query, "notTag"),
+    }
+}
+
+// queryList collects the values of a repeated or comma separated query
+// parameter.
+func queryList(query url.Values, key string) []string {
+    var values []string
+    for _, v := range query[key] {
+        for _, s := range strings.Split(v, ",") {
+            if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+                values = append(values, s)
+            }
+        }
+    }
+    return values
+}
+
+// filter is the patient filter of the cohort.
+func (c Cohort) filter() bson.M {
+    tags := bson.M{}
+    if len(c.Tags) > 0 {
+        tags["$all"] = c.Tags
+    }
+    if len(c.ExcludeTags) > 0 {
+        tags["$nin"] = c.ExcludeTags
+    }
+    filter := bson.M{}
+    if len(tags) > 0 {
+        filter["tags"] = tags
+    }
+    if len(c.AnyTags) > 0 {
+        filter["$and"] = bson.A{bson.M{"tags": bson.M{"$in": c.AnyTags}}}
+    }
+    if c.TenantID != "" {
+        filter["tenantId"] = c.TenantID
+    }
+    return filter
+}
+
+// empty reports whether the cohort selects by no tag, which would be every
+// patient.
+func (c Cohort) empty() bool {
+    return len(c.Tags) == 0 && len(c.AnyTags) == 0
+}
+
+// forEachInCohort calls fn with every patient of a cohort that has not
+// been anonymized, stopping at the first error.
+func forEachInCohort(ctx context.Context, cohort Cohort, fn func(*Patient) error) error {
+    filter := cohort.filter()
+    filter["deletedAt"] = nil
+    filter["anonymizedAt"] = nil
+    cursor, err := patientCollection.Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+
+    for cursor.Next(ctx) {
+        var patient Patient
+        if err := cursor.Decode(&patient); err != nil {
+            return err
+        }
+        if err := fn(&patient); err != nil {
+            return err
+        }
+    }
+    return cursor.Err()
+}
+
+// getCohort lists a page of the patients of a cohort with its size:
+// GET /patients/cohort?tag=&anyTag=&notTag=
+func getCohort(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    cohort := cohortFromQuery(r)
+    if cohort.empty() {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "tag")
+        return
+    }
+
+    ctx := r.Context()
+
+    filter := cohort.filter()
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    patients, err := patientRepo.List(ctx, filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    filter["deletedAt"] = nil
+    count, err := patientCollection.CountDocuments(ctx, filter)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    for _, patient := range patients {
+        notePatientAccess(ctx, patient.ID)
+    }
+
+    setNextPage(w, r, page, patients)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "cohort":   cohort,
+        "count":    count,
+        "patients": append([]Patient{}, patients...),
+    })
+}
+
+// Outreach is a message of a targeted outreach campaign.
+type Outreach struct {
+    Subject string `json:"subject" bson:"subject"`
+    Message string `json:"message" bson:"message"`
+}
+
+// OutreachCampaign sends an outreach message to the patients of a cohort.
+type OutreachCampaign struct {
+    Cohort Cohort `json:"cohort"`
+    Outreach
+}
+
+// sendOutreach notifies the patients of a cohort of a message over every
+// channel: POST /admin/outreach. Messages are sent in the background; the
+// response gives the number of patients targeted.
+func sendOutreach(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var campaign OutreachCampaign
+    if !decodeJSON(w, r, &campaign) {
+        return
+    }
+    if campaign.Cohort.empty() {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "cohort.tags")
+        return
+    }
+    if campaign.Message == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "message")
+        return
+    }
+    if len(campaign.Message) > maxOutreachLength {
+        localizedError(w, r, http.StatusBadRequest, "field_too_long", "message", maxOutreachLength)
+        return
+    }
+
+    ctx := r.Context()
+
+    filter := campaign.Cohort.filter()
+    filter["deletedAt"] = nil
+    filter["anonymizedAt"] = nil
+    count, err := patientCollection.CountDocuments(ctx, filter)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    go func() {
+        ctx := context.Background()
+        var sent int
+        err := forEachInCohort(ctx, campaign.Cohort, func(patient *Patient) error {
+            notifyCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+            defer cancel()
+            if err := notifyPatient(notifyCtx, "outreach", notificationData{Patient: patient, Outreach: &campaign.Outreach}); err != nil {
+                log.Printf("Error sending outreach to patient %s: %v\n", patient.ID.Hex(), err)
+            }
+            sent++
+            return nil
+        })
+        if err != nil {
+            log.Printf("Error sending outreach after %d patients: %v\n", sent, err)
+        }
+    }()
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]interface{}{"patients": count})
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Communication channels
+const (
+    ChannelCall    = "call"
+    ChannelSMS     = "sms"
+    ChannelMessage = "message" // secure messages of the patient portal
+)
+
+var communicationChannels = []string{ChannelCall, ChannelSMS, ChannelMessage}
+
+// Communication directions
+const (
+    Inbound  = "inbound"  // from the patient
+    Outbound = "outbound" // to the patient
+)
+
+var communicationDirections = []string{Inbound, Outbound}
+
+// Communication is a phone call, text message or secure message between
+// staff and a patient. The messages of a conversation form a thread named
+// by its first message, which has no ThreadID. A communication is unread
+// until its recipient reads it: staff for inbound ones, the patient for
+// outbound secure messages.
+type Communication struct {
+    Document        `bson:",inline"`
+    PatientID       primitive.ObjectID  `json:"patientId" bson:"patientId"`
+    ThreadID        *primitive.ObjectID `json:"threadId,omitempty" bson:"threadId,omitempty"`
+    Channel         string              `json:"channel" bson:"channel"`
+    Direction       string              `json:"direction" bson:"direction"`
+    Subject         string              `json:"subject,omitempty" bson:"subject,omitempty"`
+    Body            string              `json:"body,omitempty" bson:"body,omitempty"`
+    StaffID         *primitive.ObjectID `json:"staffId,omitempty" bson:"staffId,omitempty"` // account that handled it
+    DurationSeconds int64               `json:"durationSeconds,omitempty" bson:"durationSeconds,omitempty"` // of calls
+    ReadAt          *time.Time          `json:"readAt,omitempty" bson:"readAt,omitempty"`
+}
+
+// thread returns the id of the thread of a communication.
+func (c *Communication) thread() primitive.ObjectID {
+    if c.ThreadID != nil {
+        return *c.ThreadID
+    }
+    return c.ID
+}
+
+// CommunicationThread summarizes a thread of a patient.
+type CommunicationThread struct {
+    ID       primitive.ObjectID `json:"id" bson:"_id"`
+    Channel  string             `json:"channel" bson:"channel"`
+    Subject  string             `json:"subject,omitempty" bson:"subject"`
+    Count    int64              `json:"count" bson:"count"`
+    Unread   int64              `json:"unread" bson:"unread"`
+    LastBody string             `json:"lastBody,omitempty" bson:"lastBody"`
+    LastAt   time.Time          `json:"lastAt" bson:"lastAt"`
+}
+
+// PortalMessages is the secure messaging view of the patient portal.
+type PortalMessages struct {
+    Unread   int64           `json:"unread"`
+    Messages []Communication `json:"messages"`
+}
+
+var (
+    communicationCollection *mongo.Collection
+    communicationRepo       *Repository[Communication, *Communication]
+)
+
+func initCommunications(ctx context.Context, db *mongo.Database) {
+    communicationCollection = db.Collection("communications")
+    communicationRepo = NewRepository[Communication](communicationCollection, defaultHooks)
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "patientId", Value: 1}, {Key: "_id", Value: 1}}},
+        {Keys: bson.D{{Key: "threadId", Value: 1}}, Options: options.Index().SetSparse(true)},
+        {Keys: bson.D{{Key: "direction", Value: 1}, {Key: "readAt", Value: 1}, {Key: "patientId", Value: 1}}},
+    }
+    if _, err := communicationCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating communication indexes: %v\n", err)
+    }
+}
+
+// unreadExpr matches the communications their recipients have not read,
+// in aggregation expressions.
+var unreadExpr = bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$readAt", nil}}, nil}}
+
+// threadFilter matches the communications of a thread of a patient.
+func threadFilter(patientID, threadID primitive.ObjectID) bson.M {
+    return bson.M{
+        "patientId": patientID,
+        "$or":       bson.A{bson.M{"_id": threadID}, bson.M{"threadId": threadID}},
+    }
+}
+
+// validateCommunication checks a communication and joins it to its thread,
+// from which replies take their channel and subject.
+func validateCommunication(ctx context.Context, c *Communication) error {
+    if c.ThreadID != nil {
+        first, err := communicationRepo.GetByID(ctx, *c.ThreadID)
+        if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && first.PatientID != c.PatientID) {
+            return newAPIError("thread_not_found")
+        }
+        if err != nil {
+            return err
+        }
+        thread := first.thread()
+        c.ThreadID = &thread
+        c.Channel = first.Channel
+        c.Subject = first.Subject
+    }
+
+    if !slices.Contains(communicationChannels, c.Channel) {
+        return newAPIError("invalid_choice", "channel", strings.Join(communicationChannels, ", "))
+    }
+    if !slices.Contains(communicationDirections, c.Direction) {
+        return newAPIError("invalid_choice", "direction", strings.Join(communicationDirections, ", "))
+    }
+    c.Subject = strings.TrimSpace(c.Subject)
+    c.Body = strings.TrimSpace(c.Body)
+    if c.Channel != ChannelCall && c.Body == "" {
+        return newAPIError("field_required", "body")
+    }
+    if c.Channel == ChannelMessage && c.Subject == "" {
+        return newAPIError("field_required", "subject")
+    }
+    if c.DurationSeconds < 0 || (c.Channel != ChannelCall && c.DurationSeconds != 0) {
+        return newAPIError("invalid_call_duration")
+    }
+    c.ReadAt = nil
+    return nil
+}
+
+// markRead marks the unread communications of a thread in a direction as
+// read, returning how many were. Patients only read secure messages.
+func markRead(ctx context.Context, patientID, threadID primitive.ObjectID, direction string) (int64, error) {
+    filter := threadFilter(patientID, threadID)
+    filter["direction"] = direction
+    if direction == Outbound {
+        filter["channel"] = ChannelMessage
+    }
+    filter["readAt"] = nil
+    filter["deletedAt"] = nil
+    result, err := communicationCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"readAt": time.Now()}})
+    if err != nil {
+        return 0, err
+    }
+    return result.ModifiedCount, nil
+}
+
+// patientCommunications lists the communications of a patient, for
+// ?channel= and ?thread=, and records new ones: GET, POST
+// /patients/{id}/communications. Outbound secure messages are sent to the
+// patient portal.
+func patientCommunications(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getCommunications(w, r)
+    case http.MethodPost:
+        createCommunication(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getCommunications(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    filter := bson.M{"patientId": patientID}
+    query := r.URL.Query()
+    if channel := query.Get("channel"); channel != "" {
+        filter["channel"] = channel
+    }
+    if thread := query.Get("thread"); thread != "" {
+        threadID, err := primitive.ObjectIDFromHex(thread)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_thread_id")
+            return
+        }
+        filter = threadFilter(patientID, threadID)
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    communications, err := communicationRepo.List(ctx, filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, communications)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(communications)
+}
+
+func createCommunication(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    var c Communication
+    if !decodeJSON(w, r, &c) {
+        return
+    }
+    c.PatientID = patientID
+
+    ctx := r.Context()
+
+    patient, err := patientRepo.GetByID(ctx, patientID)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "patient_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := validateCommunication(ctx, &c); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    // Patients write secure messages themselves, through the portal
+    if c.Channel == ChannelMessage && c.Direction != Outbound {
+        writeError(w, r, http.StatusBadRequest, newAPIError("invalid_choice", "direction", Outbound))
+        return
+    }
+    if user := userFromContext(ctx); user != nil {
+        c.StaffID = &user.ID
+    }
+
+    if err := communicationRepo.Create(ctx, &c); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if c.Channel == ChannelMessage {
+        go notifyMessage(*patient)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(c)
+}
+
+// getCommunicationThreads lists the threads of a patient, latest first,
+// with the inbound communications staff have not read:
+// GET /patients/{id}/communications/threads
+func getCommunicationThreads(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: bson.M{"patientId": patientID, "deletedAt": nil}}},
+        {{Key: "$sort", Value: bson.M{"_id": 1}}},
+        {{Key: "$group", Value: bson.M{
+            "_id":      bson.M{"$ifNull": bson.A{"$threadId", "$_id"}},
+            "channel":  bson.M{"$first": "$channel"},
+            "subject":  bson.M{"$first": "$subject"},
+            "count":    bson.M{"$sum": 1},
+            "unread":   bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$and": bson.A{bson.M{"$eq": bson.A{"$direction", Inbound}}, unreadExpr}}, 1, 0}}},
+            "lastBody": bson.M{"$last": "$body"},
+            "lastAt":   bson.M{"$last": "$createdAt"},
+        }}},
+        {{Key: "$sort", Value: bson.D{{Key: "lastAt", Value: -1}, {Key: "_id", Value: -1}}}},
+    }
+    cursor, err := communicationCollection.Aggregate(ctx, pipeline)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    threads := []CommunicationThread{}
+    if err := cursor.All(ctx, &threads); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(threads)
+}
+
+// readCommunicationThread marks the inbound communications of a thread as
+// read by staff: POST /patients/{id}/communications/threads/{threadId}/read
+func readCommunicationThread(w http.ResponseWriter, r *http.Request) {
+    readThread(w, r, Inbound)
+}
+
+func readThread(w http.ResponseWriter, r *http.Request, direction string) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+    threadID, err := primitive.ObjectIDFromHex(r.PathValue("threadId"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_thread_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    read, err := markRead(ctx, patientID, threadID, direction)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]int64{"read": read})
+}
+
+// getUnreadCommunications counts the unread inbound communications by
+// patient, of the patients the account of the request may access:
+// GET /communications/unread
+func getUnreadCommunications(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+    user := userFromContext(ctx)
+
+    match := bson.M{"direction": Inbound, "readAt": nil, "deletedAt": nil}
+    if user.Role != RoleAdmin && config.CareTeamAccess {
+        members, err := careTeamRepo.List(ctx, bson.M{"userId": user.ID}, Page{})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        ids := make([]primitive.ObjectID, len(members))
+        for i, member := range members {
+            ids[i] = member.PatientID
+        }
+        match["patientId"] = bson.M{"$in": ids}
+    }
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$group", Value: bson.M{"_id": "$patientId", "unread": bson.M{"$sum": 1}}}},
+        {{Key: "$sort", Value: bson.D{{Key: "unread", Value: -1}, {Key: "_id", Value: 1}}}},
+    }
+    cursor, err := communicationCollection.Aggregate(ctx, pipeline)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var counts []struct {
+        PatientID primitive.ObjectID `json:"patientId" bson:"_id"`
+        Unread    int64              `json:"unread" bson:"unread"`
+    }
+    if err := cursor.All(ctx, &counts); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var total int64
+    for _, count := range counts {
+        total += count.Unread
+        notePatientAccess(ctx, count.PatientID)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"total": total, "patients": counts})
+}
+
+// portalKey authenticates a patient to their secure messages on the
+// patient portal. Like video join keys it is derived, not stored.
+func portalKey(patientID primitive.ObjectID) string {
+    mac := hmac.New(sha256.New, authKey)
+    mac.Write([]byte("portal:" + patientID.Hex()))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// portalURL is the link to the secure messages of a patient, or "" without
+// PORTAL_URL. The page it opens passes the key to /portal/{id}/messages.
+func portalURL(patientID primitive.ObjectID) string {
+    if config.PortalURL == "" {
+        return ""
+    }
+    query := url.Values{"patient": {patientID.Hex()}, "key": {portalKey(patientID)}}
+    separator := "?"
+    if strings.Contains(config.PortalURL, "?") {
+        separator = "&"
+    }
+    return config.PortalURL + separator + query.Encode()
+}
+
+// getPortalLink returns the portal link and key of a patient, for staff to
+// hand over: GET /patients/{id}/portal-link
+func getPortalLink(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"url": portalURL(patientID), "key": portalKey(patientID)})
+}
+
+// notifyMessage tells a patient a secure message is waiting, in the
+// background of a request.
+func notifyMessage(patient Patient) {
+    if config.PortalURL == "" {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    data := notificationData{Patient: &patient, PortalURL: portalURL(patient.ID)}
+    if err := notifyPatient(ctx, "message", data); err != nil {
+        log.Printf("Error sending message notification to patient %s: %v\n", patient.ID.Hex(), err)
+    }
+}
+
+// requirePortalKey lets requests with the ?key= of the patient of a
+// /portal/{id}/... route through.
+func requirePortalKey(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+            return
+        }
+        if !hmac.Equal([]byte(r.URL.Query().Get("key")), []byte(portalKey(patientID))) {
+            localizedError(w, r, http.StatusForbidden, "invalid_portal_key")
+            return
+        }
+        next(w, r)
+    }
+}
+
+// portalMessages lists the secure messages of a patient and sends new
+// ones to staff: GET, POST /portal/{id}/messages?key=
+func portalMessages(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getPortalMessages(w, r)
+    case http.MethodPost:
+        sendPortalMessage(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getPortalMessages(w http.ResponseWriter, r *http.Request) {
+    patientID, _ := primitive.ObjectIDFromHex(r.PathValue("id"))
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    filter := bson.M{"patientId": patientID, "channel": ChannelMessage}
+    messages, err := communicationRepo.List(ctx, filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    unread, err := communicationCollection.CountDocuments(ctx, bson.M{
+        "patientId": patientID, "channel": ChannelMessage, "direction": Outbound, "readAt": nil, "deletedAt": nil,
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, messages)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(PortalMessages{Unread: unread, Messages: messages})
+}
+
+func sendPortalMessage(w http.ResponseWriter, r *http.Request) {
+    patientID, _ := primitive.ObjectIDFromHex(r.PathValue("id"))
+
+    var message struct {
+        ThreadID *primitive.ObjectID `json:"threadId"`
+        Subject  string              `json:"subject"`
+        Body     string              `json:"body"`
+    }
+    if !decodeJSON(w, r, &message) {
+        return
+    }
+    c := Communication{
+        PatientID: patientID,
+        ThreadID:  message.ThreadID,
+        Channel:   ChannelMessage,
+        Direction: Inbound,
+        Subject:   message.Subject,
+        Body:      message.Body,
+    }
+
+    ctx := r.Context()
+
+    if err := validateCommunication(ctx, &c); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if c.Channel != ChannelMessage {
+        writeError(w, r, http.StatusBadRequest, newAPIError("thread_not_found"))
+        return
+    }
+
+    if err := communicationRepo.Create(ctx, &c); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(c)
+}
+
+// readPortalThread marks the messages of a thread as read by the patient:
+// POST /portal/{id}/messages/{threadId}/read?key=
+func readPortalThread(w http.ResponseWriter, r *http.Request) {
+    readThread(w, r, Outbound)
+}
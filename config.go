@@ -0,0 +1,683 @@
+package main
+
+import (
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Config holds the service settings, read from the environment at startup.
+type Config struct {
+    // Listeners
+    HTTPAddr         string
+    TLSAddr          string
+    TLSCertFile      string
+    TLSKeyFile       string
+    HTTPSRedirect    bool
+    AutocertDomains  []string
+    AutocertCacheDir string
+    AutocertEmail    string
+    PublicURL        string
+
+    // Administration
+    AdminToken string
+
+    // Authentication
+    AuthSecret        string
+    AuthTokenTTL      time.Duration
+    AuthRefreshTTL    time.Duration
+    PasswordMinLength int64
+    PasswordRequire   map[string]bool
+    LoginMaxFailures  int64
+    LoginLockout      time.Duration
+    PasswordResetTTL  time.Duration
+
+    // Access logs
+    AccessLogRetention time.Duration
+
+    // Patient data retention
+    RetentionInactiveYears int64
+    RetentionAction        string
+    RetentionDryRun        bool
+    RetentionCheckInterval time.Duration
+
+    // Backups
+    BackupStore       string
+    BackupDir         string
+    BackupS3Endpoint  string
+    BackupS3Region    string
+    BackupS3Bucket    string
+    BackupS3AccessKey string
+    BackupS3SecretKey string
+    BackupInterval    time.Duration
+    BackupTimeout     time.Duration
+    BackupKeep        int64
+    BackupExclude     map[string]bool
+
+    // Warehouse export: the target changed documents are shipped to, files
+    // in a directory or S3 bucket (the backup bucket by default) or
+    // BigQuery, and how often and how much at a time
+    WarehouseTarget          string
+    WarehouseDir             string
+    WarehouseS3Endpoint      string
+    WarehouseS3Region        string
+    WarehouseS3Bucket        string
+    WarehouseS3AccessKey     string
+    WarehouseS3SecretKey     string
+    WarehouseS3Prefix        string
+    WarehouseBigQueryProject string
+    WarehouseBigQueryDataset string
+    WarehouseBigQueryKeyFile string
+    WarehouseInterval        time.Duration
+    WarehouseBatch           int64
+    WarehouseLag             time.Duration
+    WarehouseTables          map[string]bool
+    WarehouseOmit            map[string]bool
+
+    // Feature flags
+    FeatureFlags       map[string]bool
+    FeatureFlagRefresh time.Duration
+
+    // Maintenance and read-only modes
+    ServiceModeRefresh time.Duration
+
+    // Outbound calls
+    OutboundTimeouts map[string]time.Duration
+    OutboundRetries  int64
+    OutboundBackoff  time.Duration
+    BreakerThreshold int64
+    BreakerCooldown  time.Duration
+
+    // Browser security
+    ContentSecurityPolicy string
+    HSTSMaxAge            time.Duration
+    HSTSIncludeSubdomains bool
+    CookieSecure          bool
+
+    // Single sign-on
+    OIDCDiscoveryURL string
+    OIDCClientID     string
+    OIDCClientSecret string
+    OIDCRedirectURL  string
+    OIDCScopes       []string
+    OIDCGroupsClaim  string
+    OIDCRoleMap      map[string]string
+
+    // MongoDB
+    MongoURI             string
+    MongoDatabase        string
+    MongoMaxPoolSize     uint64
+    MongoMinPoolSize     uint64
+    MongoMaxConnIdleTime time.Duration
+    MongoReadPreference  string
+    MongoWriteConcern    string
+    MongoRetryWrites     bool
+    BulkBatchSize        int64
+
+    // Schema evolution: how often documents upgraded on read are written
+    // back in their current shape, 0 to only upgrade them on read
+    SchemaWriteBackInterval time.Duration
+
+    // Scheduling
+    ConsultDuration     time.Duration
+    SlotDuration        time.Duration
+    SlotHoldTTL         time.Duration
+    ScheduleCache       bool
+    ScheduleCacheDays   int64
+    ScheduleCacheResync time.Duration
+    WorkdayStart        time.Duration
+    WorkdayEnd          time.Duration
+    WorkDays            map[time.Weekday]bool
+    NoShowCheckInterval time.Duration
+    NoShowGrace         time.Duration
+    NoShowOfferSlot     bool
+
+    // Waitlist: how long a patient has to confirm a freed slot offered to
+    // them
+    WaitlistOfferWindow   time.Duration
+    WaitlistCheckInterval time.Duration
+
+    // Cancellation policy
+    CancelMinNotice   time.Duration
+    CancelMaxPerMonth int64
+    CancelFeeCents    int64
+    CancelLateAction  string
+    CancelLimitAction string
+
+    // Webhooks
+    WebhookURL    string
+    WebhookSecret string
+
+    // Event outbox
+    OutboxRelayInterval   time.Duration
+    OutboxMaxAttempts     int64
+    OutboxRetryBackoff    time.Duration
+    OutboxRetryMaxBackoff time.Duration
+    OutboxRetention       time.Duration
+
+    // Event stream
+    EventStream         string
+    EventStreamBrokers  []string
+    EventStreamURL      string
+    EventStreamPrefix   string
+    EventStreamFormat   string
+    EventStreamRegistry string
+
+    // Report projections
+    Projections bool
+
+    // Email
+    SMTPAddr              string
+    SMTPUsername          string
+    SMTPPassword          string
+    SMTPFrom              string
+    SMTPPoolSize          int64
+    EmailBrand            string
+    DefaultLanguage       string
+    ReminderLead          time.Duration
+    ReminderCheckInterval time.Duration
+    SavedSearchDigestHour int64 // server time
+    SavedSearchInterval   time.Duration
+
+    // Notification delivery
+    NotificationMaxAttempts     int64
+    NotificationRetryBackoff    time.Duration
+    NotificationRetryMaxBackoff time.Duration
+    NotificationRetryInterval   time.Duration
+
+    // SMS
+    SMSProvider      string
+    TwilioAccountSID string
+    TwilioAuthToken  string
+    TwilioFrom       string
+    SMSWebhookURL    string
+    SMSWebhookSecret string
+
+    // Video consultations
+    VideoProvider   string
+    TwilioAPIKey    string
+    TwilioAPISecret string
+    DailyAPIKey     string
+    VideoJoinEarly  time.Duration
+    VideoJoinURL    string
+
+    // Patient portal page opening secure messages
+    PortalURL string
+
+    // Device data
+    DeviceRateLimit int64
+    DeviceRateBurst int64
+    DeviceBatchMax  int64
+
+    // Google Calendar
+    GoogleClientID     string
+    GoogleClientSecret string
+    GoogleRedirectURL  string
+    GoogleSyncInterval time.Duration
+    GoogleSyncDays     int64
+
+    // Geocoding of facility and patient addresses
+    Geocoder         string
+    NominatimURL     string
+    GoogleMapsAPIKey string
+    GeocodeInterval  time.Duration
+    GeocodeBatch     int64
+
+    // Clinical data
+    ICD10CodesFile            string
+    DrugInteractionsFile      string
+    ImmunizationScheduleFile  string
+    ImmunizationGrace         time.Duration
+    ConsentRequiredProcedures map[string]bool
+    TagsManagedOnly           bool
+    WardEventPoll             time.Duration
+    CareTeamAccess            bool // only care team members access patient records
+
+    // Request budgets, e.g. ROUTE_TIMEOUTS=/reports/capacity=1m
+    RequestTimeout time.Duration
+    RouteTimeouts  map[string]time.Duration
+
+    // Rate limits of the route classes, e.g. RATE_LIMITS=auth=30:10,booking=60
+    // for 30 requests a minute in bursts of 10 and 60 in bursts of 60
+    RateLimits map[string]RateLimit
+
+    // Request bodies
+    MaxBodyBytes       int64
+    BodyLimits         map[string]int64
+    LenientJSONRoutes  map[string]bool
+    AttachmentMaxBytes int64
+
+    // How long clients may keep attachments without revalidating
+    AttachmentCacheMaxAge time.Duration
+
+    // Quotas: plans by name, as JSON, and the plan of tenants without one
+    QuotaPlansFile   string
+    QuotaDefaultPlan string
+}
+
+var config Config
+
+func loadConfig() Config {
+    return Config{
+        HTTPAddr:         envString("HTTP_ADDR", ":8080"),
+        TLSAddr:          envString("TLS_ADDR", ":8443"),
+        TLSCertFile:      os.Getenv("TLS_CERT_FILE"),
+        TLSKeyFile:       os.Getenv("TLS_KEY_FILE"),
+        HTTPSRedirect:    envBool("HTTPS_REDIRECT", true),
+        AutocertDomains:  envList("AUTOCERT_DOMAINS"),
+        AutocertCacheDir: envString("AUTOCERT_CACHE_DIR", "autocert-cache"),
+        AutocertEmail:    os.Getenv("AUTOCERT_EMAIL"),
+        PublicURL:        strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+
+        AdminToken: os.Getenv("ADMIN_TOKEN"),
+
+        AuthSecret:        os.Getenv("AUTH_SECRET"),
+        AuthTokenTTL:      envDuration("AUTH_TOKEN_TTL", 15*time.Minute),
+        AuthRefreshTTL:    envDuration("AUTH_REFRESH_TTL", 30*24*time.Hour),
+        PasswordMinLength: envInt64("PASSWORD_MIN_LENGTH", 12),
+        PasswordRequire:   envSetDefault("PASSWORD_REQUIRE", "upper,lower,digit"),
+        LoginMaxFailures:  envInt64("LOGIN_MAX_FAILURES", 5),
+        LoginLockout:      envDuration("LOGIN_LOCKOUT", 15*time.Minute),
+        PasswordResetTTL:  envDuration("PASSWORD_RESET_TTL", time.Hour),
+
+        AccessLogRetention: envDuration("ACCESS_LOG_RETENTION", 6*365*24*time.Hour),
+
+        RetentionInactiveYears: envInt64("RETENTION_INACTIVE_YEARS", 0),
+        RetentionAction:        envChoice("RETENTION_ACTION", RetentionAnonymize, RetentionAnonymize, RetentionPurge),
+        RetentionDryRun:        envBool("RETENTION_DRY_RUN", false),
+        RetentionCheckInterval: envDuration("RETENTION_CHECK_INTERVAL", 24*time.Hour),
+
+        BackupStore:       envChoice("BACKUP_STORE", "", "", "dir", "s3"),
+        BackupDir:         envString("BACKUP_DIR", "backups"),
+        BackupS3Endpoint:  os.Getenv("BACKUP_S3_ENDPOINT"),
+        BackupS3Region:    envString("BACKUP_S3_REGION", "us-east-1"),
+        BackupS3Bucket:    os.Getenv("BACKUP_S3_BUCKET"),
+        BackupS3AccessKey: os.Getenv("BACKUP_S3_ACCESS_KEY"),
+        BackupS3SecretKey: os.Getenv("BACKUP_S3_SECRET_KEY"),
+        BackupInterval:    envDuration("BACKUP_INTERVAL", 24*time.Hour),
+        BackupTimeout:     envDuration("BACKUP_TIMEOUT", 2*time.Hour),
+        BackupKeep:        envInt64("BACKUP_KEEP", 14),
+        BackupExclude:     envSetDefault("BACKUP_EXCLUDE", "sessions,sso_logins,password_resets"),
+
+        WarehouseTarget:          envChoice("WAREHOUSE_TARGET", "", "", "dir", "s3", "bigquery"),
+        WarehouseDir:             envString("WAREHOUSE_DIR", "warehouse"),
+        WarehouseS3Endpoint:      envString("WAREHOUSE_S3_ENDPOINT", os.Getenv("BACKUP_S3_ENDPOINT")),
+        WarehouseS3Region:        envString("WAREHOUSE_S3_REGION", envString("BACKUP_S3_REGION", "us-east-1")),
+        WarehouseS3Bucket:        envString("WAREHOUSE_S3_BUCKET", os.Getenv("BACKUP_S3_BUCKET")),
+        WarehouseS3AccessKey:     envString("WAREHOUSE_S3_ACCESS_KEY", os.Getenv("BACKUP_S3_ACCESS_KEY")),
+        WarehouseS3SecretKey:     envString("WAREHOUSE_S3_SECRET_KEY", os.Getenv("BACKUP_S3_SECRET_KEY")),
+        WarehouseS3Prefix:        envString("WAREHOUSE_S3_PREFIX", "warehouse"),
+        WarehouseBigQueryProject: os.Getenv("WAREHOUSE_BIGQUERY_PROJECT"),
+        WarehouseBigQueryDataset: envString("WAREHOUSE_BIGQUERY_DATASET", "clinic"),
+        WarehouseBigQueryKeyFile: os.Getenv("WAREHOUSE_BIGQUERY_KEY_FILE"),
+        WarehouseInterval:        envDuration("WAREHOUSE_INTERVAL", 15*time.Minute),
+        WarehouseBatch:           envInt64("WAREHOUSE_BATCH", 1000),
+        WarehouseLag:             envDuration("WAREHOUSE_LAG", time.Minute),
+        WarehouseTables:          envSetDefault("WAREHOUSE_TABLES", "patients,appointments,invoices"),
+        WarehouseOmit:            envSet("WAREHOUSE_OMIT"),
+
+        FeatureFlags:       envSetDefault("FEATURE_FLAGS", "billing"),
+        FeatureFlagRefresh: envDuration("FEATURE_FLAG_REFRESH", 30*time.Second),
+
+        ServiceModeRefresh: envDuration("SERVICE_MODE_REFRESH", 5*time.Second),
+
+        OutboundTimeouts: envDurationMap("OUTBOUND_TIMEOUTS"),
+        OutboundRetries:  envInt64("OUTBOUND_RETRIES", 2),
+        OutboundBackoff:  envDuration("OUTBOUND_BACKOFF", 200*time.Millisecond),
+        BreakerThreshold: envInt64("BREAKER_THRESHOLD", 5),
+        BreakerCooldown:  envDuration("BREAKER_COOLDOWN", 30*time.Second),
+
+        ContentSecurityPolicy: envString("CONTENT_SECURITY_POLICY", "default-src 'self'; frame-ancestors 'none'; base-uri 'none'; form-action 'self'"),
+        HSTSMaxAge:            envDuration("HSTS_MAX_AGE", 365*24*time.Hour),
+        HSTSIncludeSubdomains: envBool("HSTS_INCLUDE_SUBDOMAINS", false),
+        CookieSecure:          envBool("COOKIE_SECURE", true),
+
+        OIDCDiscoveryURL: os.Getenv("OIDC_DISCOVERY_URL"),
+        OIDCClientID:     os.Getenv("OIDC_CLIENT_ID"),
+        OIDCClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+        OIDCRedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+        OIDCScopes:       splitList(envString("OIDC_SCOPES", "openid,email,profile")),
+        OIDCGroupsClaim:  envString("OIDC_GROUPS_CLAIM", "groups"),
+        OIDCRoleMap:      envStringMap("OIDC_ROLE_MAP"),
+
+        MongoURI:             envString("MONGO_URI", "mongodb://localhost:27017"),
+        MongoDatabase:        envString("MONGO_DATABASE", "hospitaldb"),
+        MongoMaxPoolSize:     uint64(envInt64("MONGO_MAX_POOL_SIZE", 0)),
+        MongoMinPoolSize:     uint64(envInt64("MONGO_MIN_POOL_SIZE", 0)),
+        MongoMaxConnIdleTime: envDuration("MONGO_MAX_CONN_IDLE_TIME", 0),
+        MongoReadPreference:  os.Getenv("MONGO_READ_PREFERENCE"),
+        MongoWriteConcern:    os.Getenv("MONGO_WRITE_CONCERN"),
+        MongoRetryWrites:     envBool("MONGO_RETRY_WRITES", true),
+        BulkBatchSize:        envInt64("BULK_BATCH_SIZE", 1000),
+
+        SchemaWriteBackInterval: envDuration("SCHEMA_WRITE_BACK_INTERVAL", 10*time.Second),
+
+        ConsultDuration:     envDuration("CONSULT_DURATION", 15*time.Minute),
+        SlotDuration:        envDuration("SLOT_DURATION", 30*time.Minute),
+        SlotHoldTTL:         envDuration("SLOT_HOLD_TTL", 5*time.Minute),
+        ScheduleCache:       envBool("SCHEDULE_CACHE", true),
+        ScheduleCacheDays:   envInt64("SCHEDULE_CACHE_DAYS", slotSearchDays+1),
+        ScheduleCacheResync: envDuration("SCHEDULE_CACHE_RESYNC", 10*time.Minute),
+        WorkdayStart:        envClock("WORKDAY_START", "09:00"),
+        WorkdayEnd:          envClock("WORKDAY_END", "17:00"),
+        WorkDays:            envWeekdays("WORK_DAYS", "mon,tue,wed,thu,fri"),
+        NoShowCheckInterval: envDuration("NO_SHOW_CHECK_INTERVAL", time.Minute),
+        NoShowGrace:         envDuration("NO_SHOW_GRACE", 15*time.Minute),
+        NoShowOfferSlot:     envBool("NO_SHOW_OFFER_SLOT", false),
+
+        WaitlistOfferWindow:   envDuration("WAITLIST_OFFER_WINDOW", 2*time.Hour),
+        WaitlistCheckInterval: envDuration("WAITLIST_CHECK_INTERVAL", time.Minute),
+
+        CancelMinNotice:   envDuration("CANCEL_MIN_NOTICE", 24*time.Hour),
+        CancelMaxPerMonth: envInt64("CANCEL_MAX_PER_MONTH", 3),
+        CancelFeeCents:    envInt64("CANCEL_FEE_CENTS", 2500),
+        CancelLateAction:  envChoice("CANCEL_LATE_ACTION", ActionFee, ActionFee, ActionBlock),
+        CancelLimitAction: envChoice("CANCEL_LIMIT_ACTION", ActionBlock, ActionFee, ActionBlock),
+
+        WebhookURL:    os.Getenv("WEBHOOK_URL"),
+        WebhookSecret: os.Getenv("WEBHOOK_SECRET"),
+
+        OutboxRelayInterval:   envDuration("OUTBOX_RELAY_INTERVAL", 5*time.Second),
+        OutboxMaxAttempts:     envInt64("OUTBOX_MAX_ATTEMPTS", 10),
+        OutboxRetryBackoff:    envDuration("OUTBOX_RETRY_BACKOFF", 30*time.Second),
+        OutboxRetryMaxBackoff: envDuration("OUTBOX_RETRY_MAX_BACKOFF", time.Hour),
+        OutboxRetention:       envDuration("OUTBOX_RETENTION", 7*24*time.Hour),
+
+        EventStream:         envChoice("EVENT_STREAM", "", "", "kafka", "nats"),
+        EventStreamBrokers:  envList("EVENT_STREAM_BROKERS"),
+        EventStreamURL:      envString("EVENT_STREAM_URL", "nats://127.0.0.1:4222"),
+        EventStreamPrefix:   envString("EVENT_STREAM_PREFIX", "hospital"),
+        EventStreamFormat:   envChoice("EVENT_STREAM_FORMAT", "json", "json", "avro"),
+        EventStreamRegistry: os.Getenv("EVENT_STREAM_SCHEMA_REGISTRY"),
+
+        Projections: envBool("PROJECTIONS", true),
+
+        SMTPAddr:              os.Getenv("SMTP_ADDR"),
+        SMTPUsername:          os.Getenv("SMTP_USERNAME"),
+        SMTPPassword:          os.Getenv("SMTP_PASSWORD"),
+        SMTPFrom:              envString("SMTP_FROM", "no-reply@localhost"),
+        SMTPPoolSize:          envInt64("SMTP_POOL_SIZE", 4),
+        EmailBrand:            envString("EMAIL_BRAND", "Hospital"),
+        DefaultLanguage:       envString("DEFAULT_LANGUAGE", "en"),
+        ReminderLead:          envDuration("REMINDER_LEAD", 24*time.Hour),
+        ReminderCheckInterval: envDuration("REMINDER_CHECK_INTERVAL", 5*time.Minute),
+        SavedSearchDigestHour: envInt64("SAVED_SEARCH_DIGEST_HOUR", 7),
+        SavedSearchInterval:   envDuration("SAVED_SEARCH_INTERVAL", 15*time.Minute),
+
+        NotificationMaxAttempts:     envInt64("NOTIFICATION_MAX_ATTEMPTS", 5),
+        NotificationRetryBackoff:    envDuration("NOTIFICATION_RETRY_BACKOFF", time.Minute),
+        NotificationRetryMaxBackoff: envDuration("NOTIFICATION_RETRY_MAX_BACKOFF", time.Hour),
+        NotificationRetryInterval:   envDuration("NOTIFICATION_RETRY_INTERVAL", time.Minute),
+
+        SMSProvider:      envChoice("SMS_PROVIDER", "", "", "twilio", "webhook"),
+        TwilioAccountSID: os.Getenv("TWILIO_ACCOUNT_SID"),
+        TwilioAuthToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
+        TwilioFrom:       os.Getenv("TWILIO_FROM"),
+        SMSWebhookURL:    os.Getenv("SMS_WEBHOOK_URL"),
+        SMSWebhookSecret: os.Getenv("SMS_WEBHOOK_SECRET"),
+
+        VideoProvider:   envChoice("VIDEO_PROVIDER", "", "", "twilio", "daily"),
+        TwilioAPIKey:    os.Getenv("TWILIO_API_KEY"),
+        TwilioAPISecret: os.Getenv("TWILIO_API_SECRET"),
+        DailyAPIKey:     os.Getenv("DAILY_API_KEY"),
+        VideoJoinEarly:  envDuration("VIDEO_JOIN_EARLY", 10*time.Minute),
+        VideoJoinURL:    os.Getenv("VIDEO_JOIN_URL"),
+
+        PortalURL: os.Getenv("PORTAL_URL"),
+
+        DeviceRateLimit: envInt64("DEVICE_RATE_LIMIT", 60),
+        DeviceRateBurst: envInt64("DEVICE_RATE_BURST", 10),
+        DeviceBatchMax:  envInt64("DEVICE_BATCH_MAX", 1000),
+
+        GoogleClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+        GoogleClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+        GoogleRedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+        GoogleSyncInterval: envDuration("GOOGLE_SYNC_INTERVAL", 5*time.Minute),
+        GoogleSyncDays:     envInt64("GOOGLE_SYNC_DAYS", 30),
+
+        Geocoder:         envChoice("GEOCODER", "", "", "nominatim", "google"),
+        NominatimURL:     os.Getenv("NOMINATIM_URL"),
+        GoogleMapsAPIKey: os.Getenv("GOOGLE_MAPS_API_KEY"),
+        GeocodeInterval:  envDuration("GEOCODE_INTERVAL", time.Minute),
+        GeocodeBatch:     envInt64("GEOCODE_BATCH", 50),
+
+        ICD10CodesFile:            os.Getenv("ICD10_CODES_FILE"),
+        DrugInteractionsFile:      os.Getenv("DRUG_INTERACTIONS_FILE"),
+        ImmunizationScheduleFile:  os.Getenv("IMMUNIZATION_SCHEDULE_FILE"),
+        ImmunizationGrace:         envDuration("IMMUNIZATION_GRACE", 30*24*time.Hour),
+        ConsentRequiredProcedures: envSetDefault("CONSENT_REQUIRED_PROCEDURES", "surgery,anesthesia,transfusion,endoscopy"),
+        TagsManagedOnly:           envBool("TAGS_MANAGED_ONLY", false),
+        WardEventPoll:             envDuration("WARD_EVENT_POLL", 2*time.Second),
+        CareTeamAccess:            envBool("CARE_TEAM_ACCESS", true),
+
+        RequestTimeout: envDuration("REQUEST_TIMEOUT", 5*time.Second),
+        RouteTimeouts:  envDurationMap("ROUTE_TIMEOUTS"),
+
+        RateLimits: envRateLimits("RATE_LIMITS", "auth=30:10"),
+
+        MaxBodyBytes:      envInt64("MAX_BODY_BYTES", 1<<20),
+        BodyLimits:        envInt64Map("BODY_LIMITS"),
+        LenientJSONRoutes: envSet("LENIENT_JSON_ROUTES"),
+
+        AttachmentMaxBytes: envInt64("ATTACHMENT_MAX_BYTES", 25<<20),
+
+        AttachmentCacheMaxAge: envDuration("ATTACHMENT_CACHE_MAX_AGE", 24*time.Hour),
+
+        QuotaPlansFile:   os.Getenv("QUOTA_PLANS_FILE"),
+        QuotaDefaultPlan: os.Getenv("QUOTA_DEFAULT_PLAN"),
+    }
+}
+
+func envString(key, def string) string {
+    if v, ok := os.LookupEnv(key); ok && v != "" {
+        return v
+    }
+    return def
+}
+
+func envInt64(key string, def int64) int64 {
+    v := os.Getenv(key)
+    if v == "" {
+        return def
+    }
+    n, err := strconv.ParseInt(v, 10, 64)
+    if err != nil {
+        log.Printf("Invalid %s %q, using %d\n", key, v, def)
+        return def
+    }
+    return n
+}
+
+func envBool(key string, def bool) bool {
+    v := os.Getenv(key)
+    if v == "" {
+        return def
+    }
+    b, err := strconv.ParseBool(v)
+    if err != nil {
+        log.Printf("Invalid %s %q, using %t\n", key, v, def)
+        return def
+    }
+    return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+    v := os.Getenv(key)
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        log.Printf("Invalid %s %q, using %s\n", key, v, def)
+        return def
+    }
+    return d
+}
+
+// envChoice reads one of a fixed set of values.
+func envChoice(key, def string, choices ...string) string {
+    v := envString(key, def)
+    for _, c := range choices {
+        if v == c {
+            return v
+        }
+    }
+    log.Printf("Invalid %s %q, using %s\n", key, v, def)
+    return def
+}
+
+// envClock reads a HH:MM time of day as the offset from midnight.
+func envClock(key, def string) time.Duration {
+    d, err := parseClock(envString(key, def))
+    if err != nil {
+        log.Printf("Invalid %s, using %s\n", key, def)
+        d, _ = parseClock(def)
+    }
+    return d
+}
+
+func parseClock(s string) (time.Duration, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, err
+    }
+    return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+var weekdays = map[string]time.Weekday{
+    "sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+    "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// envWeekdays reads a list of three letter day names such as mon,tue,wed.
+func envWeekdays(key, def string) map[time.Weekday]bool {
+    days := map[time.Weekday]bool{}
+    for name := range envSetDefault(key, def) {
+        day, ok := weekdays[strings.ToLower(name)]
+        if !ok {
+            log.Printf("Ignoring invalid %s entry %q\n", key, name)
+            continue
+        }
+        days[day] = true
+    }
+    return days
+}
+
+// envList reads a comma separated list, dropping empty entries.
+func envList(key string) []string {
+    return splitList(os.Getenv(key))
+}
+
+func envSet(key string) map[string]bool {
+    return toSet(envList(key))
+}
+
+// envSetDefault is envSet with a default list used when key is unset.
+func envSetDefault(key, def string) map[string]bool {
+    value, ok := os.LookupEnv(key)
+    if !ok {
+        value = def
+    }
+    return toSet(splitList(value))
+}
+
+func splitList(s string) []string {
+    var list []string
+    for _, item := range strings.Split(s, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+func toSet(items []string) map[string]bool {
+    set := map[string]bool{}
+    for _, item := range items {
+        set[item] = true
+    }
+    return set
+}
+
+// envInt64Map reads a comma separated list of name=value pairs,
+// e.g. BODY_LIMITS=/patients=65536,/departments=16384.
+func envInt64Map(key string) map[string]int64 {
+    m := map[string]int64{}
+    for _, item := range envList(key) {
+        name, value, ok := strings.Cut(item, "=")
+        n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+        if !ok || err != nil {
+            log.Printf("Ignoring invalid %s entry %q\n", key, item)
+            continue
+        }
+        m[strings.TrimSpace(name)] = n
+    }
+    return m
+}
+
+// envStringMap reads a comma separated list of name=value pairs,
+// e.g. OIDC_ROLE_MAP=hospital-admins=admin,physicians=doctor.
+func envStringMap(key string) map[string]string {
+    m := map[string]string{}
+    for _, item := range envList(key) {
+        name, value, ok := strings.Cut(item, "=")
+        if !ok {
+            log.Printf("Ignoring invalid %s entry %q\n", key, item)
+            continue
+        }
+        m[strings.TrimSpace(name)] = strings.TrimSpace(value)
+    }
+    return m
+}
+
+// RateLimit is a number of requests a minute, in bursts of Burst.
+type RateLimit struct {
+    PerMinute int64
+    Burst     int64
+}
+
+// envRateLimits reads a comma separated list of class=perMinute[:burst]
+// pairs; the burst is the rate a minute if left out.
+func envRateLimits(key, def string) map[string]RateLimit {
+    value, ok := os.LookupEnv(key)
+    if !ok {
+        value = def
+    }
+    m := map[string]RateLimit{}
+    for _, item := range splitList(value) {
+        name, limit, ok := strings.Cut(item, "=")
+        rate, burst, hasBurst := strings.Cut(strings.TrimSpace(limit), ":")
+        perMinute, err := strconv.ParseInt(rate, 10, 64)
+        if !ok || err != nil || perMinute <= 0 {
+            log.Printf("Ignoring invalid %s entry %q\n", key, item)
+            continue
+        }
+        limits := RateLimit{PerMinute: perMinute, Burst: perMinute}
+        if hasBurst {
+            if limits.Burst, err = strconv.ParseInt(burst, 10, 64); err != nil || limits.Burst <= 0 {
+                log.Printf("Ignoring invalid %s entry %q\n", key, item)
+                continue
+            }
+        }
+        m[strings.TrimSpace(name)] = limits
+    }
+    return m
+}
+
+// envDurationMap reads a comma separated list of name=duration pairs,
+// e.g. OUTBOUND_TIMEOUTS=sms=5s,email=20s.
+func envDurationMap(key string) map[string]time.Duration {
+    m := map[string]time.Duration{}
+    for _, item := range envList(key) {
+        name, value, ok := strings.Cut(item, "=")
+        d, err := time.ParseDuration(strings.TrimSpace(value))
+        if !ok || err != nil {
+            log.Printf("Ignoring invalid %s entry %q\n", key, item)
+            continue
+        }
+        m[strings.TrimSpace(name)] = d
+    }
+    return m
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Consent forms
+const (
+    ConsentTreatment   = "treatment"
+    ConsentDataSharing = "data-sharing"
+)
+
+var consentForms = map[string]bool{
+    ConsentTreatment:   true,
+    ConsentDataSharing: true,
+}
+
+// Consent records a consent form signed by a patient. SignatureRef points at
+// the stored signature image or signed PDF.
+type Consent struct {
+    Document      `bson:",inline"`
+    PatientID     primitive.ObjectID `json:"patientId" bson:"patientId"`
+    Form          string             `json:"form" bson:"form"`
+    SignedAt      time.Time          `json:"signedAt" bson:"signedAt"`
+    SignatureRef  string             `json:"signatureRef" bson:"signatureRef"`
+    SignatureType string             `json:"signatureType" bson:"signatureType"` // image/png, application/pdf, ...
+    ExpiresAt     *time.Time         `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+    RevokedAt     *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+var (
+    consentCollection *mongo.Collection
+    consentRepo       *Repository[Consent, *Consent]
+)
+
+func initConsents(ctx context.Context, db *mongo.Database) {
+    consentCollection = db.Collection("consents")
+    consentRepo = NewRepository[Consent](consentCollection, defaultHooks)
+
+    index := mongo.IndexModel{
+        Keys: bson.D{{Key: "patientId", Value: 1}, {Key: "form", Value: 1}, {Key: "signedAt", Value: -1}},
+    }
+    if _, err := consentCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating consent index: %v\n", err)
+    }
+}
+
+// activeConsent returns the most recent signed, unrevoked and unexpired
+// consent of a patient for a form, or mongo.ErrNoDocuments.
+func activeConsent(ctx context.Context, patientID primitive.ObjectID, form string) (*Consent, error) {
+    now := time.Now()
+    filter := bson.M{
+        "patientId": patientID,
+        "form":      form,
+        "signedAt":  bson.M{"$lte": now},
+        "revokedAt": nil,
+        "deletedAt": nil,
+        "$or": bson.A{
+            bson.M{"expiresAt": nil},
+            bson.M{"expiresAt": bson.M{"$gt": now}},
+        },
+    }
+    opts := options.FindOne().SetSort(bson.D{{Key: "signedAt", Value: -1}})
+
+    var consent Consent
+    if err := consentCollection.FindOne(ctx, filter, opts).Decode(&consent); err != nil {
+        return nil, err
+    }
+    return &consent, nil
+}
+
+// requireConsentForProcedures rejects recording any procedure listed in
+// CONSENT_REQUIRED_PROCEDURES without an active treatment consent.
+func requireConsentForProcedures(ctx context.Context, patientID primitive.ObjectID, procedures []string) error {
+    for _, procedure := range procedures {
+        if !config.ConsentRequiredProcedures[procedure] {
+            continue
+        }
+        _, err := activeConsent(ctx, patientID, ConsentTreatment)
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            return newAPIError("consent_required", procedure, ConsentTreatment)
+        }
+        return err
+    }
+    return nil
+}
+
+// Consent handlers
+func createConsent(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var consent Consent
+    if !decodeJSON(w, r, &consent) {
+        return
+    }
+
+    if !consentForms[consent.Form] {
+        localizedError(w, r, http.StatusBadRequest, "unknown_consent_form", consent.Form)
+        return
+    }
+    if consent.SignatureRef == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "signatureRef")
+        return
+    }
+    if consent.SignedAt.IsZero() {
+        consent.SignedAt = time.Now()
+    }
+    consent.RevokedAt = nil
+
+    ctx := r.Context()
+
+    if _, err := patientRepo.GetByID(ctx, consent.PatientID); err != nil {
+        localizedError(w, r, http.StatusBadRequest, "patient_not_found")
+        return
+    }
+
+    if err := consentRepo.Create(ctx, &consent); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(consent)
+}
+
+func getPatientConsents(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    consents, err := consentRepo.List(ctx, bson.M{"patientId": patientID}, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, consents)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(consents)
+}
+
+// verifyConsent answers whether a patient holds an active consent:
+// GET /patients/{id}/consents/verify?form=treatment
+func verifyConsent(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+    form := r.URL.Query().Get("form")
+    if !consentForms[form] {
+        localizedError(w, r, http.StatusBadRequest, "unknown_consent_form", form)
+        return
+    }
+
+    ctx := r.Context()
+
+    consent, err := activeConsent(ctx, patientID, form)
+    if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "patientId": patientID,
+        "form":      form,
+        "active":    consent != nil,
+        "consent":   consent,
+    })
+}
+
+func revokeConsent(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_consent_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    consent, err := consentRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "consent_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if consent.RevokedAt == nil {
+        now := time.Now()
+        consent.RevokedAt = &now
+        if err := consentRepo.Update(ctx, id, consent); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(consent)
+}
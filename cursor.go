@@ -0,0 +1,115 @@
+package main
+
+import (
+    "encoding/base64"
+    "net/http"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Cursor continues a list after the last item of a page: the value of the
+// key the list is sorted by and the _id of that item. Unlike page numbers,
+// cursors neither skip nor repeat items when others are added or removed
+// meanwhile. Clients see them as opaque tokens.
+type Cursor struct {
+    Key interface{}        `bson:"k,omitempty"`
+    ID  primitive.ObjectID `bson:"id"`
+}
+
+// Token encodes the cursor for ?cursor=.
+func (c Cursor) Token() string {
+    raw, _ := bson.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func parseCursor(token string) (*Cursor, error) {
+    raw, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil {
+        return nil, newAPIError("invalid_cursor")
+    }
+    var c Cursor
+    if err := bson.Unmarshal(raw, &c); err != nil || c.ID.IsZero() {
+        return nil, newAPIError("invalid_cursor")
+    }
+    return &c, nil
+}
+
+// listOrder is the order of a list: by Key, then by _id, descending when
+// Desc.
+type listOrder struct {
+    Key  string
+    Desc bool
+}
+
+// byID orders lists by creation.
+var byID = listOrder{Key: "_id"}
+
+func (o listOrder) sort() bson.D {
+    dir := 1
+    if o.Desc {
+        dir = -1
+    }
+    if o.Key == "_id" {
+        return bson.D{{Key: "_id", Value: dir}}
+    }
+    return bson.D{{Key: o.Key, Value: dir}, {Key: "_id", Value: dir}}
+}
+
+// restrict adds the condition selecting the items after the cursor of the
+// page to filter.
+func (o listOrder) restrict(filter bson.M, page Page) {
+    if page.After == nil {
+        return
+    }
+    op := "$gt"
+    if o.Desc {
+        op = "$lt"
+    }
+    after := bson.M{"_id": bson.M{op: page.After.ID}}
+    if o.Key != "_id" {
+        after = bson.M{"$or": bson.A{
+            bson.M{o.Key: bson.M{op: page.After.Key}},
+            bson.M{o.Key: page.After.Key, "_id": bson.M{op: page.After.ID}},
+        }}
+    }
+    and, _ := filter["$and"].(bson.A)
+    filter["$and"] = append(and, after)
+}
+
+// findPage restricts filter to page of a list in order o and returns the
+// options that find it.
+func findPage(filter bson.M, page Page, o listOrder) *options.FindOptions {
+    o.restrict(filter, page)
+    opts := options.Find().SetSort(o.sort())
+    if page.Size > 0 {
+        if page.After == nil {
+            opts.SetSkip((max(page.Number, 1) - 1) * page.Size)
+        }
+        opts.SetLimit(page.Size)
+    }
+    return opts
+}
+
+// setNextCursor links a full page of n items to the page after it, in the
+// Link and X-Next-Cursor headers. last returns the cursor of its last item.
+func setNextCursor(w http.ResponseWriter, r *http.Request, page Page, n int, last func() Cursor) {
+    if page.Size <= 0 || int64(n) < page.Size {
+        return
+    }
+    token := last().Token()
+    query := r.URL.Query()
+    query.Del("page")
+    query.Set("cursor", token)
+    w.Header().Set("Link", "<"+r.URL.Path+"?"+query.Encode()+`>; rel="next"`)
+    w.Header().Set("X-Next-Cursor", token)
+}
+
+// setNextPage links a full page of documents listed by _id to the page
+// after it.
+func setNextPage[T any, PT model[T]](w http.ResponseWriter, r *http.Request, page Page, docs []T) {
+    setNextCursor(w, r, page, len(docs), func() Cursor {
+        return Cursor{ID: PT(&docs[len(docs)-1]).document().ID}
+    })
+}
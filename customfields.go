@@ -0,0 +1,388 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "regexp"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Types of custom field values
+const (
+    CustomString  = "string"
+    CustomNumber  = "number"
+    CustomBoolean = "boolean"
+    CustomDate    = "date" // YYYY-MM-DD
+    CustomEnum    = "enum" // one of Options
+)
+
+var customTypes = []string{CustomString, CustomNumber, CustomBoolean, CustomDate, CustomEnum}
+
+// Models that carry custom fields, by collection
+var customModels = []string{"patients", "appointments"}
+
+var customKeyPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,39}$`)
+
+// CustomField defines an extra field a tenant records on a model, such
+// as the referral source of patients. Values are kept in the custom map of
+// the documents. Documents without a tenant use the definitions without
+// one.
+type CustomField struct {
+    Document `bson:",inline"`
+    TenantID string   `json:"tenantId,omitempty" bson:"tenantId,omitempty"`
+    Model    string   `json:"model" bson:"model"` // patients or appointments
+    Key      string   `json:"key" bson:"key"`
+    Label    string   `json:"label" bson:"label"`
+    Type     string   `json:"type" bson:"type"`
+    Options  []string `json:"options,omitempty" bson:"options,omitempty"`
+    Required bool     `json:"required" bson:"required"`
+    // Indexed fields can be searched with ?custom.<key>=
+    Indexed bool `json:"indexed" bson:"indexed"`
+}
+
+var (
+    customFieldCollection *mongo.Collection
+    customFieldRepo       *Repository[CustomField, *CustomField]
+)
+
+func initCustomFields(ctx context.Context, db *mongo.Database) {
+    customFieldCollection = db.Collection("custom_fields")
+    customFieldRepo = NewRepository[CustomField](customFieldCollection, defaultHooks)
+
+    index := mongo.IndexModel{
+        Keys:    bson.D{{Key: "tenantId", Value: 1}, {Key: "model", Value: 1}, {Key: "key", Value: 1}},
+        Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"deletedAt": bson.M{"$exists": false}}),
+    }
+    if _, err := customFieldCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating custom field index: %v\n", err)
+    }
+}
+
+// customFields returns the definitions of a tenant for a model, by key.
+func customFields(ctx context.Context, tenant, model string) (map[string]CustomField, error) {
+    filter := bson.M{"model": model, "tenantId": tenant}
+    if tenant == "" {
+        filter["tenantId"] = nil
+    }
+    list, err := customFieldRepo.List(ctx, filter, Page{})
+    if err != nil {
+        return nil, err
+    }
+    fields := make(map[string]CustomField, len(list))
+    for _, field := range list {
+        fields[field.Key] = field
+    }
+    return fields, nil
+}
+
+// validateCustom checks the custom map of a document of model against the
+// definitions of its tenant, normalizing values to their stored form.
+func validateCustom(ctx context.Context, tenant, model string, custom map[string]interface{}) error {
+    fields, err := customFields(ctx, tenant, model)
+    if err != nil {
+        return err
+    }
+    for key, value := range custom {
+        field, ok := fields[key]
+        if !ok {
+            return newAPIError("unknown_custom_field", key)
+        }
+        if value == nil {
+            delete(custom, key)
+            continue
+        }
+        normalized, ok := field.normalize(value)
+        if !ok {
+            return newAPIError("invalid_custom_field", key, field.describe())
+        }
+        custom[key] = normalized
+    }
+    for key, field := range fields {
+        if _, ok := custom[key]; field.Required && !ok {
+            return newAPIError("field_required", "custom."+key)
+        }
+    }
+    return nil
+}
+
+// normalize returns the stored form of a value of the field, or false if
+// the value does not fit it.
+func (f *CustomField) normalize(value interface{}) (interface{}, bool) {
+    switch f.Type {
+    case CustomString:
+        s, ok := value.(string)
+        return s, ok
+    case CustomNumber:
+        switch n := value.(type) {
+        case float64:
+            return n, true
+        case int32:
+            return float64(n), true
+        case int64:
+            return float64(n), true
+        }
+        return nil, false
+    case CustomBoolean:
+        b, ok := value.(bool)
+        return b, ok
+    case CustomDate:
+        s, ok := value.(string)
+        if !ok {
+            return nil, false
+        }
+        if _, err := time.Parse(time.DateOnly, s); err != nil {
+            return nil, false
+        }
+        return s, true
+    case CustomEnum:
+        s, ok := value.(string)
+        return s, ok && slices.Contains(f.Options, s)
+    }
+    return nil, false
+}
+
+// describe names the values a field takes, for errors.
+func (f *CustomField) describe() string {
+    if f.Type == CustomEnum {
+        return strings.Join(f.Options, ", ")
+    }
+    return f.Type
+}
+
+// parseQuery converts a query parameter to a value of the field.
+func (f *CustomField) parseQuery(v string) (interface{}, bool) {
+    switch f.Type {
+    case CustomNumber:
+        n, err := strconv.ParseFloat(v, 64)
+        return n, err == nil
+    case CustomBoolean:
+        b, err := strconv.ParseBool(v)
+        return b, err == nil
+    }
+    return f.normalize(v)
+}
+
+// customFilter turns ?custom.<key>=value parameters into a filter on the
+// custom fields of model. Only indexed fields of the tenant of the request
+// can be searched.
+func customFilter(r *http.Request, model string) (bson.M, error) {
+    filter := bson.M{}
+    var keys []string
+    for param := range r.URL.Query() {
+        if key, ok := strings.CutPrefix(param, "custom."); ok {
+            keys = append(keys, key)
+        }
+    }
+    if len(keys) == 0 {
+        return filter, nil
+    }
+
+    fields, err := customFields(r.Context(), r.Header.Get(tenantHeader), model)
+    if err != nil {
+        return nil, err
+    }
+    for _, key := range keys {
+        field, ok := fields[key]
+        if !ok {
+            return nil, newAPIError("unknown_custom_field", key)
+        }
+        if !field.Indexed {
+            return nil, newAPIError("custom_field_not_indexed", key)
+        }
+        value, ok := field.parseQuery(r.URL.Query().Get("custom." + key))
+        if !ok {
+            return nil, newAPIError("invalid_custom_field", key, field.describe())
+        }
+        filter["custom."+key] = value
+    }
+    return filter, nil
+}
+
+// customIndexName names the index of a custom field.
+func customIndexName(key string) string {
+    return "custom_" + key
+}
+
+// syncCustomIndex creates the index of a custom field while some tenant
+// has it indexed and drops it once none does.
+func syncCustomIndex(ctx context.Context, model, key string) error {
+    coll := customFieldCollection.Database().Collection(model)
+    n, err := customFieldCollection.CountDocuments(ctx, bson.M{"model": model, "key": key, "indexed": true, "deletedAt": nil})
+    if err != nil {
+        return err
+    }
+    if n > 0 {
+        _, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+            Keys:    bson.D{{Key: "custom." + key, Value: 1}},
+            Options: options.Index().SetName(customIndexName(key)).SetSparse(true),
+        })
+        return err
+    }
+    _, err = coll.Indexes().DropOne(ctx, customIndexName(key))
+    var cmdErr mongo.CommandError
+    if errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound" {
+        return nil
+    }
+    return err
+}
+
+// validateCustomField checks a definition.
+func validateCustomField(field *CustomField) error {
+    if !slices.Contains(customModels, field.Model) {
+        return newAPIError("invalid_choice", "model", strings.Join(customModels, ", "))
+    }
+    if !customKeyPattern.MatchString(field.Key) {
+        return newAPIError("invalid_custom_key")
+    }
+    if !slices.Contains(customTypes, field.Type) {
+        return newAPIError("invalid_choice", "type", strings.Join(customTypes, ", "))
+    }
+    if field.Type == CustomEnum && len(field.Options) == 0 {
+        return newAPIError("field_required", "options")
+    }
+    if field.Type != CustomEnum {
+        field.Options = nil
+    }
+    if field.Label == "" {
+        field.Label = field.Key
+    }
+    return nil
+}
+
+// adminCustomFields lists the definitions, for ?tenant= and ?model=, and
+// creates them: GET, POST /admin/custom-fields
+func adminCustomFields(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getCustomFields(w, r)
+    case http.MethodPost:
+        createCustomField(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getCustomFields(w http.ResponseWriter, r *http.Request) {
+    filter := bson.M{}
+    query := r.URL.Query()
+    if tenant, ok := query["tenant"]; ok {
+        filter["tenantId"] = tenant[0]
+        if tenant[0] == "" {
+            filter["tenantId"] = nil
+        }
+    }
+    if model := query.Get("model"); model != "" {
+        filter["model"] = model
+    }
+
+    ctx := r.Context()
+
+    fields, err := customFieldRepo.List(ctx, filter, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(fields)
+}
+
+func createCustomField(w http.ResponseWriter, r *http.Request) {
+    var field CustomField
+    if !decodeJSON(w, r, &field) {
+        return
+    }
+    if err := validateCustomField(&field); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := customFieldRepo.Create(ctx, &field); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            localizedError(w, r, http.StatusConflict, "custom_field_exists", field.Key)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if field.Indexed {
+        if err := syncCustomIndex(ctx, field.Model, field.Key); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(field)
+}
+
+// adminCustomField updates a definition with a JSON Merge Patch or
+// deletes it: PATCH, DELETE /admin/custom-fields/{id}. Stored values are
+// left as they are.
+func adminCustomField(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_custom_field_id")
+        return
+    }
+
+    var field *CustomField
+    switch r.Method {
+    case http.MethodPatch:
+        var ok bool
+        field, ok = patchDocument(w, r, customFieldRepo, id, patchable[CustomField]{
+            notFound: "custom_field_not_found",
+            readOnly: []string{"tenantId", "model", "key", "type"},
+            check: func(ctx context.Context, field *CustomField) error {
+                return validateCustomField(field)
+            },
+        })
+        if !ok {
+            return
+        }
+    case http.MethodDelete:
+        ctx := r.Context()
+        field, err = customFieldRepo.GetByID(ctx, id)
+        if err == nil {
+            err = customFieldRepo.SoftDelete(ctx, id)
+        }
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "custom_field_not_found")
+            return
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+    if err := syncCustomIndex(ctx, field.Model, field.Key); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if r.Method == http.MethodDelete {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(field)
+}
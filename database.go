@@ -0,0 +1,199 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "sync"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/event"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "go.mongodb.org/mongo-driver/mongo/readpref"
+    "go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// mongoClientOptions builds the client options from the MONGO_* settings.
+// Zero values leave the driver defaults in place.
+func mongoClientOptions() (*options.ClientOptions, error) {
+    opts := options.Client().
+        ApplyURI(config.MongoURI).
+        SetRetryWrites(config.MongoRetryWrites).
+        SetPoolMonitor(poolStats.monitor())
+
+    if dialer := chaosDialer(); dialer != nil {
+        opts.SetDialer(dialer)
+    }
+    if config.MongoMaxPoolSize > 0 {
+        opts.SetMaxPoolSize(config.MongoMaxPoolSize)
+    }
+    if config.MongoMinPoolSize > 0 {
+        opts.SetMinPoolSize(config.MongoMinPoolSize)
+    }
+    if config.MongoMaxConnIdleTime > 0 {
+        opts.SetMaxConnIdleTime(config.MongoMaxConnIdleTime)
+    }
+
+    if config.MongoReadPreference != "" {
+        mode, err := readpref.ModeFromString(config.MongoReadPreference)
+        if err != nil {
+            return nil, err
+        }
+        rp, err := readpref.New(mode)
+        if err != nil {
+            return nil, err
+        }
+        opts.SetReadPreference(rp)
+    }
+
+    switch wc := config.MongoWriteConcern; wc {
+    case "":
+    case "majority":
+        opts.SetWriteConcern(writeconcern.Majority())
+    default:
+        w, err := strconv.Atoi(wc)
+        if err != nil {
+            // Anything else names a custom write concern tag set.
+            opts.SetWriteConcern(writeconcern.Custom(wc))
+        } else {
+            opts.SetWriteConcern(&writeconcern.WriteConcern{W: w})
+        }
+    }
+
+    return opts, nil
+}
+
+// transactionsSupported is whether the deployment is a replica set or a
+// sharded cluster, the only ones supporting multi-document transactions.
+var transactionsSupported bool
+
+func detectTransactions(ctx context.Context) {
+    var hello struct {
+        SetName string `bson:"setName"`
+        Msg     string `bson:"msg"`
+    }
+    err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+    if err != nil {
+        log.Printf("Error detecting transaction support: %v\n", err)
+        return
+    }
+    transactionsSupported = hello.SetName != "" || hello.Msg == "isdbgrid"
+    if !transactionsSupported {
+        log.Println("MongoDB is standalone: writes and their events are not atomic")
+    }
+}
+
+// withTransaction runs fn in a transaction, retried by the driver on
+// transient errors. fn must do its writes with the context it is given.
+// Within a transaction, or on a standalone server, fn runs as is.
+func withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+    if !transactionsSupported || mongo.SessionFromContext(ctx) != nil {
+        return fn(ctx)
+    }
+    session, err := client.StartSession()
+    if err != nil {
+        return err
+    }
+    defer session.EndSession(ctx)
+
+    _, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+        return nil, fn(sc)
+    })
+    return err
+}
+
+// Connection pool utilization, tracked per server from driver pool events
+type serverPoolStats struct {
+    Open             int64 `json:"open"`
+    InUse            int64 `json:"inUse"`
+    Idle             int64 `json:"idle"`
+    CheckoutFailures int64 `json:"checkoutFailures"`
+    Cleared          int64 `json:"cleared"`
+}
+
+type poolStatsTracker struct {
+    mu      sync.Mutex
+    servers map[string]*serverPoolStats
+}
+
+var poolStats = &poolStatsTracker{servers: map[string]*serverPoolStats{}}
+
+func (p *poolStatsTracker) monitor() *event.PoolMonitor {
+    return &event.PoolMonitor{Event: p.record}
+}
+
+func (p *poolStatsTracker) record(e *event.PoolEvent) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    s, ok := p.servers[e.Address]
+    if !ok {
+        s = &serverPoolStats{}
+        p.servers[e.Address] = s
+    }
+
+    switch e.Type {
+    case event.ConnectionCreated:
+        s.Open++
+    case event.ConnectionClosed:
+        s.Open--
+    case event.GetSucceeded:
+        s.InUse++
+    case event.ConnectionReturned:
+        s.InUse--
+    case event.GetFailed:
+        s.CheckoutFailures++
+    case event.PoolCleared:
+        s.Cleared++
+    case event.PoolClosedEvent:
+        delete(p.servers, e.Address)
+    }
+}
+
+func (p *poolStatsTracker) snapshot() map[string]serverPoolStats {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    servers := make(map[string]serverPoolStats, len(p.servers))
+    for addr, s := range p.servers {
+        stats := *s
+        stats.Idle = stats.Open - stats.InUse
+        servers[addr] = stats
+    }
+    return servers
+}
+
+// getDBStats reports the connection pool configuration and utilization
+// together with the database's dbStats output.
+func getDBStats(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    var dbStats bson.M
+    err := client.Database(config.MongoDatabase).RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&dbStats)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "pool": map[string]interface{}{
+            "maxPoolSize":     config.MongoMaxPoolSize,
+            "minPoolSize":     config.MongoMinPoolSize,
+            "maxConnIdleTime": config.MongoMaxConnIdleTime.String(),
+            "servers":         poolStats.snapshot(),
+        },
+        "readPreference": config.MongoReadPreference,
+        "writeConcern":   config.MongoWriteConcern,
+        "retryWrites":    config.MongoRetryWrites,
+        "database":       dbStats,
+    })
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Failed notification statuses. Pending notifications are retried until
+// they are delivered or reach NOTIFICATION_MAX_ATTEMPTS and become Dead.
+const (
+    DeliveryPending   = "pending"
+    DeliveryDead      = "dead"
+    DeliveryDelivered = "delivered"
+)
+
+// retryBatchSize bounds the notifications retried per run.
+const retryBatchSize = 100
+
+// retryLease is how long a claimed retry is hidden from other instances.
+const retryLease = 5 * time.Minute
+
+// DeliveryAttempt is one failed attempt to deliver a notification.
+type DeliveryAttempt struct {
+    Error string    `json:"error" bson:"error"`
+    At    time.Time `json:"at" bson:"at"`
+}
+
+// FailedNotification keeps a notification that could not be delivered
+// over a channel, with what is needed to send it again.
+type FailedNotification struct {
+    Document             `bson:",inline"`
+    Channel              string              `json:"channel" bson:"channel"`
+    Kind                 string              `json:"kind" bson:"kind"`
+    PatientID            primitive.ObjectID  `json:"patientId" bson:"patientId"`
+    AppointmentID        *primitive.ObjectID `json:"appointmentId,omitempty" bson:"appointmentId,omitempty"`
+    InvoiceID            *primitive.ObjectID `json:"invoiceId,omitempty" bson:"invoiceId,omitempty"`
+    QueuePosition        int64               `json:"queuePosition,omitempty" bson:"queuePosition,omitempty"`
+    EstimatedWaitMinutes int64               `json:"estimatedWaitMinutes,omitempty" bson:"estimatedWaitMinutes,omitempty"`
+    Outreach             *Outreach           `json:"outreach,omitempty" bson:"outreach,omitempty"`
+    Status               string              `json:"status" bson:"status"`
+    Attempts             int64               `json:"attempts" bson:"attempts"`
+    LastError            string              `json:"lastError" bson:"lastError"`
+    History              []DeliveryAttempt   `json:"history" bson:"history"`
+    NextAttemptAt        *time.Time          `json:"nextAttemptAt,omitempty" bson:"nextAttemptAt,omitempty"`
+}
+
+var (
+    failedNotificationCollection *mongo.Collection
+    failedNotificationRepo       *Repository[FailedNotification, *FailedNotification]
+)
+
+func initDeadLetters(ctx context.Context, db *mongo.Database) {
+    failedNotificationCollection = db.Collection("failed_notifications")
+    failedNotificationRepo = NewRepository[FailedNotification](failedNotificationCollection, defaultHooks)
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}}
+    if _, err := failedNotificationCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating failed notification index: %v\n", err)
+    }
+}
+
+// retryBackoff is the delay before the next attempt after attempts
+// failures: NOTIFICATION_RETRY_BACKOFF doubled per failure, capped at
+// NOTIFICATION_RETRY_MAX_BACKOFF.
+func retryBackoff(attempts int64) time.Duration {
+    backoff := config.NotificationRetryBackoff
+    for i := int64(1); i < attempts && backoff < config.NotificationRetryMaxBackoff; i++ {
+        backoff *= 2
+    }
+    return min(backoff, config.NotificationRetryMaxBackoff)
+}
+
+// recordFailedNotification dead-letters a notification that failed on
+// channel, scheduling its first retry.
+func recordFailedNotification(ctx context.Context, channel, kind string, data notificationData, cause error) error {
+    now := time.Now()
+    next := now.Add(retryBackoff(1))
+    failed := FailedNotification{
+        Channel:       channel,
+        Kind:          kind,
+        PatientID:     data.Patient.ID,
+        Status:        DeliveryPending,
+        Attempts:      1,
+        LastError:     cause.Error(),
+        History:       []DeliveryAttempt{{Error: cause.Error(), At: now}},
+        NextAttemptAt: &next,
+    }
+    if data.Appointment != nil {
+        failed.AppointmentID = &data.Appointment.ID
+    }
+    if data.Invoice != nil {
+        failed.InvoiceID = &data.Invoice.ID
+    }
+    if data.CheckIn != nil {
+        failed.QueuePosition = data.CheckIn.QueuePosition
+        failed.EstimatedWaitMinutes = data.CheckIn.EstimatedWaitMinutes
+    }
+    failed.Outreach = data.Outreach
+    if failed.Attempts >= config.NotificationMaxAttempts {
+        failed.Status, failed.NextAttemptAt = DeliveryDead, nil
+    }
+    return failedNotificationRepo.Create(ctx, &failed)
+}
+
+// failedNotificationData reloads the data a failed notification was
+// rendered from.
+func failedNotificationData(ctx context.Context, failed *FailedNotification) (notificationData, error) {
+    var data notificationData
+    var err error
+    if failed.AppointmentID != nil {
+        appointment, err := appointmentRepo.GetByID(ctx, *failed.AppointmentID)
+        if err != nil {
+            return data, err
+        }
+        if data, err = appointmentNotificationData(ctx, appointment); err != nil {
+            return data, err
+        }
+    } else if data.Patient, err = patientRepo.GetByID(ctx, failed.PatientID); err != nil {
+        return data, err
+    }
+
+    if failed.InvoiceID != nil {
+        if data.Invoice, err = invoiceRepo.GetByID(ctx, *failed.InvoiceID); err != nil {
+            return data, err
+        }
+    }
+    if failed.Kind == "queue" && data.Appointment != nil {
+        data.CheckIn = &CheckIn{
+            Appointment:          *data.Appointment,
+            QueuePosition:        failed.QueuePosition,
+            PatientsAhead:        failed.QueuePosition - 1,
+            EstimatedWaitMinutes: failed.EstimatedWaitMinutes,
+        }
+    }
+    data.Outreach = failed.Outreach
+    return data, nil
+}
+
+// retryNotification makes one more delivery attempt of a failed
+// notification and records the outcome.
+func retryNotification(ctx context.Context, failed *FailedNotification) error {
+    var notifier Notifier
+    for _, n := range notifiers {
+        if n.Channel() == failed.Channel {
+            notifier = n
+        }
+    }
+
+    data, err := failedNotificationData(ctx, failed)
+    if err == nil {
+        if notifier == nil {
+            err = errors.New("channel " + failed.Channel + " is not configured")
+        } else {
+            err = notifier.Notify(ctx, failed.Kind, data)
+        }
+    }
+
+    now := time.Now()
+    failed.Attempts++
+    if err == nil {
+        failed.Status, failed.NextAttemptAt = DeliveryDelivered, nil
+    } else {
+        failed.LastError = err.Error()
+        failed.History = append(failed.History, DeliveryAttempt{Error: err.Error(), At: now})
+        next := now.Add(retryBackoff(failed.Attempts))
+        failed.Status, failed.NextAttemptAt = DeliveryPending, &next
+        if failed.Attempts >= config.NotificationMaxAttempts {
+            failed.Status, failed.NextAttemptAt = DeliveryDead, nil
+        }
+    }
+
+    return failedNotificationRepo.UpdateFields(ctx, failed.ID, nil, bson.M{
+        "status":        failed.Status,
+        "attempts":      failed.Attempts,
+        "lastError":     failed.LastError,
+        "history":       failed.History,
+        "nextAttemptAt": failed.NextAttemptAt,
+    })
+}
+
+// retryFailedNotifications retries the pending notifications that are due.
+func retryFailedNotifications(ctx context.Context) error {
+    now := time.Now()
+    due, err := failedNotificationRepo.List(ctx, bson.M{
+        "status":        DeliveryPending,
+        "nextAttemptAt": bson.M{"$lte": now},
+    }, Page{Number: 1, Size: retryBatchSize})
+    if err != nil {
+        return err
+    }
+
+    for i := range due {
+        failed := &due[i]
+        // Claim the retry so concurrent instances skip it
+        err := failedNotificationRepo.UpdateFields(ctx, failed.ID,
+            bson.M{"status": DeliveryPending, "nextAttemptAt": failed.NextAttemptAt},
+            bson.M{"nextAttemptAt": now.Add(retryLease)},
+        )
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            continue
+        }
+        if err != nil {
+            return err
+        }
+
+        if err := retryNotification(ctx, failed); err != nil {
+            log.Printf("Error recording retry of notification %s: %v\n", failed.ID.Hex(), err)
+        }
+    }
+    return nil
+}
+
+// Failed notification handlers
+
+// getFailedNotifications lists undelivered notifications, optionally
+// filtered by ?status=pending|dead and ?channel=email|sms.
+func getFailedNotifications(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    filter := bson.M{"status": bson.M{"$in": bson.A{DeliveryPending, DeliveryDead}}}
+    if status := r.URL.Query().Get("status"); status != "" {
+        filter["status"] = status
+    }
+    if channel := r.URL.Query().Get("channel"); channel != "" {
+        filter["channel"] = channel
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    failed, err := failedNotificationRepo.List(ctx, filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, failed)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(failed)
+}
+
+// retryFailedNotification makes an immediate delivery attempt, including
+// for dead notifications, which get one more attempt.
+func retryFailedNotification(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_notification_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    failed, err := failedNotificationRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "notification_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if failed.Status == DeliveryDelivered {
+        localizedError(w, r, http.StatusConflict, "notification_delivered")
+        return
+    }
+    if failed.Status == DeliveryDead {
+        // A manual retry grants one more attempt
+        failed.Attempts = min(failed.Attempts, config.NotificationMaxAttempts-1)
+    }
+
+    if err := retryNotification(ctx, failed); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(failed)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+    "encoding/json"
+    "expvar"
+    "fmt"
+    "net/http"
+    _ "net/http/pprof" // registers /debug/pprof/ on the default mux
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Runtime diagnostics under /debug, for admins only:
+//
+//	/debug/pprof/   profiles of net/http/pprof, e.g. go tool pprof on
+//	                /debug/pprof/heap fetched with the admin token
+//	/debug/vars     expvar: memstats, the command line and the vars below
+//	/debug/snapshot goroutines and heap at a glance
+//
+// net/http/pprof and expvar register their routes on the default mux
+// unguarded when imported, so withDebugAuth guards the whole /debug tree
+// in front of the mux rather than route by route.
+
+var startedAt = time.Now()
+
+func init() {
+    expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+    expvar.Publish("uptime", expvar.Func(func() interface{} { return time.Since(startedAt).Round(time.Second).String() }))
+    expvar.Publish("mongo_pool", expvar.Func(func() interface{} { return poolStats.snapshot() }))
+    expvar.Publish("schedule_cache", expvar.Func(func() interface{} {
+        return map[string]uint64{
+            "hits":    schedules.hits.Load(),
+            "misses":  schedules.misses.Load(),
+            "updates": schedules.updates.Load(),
+            "drift":   schedules.drift.Load(),
+        }
+    }))
+}
+
+// withDebugAuth requires an admin for every route under /debug.
+func withDebugAuth(next http.Handler) http.Handler {
+    guarded := requireAdmin(next.ServeHTTP)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/debug" || strings.HasPrefix(r.URL.Path, "/debug/") {
+            guarded(w, r)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// MemorySnapshot is the heap of a DebugSnapshot, in bytes.
+type MemorySnapshot struct {
+    HeapAlloc    uint64    `json:"heapAlloc"`
+    HeapInuse    uint64    `json:"heapInuse"`
+    HeapIdle     uint64    `json:"heapIdle"`
+    HeapReleased uint64    `json:"heapReleased"`
+    HeapObjects  uint64    `json:"heapObjects"`
+    StackInuse   uint64    `json:"stackInuse"`
+    Sys          uint64    `json:"sys"`
+    NextGC       uint64    `json:"nextGC"`
+    NumGC        uint32    `json:"numGC"`
+    PauseTotal   string    `json:"pauseTotal"`
+    LastGC       time.Time `json:"lastGC"`
+}
+
+// GoroutineGroup is the goroutines blocked or running at the same stack.
+type GoroutineGroup struct {
+    Count int      `json:"count"`
+    Stack []string `json:"stack"` // innermost frame first
+}
+
+// DebugSnapshot is the state of the runtime at a glance.
+type DebugSnapshot struct {
+    Time       time.Time        `json:"time"`
+    Uptime     string           `json:"uptime"`
+    GoVersion  string           `json:"goVersion"`
+    GOMAXPROCS int              `json:"gomaxprocs"`
+    Goroutines int              `json:"goroutines"`
+    Memory     MemorySnapshot   `json:"memory"`
+    Stacks     []GoroutineGroup `json:"stacks"`
+}
+
+// getDebugSnapshot reports the heap and the goroutines grouped by stack,
+// largest groups first: GET /debug/snapshot?top=20. With ?gc=true a
+// collection runs first, so the heap is what is live.
+func getDebugSnapshot(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    top := 20
+    if n, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && n > 0 {
+        top = n
+    }
+    if r.URL.Query().Get("gc") == "true" {
+        runtime.GC()
+    }
+
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+    snapshot := DebugSnapshot{
+        Time:       time.Now(),
+        Uptime:     time.Since(startedAt).Round(time.Second).String(),
+        GoVersion:  runtime.Version(),
+        GOMAXPROCS: runtime.GOMAXPROCS(0),
+        Goroutines: runtime.NumGoroutine(),
+        Memory: MemorySnapshot{
+            HeapAlloc:    mem.HeapAlloc,
+            HeapInuse:    mem.HeapInuse,
+            HeapIdle:     mem.HeapIdle,
+            HeapReleased: mem.HeapReleased,
+            HeapObjects:  mem.HeapObjects,
+            StackInuse:   mem.StackInuse,
+            Sys:          mem.Sys,
+            NextGC:       mem.NextGC,
+            NumGC:        mem.NumGC,
+            PauseTotal:   time.Duration(mem.PauseTotalNs).String(),
+            LastGC:       time.Unix(0, int64(mem.LastGC)),
+        },
+        Stacks: goroutineGroups(top),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(snapshot)
+}
+
+// goroutineGroups groups the goroutines by stack and returns the top
+// largest groups.
+func goroutineGroups(top int) []GoroutineGroup {
+    var records []runtime.StackRecord
+    n, ok := runtime.GoroutineProfile(nil)
+    for !ok {
+        // Goroutines may start between the calls: leave room for some
+        records = make([]runtime.StackRecord, n+n/4+8)
+        n, ok = runtime.GoroutineProfile(records)
+    }
+    records = records[:n]
+
+    counts := map[string]int{}
+    stacks := map[string][]string{}
+    for _, record := range records {
+        key := fmt.Sprint(record.Stack())
+        if _, seen := stacks[key]; !seen {
+            var stack []string
+            frames := runtime.CallersFrames(record.Stack())
+            for {
+                frame, more := frames.Next()
+                stack = append(stack, fmt.Sprintf("%s %s:%d", frame.Function, frame.File, frame.Line))
+                if !more {
+                    break
+                }
+            }
+            stacks[key] = stack
+        }
+        counts[key]++
+    }
+
+    groups := make([]GoroutineGroup, 0, len(stacks))
+    for key, stack := range stacks {
+        groups = append(groups, GoroutineGroup{Count: counts[key], Stack: stack})
+    }
+    sort.Slice(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+    if len(groups) > top {
+        groups = groups[:top]
+    }
+    return groups
+}
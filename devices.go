@@ -0,0 +1,465 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deviceClockSkew is how far in the future a reading may be dated, for
+// devices whose clock runs ahead.
+const deviceClockSkew = 5 * time.Minute
+
+// Device is a wearable or home device that uploads a patient's readings.
+// It authenticates with an API key shown once at registration.
+type Device struct {
+    Document   `bson:",inline"`
+    PatientID  primitive.ObjectID `json:"patientId" bson:"patientId"`
+    Name       string             `json:"name" bson:"name"`
+    Kind       string             `json:"kind,omitempty" bson:"kind,omitempty"` // e.g. smartwatch, glucometer
+    KeyHash    string             `json:"-" bson:"keyHash"`
+    LastSeenAt *time.Time         `json:"lastSeenAt,omitempty" bson:"lastSeenAt,omitempty"`
+}
+
+// RegisteredDevice is a new device with its API key.
+type RegisteredDevice struct {
+    Device
+    Key string `json:"key"`
+}
+
+// Vital is a reading in the vitals time series. Each reading holds the
+// measurements a device took at one instant.
+type Vital struct {
+    ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    TakenAt    time.Time          `json:"takenAt" bson:"takenAt"`
+    Meta       VitalMeta          `json:"meta" bson:"meta"`
+    HeartRate  *float64           `json:"heartRate,omitempty" bson:"heartRate,omitempty"` // beats per minute
+    Glucose    *float64           `json:"glucose,omitempty" bson:"glucose,omitempty"`     // mg/dL
+    ReceivedAt time.Time          `json:"receivedAt" bson:"receivedAt"`
+}
+
+// VitalMeta identifies the series of a reading.
+type VitalMeta struct {
+    PatientID primitive.ObjectID `json:"patientId" bson:"patientId"`
+    DeviceID  primitive.ObjectID `json:"deviceId" bson:"deviceId"`
+}
+
+// DeviceReading is a reading uploaded by a device.
+type DeviceReading struct {
+    Timestamp time.Time `json:"timestamp"`
+    HeartRate *float64  `json:"heartRate,omitempty"`
+    Glucose   *float64  `json:"glucose,omitempty"`
+}
+
+// Plausible ranges of the measurements, to catch unit mix-ups and sensor
+// faults
+var vitalRanges = []struct {
+    name     string
+    value    func(*DeviceReading) *float64
+    min, max float64
+}{
+    {"heartRate", func(r *DeviceReading) *float64 { return r.HeartRate }, 20, 300},
+    {"glucose", func(r *DeviceReading) *float64 { return r.Glucose }, 10, 1000},
+}
+
+var (
+    deviceCollection *mongo.Collection
+    vitalCollection  *mongo.Collection
+    deviceRepo       *Repository[Device, *Device]
+    deviceLimiter    *rateLimiter
+)
+
+func initDevices(ctx context.Context, db *mongo.Database) {
+    deviceCollection = db.Collection("devices")
+    deviceRepo = NewRepository[Device](deviceCollection, defaultHooks)
+    deviceLimiter = newRateLimiter(config.DeviceRateLimit, config.DeviceRateBurst)
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "patientId", Value: 1}}}
+    if _, err := deviceCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating device index: %v\n", err)
+    }
+
+    // Time series collections need MongoDB 5.0; on older servers the
+    // readings go to a plain collection
+    timeSeries := options.TimeSeries().SetTimeField("takenAt").SetMetaField("meta").SetGranularity("seconds")
+    err := db.CreateCollection(ctx, "vitals", options.CreateCollection().SetTimeSeriesOptions(timeSeries))
+    var cmdErr mongo.CommandError
+    if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists") {
+        log.Printf("Error creating vitals time series: %v\n", err)
+    }
+    vitalCollection = db.Collection("vitals")
+
+    index = mongo.IndexModel{Keys: bson.D{{Key: "meta.deviceId", Value: 1}, {Key: "takenAt", Value: 1}}}
+    if _, err := vitalCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating vitals index: %v\n", err)
+    }
+}
+
+// hashDeviceKey is how device keys are stored. Keys are random, so a fast
+// hash suffices.
+func hashDeviceKey(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// authenticateDevice returns the device of the API key in the
+// Authorization header, "Bearer <device id>.<secret>".
+func authenticateDevice(ctx context.Context, r *http.Request) (*Device, error) {
+    key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if !ok {
+        return nil, errors.New("missing device key")
+    }
+    idHex, secret, ok := strings.Cut(key, ".")
+    if !ok {
+        return nil, errors.New("malformed device key")
+    }
+    id, err := primitive.ObjectIDFromHex(idHex)
+    if err != nil {
+        return nil, err
+    }
+    device, err := deviceRepo.GetByID(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    if subtle.ConstantTimeCompare([]byte(hashDeviceKey(secret)), []byte(device.KeyHash)) != 1 {
+        return nil, errors.New("invalid device key")
+    }
+    return device, nil
+}
+
+// patientDevices registers a device of a patient and lists them:
+// POST, GET /patients/{id}/devices
+func patientDevices(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    switch r.Method {
+    case http.MethodGet:
+        page, err := parsePage(r)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return
+        }
+        devices, err := deviceRepo.List(ctx, bson.M{"patientId": patientID}, page)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        setNextPage(w, r, page, devices)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(devices)
+
+    case http.MethodPost:
+        var req struct {
+            Name string `json:"name"`
+            Kind string `json:"kind"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        if strings.TrimSpace(req.Name) == "" {
+            localizedError(w, r, http.StatusBadRequest, "field_required", "name")
+            return
+        }
+        if _, err := patientRepo.GetByID(ctx, patientID); err != nil {
+            if errors.Is(err, mongo.ErrNoDocuments) {
+                localizedError(w, r, http.StatusNotFound, "patient_not_found")
+                return
+            }
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        secret := randomToken(32)
+        device := Device{PatientID: patientID, Name: req.Name, Kind: req.Kind, KeyHash: hashDeviceKey(secret)}
+        if err := deviceRepo.Create(ctx, &device); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(RegisteredDevice{Device: device, Key: device.ID.Hex() + "." + secret})
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// revokeDevice deletes a device, invalidating its key:
+// DELETE /patients/{id}/devices/{deviceId}
+func revokeDevice(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+    id, err := primitive.ObjectIDFromHex(r.PathValue("deviceId"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_device_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    device, err := deviceRepo.GetByID(ctx, id)
+    if err == nil && device.PatientID != patientID {
+        err = mongo.ErrNoDocuments
+    }
+    if err == nil {
+        err = deviceRepo.SoftDelete(ctx, id)
+    }
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusNotFound, "device_not_found")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// ingestDeviceData stores a batch of readings uploaded by a device of the
+// patient: POST /patients/{id}/device-data with {"readings": [...]}.
+// Readings the device already uploaded, by timestamp, are skipped, so
+// devices can resend a batch whose response they missed.
+// Readings that cannot be stored are listed under failures by their
+// position in the batch; the others are kept.
+func ingestDeviceData(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    device, err := authenticateDevice(ctx, r)
+    if err != nil {
+        w.Header().Set("WWW-Authenticate", `Bearer realm="devices"`)
+        localizedError(w, r, http.StatusUnauthorized, "invalid_device_key")
+        return
+    }
+    if device.PatientID != patientID {
+        localizedError(w, r, http.StatusForbidden, "forbidden")
+        return
+    }
+    if ok, wait := deviceLimiter.allow(device.ID.Hex()); !ok {
+        seconds := int64(math.Ceil(wait.Seconds()))
+        w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+        localizedError(w, r, http.StatusTooManyRequests, "rate_limited", seconds)
+        return
+    }
+
+    var req struct {
+        Readings []DeviceReading `json:"readings"`
+    }
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    if int64(len(req.Readings)) > config.DeviceBatchMax {
+        localizedError(w, r, http.StatusRequestEntityTooLarge, "too_many_readings", config.DeviceBatchMax)
+        return
+    }
+
+    now := time.Now()
+    vitals := make([]Vital, 0, len(req.Readings))
+    positions := make([]int, 0, len(req.Readings)) // of the vitals in the request
+    seen := map[time.Time]bool{}
+    for i := range req.Readings {
+        reading := &req.Readings[i]
+        // Stored with millisecond precision; compare as stored
+        takenAt := reading.Timestamp.Truncate(time.Millisecond).UTC()
+        if takenAt.IsZero() || takenAt.After(now.Add(deviceClockSkew)) {
+            localizedError(w, r, http.StatusBadRequest, "invalid_reading_time", i)
+            return
+        }
+        measured := false
+        for _, v := range vitalRanges {
+            value := v.value(reading)
+            if value == nil {
+                continue
+            }
+            if *value < v.min || *value > v.max || math.IsNaN(*value) {
+                localizedError(w, r, http.StatusBadRequest, "reading_out_of_range", i, v.name, v.min, v.max)
+                return
+            }
+            measured = true
+        }
+        if !measured {
+            localizedError(w, r, http.StatusBadRequest, "empty_reading", i)
+            return
+        }
+        if seen[takenAt] {
+            continue
+        }
+        seen[takenAt] = true
+        positions = append(positions, i)
+        vitals = append(vitals, Vital{
+            TakenAt:    takenAt,
+            Meta:       VitalMeta{PatientID: patientID, DeviceID: device.ID},
+            HeartRate:  reading.HeartRate,
+            Glucose:    reading.Glucose,
+            ReceivedAt: now,
+        })
+    }
+
+    // Time series collections have no unique indexes: drop the readings
+    // stored before. Concurrent uploads of one batch can still both land.
+    var fresh []Vital
+    var freshPositions []int
+    if len(vitals) > 0 {
+        timestamps := make([]time.Time, 0, len(vitals))
+        for _, v := range vitals {
+            timestamps = append(timestamps, v.TakenAt)
+        }
+        cursor, err := vitalCollection.Find(ctx,
+            bson.M{"meta.deviceId": device.ID, "takenAt": bson.M{"$in": timestamps}},
+            options.Find().SetProjection(bson.M{"takenAt": 1}),
+        )
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        var stored []Vital
+        if err := cursor.All(ctx, &stored); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        exists := map[time.Time]bool{}
+        for _, v := range stored {
+            exists[v.TakenAt.UTC()] = true
+        }
+        for i, v := range vitals {
+            if !exists[v.TakenAt] {
+                fresh = append(fresh, v)
+                freshPositions = append(freshPositions, positions[i])
+            }
+        }
+    }
+    inserter := newBulkInserter(vitalCollection)
+    for _, v := range fresh {
+        if err := inserter.Add(ctx, v); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    }
+    if err := inserter.Flush(ctx); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    result := inserter.Result()
+    // Report failures by their position in the request
+    for i := range result.Failures {
+        result.Failures[i].Index = int64(freshPositions[result.Failures[i].Index])
+    }
+    if _, err := deviceCollection.UpdateOne(ctx, bson.M{"_id": device.ID}, bson.M{"$set": bson.M{"lastSeenAt": now}}); err != nil {
+        log.Printf("Error recording device %s as seen: %v\n", device.ID.Hex(), err)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "accepted":   result.Inserted,
+        "duplicates": len(req.Readings) - len(fresh),
+        "failed":     result.Failed,
+        "failures":   result.Failures,
+    })
+}
+
+// getPatientVitals lists the readings of a patient in time order, within
+// ?from= and ?to= (RFC 3339) and for ?deviceId=:
+// GET /patients/{id}/vitals
+func getPatientVitals(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+    query := r.URL.Query()
+    filter := bson.M{"meta.patientId": patientID}
+    if v := query.Get("deviceId"); v != "" {
+        id, err := primitive.ObjectIDFromHex(v)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_device_id")
+            return
+        }
+        filter["meta.deviceId"] = id
+    }
+    takenAt := bson.M{}
+    for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+        v := query.Get(param)
+        if v == "" {
+            continue
+        }
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_time", param)
+            return
+        }
+        takenAt[op] = t
+    }
+    if len(takenAt) > 0 {
+        filter["takenAt"] = takenAt
+    }
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    cursor, err := vitalCollection.Find(ctx, filter, findPage(filter, page, listOrder{Key: "takenAt"}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    vitals := []Vital{}
+    if err := cursor.All(ctx, &vitals); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextCursor(w, r, page, len(vitals), func() Cursor {
+        last := vitals[len(vitals)-1]
+        return Cursor{Key: last.TakenAt, ID: last.ID}
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(vitals)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/pdf"
+)
+
+// writePDF renders a printable document in lang and serves it inline, so
+// browsers open it ready to print. modified is when the records rendered
+// last changed. Renders are deterministic, so the ETag of the bytes lets
+// clients revalidate and resume them with Range requests; they revalidate
+// every time as names and translations may change.
+func writePDF(w http.ResponseWriter, r *http.Request, lang, template, filename string, modified time.Time, data interface{}) {
+    body, err := pdf.Render(lang, template, data)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    sum := sha256.Sum256(body)
+
+    w.Header().Set("Content-Type", "application/pdf")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+    w.Header().Set("Content-Language", lang)
+    w.Header().Set("Cache-Control", "private, no-cache")
+    w.Header().Set("ETag", strconv.Quote(hex.EncodeToString(sum[:])))
+    w.Header().Add("Vary", "Accept-Language")
+    http.ServeContent(w, r, filename, modified, bytes.NewReader(body))
+}
+
+// lastModified returns the latest of the update times of records.
+func lastModified(updated ...time.Time) time.Time {
+    var latest time.Time
+    for _, t := range updated {
+        if t.After(latest) {
+            latest = t
+        }
+    }
+    return latest
+}
+
+// Document handlers
+func getInvoicePDF(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_invoice_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    invoice, err := invoiceRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "invoice_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    notePatientAccess(ctx, invoice.PatientID)
+    patient, err := patientRepo.GetByID(ctx, invoice.PatientID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writePDF(w, r, documentLanguage(r, patient), "invoice", "invoice-"+id.Hex()+".pdf", lastModified(invoice.UpdatedAt, patient.UpdatedAt), struct {
+        Invoice *Invoice
+        Patient *Patient
+        Printed time.Time
+    }{invoice, patient, time.Now()})
+}
+
+func getPrescriptionPDF(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_prescription_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    prescription, err := prescriptionRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "prescription_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !checkPatientAccess(w, r, prescription.PatientID) {
+        return
+    }
+    notePatientAccess(ctx, prescription.PatientID)
+    patient, err := patientRepo.GetByID(ctx, prescription.PatientID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    doctor, err := doctorRepo.GetByID(ctx, prescription.DoctorID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    lang := documentLanguage(r, patient)
+    writePDF(w, r, lang, "prescription", "prescription-"+id.Hex()+".pdf", lastModified(prescription.UpdatedAt, patient.UpdatedAt, doctor.UpdatedAt), struct {
+        Prescription   *Prescription
+        Patient        *Patient
+        Doctor         *Doctor
+        Specialization string
+    }{prescription, patient, doctor, specializationName(ctx, doctor.Specialization, lang)})
+}
+
+// getAppointmentSlip renders the confirmation slip handed to the patient
+// at booking.
+func getAppointmentSlip(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_appointment_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    appointment, err := appointmentRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "appointment_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    notePatientAccess(ctx, appointment.PatientID)
+    patient, err := patientRepo.GetByID(ctx, appointment.PatientID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    doctor, err := doctorRepo.GetByID(ctx, appointment.DoctorID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    lang := documentLanguage(r, patient)
+    writePDF(w, r, lang, "slip", "appointment-"+id.Hex()+".pdf", lastModified(appointment.UpdatedAt, patient.UpdatedAt, doctor.UpdatedAt), struct {
+        Appointment    *Appointment
+        Patient        *Patient
+        Doctor         *Doctor
+        Specialization string
+    }{appointment, patient, doctor, specializationName(ctx, doctor.Specialization, lang)})
+}
@@ -0,0 +1,124 @@
+// Package email renders branded HTML notification emails and delivers them
+// over SMTP.
+//
+// Each template under templates/ (other than layout.html) defines a
+// "subject" and a "content" block; layout.html wraps the content in the
+// shared branded frame. Texts are looked up in the i18n catalogs, so a
+// template renders in any supported language. Where a language needs more
+// than other words, a variant such as reminder.es.html replaces the
+// template for it.
+package email
+
+import (
+    "bytes"
+    "embed"
+    "fmt"
+    "html"
+    "html/template"
+    "io/fs"
+    "sort"
+    "strings"
+    "time"
+
+    "new/i18n"
+)
+
+//go:embed templates/*.html
+var files embed.FS
+
+// Message is a rendered email ready to send.
+type Message struct {
+    To          []string
+    Subject     string
+    HTML        string
+    Attachments []Attachment
+}
+
+// Attachment is a file sent along with a message.
+type Attachment struct {
+    Filename    string
+    ContentType string // e.g. text/calendar; method=PUBLISH
+    Data        []byte
+}
+
+// Templates are the parsed email templates of one brand.
+type Templates struct {
+    brand string
+    sets  map[string]*template.Template
+}
+
+// LoadTemplates parses the bundled templates, branding them with brand.
+func LoadTemplates(brand string) (*Templates, error) {
+    names, err := fs.Glob(files, "templates/*.html")
+    if err != nil {
+        return nil, err
+    }
+
+    t := &Templates{brand: brand, sets: map[string]*template.Template{}}
+    for _, file := range names {
+        name := strings.TrimSuffix(strings.TrimPrefix(file, "templates/"), ".html")
+        if name == "layout" {
+            continue
+        }
+        set, err := template.New("layout.html").Funcs(t.funcs(i18n.Default)).
+            ParseFS(files, "templates/layout.html", file)
+        if err != nil {
+            return nil, fmt.Errorf("email template %s: %w", name, err)
+        }
+        t.sets[name] = set
+    }
+    return t, nil
+}
+
+// Names lists the available templates, without their language variants.
+func (t *Templates) Names() []string {
+    names := make([]string, 0, len(t.sets))
+    for name := range t.sets {
+        if !strings.Contains(name, ".") {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// funcs are the template functions, formatting in lang.
+func (t *Templates) funcs(lang string) template.FuncMap {
+    return template.FuncMap{
+        "brand":  func() string { return t.brand },
+        "lang":   func() string { return lang },
+        "t":      func(key string, args ...interface{}) string { return i18n.Message(lang, key, args...) },
+        "date":   func(at time.Time) string { return i18n.FormatDate(lang, at.Local()) },
+        "time":   func(at time.Time) string { return i18n.FormatTime(lang, at.Local()) },
+        "amount": func(cents int64) string { return i18n.FormatAmount(lang, cents) },
+        "status": func(status string) string { return i18n.StatusLabel(lang, status) },
+    }
+}
+
+// Render executes the template name with data in lang, or its variant for
+// lang if there is one.
+func (t *Templates) Render(lang, name string, data interface{}) (*Message, error) {
+    set, ok := t.sets[name+"."+lang]
+    if !ok {
+        set, ok = t.sets[name]
+    }
+    if !ok {
+        return nil, fmt.Errorf("unknown email template %q", name)
+    }
+    set, err := set.Clone()
+    if err != nil {
+        return nil, err
+    }
+    set.Funcs(t.funcs(lang))
+
+    var subject, body bytes.Buffer
+    if err := set.ExecuteTemplate(&subject, "subject", data); err != nil {
+        return nil, err
+    }
+    if err := set.ExecuteTemplate(&body, "layout.html", data); err != nil {
+        return nil, err
+    }
+    // The subject is rendered with HTML escaping like the body; headers
+    // carry it as plain text.
+    return &Message{Subject: html.UnescapeString(strings.TrimSpace(subject.String())), HTML: body.String()}, nil
+}
@@ -0,0 +1,221 @@
+package email
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "mime"
+    "mime/multipart"
+    "mime/quotedprintable"
+    "net"
+    "net/smtp"
+    "net/textproto"
+    "strings"
+    "time"
+)
+
+// SMTPConfig configures a Sender.
+type SMTPConfig struct {
+    Addr     string // host:port
+    Username string
+    Password string
+    From     string
+    PoolSize int           // maximum open connections
+    Timeout  time.Duration // of each send; 0 for none
+}
+
+// Sender delivers messages over SMTP, keeping up to PoolSize connections
+// open between sends.
+type Sender struct {
+    config SMTPConfig
+    host   string
+    slots  chan struct{} // one token per connection in use
+    idle   chan *conn     // open connections ready for reuse
+}
+
+// conn is an SMTP connection with its network connection, for deadlines.
+type conn struct {
+    *smtp.Client
+    net net.Conn
+}
+
+// NewSender returns a Sender for config. Connections are opened lazily.
+func NewSender(config SMTPConfig) *Sender {
+    if config.PoolSize <= 0 {
+        config.PoolSize = 1
+    }
+    host, _, _ := net.SplitHostPort(config.Addr)
+    return &Sender{
+        config: config,
+        host:   host,
+        slots:  make(chan struct{}, config.PoolSize),
+        idle:   make(chan *conn, config.PoolSize),
+    }
+}
+
+// Send delivers msg, waiting for a free connection when all PoolSize are
+// busy.
+func (s *Sender) Send(msg *Message) error {
+    s.slots <- struct{}{}
+    defer func() { <-s.slots }()
+
+    c, err := s.conn()
+    if err != nil {
+        return err
+    }
+    if s.config.Timeout > 0 {
+        c.net.SetDeadline(time.Now().Add(s.config.Timeout))
+    }
+    if err := s.send(c.Client, msg); err != nil {
+        c.Close()
+        return err
+    }
+
+    select {
+    case s.idle <- c:
+    default:
+        c.Quit()
+    }
+    return nil
+}
+
+// Close closes the idle connections.
+func (s *Sender) Close() {
+    for {
+        select {
+        case c := <-s.idle:
+            c.Quit()
+        default:
+            return
+        }
+    }
+}
+
+// conn returns an idle connection that is still alive, or dials a new one.
+func (s *Sender) conn() (*conn, error) {
+    for {
+        select {
+        case c := <-s.idle:
+            if s.config.Timeout > 0 {
+                c.net.SetDeadline(time.Now().Add(s.config.Timeout))
+            }
+            if err := c.Reset(); err == nil {
+                return c, nil
+            }
+            c.Close()
+        default:
+            return s.dial()
+        }
+    }
+}
+
+func (s *Sender) dial() (*conn, error) {
+    timeout := s.config.Timeout
+    if timeout <= 0 {
+        timeout = 10 * time.Second
+    }
+    netConn, err := net.DialTimeout("tcp", s.config.Addr, timeout)
+    if err != nil {
+        return nil, err
+    }
+    if s.config.Timeout > 0 {
+        netConn.SetDeadline(time.Now().Add(s.config.Timeout))
+    }
+    c, err := smtp.NewClient(netConn, s.host)
+    if err != nil {
+        netConn.Close()
+        return nil, err
+    }
+
+    if ok, _ := c.Extension("STARTTLS"); ok {
+        if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+    if s.config.Username != "" {
+        auth := smtp.PlainAuth("", s.config.Username, s.config.Password, s.host)
+        if err := c.Auth(auth); err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+    return &conn{Client: c, net: netConn}, nil
+}
+
+func (s *Sender) send(c *smtp.Client, msg *Message) error {
+    if err := c.Mail(s.config.From); err != nil {
+        return err
+    }
+    for _, to := range msg.To {
+        if err := c.Rcpt(to); err != nil {
+            return err
+        }
+    }
+
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(s.encode(msg)); err != nil {
+        w.Close()
+        return err
+    }
+    return w.Close()
+}
+
+// encode builds the RFC 5322 message: headers and a quoted-printable HTML
+// body, wrapped in a multipart/mixed body when there are attachments.
+func (s *Sender) encode(msg *Message) []byte {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "From: %s\r\n", s.config.From)
+    fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(msg.To, ", "))
+    fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+    fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    buf.WriteString("MIME-Version: 1.0\r\n")
+
+    if len(msg.Attachments) == 0 {
+        buf.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+        buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+        writeQuotedPrintable(&buf, msg.HTML)
+        return buf.Bytes()
+    }
+
+    mw := multipart.NewWriter(&buf)
+    fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+
+    part, _ := mw.CreatePart(textproto.MIMEHeader{
+        "Content-Type":              {"text/html; charset=utf-8"},
+        "Content-Transfer-Encoding": {"quoted-printable"},
+    })
+    writeQuotedPrintable(part, msg.HTML)
+
+    for _, a := range msg.Attachments {
+        part, _ := mw.CreatePart(textproto.MIMEHeader{
+            "Content-Type":              {a.ContentType},
+            "Content-Transfer-Encoding": {"base64"},
+            "Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+        })
+        writeBase64(part, a.Data)
+    }
+    mw.Close()
+    return buf.Bytes()
+}
+
+func writeQuotedPrintable(w io.Writer, s string) {
+    qp := quotedprintable.NewWriter(w)
+    qp.Write([]byte(s))
+    qp.Close()
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) {
+    encoded := base64.StdEncoding.EncodeToString(data)
+    for len(encoded) > 76 {
+        io.WriteString(w, encoded[:76]+"\r\n")
+        encoded = encoded[76:]
+    }
+    io.WriteString(w, encoded+"\r\n")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+
+    "new/i18n"
+)
+
+// apiError is a client error whose message is looked up in the i18n
+// catalogs under "error." + key when it is written to a response.
+type apiError struct {
+    key  string
+    args []interface{}
+}
+
+func newAPIError(key string, args ...interface{}) error {
+    return &apiError{key: key, args: args}
+}
+
+func (e *apiError) Error() string {
+    return i18n.Message(i18n.Default, "error."+e.key, e.args...)
+}
+
+// requestLanguage is the language negotiated from the Accept-Language
+// header of r.
+func requestLanguage(r *http.Request) string {
+    return i18n.Negotiate(r.Header.Get("Accept-Language"))
+}
+
+// localizedError replies with the catalog message "error." + key in the
+// language of the request.
+func localizedError(w http.ResponseWriter, r *http.Request, status int, key string, args ...interface{}) {
+    lang := requestLanguage(r)
+    w.Header().Set("Content-Language", lang)
+    http.Error(w, i18n.Message(lang, "error."+key, args...), status)
+}
+
+// writeError replies with err, localized when it is an apiError.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+    var apiErr *apiError
+    if errors.As(err, &apiErr) {
+        localizedError(w, r, status, apiErr.key, apiErr.args...)
+        return
+    }
+    http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,51 @@
+// Command checkevents records added event payload fields and versions in
+// events/schemas.json with -write. It refuses changes that would break
+// consumers; go test ./events reports them along with unrecorded versions.
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+
+    "new/events"
+)
+
+func main() {
+    write := flag.Bool("write", false, "record the current payloads in the schemas file")
+    file := flag.String("file", "events/schemas.json", "schemas file to write")
+    flag.Parse()
+
+    if !*write {
+        fmt.Fprintln(os.Stderr, "checkevents only records payloads; run it with -write, or go test ./events to check them")
+        os.Exit(2)
+    }
+
+    problems, err := events.Check()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    breaking := 0
+    for _, problem := range problems {
+        if problem.Breaking {
+            fmt.Println(problem)
+            breaking++
+        }
+    }
+    if breaking > 0 {
+        fmt.Fprintf(os.Stderr, "%d breaking changes; add a payload version instead\n", breaking)
+        os.Exit(1)
+    }
+
+    data, err := events.Snapshot()
+    if err == nil {
+        err = os.WriteFile(*file, data, 0o644)
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    fmt.Printf("Recorded %d event types in %s\n", len(events.Types()), *file)
+}
@@ -0,0 +1,115 @@
+// Package events defines the domain events of the service: one envelope,
+// shared by the webhook, the server-sent event streams and the Kafka and
+// NATS publishers, and a versioned payload struct per event type.
+//
+// A payload version is a contract with consumers. Fields may be added to
+// the struct of a version, since consumers must ignore fields they do not
+// know, but not removed, renamed, retyped or made optional; such changes
+// take a new version. Check compares the payloads with the schemas
+// recorded in schemas.json and reports the changes that would break
+// consumers; the package tests run it, and
+//
+//	go run ./events/checkevents -write
+//
+// records added fields and versions.
+package events
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "time"
+)
+
+// Event is the envelope of a domain event. Version is the version of the
+// payload of its type.
+type Event struct {
+    ID         string          `json:"id"`
+    Type       string          `json:"type"` // <entity>.<change>, e.g. patient.updated
+    Version    int             `json:"version"`
+    OccurredAt time.Time       `json:"occurredAt"`
+    Actor      string          `json:"actor,omitempty"`
+    EntityID   string          `json:"entityId"`
+    Data       json.RawMessage `json:"data,omitempty"` // absent for deletions
+}
+
+// payloads holds the payload struct of each version of each event type.
+// Types without data, such as deletions, have a nil struct.
+var (
+    payloads = map[string]map[int]reflect.Type{}
+    current  = map[string]int{}
+)
+
+// register records v as the payload struct of version of eventTypes; the
+// highest registered version of a type is the one published.
+func register(v interface{}, version int, eventTypes ...string) {
+    var typ reflect.Type
+    if v != nil {
+        typ = reflect.TypeOf(v)
+    }
+    for _, eventType := range eventTypes {
+        if payloads[eventType] == nil {
+            payloads[eventType] = map[int]reflect.Type{}
+        }
+        if _, ok := payloads[eventType][version]; ok {
+            panic(fmt.Sprintf("events: %s v%d registered twice", eventType, version))
+        }
+        payloads[eventType][version] = typ
+        current[eventType] = max(current[eventType], version)
+    }
+}
+
+// Types lists the registered event types.
+func Types() []string {
+    types := make([]string, 0, len(current))
+    for eventType := range current {
+        types = append(types, eventType)
+    }
+    sort.Strings(types)
+    return types
+}
+
+// Current returns the version of an event type that is published.
+func Current(eventType string) (int, bool) {
+    version, ok := current[eventType]
+    return version, ok
+}
+
+// New returns an event of the current version of its type, with data as
+// its payload. Data is converted to the payload struct of the version
+// through JSON, so fields outside the contract are left out. Callers fill
+// in the rest of the envelope.
+func New(eventType string, data interface{}) (Event, error) {
+    version, ok := current[eventType]
+    if !ok {
+        return Event{}, fmt.Errorf("events: unknown event type %q", eventType)
+    }
+    event := Event{Type: eventType, Version: version}
+
+    typ := payloads[eventType][version]
+    if typ == nil || data == nil {
+        return event, nil
+    }
+    raw, err := json.Marshal(data)
+    if err != nil {
+        return Event{}, err
+    }
+    value := reflect.New(typ)
+    if err := json.Unmarshal(raw, value.Interface()); err != nil {
+        return Event{}, fmt.Errorf("events: %s v%d: %w", eventType, version, err)
+    }
+    if event.Data, err = json.Marshal(value.Interface()); err != nil {
+        return Event{}, err
+    }
+    return event, nil
+}
+
+// Decode decodes the payload of an event into v, typically the payload
+// struct of its version.
+func (e Event) Decode(v interface{}) error {
+    if e.Data == nil {
+        return fmt.Errorf("events: %s has no data", e.Type)
+    }
+    return json.Unmarshal(e.Data, v)
+}
@@ -0,0 +1,142 @@
+package events
+
+import "time"
+
+// Payload structs, by version. Ids are hex strings.
+
+// DocumentV1 holds the fields every stored entity has.
+type DocumentV1 struct {
+    ID        string     `json:"id"`
+    CreatedAt time.Time  `json:"createdAt"`
+    UpdatedAt time.Time  `json:"updatedAt"`
+    CreatedBy string     `json:"createdBy,omitempty"`
+    UpdatedBy string     `json:"updatedBy,omitempty"`
+    DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// PatientV1 is the payload of patient.created and patient.updated.
+type PatientV1 struct {
+    DocumentV1
+    Name         string                 `json:"name"`
+    Email        string                 `json:"email"`
+    Age          int                    `json:"age"`
+    Gender       string                 `json:"gender"`
+    BloodGroup   string                 `json:"bloodGroup"`
+    ContactNo    string                 `json:"contactNo"`
+    TenantID     string                 `json:"tenantId,omitempty"`
+    Language     string                 `json:"language,omitempty"`
+    Custom       map[string]interface{} `json:"custom,omitempty"`
+    Tags         []string               `json:"tags,omitempty"`
+    Allergies    []string               `json:"allergies,omitempty"`
+    AnonymizedAt *time.Time             `json:"anonymizedAt,omitempty"`
+}
+
+// VideoRoomV1 is the room of a video consultation.
+type VideoRoomV1 struct {
+    Provider  string    `json:"provider"`
+    Name      string    `json:"name"`
+    URL       string    `json:"url,omitempty"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+// AppointmentV1 is the payload of appointment.created, appointment.updated
+// and appointment.no_show.
+type AppointmentV1 struct {
+    DocumentV1
+    PatientID          string                 `json:"patientId"`
+    DoctorID           string                 `json:"doctorId"`
+    DateTime           time.Time              `json:"dateTime"`
+    Status             string                 `json:"status"`
+    Description        string                 `json:"description"`
+    Mode               string                 `json:"mode"`
+    Video              *VideoRoomV1           `json:"video,omitempty"`
+    Custom             map[string]interface{} `json:"custom,omitempty"`
+    CheckedInAt        *time.Time             `json:"checkedInAt,omitempty"`
+    CancelledAt        *time.Time             `json:"cancelledAt,omitempty"`
+    CancellationReason string                 `json:"cancellationReason,omitempty"`
+    ReminderSentAt     *time.Time             `json:"reminderSentAt,omitempty"`
+}
+
+// LineItemV1 is a charge of an invoice.
+type LineItemV1 struct {
+    Description   string    `json:"description"`
+    AmountCents   int64     `json:"amountCents"`
+    AppointmentID string    `json:"appointmentId,omitempty"`
+    AddedAt       time.Time `json:"addedAt"`
+}
+
+// InvoiceV1 is the payload of invoice.created and invoice.updated.
+type InvoiceV1 struct {
+    DocumentV1
+    PatientID  string       `json:"patientId"`
+    Status     string       `json:"status"`
+    LineItems  []LineItemV1 `json:"lineItems"`
+    TotalCents int64        `json:"totalCents"`
+    IssuedAt   *time.Time   `json:"issuedAt,omitempty"`
+}
+
+// SlotOfferedV1 is the payload of appointment.slot_offered: the next free
+// slot of the doctor of a missed appointment.
+type SlotOfferedV1 struct {
+    AppointmentID string    `json:"appointmentId"`
+    PatientID     string    `json:"patientId"`
+    DoctorID      string    `json:"doctorId"`
+    DateTime      time.Time `json:"dateTime"`
+    Message       string    `json:"message"`
+}
+
+// CalendarConflictV1 is the payload of appointment.calendar_conflict.
+type CalendarConflictV1 struct {
+    AppointmentID string    `json:"appointmentId"`
+    DateTime      time.Time `json:"dateTime"`
+    BusyStart     time.Time `json:"busyStart"`
+    BusyEnd       time.Time `json:"busyEnd"`
+    Summary       string    `json:"summary,omitempty"`
+}
+
+// UserLockedV1 is the payload of user.locked.
+type UserLockedV1 struct {
+    UserID      string    `json:"userId"`
+    Email       string    `json:"email"`
+    LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// BackupCompletedV1 is the payload of backup.completed.
+type BackupCompletedV1 struct {
+    ID          string           `json:"id"`
+    Key         string           `json:"key"`
+    Store       string           `json:"store"`
+    Status      string           `json:"status"`
+    Trigger     string           `json:"trigger"`
+    Actor       string           `json:"actor,omitempty"`
+    StartedAt   time.Time        `json:"startedAt"`
+    FinishedAt  *time.Time       `json:"finishedAt,omitempty"`
+    Collections map[string]int64 `json:"collections,omitempty"`
+    SizeBytes   int64            `json:"sizeBytes,omitempty"`
+    SHA256      string           `json:"sha256,omitempty"`
+    Error       string           `json:"error,omitempty"`
+}
+
+// WardMovementV1 is the payload of ward.admit, ward.transfer and
+// ward.discharge.
+type WardMovementV1 struct {
+    WardID            string     `json:"wardId"`
+    Bed               string     `json:"bed"`
+    FromWardID        string     `json:"fromWardId,omitempty"`
+    FromBed           string     `json:"fromBed,omitempty"`
+    AdmissionID       string     `json:"admissionId"`
+    PatientID         string     `json:"patientId"`
+    ExpectedDischarge *time.Time `json:"expectedDischarge,omitempty"`
+}
+
+func init() {
+    register(PatientV1{}, 1, "patient.created", "patient.updated")
+    register(AppointmentV1{}, 1, "appointment.created", "appointment.updated", "appointment.no_show")
+    register(InvoiceV1{}, 1, "invoice.created", "invoice.updated")
+    register(nil, 1, "patient.deleted", "appointment.deleted", "invoice.deleted")
+    register(SlotOfferedV1{}, 1, "appointment.slot_offered")
+    register(CalendarConflictV1{}, 1, "appointment.calendar_conflict")
+    register(UserLockedV1{}, 1, "user.locked")
+    register(BackupCompletedV1{}, 1, "backup.completed")
+    register(WardMovementV1{}, 1, "ward.admit", "ward.transfer", "ward.discharge")
+}
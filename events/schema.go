@@ -0,0 +1,210 @@
+package events
+
+import (
+    _ "embed"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+    "time"
+)
+
+//go:embed schemas.json
+var recordedSchemas []byte
+
+// Schema describes a payload as the JSON type of each field, by path:
+//
+//	"lineItems[].amountCents": "integer"
+//
+// Types are string, integer, number, boolean, time, object, any and
+// array<type>. Fields that may be absent or null end with "?".
+type Schema map[string]string
+
+// Schemas are the schemas of the versions of each event type.
+type Schemas map[string]map[int]Schema
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Describe returns the schema of a payload struct, or an empty schema for
+// types without data.
+func Describe(typ reflect.Type) Schema {
+    schema := Schema{}
+    if typ != nil {
+        describeStruct(schema, "", typ)
+    }
+    return schema
+}
+
+func describeStruct(schema Schema, prefix string, typ reflect.Type) {
+    for i := 0; i < typ.NumField(); i++ {
+        field := typ.Field(i)
+        if field.Anonymous && field.Type.Kind() == reflect.Struct {
+            describeStruct(schema, prefix, field.Type)
+            continue
+        }
+        name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+        if name == "-" || !field.IsExported() {
+            continue
+        }
+        if name == "" {
+            name = field.Name
+        }
+        optional := strings.Contains(options, "omitempty")
+        describeField(schema, prefix+name, field.Type, optional)
+    }
+}
+
+func describeField(schema Schema, path string, typ reflect.Type, optional bool) {
+    if typ.Kind() == reflect.Pointer {
+        typ, optional = typ.Elem(), true
+    }
+    mark := ""
+    if optional {
+        mark = "?"
+    }
+
+    switch {
+    case typ == timeType:
+        schema[path] = "time" + mark
+    case typ.Kind() == reflect.Struct:
+        schema[path] = "object" + mark
+        describeStruct(schema, path+".", typ)
+    case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Struct && typ.Elem() != timeType:
+        schema[path] = "array<object>" + mark
+        describeStruct(schema, path+"[].", typ.Elem())
+    case typ.Kind() == reflect.Slice:
+        schema[path] = "array<" + jsonType(typ.Elem()) + ">" + mark
+    default:
+        schema[path] = jsonType(typ) + mark
+    }
+}
+
+// jsonType names the JSON type of values of a Go type.
+func jsonType(typ reflect.Type) string {
+    if typ == timeType {
+        return "time"
+    }
+    switch typ.Kind() {
+    case reflect.String:
+        return "string"
+    case reflect.Bool:
+        return "boolean"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "integer"
+    case reflect.Float32, reflect.Float64:
+        return "number"
+    case reflect.Map, reflect.Struct:
+        return "object"
+    case reflect.Pointer:
+        return jsonType(typ.Elem())
+    }
+    return "any"
+}
+
+// CurrentSchemas returns the schemas of the registered payloads.
+func CurrentSchemas() Schemas {
+    schemas := Schemas{}
+    for eventType, versions := range payloads {
+        schemas[eventType] = map[int]Schema{}
+        for version, typ := range versions {
+            schemas[eventType][version] = Describe(typ)
+        }
+    }
+    return schemas
+}
+
+// Recorded returns the schemas recorded in schemas.json.
+func Recorded() (Schemas, error) {
+    var schemas Schemas
+    if err := json.Unmarshal(recordedSchemas, &schemas); err != nil {
+        return nil, fmt.Errorf("events: schemas.json: %w", err)
+    }
+    return schemas, nil
+}
+
+// Problem is a difference between a recorded payload schema and the
+// current one. Breaking problems would break consumers; the others are
+// versions not recorded yet.
+type Problem struct {
+    EventType string
+    Version   int
+    Change    string
+    Breaking  bool
+}
+
+func (p Problem) String() string {
+    return fmt.Sprintf("%s v%d: %s", p.EventType, p.Version, p.Change)
+}
+
+// Compare lists the changes from the recorded schemas to the current ones:
+// payload versions or fields that disappeared, fields that changed type or
+// became optional, and payload versions that were never recorded.
+func Compare(recorded, current Schemas) []Problem {
+    var problems []Problem
+    add := func(eventType string, version int, breaking bool, format string, args ...interface{}) {
+        problems = append(problems, Problem{eventType, version, fmt.Sprintf(format, args...), breaking})
+    }
+    for eventType, versions := range recorded {
+        for version, was := range versions {
+            is, ok := current[eventType][version]
+            if !ok {
+                add(eventType, version, true, "payload removed")
+                continue
+            }
+            for path, wasType := range was {
+                isType, ok := is[path]
+                switch {
+                case !ok:
+                    add(eventType, version, true, "field %s removed", path)
+                case strings.TrimSuffix(isType, "?") != strings.TrimSuffix(wasType, "?"):
+                    add(eventType, version, true, "field %s changed from %s to %s", path, wasType, isType)
+                case strings.HasSuffix(isType, "?") && !strings.HasSuffix(wasType, "?"):
+                    add(eventType, version, true, "field %s became optional", path)
+                }
+            }
+        }
+    }
+    for eventType, versions := range current {
+        for version := range versions {
+            if _, ok := recorded[eventType][version]; !ok {
+                add(eventType, version, false, "not recorded in schemas.json")
+            }
+        }
+    }
+    sort.Slice(problems, func(i, j int) bool { return problems[i].String() < problems[j].String() })
+    return problems
+}
+
+// Check compares the registered payloads with schemas.json.
+func Check() ([]Problem, error) {
+    recorded, err := Recorded()
+    if err != nil {
+        return nil, err
+    }
+    return Compare(recorded, CurrentSchemas()), nil
+}
+
+// Snapshot returns schemas.json updated with the registered payloads, for
+// recording added fields and versions once Check finds nothing breaking. Versions
+// no longer registered are kept.
+func Snapshot() ([]byte, error) {
+    schemas, err := Recorded()
+    if err != nil {
+        return nil, err
+    }
+    for eventType, versions := range CurrentSchemas() {
+        if schemas[eventType] == nil {
+            schemas[eventType] = map[int]Schema{}
+        }
+        for version, schema := range versions {
+            schemas[eventType][version] = schema
+        }
+    }
+    data, err := json.MarshalIndent(schemas, "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    return append(data, '\n'), nil
+}
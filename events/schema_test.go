@@ -0,0 +1,19 @@
+package events
+
+import "testing"
+
+// TestPayloadsCompatible fails on payload changes that would break
+// consumers and on payload versions not recorded in schemas.json.
+func TestPayloadsCompatible(t *testing.T) {
+    problems, err := Check()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, problem := range problems {
+        if problem.Breaking {
+            t.Errorf("%s; add a payload version instead", problem)
+        } else {
+            t.Errorf("%s; run go run ./events/checkevents -write", problem)
+        }
+    }
+}
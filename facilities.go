@@ -0,0 +1,435 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/geo"
+)
+
+// GeoPoint is a GeoJSON point, as 2dsphere indexes store positions:
+// {"type": "Point", "coordinates": [lng, lat]}.
+type GeoPoint struct {
+    Type        string    `json:"type" bson:"type"`
+    Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+func newGeoPoint(p geo.Point) *GeoPoint {
+    return &GeoPoint{Type: "Point", Coordinates: []float64{p.Lng, p.Lat}}
+}
+
+// point returns the position of a valid GeoPoint.
+func (g *GeoPoint) point() geo.Point {
+    return geo.Point{Lat: g.Coordinates[1], Lng: g.Coordinates[0]}
+}
+
+func (g *GeoPoint) validate() error {
+    if g.Type != "Point" || len(g.Coordinates) != 2 || !g.point().Valid() {
+        return newAPIError("invalid_location")
+    }
+    return nil
+}
+
+// Facility is a clinic or hospital of a tenant. Its location is given or,
+// without one, geocoded from its address.
+type Facility struct {
+    Document        `bson:",inline"`
+    Name            string    `json:"name" bson:"name"`
+    TenantID        string    `json:"tenantId,omitempty" bson:"tenantId,omitempty"`
+    Address         string    `json:"address" bson:"address"`
+    ContactNo       string    `json:"contactNo,omitempty" bson:"contactNo,omitempty"`
+    Location        *GeoPoint `json:"location,omitempty" bson:"location,omitempty"`
+    GeocodedAddress string    `json:"-" bson:"geocodedAddress,omitempty"` // the address Location is of
+}
+
+// FacilityDistance is a facility and its distance from where the search
+// was made.
+type FacilityDistance struct {
+    Facility
+    DistanceKm float64 `json:"distanceKm" bson:"distanceKm"`
+}
+
+// DoctorDistance is a doctor found by distance, and the facility they
+// work at.
+type DoctorDistance struct {
+    Doctor     Doctor   `json:"doctor" bson:"doctor"`
+    Facility   Facility `json:"facility" bson:"facility"`
+    DistanceKm float64  `json:"distanceKm" bson:"distanceKm"`
+}
+
+// Bounds of nearest searches
+const (
+    defaultNearestLimit = 10
+    maxNearestLimit     = 50
+)
+
+var (
+    facilityCollection *mongo.Collection
+    facilityRepo       *Repository[Facility, *Facility]
+    geocoder           geo.Geocoder // nil without GEOCODER
+)
+
+func initFacilities(ctx context.Context, db *mongo.Database) {
+    facilityCollection = db.Collection("facilities")
+    facilityRepo = NewRepository[Facility](facilityCollection, defaultHooks)
+
+    switch config.Geocoder {
+    case "nominatim":
+        geocoder = geo.NewNominatim(config.NominatimURL, "hospital-api ("+config.PublicURL+")", geocodePolicy.Client())
+    case "google":
+        geocoder = geo.NewGoogle(config.GoogleMapsAPIKey, geocodePolicy.Client())
+    }
+
+    location := mongo.IndexModel{Keys: bson.D{{Key: "location", Value: "2dsphere"}}}
+    for _, coll := range []*mongo.Collection{facilityCollection, patientCollection} {
+        if _, err := coll.Indexes().CreateOne(ctx, location); err != nil {
+            log.Printf("Error creating %s location index: %v\n", coll.Name(), err)
+        }
+    }
+    facility := mongo.IndexModel{Keys: bson.D{{Key: "facilityId", Value: 1}}}
+    if _, err := doctorCollection.Indexes().CreateOne(ctx, facility); err != nil {
+        log.Printf("Error creating doctor facility index: %v\n", err)
+    }
+}
+
+// validateFacility checks a facility. A facility needs a location to be
+// found by distance, given or geocoded from its address.
+func validateFacility(facility *Facility) error {
+    facility.Name = strings.TrimSpace(facility.Name)
+    facility.Address = strings.TrimSpace(facility.Address)
+    if facility.Name == "" {
+        return newAPIError("field_required", "name")
+    }
+    if facility.Address == "" && facility.Location == nil {
+        return newAPIError("field_required", "address")
+    }
+    if facility.Location != nil {
+        return facility.Location.validate()
+    }
+    return nil
+}
+
+// validateFacilityID checks that the facility of a doctor exists.
+func validateFacilityID(ctx context.Context, id *primitive.ObjectID) error {
+    if id == nil {
+        return nil
+    }
+    if _, err := facilityRepo.GetByID(ctx, *id); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            return newAPIError("facility_not_found")
+        }
+        return err
+    }
+    return nil
+}
+
+// geocodeAddresses locates the facilities and patients whose address
+// changed since it was last geocoded, a batch at a time. Addresses the
+// geocoder cannot place are left without a location.
+func geocodeAddresses(ctx context.Context) error {
+    if geocoder == nil {
+        return nil
+    }
+    ctx = contextWithActor(ctx, "geocoder")
+
+    pending := bson.M{
+        "address":   bson.M{"$nin": bson.A{"", nil}},
+        "$expr":     bson.M{"$ne": bson.A{"$address", "$geocodedAddress"}},
+        "deletedAt": nil,
+    }
+    facilities, err := facilityRepo.List(ctx, pending, Page{Size: config.GeocodeBatch})
+    if err != nil {
+        return err
+    }
+    for _, facility := range facilities {
+        if err := geocodeDocument(ctx, facility.ID, facility.Address, facilityRepo.UpdateFields); err != nil {
+            return err
+        }
+    }
+
+    patients, err := patientRepo.List(ctx, pending, Page{Size: config.GeocodeBatch})
+    if err != nil {
+        return err
+    }
+    for _, patient := range patients {
+        if err := geocodeDocument(ctx, patient.ID, patient.Address, patientRepo.UpdateFields); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// geocodeDocument geocodes the address of document id and stores its
+// location, unless the address changed meanwhile.
+func geocodeDocument(ctx context.Context, id primitive.ObjectID, address string, update func(context.Context, primitive.ObjectID, bson.M, bson.M) error) error {
+    fields := bson.M{"geocodedAddress": address}
+    point, err := geocoder.Geocode(ctx, address)
+    switch {
+    case errors.Is(err, geo.ErrNotFound):
+        log.Printf("Geocoder %s cannot place the address of %s\n", geocoder.Name(), id.Hex())
+        fields["location"] = nil
+    case err != nil:
+        return err
+    default:
+        fields["location"] = newGeoPoint(point)
+    }
+    err = update(ctx, id, bson.M{"address": address}, fields)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return nil
+    }
+    return err
+}
+
+// nearestQuery reads the origin of a nearest search, ?lat=&lng= or the
+// location of ?patientId=, and its ?limit= and ?maxKm=.
+func nearestQuery(r *http.Request) (origin geo.Point, limit int64, maxKm float64, err error) {
+    query := r.URL.Query()
+
+    limit = defaultNearestLimit
+    if n, err := strconv.ParseInt(query.Get("limit"), 10, 64); err == nil && n > 0 {
+        limit = min(n, maxNearestLimit)
+    }
+    if s := query.Get("maxKm"); s != "" {
+        if maxKm, err = strconv.ParseFloat(s, 64); err != nil || maxKm <= 0 {
+            return origin, 0, 0, newAPIError("invalid_max_km")
+        }
+    }
+
+    if s := query.Get("patientId"); s != "" {
+        id, err := primitive.ObjectIDFromHex(s)
+        if err != nil {
+            return origin, 0, 0, newAPIError("invalid_patient_id")
+        }
+        patient, err := patientRepo.GetByID(r.Context(), id)
+        if err != nil {
+            if errors.Is(err, mongo.ErrNoDocuments) {
+                return origin, 0, 0, newAPIError("patient_not_found")
+            }
+            return origin, 0, 0, err
+        }
+        if patient.Location == nil {
+            return origin, 0, 0, newAPIError("patient_not_located")
+        }
+        notePatientAccess(r.Context(), patient.ID)
+        return patient.Location.point(), limit, maxKm, nil
+    }
+
+    lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+    lng, lngErr := strconv.ParseFloat(query.Get("lng"), 64)
+    origin = geo.Point{Lat: lat, Lng: lng}
+    if latErr != nil || lngErr != nil || !origin.Valid() {
+        return origin, 0, 0, newAPIError("invalid_location")
+    }
+    return origin, limit, maxKm, nil
+}
+
+// geoNearStage is the $geoNear stage of the facilities of the tenant of a
+// request, if it names one, nearest first, with their distance in km.
+func geoNearStage(r *http.Request, origin geo.Point, maxKm float64) bson.D {
+    query := bson.M{"deletedAt": nil}
+    if tenant := r.Header.Get(tenantHeader); tenant != "" {
+        query["tenantId"] = tenant
+    }
+    near := bson.M{
+        "near":               newGeoPoint(origin),
+        "key":                "location",
+        "distanceField":      "distanceKm",
+        "distanceMultiplier": 0.001,
+        "spherical":          true,
+        "query":              query,
+    }
+    if maxKm > 0 {
+        near["maxDistance"] = maxKm * 1000
+    }
+    return bson.D{{Key: "$geoNear", Value: near}}
+}
+
+// writeNearestError answers the errors of nearestQuery.
+func writeNearestError(w http.ResponseWriter, r *http.Request, err error) {
+    var apiErr *apiError
+    switch {
+    case errors.As(err, &apiErr) && apiErr.key == "patient_not_found":
+        writeError(w, r, http.StatusNotFound, err)
+    case errors.As(err, &apiErr):
+        writeError(w, r, http.StatusBadRequest, err)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// Facility handlers
+
+// facilities lists the facilities, of the tenant of X-Tenant-ID if set:
+// GET /facilities
+func facilities(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    filter := bson.M{}
+    if tenant := r.Header.Get(tenantHeader); tenant != "" {
+        filter["tenantId"] = tenant
+    }
+
+    ctx := r.Context()
+
+    list, err := facilityRepo.List(ctx, filter, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
+
+// createFacility adds a facility: POST /admin/facilities
+func createFacility(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var facility Facility
+    if !decodeJSON(w, r, &facility) {
+        return
+    }
+    if err := validateFacility(&facility); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if facility.Location != nil {
+        facility.GeocodedAddress = facility.Address
+    }
+
+    ctx := r.Context()
+
+    if err := facilityRepo.Create(ctx, &facility); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(facility)
+}
+
+// patchFacility updates a facility with a JSON Merge Patch:
+// PATCH /admin/facilities/{id}. A changed address is geocoded again.
+func patchFacility(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPatch {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_facility_id")
+        return
+    }
+
+    facility, ok := patchDocument(w, r, facilityRepo, id, patchable[Facility]{
+        notFound: "facility_not_found",
+        readOnly: []string{"location"},
+        check: func(ctx context.Context, facility *Facility) error {
+            return validateFacility(facility)
+        },
+    })
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(facility)
+}
+
+// getNearestFacilities lists the facilities closest to a place, nearest
+// first: GET /facilities/nearest?lat=&lng= or ?patientId=, with ?maxKm=
+// and ?limit=
+func getNearestFacilities(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    origin, limit, maxKm, err := nearestQuery(r)
+    if err != nil {
+        writeNearestError(w, r, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    pipeline := mongo.Pipeline{
+        geoNearStage(r, origin, maxKm),
+        {{Key: "$limit", Value: limit}},
+    }
+    cursor, err := facilityCollection.Aggregate(ctx, pipeline)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    nearest := []FacilityDistance{}
+    if err := cursor.All(ctx, &nearest); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(nearest)
+}
+
+// getNearestDoctors lists the doctors of the facilities closest to a
+// place, nearest first, optionally of a ?specialization=:
+// GET /doctors/nearest?lat=&lng= or ?patientId=, with ?maxKm= and ?limit=
+func getNearestDoctors(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    origin, limit, maxKm, err := nearestQuery(r)
+    if err != nil {
+        writeNearestError(w, r, err)
+        return
+    }
+    doctorMatch := bson.M{"doctor.deletedAt": nil}
+    if specialization := r.URL.Query().Get("specialization"); specialization != "" {
+        doctorMatch["doctor.specialization"] = normalizeSpecialization(specialization)
+    }
+
+    ctx := r.Context()
+
+    pipeline := mongo.Pipeline{
+        geoNearStage(r, origin, maxKm),
+        {{Key: "$lookup", Value: bson.M{"from": "doctors", "localField": "_id", "foreignField": "facilityId", "as": "doctor"}}},
+        {{Key: "$unwind", Value: "$doctor"}},
+        {{Key: "$match", Value: doctorMatch}},
+        {{Key: "$limit", Value: limit}},
+        {{Key: "$project", Value: bson.M{"_id": 0, "doctor": 1, "distanceKm": 1, "facility": "$$ROOT"}}},
+        {{Key: "$unset", Value: bson.A{"facility.doctor", "facility.distanceKm"}}},
+    }
+    cursor, err := facilityCollection.Aggregate(ctx, pipeline)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    nearest := []DoctorDistance{}
+    if err := cursor.All(ctx, &nearest); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(nearest)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "slices"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/flags"
+)
+
+// Feature flags of modules under gradual rollout
+const (
+    FlagBilling = "billing"
+    FlagFHIR    = "fhir"
+)
+
+var knownFlags = []string{FlagBilling, FlagFHIR}
+
+// tenantHeader names the tenant a request is made for, which flags may
+// target.
+const tenantHeader = "X-Tenant-ID"
+
+var (
+    flagCollection *mongo.Collection
+    featureFlags   *flags.Set
+)
+
+func initFeatureFlags(ctx context.Context, db *mongo.Database) {
+    flagCollection = db.Collection("feature_flags")
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)}
+    if _, err := flagCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating feature flag index: %v\n", err)
+    }
+
+    featureFlags = flags.New(config.FeatureFlags, loadFlags, config.FeatureFlagRefresh)
+    if err := featureFlags.Refresh(ctx); err != nil {
+        log.Printf("Error loading feature flags: %v\n", err)
+    }
+}
+
+func loadFlags(ctx context.Context) ([]flags.Flag, error) {
+    cursor, err := flagCollection.Find(ctx, bson.M{})
+    if err != nil {
+        return nil, err
+    }
+    var stored []flags.Flag
+    err = cursor.All(ctx, &stored)
+    return stored, err
+}
+
+// featureEnabled reports whether a flag is on for the tenant of a request.
+func featureEnabled(r *http.Request, name string) bool {
+    return featureFlags.Enabled(r.Context(), name, r.Header.Get(tenantHeader))
+}
+
+// requireFlag hides a route while its feature flag is off.
+func requireFlag(name string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !featureEnabled(r, name) {
+            localizedError(w, r, http.StatusNotFound, "feature_disabled", name)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// FlagState is a flag as listed by the admin API.
+type FlagState struct {
+    Name     string      `json:"name"`
+    Default  bool        `json:"default"`
+    Override *flags.Flag `json:"override,omitempty"`
+    Enabled  *bool       `json:"enabled,omitempty"` // for ?tenant=
+}
+
+// Feature flag handlers
+
+// getFlags lists the known and overridden flags, with their value for a
+// tenant given ?tenant=: GET /admin/flags
+func getFlags(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := featureFlags.Refresh(ctx); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    overrides := featureFlags.Overrides()
+    names := append([]string{}, knownFlags...)
+    for name := range overrides {
+        if !slices.Contains(names, name) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    tenant, scoped := r.URL.Query()["tenant"]
+    states := make([]FlagState, 0, len(names))
+    for _, name := range names {
+        state := FlagState{Name: name, Default: featureFlags.Default(name)}
+        if override, ok := overrides[name]; ok {
+            state.Override = &override
+        }
+        if scoped {
+            enabled := featureFlags.Enabled(ctx, name, tenant[0])
+            state.Enabled = &enabled
+        }
+        states = append(states, state)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(states)
+}
+
+// adminFlag overrides a flag (PUT) or returns it to its default (DELETE):
+// /admin/flags/{name}
+func adminFlag(w http.ResponseWriter, r *http.Request) {
+    name := r.PathValue("name")
+    if !slices.Contains(knownFlags, name) {
+        localizedError(w, r, http.StatusNotFound, "flag_not_found", name)
+        return
+    }
+
+    ctx := r.Context()
+
+    var flag flags.Flag
+    switch r.Method {
+    case http.MethodPut:
+        if !decodeJSON(w, r, &flag) {
+            return
+        }
+        flag.Name, flag.UpdatedAt, flag.UpdatedBy = name, time.Now(), actorFromContext(ctx)
+        _, err := flagCollection.ReplaceOne(ctx, bson.M{"name": name}, flag, options.Replace().SetUpsert(true))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    case http.MethodDelete:
+        if _, err := flagCollection.DeleteOne(ctx, bson.M{"name": name}); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if err := featureFlags.Refresh(ctx); err != nil {
+        log.Printf("Error reloading feature flags: %v\n", err)
+    }
+
+    if r.Method == http.MethodDelete {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(flag)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/email"
+    "new/i18n"
+    "new/ics"
+)
+
+// calendarFeedHistory is how far back the doctor feed reaches.
+const calendarFeedHistory = 30 * 24 * time.Hour
+
+// randomToken returns n random bytes, hex encoded.
+func randomToken(n int) string {
+    b := make([]byte, n)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// appointmentEvent describes an appointment as a calendar event. UIDs are
+// stable so clients update events in place.
+func appointmentEvent(appointment *Appointment, summary string) ics.Event {
+    domain := "localhost"
+    if _, d, ok := strings.Cut(config.SMTPFrom, "@"); ok {
+        domain = d
+    }
+
+    event := ics.Event{
+        UID:         "appointment-" + appointment.ID.Hex() + "@" + domain,
+        Start:       appointment.DateTime,
+        End:         appointment.DateTime.Add(config.SlotDuration),
+        Stamp:       appointment.UpdatedAt,
+        Summary:     summary,
+        Description: appointment.Description,
+        Status:      ics.Confirmed,
+    }
+    if appointment.Status == StatusCancelled {
+        event.Status = ics.Cancelled
+    }
+    return event
+}
+
+// appointmentInvite is the .ics attachment of the confirmation email.
+func appointmentInvite(lang string, appointment *Appointment, doctor *Doctor) email.Attachment {
+    event := appointmentEvent(appointment, i18n.Message(lang, "ics.summary", doctor.Name))
+    event.Location = doctor.Department
+
+    calendar := ics.Calendar{Method: ics.Publish, Events: []ics.Event{event}}
+    return email.Attachment{
+        Filename:    "appointment.ics",
+        ContentType: "text/calendar; charset=utf-8; method=" + ics.Publish,
+        Data:        calendar.Marshal(),
+    }
+}
+
+// calendarFeedURL is the subscription URL of a doctor's feed.
+func calendarFeedURL(doctor *Doctor) string {
+    return config.PublicURL + "/doctors/" + doctor.ID.Hex() + "/calendar.ics?token=" + doctor.CalendarToken
+}
+
+// Calendar feed handlers
+
+// rotateCalendarToken issues a new secret for a doctor's calendar feed,
+// revoking the previous subscription URL.
+func rotateCalendarToken(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_doctor_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    doctor := &Doctor{Document: Document{ID: id}, CalendarToken: randomToken(24)}
+    err = doctorRepo.UpdateFields(ctx, id, nil, bson.M{"calendarToken": doctor.CalendarToken})
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "doctor_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"feedUrl": calendarFeedURL(doctor)})
+}
+
+// getDoctorCalendar serves a doctor's appointments as a subscribable
+// iCalendar feed, authenticated by the secret token in the URL:
+// GET /doctors/{id}/calendar.ics?token=...
+func getDoctorCalendar(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_doctor_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    doctor, err := doctorRepo.GetByID(ctx, id)
+    if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    token := r.URL.Query().Get("token")
+    if doctor == nil || doctor.CalendarToken == "" ||
+        subtle.ConstantTimeCompare([]byte(token), []byte(doctor.CalendarToken)) != 1 {
+        localizedError(w, r, http.StatusUnauthorized, "unauthorized")
+        return
+    }
+
+    appointments, err := appointmentRepo.List(ctx, bson.M{
+        "doctorId": id,
+        "status":   bson.M{"$in": bson.A{StatusScheduled, StatusCheckedIn, StatusCompleted}},
+        "dateTime": bson.M{"$gte": time.Now().Add(-calendarFeedHistory)},
+    }, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    patientIDs := bson.A{}
+    for _, appointment := range appointments {
+        patientIDs = append(patientIDs, appointment.PatientID)
+        notePatientAccess(ctx, appointment.PatientID)
+    }
+    patients, err := patientRepo.List(ctx, bson.M{"_id": bson.M{"$in": patientIDs}}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    names := map[primitive.ObjectID]string{}
+    for _, patient := range patients {
+        names[patient.ID] = patient.Name
+    }
+
+    lang := requestLanguage(r)
+    calendar := ics.Calendar{Name: i18n.Message(lang, "ics.feed_name", doctor.Name), Method: ics.Publish}
+    for i := range appointments {
+        event := appointmentEvent(&appointments[i], names[appointments[i].PatientID])
+        event.Location = doctor.Department
+        calendar.Events = append(calendar.Events, event)
+    }
+
+    w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+    w.Header().Set("Cache-Control", "private, max-age=300")
+    w.Write(calendar.Marshal())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "net/http"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+
+    "new/rsql"
+)
+
+// Fields the ?filter= expressions of the list endpoints may use, by their
+// JSON names
+var (
+    patientFilterSchema = rsql.Schema{
+        "name":       {Name: "name"},
+        "email":      {Name: "email"},
+        "age":        {Name: "age", Type: rsql.Int},
+        "gender":     {Name: "gender"},
+        "bloodGroup": {Name: "bloodGroup"},
+        "contactNo":  {Name: "contactNo"},
+        "tenantId":   {Name: "tenantId"},
+        "language":   {Name: "language"},
+        "tags":       {Name: "tags"},
+        "createdAt":  {Name: "createdAt", Type: rsql.Time},
+        "updatedAt":  {Name: "updatedAt", Type: rsql.Time},
+    }
+    doctorFilterSchema = rsql.Schema{
+        "name":           {Name: "name"},
+        "email":          {Name: "email"},
+        "specialization": {Name: "specialization"},
+        "department":     {Name: "department"},
+        "contactNo":      {Name: "contactNo"},
+        "createdAt":      {Name: "createdAt", Type: rsql.Time},
+        "updatedAt":      {Name: "updatedAt", Type: rsql.Time},
+    }
+    appointmentFilterSchema = rsql.Schema{
+        "patientId":   {Name: "patientId", Type: rsql.Custom, Parse: parseObjectID},
+        "doctorId":    {Name: "doctorId", Type: rsql.Custom, Parse: parseObjectID},
+        "dateTime":    {Name: "dateTime", Type: rsql.Time},
+        "status":      {Name: "status"},
+        "mode":        {Name: "mode"},
+        "description": {Name: "description"},
+        "checkedInAt": {Name: "checkedInAt", Type: rsql.Time},
+        "cancelledAt": {Name: "cancelledAt", Type: rsql.Time},
+        "createdAt":   {Name: "createdAt", Type: rsql.Time},
+        "updatedAt":   {Name: "updatedAt", Type: rsql.Time},
+    }
+)
+
+func parseObjectID(s string) (interface{}, error) {
+    return primitive.ObjectIDFromHex(s)
+}
+
+// applyQueryFilter adds the RSQL expression of ?filter=, such as
+// age=ge=65;bloodGroup=="O+", to the filter of a list endpoint. Only the
+// fields of schema can be filtered on.
+func applyQueryFilter(r *http.Request, filter bson.M, schema rsql.Schema) error {
+    expr := r.URL.Query().Get("filter")
+    if expr == "" {
+        return nil
+    }
+    parsed, err := schema.Filter(expr)
+    if err != nil {
+        return newAPIError("invalid_filter", err.Error())
+    }
+    if len(parsed) == 0 {
+        return nil
+    }
+    and, _ := filter["$and"].(bson.A)
+    filter["$and"] = append(and, bson.M(parsed))
+    return nil
+}
@@ -0,0 +1,98 @@
+// Package flags evaluates feature flags: defaults from configuration,
+// overridden by stored flags that may target individual tenants.
+package flags
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+// Flag is a stored override of a feature flag. Tenants listed in Tenants
+// get their own value; everyone else gets Enabled.
+type Flag struct {
+    Name      string          `json:"name" bson:"name"`
+    Enabled   bool            `json:"enabled" bson:"enabled"`
+    Tenants   map[string]bool `json:"tenants,omitempty" bson:"tenants,omitempty"`
+    UpdatedAt time.Time       `json:"updatedAt" bson:"updatedAt"`
+    UpdatedBy string          `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+}
+
+// For reports whether the flag is on for tenant.
+func (f *Flag) For(tenant string) bool {
+    if on, ok := f.Tenants[tenant]; ok && tenant != "" {
+        return on
+    }
+    return f.Enabled
+}
+
+// Source loads the stored overrides.
+type Source func(ctx context.Context) ([]Flag, error)
+
+// Set evaluates flags against cached overrides, reloaded from the source
+// at most once per TTL. When reloading fails the previous overrides stay
+// in effect.
+type Set struct {
+    defaults map[string]bool
+    source   Source
+    ttl      time.Duration
+
+    mu        sync.Mutex
+    overrides map[string]Flag
+    loadedAt  time.Time
+}
+
+// New returns a Set where the flags in defaults are on unless overridden.
+func New(defaults map[string]bool, source Source, ttl time.Duration) *Set {
+    return &Set{defaults: defaults, source: source, ttl: ttl}
+}
+
+// Default reports whether a flag is on by configuration.
+func (s *Set) Default(name string) bool {
+    return s.defaults[name]
+}
+
+// Enabled reports whether a flag is on for tenant, which may be "".
+func (s *Set) Enabled(ctx context.Context, name, tenant string) bool {
+    s.mu.Lock()
+    if time.Since(s.loadedAt) >= s.ttl {
+        s.mu.Unlock()
+        s.Refresh(ctx)
+        s.mu.Lock()
+    }
+    flag, ok := s.overrides[name]
+    s.mu.Unlock()
+
+    if ok {
+        return flag.For(tenant)
+    }
+    return s.defaults[name]
+}
+
+// Overrides returns the cached overrides.
+func (s *Set) Overrides() map[string]Flag {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    overrides := make(map[string]Flag, len(s.overrides))
+    for name, flag := range s.overrides {
+        overrides[name] = flag
+    }
+    return overrides
+}
+
+// Refresh reloads the overrides now, as after changing them.
+func (s *Set) Refresh(ctx context.Context) error {
+    loaded, err := s.source(ctx)
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.loadedAt = time.Now()
+    if err != nil {
+        return err
+    }
+    s.overrides = make(map[string]Flag, len(loaded))
+    for _, flag := range loaded {
+        s.overrides[flag.Name] = flag
+    }
+    return nil
+}
@@ -0,0 +1,306 @@
+// Package gcal is a minimal Google Calendar API v3 client: OAuth consent,
+// event upserts and deletes, and listing the events of a time range.
+package gcal
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "time"
+
+    "golang.org/x/oauth2"
+    "golang.org/x/oauth2/endpoints"
+)
+
+const (
+    apiBase   = "https://www.googleapis.com/calendar/v3"
+    revokeURL = "https://oauth2.googleapis.com/revoke"
+
+    // Scope grants read/write access to events.
+    Scope = "https://www.googleapis.com/auth/calendar.events"
+)
+
+// Client holds the OAuth application credentials and the HTTP client
+// all calls to Google go through.
+type Client struct {
+    oauth *oauth2.Config
+    http  *http.Client
+}
+
+// New returns a Client calling Google through httpClient, or
+// http.DefaultClient if nil.
+func New(clientID, clientSecret, redirectURL string, httpClient *http.Client) *Client {
+    if httpClient == nil {
+        httpClient = http.DefaultClient
+    }
+    return &Client{
+        oauth: &oauth2.Config{
+            ClientID:     clientID,
+            ClientSecret: clientSecret,
+            RedirectURL:  redirectURL,
+            Endpoint:     endpoints.Google,
+            Scopes:       []string{Scope},
+        },
+        http: httpClient,
+    }
+}
+
+// context makes the oauth2 package use the HTTP client of c.
+func (c *Client) context(ctx context.Context) context.Context {
+    return context.WithValue(ctx, oauth2.HTTPClient, c.http)
+}
+
+// AuthURL is the consent page a user is sent to. Offline access with a
+// forced consent prompt guarantees a refresh token.
+func (c *Client) AuthURL(state string) string {
+    return c.oauth.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+}
+
+// Exchange trades the authorization code of the callback for a token.
+func (c *Client) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+    return c.oauth.Exchange(c.context(ctx), code)
+}
+
+// Revoke invalidates a token at Google.
+func (c *Client) Revoke(ctx context.Context, token *oauth2.Token) error {
+    t := token.RefreshToken
+    if t == "" {
+        t = token.AccessToken
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL,
+        bytes.NewBufferString(url.Values{"token": {t}}.Encode()))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 && resp.StatusCode != http.StatusBadRequest {
+        // 400 means the token is already invalid
+        return fmt.Errorf("revoke: %s", resp.Status)
+    }
+    return nil
+}
+
+// Session makes API calls on behalf of one user, refreshing the access
+// token as needed.
+type Session struct {
+    source oauth2.TokenSource
+    http   *http.Client
+}
+
+func (c *Client) Session(ctx context.Context, token *oauth2.Token) *Session {
+    ctx = c.context(ctx)
+    source := c.oauth.TokenSource(ctx, token)
+    client := oauth2.NewClient(ctx, source)
+    client.Timeout = c.http.Timeout
+    return &Session{source: source, http: client}
+}
+
+// Token returns the current token, which differs from the one the session
+// was created with after a refresh.
+func (s *Session) Token() (*oauth2.Token, error) {
+    return s.source.Token()
+}
+
+// Event is a calendar event. AppointmentID is kept in the event's private
+// extended properties to recognize events pushed by this service.
+type Event struct {
+    ID            string
+    Summary       string
+    Description   string
+    Location      string
+    Start         time.Time
+    End           time.Time
+    Transparent   bool // does not block time
+    AppointmentID string
+}
+
+type eventTime struct {
+    DateTime string `json:"dateTime,omitempty"`
+    Date     string `json:"date,omitempty"`
+}
+
+type apiEvent struct {
+    ID                 string              `json:"id,omitempty"`
+    Status             string              `json:"status,omitempty"`
+    Summary            string              `json:"summary,omitempty"`
+    Description        string              `json:"description,omitempty"`
+    Location           string              `json:"location,omitempty"`
+    Start              eventTime           `json:"start"`
+    End                eventTime           `json:"end"`
+    Transparency       string              `json:"transparency,omitempty"`
+    ExtendedProperties *extendedProperties `json:"extendedProperties,omitempty"`
+}
+
+type extendedProperties struct {
+    Private map[string]string `json:"private,omitempty"`
+}
+
+func (t eventTime) parse() (time.Time, error) {
+    if t.DateTime != "" {
+        return time.Parse(time.RFC3339, t.DateTime)
+    }
+    // All-day events
+    return time.ParseInLocation(time.DateOnly, t.Date, time.Local)
+}
+
+func (e *apiEvent) event() (Event, error) {
+    start, err := e.Start.parse()
+    if err != nil {
+        return Event{}, err
+    }
+    end, err := e.End.parse()
+    if err != nil {
+        return Event{}, err
+    }
+    event := Event{
+        ID:          e.ID,
+        Summary:     e.Summary,
+        Description: e.Description,
+        Location:    e.Location,
+        Start:       start,
+        End:         end,
+        Transparent: e.Transparency == "transparent",
+    }
+    if e.ExtendedProperties != nil {
+        event.AppointmentID = e.ExtendedProperties.Private["appointmentId"]
+    }
+    return event, nil
+}
+
+// PutEvent creates the event, or replaces it when it has an ID, and
+// returns its ID.
+func (s *Session) PutEvent(ctx context.Context, calendarID string, e Event) (string, error) {
+    body := apiEvent{
+        Summary:     e.Summary,
+        Description: e.Description,
+        Location:    e.Location,
+        Start:       eventTime{DateTime: e.Start.Format(time.RFC3339)},
+        End:         eventTime{DateTime: e.End.Format(time.RFC3339)},
+    }
+    if e.Transparent {
+        body.Transparency = "transparent"
+    }
+    if e.AppointmentID != "" {
+        body.ExtendedProperties = &extendedProperties{Private: map[string]string{"appointmentId": e.AppointmentID}}
+    }
+
+    method, path := http.MethodPost, "/calendars/"+url.PathEscape(calendarID)+"/events"
+    if e.ID != "" {
+        method, path = http.MethodPut, path+"/"+url.PathEscape(e.ID)
+    }
+
+    var created apiEvent
+    if err := s.call(ctx, method, path, body, &created); err != nil {
+        return "", err
+    }
+    return created.ID, nil
+}
+
+// DeleteEvent deletes an event. Events already gone are not an error.
+func (s *Session) DeleteEvent(ctx context.Context, calendarID, id string) error {
+    err := s.call(ctx, http.MethodDelete, "/calendars/"+url.PathEscape(calendarID)+"/events/"+url.PathEscape(id), nil, nil)
+    var apiErr *Error
+    if errors.As(err, &apiErr) && (apiErr.Status == http.StatusNotFound || apiErr.Status == http.StatusGone) {
+        return nil
+    }
+    return err
+}
+
+// ListEvents returns the confirmed events overlapping [from, to), with
+// recurring events expanded into instances.
+func (s *Session) ListEvents(ctx context.Context, calendarID string, from, to time.Time) ([]Event, error) {
+    query := url.Values{
+        "timeMin":      {from.Format(time.RFC3339)},
+        "timeMax":      {to.Format(time.RFC3339)},
+        "singleEvents": {"true"},
+        "maxResults":   {"250"},
+    }
+
+    var events []Event
+    for {
+        var page struct {
+            Items         []apiEvent `json:"items"`
+            NextPageToken string     `json:"nextPageToken"`
+        }
+        path := "/calendars/" + url.PathEscape(calendarID) + "/events?" + query.Encode()
+        if err := s.call(ctx, http.MethodGet, path, nil, &page); err != nil {
+            return nil, err
+        }
+
+        for _, item := range page.Items {
+            if item.Status == "cancelled" {
+                continue
+            }
+            event, err := item.event()
+            if err != nil {
+                return nil, fmt.Errorf("event %s: %w", item.ID, err)
+            }
+            events = append(events, event)
+        }
+
+        if page.NextPageToken == "" {
+            return events, nil
+        }
+        query.Set("pageToken", page.NextPageToken)
+    }
+}
+
+// Error is a non-2xx API response.
+type Error struct {
+    Status  int
+    Message string
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("google calendar: %d %s", e.Status, e.Message)
+}
+
+func (s *Session) call(ctx context.Context, method, path string, in, out interface{}) error {
+    var body io.Reader
+    if in != nil {
+        data, err := json.Marshal(in)
+        if err != nil {
+            return err
+        }
+        body = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, apiBase+path, body)
+    if err != nil {
+        return err
+    }
+    if in != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+
+    resp, err := s.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        var apiErr struct {
+            Error struct {
+                Message string `json:"message"`
+            } `json:"error"`
+        }
+        json.NewDecoder(resp.Body).Decode(&apiErr)
+        return &Error{Status: resp.StatusCode, Message: apiErr.Error.Message}
+    }
+    if out == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,44 @@
+// Package geo turns addresses into coordinates through pluggable
+// geocoders and measures distances between them.
+package geo
+
+import (
+    "context"
+    "errors"
+    "math"
+)
+
+// ErrNotFound is returned by geocoders for addresses they cannot place.
+var ErrNotFound = errors.New("geo: address not found")
+
+// Point is a position in degrees.
+type Point struct {
+    Lat float64 `json:"lat"`
+    Lng float64 `json:"lng"`
+}
+
+// Valid reports whether p is within the ranges of latitudes and longitudes.
+func (p Point) Valid() bool {
+    return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// Geocoder is a geocoding service.
+type Geocoder interface {
+    Name() string
+    // Geocode returns the position of the best match for address, or
+    // ErrNotFound.
+    Geocode(ctx context.Context, address string) (Point, error)
+}
+
+// earthRadius is the mean radius of the Earth in meters, which MongoDB
+// also uses for spherical distances.
+const earthRadius = 6378100.0
+
+// Distance returns the great-circle distance between a and b in meters.
+func Distance(a, b Point) float64 {
+    lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+    dLat := lat2 - lat1
+    dLng := (b.Lng - a.Lng) * math.Pi / 180
+    h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+    return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
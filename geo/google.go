@@ -0,0 +1,67 @@
+package geo
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "time"
+)
+
+const googleGeocodeAPI = "https://maps.googleapis.com/maps/api/geocode/json"
+
+// Google geocodes with the Google Geocoding API.
+type Google struct {
+    APIKey string
+
+    client *http.Client
+}
+
+// NewGoogle returns a geocoder calling the API through client, or a
+// default client if nil.
+func NewGoogle(apiKey string, client *http.Client) *Google {
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &Google{APIKey: apiKey, client: client}
+}
+
+func (g *Google) Name() string { return "google" }
+
+func (g *Google) Geocode(ctx context.Context, address string) (Point, error) {
+    query := url.Values{"address": {address}, "key": {g.APIKey}}
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, googleGeocodeAPI+"?"+query.Encode(), nil)
+    if err != nil {
+        return Point{}, err
+    }
+
+    resp, err := g.client.Do(req)
+    if err != nil {
+        return Point{}, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return Point{}, fmt.Errorf("google geocoding: %s", resp.Status)
+    }
+
+    var body struct {
+        Status       string `json:"status"`
+        ErrorMessage string `json:"error_message"`
+        Results      []struct {
+            Geometry struct {
+                Location Point `json:"location"`
+            } `json:"geometry"`
+        } `json:"results"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return Point{}, fmt.Errorf("google geocoding: %w", err)
+    }
+    switch body.Status {
+    case "OK":
+        return body.Results[0].Geometry.Location, nil
+    case "ZERO_RESULTS":
+        return Point{}, ErrNotFound
+    }
+    return Point{}, fmt.Errorf("google geocoding: %s %s", body.Status, body.ErrorMessage)
+}
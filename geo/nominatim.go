@@ -0,0 +1,101 @@
+package geo
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const nominatimAPI = "https://nominatim.openstreetmap.org"
+
+// nominatimInterval spaces requests, as the usage policy of the public
+// OpenStreetMap server requires.
+const nominatimInterval = time.Second
+
+// Nominatim geocodes with Nominatim, the OpenStreetMap geocoder, on the
+// public server or a server of its own. Requests identify the service by
+// its user agent and are sent at most one a second.
+type Nominatim struct {
+    URL       string
+    UserAgent string
+
+    client *http.Client
+    mu     sync.Mutex
+    last   time.Time
+}
+
+// NewNominatim returns a geocoder calling the server at baseURL, or the
+// public one if "", through client, or a default client if nil.
+func NewNominatim(baseURL, userAgent string, client *http.Client) *Nominatim {
+    if baseURL == "" {
+        baseURL = nominatimAPI
+    }
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &Nominatim{URL: baseURL, UserAgent: userAgent, client: client}
+}
+
+func (n *Nominatim) Name() string { return "nominatim" }
+
+// wait blocks until the next request may be sent.
+func (n *Nominatim) wait(ctx context.Context) error {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if delay := time.Until(n.last.Add(nominatimInterval)); delay > 0 {
+        select {
+        case <-time.After(delay):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+    n.last = time.Now()
+    return nil
+}
+
+func (n *Nominatim) Geocode(ctx context.Context, address string) (Point, error) {
+    if err := n.wait(ctx); err != nil {
+        return Point{}, err
+    }
+
+    query := url.Values{"q": {address}, "format": {"jsonv2"}, "limit": {"1"}}
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.URL+"/search?"+query.Encode(), nil)
+    if err != nil {
+        return Point{}, err
+    }
+    req.Header.Set("User-Agent", n.UserAgent)
+
+    resp, err := n.client.Do(req)
+    if err != nil {
+        return Point{}, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return Point{}, fmt.Errorf("nominatim: %s", resp.Status)
+    }
+
+    var results []struct {
+        Lat string `json:"lat"`
+        Lon string `json:"lon"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+        return Point{}, fmt.Errorf("nominatim: %w", err)
+    }
+    if len(results) == 0 {
+        return Point{}, ErrNotFound
+    }
+    lat, err := strconv.ParseFloat(results[0].Lat, 64)
+    if err != nil {
+        return Point{}, fmt.Errorf("nominatim: %w", err)
+    }
+    lng, err := strconv.ParseFloat(results[0].Lon, 64)
+    if err != nil {
+        return Point{}, fmt.Errorf("nominatim: %w", err)
+    }
+    return Point{Lat: lat, Lng: lng}, nil
+}
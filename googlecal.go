@@ -0,0 +1,497 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "golang.org/x/oauth2"
+
+    "new/gcal"
+    "new/i18n"
+)
+
+// SourceGoogle marks unavailability imported from Google Calendar.
+const SourceGoogle = "google"
+
+// CalendarToken is the stored OAuth token of a calendar link.
+type CalendarToken struct {
+    AccessToken  string    `bson:"accessToken"`
+    RefreshToken string    `bson:"refreshToken"`
+    TokenType    string    `bson:"tokenType"`
+    Expiry       time.Time `bson:"expiry"`
+}
+
+func (t *CalendarToken) oauth() *oauth2.Token {
+    return &oauth2.Token{AccessToken: t.AccessToken, RefreshToken: t.RefreshToken, TokenType: t.TokenType, Expiry: t.Expiry}
+}
+
+func calendarToken(t *oauth2.Token) *CalendarToken {
+    return &CalendarToken{AccessToken: t.AccessToken, RefreshToken: t.RefreshToken, TokenType: t.TokenType, Expiry: t.Expiry}
+}
+
+// CalendarConflict is a booked appointment overlapping a busy block of the
+// doctor's Google Calendar. Bookings take precedence; conflicts are
+// reported for staff to resolve.
+type CalendarConflict struct {
+    AppointmentID primitive.ObjectID `json:"appointmentId" bson:"appointmentId"`
+    DateTime      time.Time          `json:"dateTime" bson:"dateTime"`
+    BusyStart     time.Time          `json:"busyStart" bson:"busyStart"`
+    BusyEnd       time.Time          `json:"busyEnd" bson:"busyEnd"`
+    Summary       string             `json:"summary,omitempty" bson:"summary,omitempty"`
+}
+
+// CalendarLink connects a doctor to their Google Calendar.
+type CalendarLink struct {
+    Document    `bson:",inline"`
+    DoctorID    primitive.ObjectID `json:"doctorId" bson:"doctorId"`
+    CalendarID  string             `json:"calendarId" bson:"calendarId"`
+    State       string             `json:"-" bson:"state,omitempty"` // pending OAuth consent
+    Token       *CalendarToken     `json:"-" bson:"token,omitempty"`
+    ConnectedAt *time.Time         `json:"connectedAt,omitempty" bson:"connectedAt,omitempty"`
+    LastSyncAt  *time.Time         `json:"lastSyncAt,omitempty" bson:"lastSyncAt,omitempty"`
+    LastError   string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+    Conflicts   []CalendarConflict `json:"conflicts" bson:"conflicts"`
+}
+
+var (
+    calendarLinkCollection *mongo.Collection
+    calendarLinkRepo       *Repository[CalendarLink, *CalendarLink]
+    gcalClient             *gcal.Client // nil without GOOGLE_CLIENT_ID
+)
+
+func initGoogleCalendar(ctx context.Context, db *mongo.Database) {
+    calendarLinkCollection = db.Collection("calendar_links")
+    calendarLinkRepo = NewRepository[CalendarLink](calendarLinkCollection, defaultHooks)
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "doctorId", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "state", Value: 1}}, Options: options.Index().SetSparse(true)},
+    }
+    if _, err := calendarLinkCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating calendar link indexes: %v\n", err)
+    }
+
+    if config.GoogleClientID != "" {
+        redirect := config.GoogleRedirectURL
+        if redirect == "" {
+            redirect = config.PublicURL + "/integrations/google/callback"
+        }
+        gcalClient = gcal.New(config.GoogleClientID, config.GoogleClientSecret, redirect, calendarPolicy.Client())
+    }
+}
+
+// calendarLinkOf returns the connected calendar link of a doctor, or
+// mongo.ErrNoDocuments.
+func calendarLinkOf(ctx context.Context, doctorID primitive.ObjectID) (*CalendarLink, error) {
+    var link CalendarLink
+    err := calendarLinkCollection.FindOne(ctx, bson.M{
+        "doctorId":  doctorID,
+        "token":     bson.M{"$ne": nil},
+        "deletedAt": nil,
+    }).Decode(&link)
+    if err != nil {
+        return nil, err
+    }
+    return &link, nil
+}
+
+// pushAppointment mirrors an appointment to the linked calendar: active
+// appointments get an event, cancelled and missed ones lose theirs.
+func pushAppointment(ctx context.Context, session *gcal.Session, link *CalendarLink, appointment *Appointment) error {
+    active := appointment.Status == StatusScheduled || appointment.Status == StatusCheckedIn
+    switch {
+    case active && appointment.CalendarEventID == "":
+        patient, err := patientRepo.GetByID(ctx, appointment.PatientID)
+        if err != nil {
+            return err
+        }
+        eventID, err := session.PutEvent(ctx, link.CalendarID, gcal.Event{
+            Summary:       i18n.Message(i18n.Default, "gcal.summary", patient.Name),
+            Description:   appointment.Description,
+            Start:         appointment.DateTime,
+            End:           appointment.DateTime.Add(config.SlotDuration),
+            AppointmentID: appointment.ID.Hex(),
+        })
+        if err != nil {
+            return err
+        }
+        appointment.CalendarEventID = eventID
+
+    case !active && appointment.CalendarEventID != "":
+        if err := session.DeleteEvent(ctx, link.CalendarID, appointment.CalendarEventID); err != nil {
+            return err
+        }
+        appointment.CalendarEventID = ""
+
+    default:
+        return nil
+    }
+    return appointmentRepo.UpdateFields(ctx, appointment.ID, nil, bson.M{"calendarEventId": appointment.CalendarEventID})
+}
+
+// importBusyBlocks replaces the doctor's Google unavailability within
+// [from, to) with the busy events of their calendar, ignoring the events
+// pushed for appointments.
+func importBusyBlocks(ctx context.Context, session *gcal.Session, link *CalendarLink, from, to time.Time) ([]Unavailability, error) {
+    events, err := session.ListEvents(ctx, link.CalendarID, from, to)
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    blocks := []Unavailability{}
+    docs := []interface{}{}
+    for _, event := range events {
+        if event.Transparent || event.AppointmentID != "" {
+            continue
+        }
+        block := Unavailability{
+            Document:   Document{ID: primitive.NewObjectID(), CreatedAt: now, UpdatedAt: now},
+            DoctorID:   link.DoctorID,
+            Start:      event.Start,
+            End:        event.End,
+            Source:     SourceGoogle,
+            ExternalID: event.ID,
+            Summary:    event.Summary,
+        }
+        blocks = append(blocks, block)
+        docs = append(docs, block)
+    }
+
+    // Imported blocks are a cache of the external calendar, so they are
+    // replaced outright rather than soft deleted.
+    _, err = unavailabilityCollection.DeleteMany(ctx, bson.M{
+        "doctorId": link.DoctorID,
+        "source":   SourceGoogle,
+        "start":    bson.M{"$lt": to},
+        "end":      bson.M{"$gt": from},
+    })
+    if err != nil {
+        return nil, err
+    }
+    if len(docs) > 0 {
+        if _, err := unavailabilityCollection.InsertMany(ctx, docs); err != nil {
+            return nil, err
+        }
+    }
+    return blocks, nil
+}
+
+// findConflicts pairs active appointments with the busy blocks they
+// overlap.
+func findConflicts(appointments []Appointment, blocks []Unavailability) []CalendarConflict {
+    conflicts := []CalendarConflict{}
+    for _, a := range appointments {
+        if a.Status != StatusScheduled && a.Status != StatusCheckedIn {
+            continue
+        }
+        end := a.DateTime.Add(config.SlotDuration)
+        for _, b := range blocks {
+            if b.Start.Before(end) && a.DateTime.Before(b.End) {
+                conflicts = append(conflicts, CalendarConflict{
+                    AppointmentID: a.ID,
+                    DateTime:      a.DateTime,
+                    BusyStart:     b.Start,
+                    BusyEnd:       b.End,
+                    Summary:       b.Summary,
+                })
+            }
+        }
+    }
+    return conflicts
+}
+
+// syncCalendarLink runs one two-way sync of a link over the next
+// GOOGLE_SYNC_DAYS: pushes appointment changes, imports busy blocks and
+// reconciles conflicts between the two, publishing newly found ones as
+// appointment.calendar_conflict events.
+func syncCalendarLink(ctx context.Context, link *CalendarLink) error {
+    session := gcalClient.Session(ctx, link.Token.oauth())
+    from := time.Now()
+    to := from.AddDate(0, 0, int(config.GoogleSyncDays))
+
+    appointments, err := appointmentRepo.List(ctx, bson.M{
+        "doctorId": link.DoctorID,
+        "dateTime": bson.M{"$gte": from, "$lt": to},
+    }, Page{})
+    if err != nil {
+        return err
+    }
+    for i := range appointments {
+        if err := pushAppointment(ctx, session, link, &appointments[i]); err != nil {
+            return err
+        }
+    }
+
+    blocks, err := importBusyBlocks(ctx, session, link, from, to)
+    if err != nil {
+        return err
+    }
+
+    known := map[primitive.ObjectID]bool{}
+    for _, c := range link.Conflicts {
+        known[c.AppointmentID] = true
+    }
+    conflicts := findConflicts(appointments, blocks)
+    for _, c := range conflicts {
+        if known[c.AppointmentID] {
+            continue
+        }
+        if err := publishEvent(ctx, "appointment.calendar_conflict", c.AppointmentID, c); err != nil {
+            log.Printf("Error publishing calendar conflict of appointment %s: %v\n", c.AppointmentID.Hex(), err)
+        }
+    }
+
+    token, err := session.Token()
+    if err != nil {
+        return err
+    }
+    return calendarLinkRepo.UpdateFields(ctx, link.ID, nil, bson.M{
+        "token":      calendarToken(token),
+        "lastSyncAt": time.Now(),
+        "lastError":  "",
+        "conflicts":  conflicts,
+    })
+}
+
+// syncGoogleCalendars syncs every connected calendar.
+func syncGoogleCalendars(ctx context.Context) error {
+    if gcalClient == nil {
+        return nil
+    }
+
+    links, err := calendarLinkRepo.List(ctx, bson.M{"token": bson.M{"$ne": nil}}, Page{})
+    if err != nil {
+        return err
+    }
+    for i := range links {
+        if err := syncCalendarLink(ctx, &links[i]); err != nil {
+            log.Printf("Error syncing calendar of doctor %s: %v\n", links[i].DoctorID.Hex(), err)
+            calendarLinkRepo.UpdateFields(ctx, links[i].ID, nil, bson.M{"lastError": err.Error()})
+        }
+    }
+    return nil
+}
+
+// syncAppointmentCalendar pushes a single appointment change right away,
+// ahead of the next scheduled sync.
+func syncAppointmentCalendar(appointment Appointment) {
+    if gcalClient == nil {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    link, err := calendarLinkOf(ctx, appointment.DoctorID)
+    if err != nil {
+        if !errors.Is(err, mongo.ErrNoDocuments) {
+            log.Printf("Error loading calendar link of doctor %s: %v\n", appointment.DoctorID.Hex(), err)
+        }
+        return
+    }
+    session := gcalClient.Session(ctx, link.Token.oauth())
+    if err := pushAppointment(ctx, session, link, &appointment); err != nil {
+        log.Printf("Error pushing appointment %s to calendar: %v\n", appointment.ID.Hex(), err)
+    }
+}
+
+// Google Calendar handlers
+
+// connectGoogleCalendar starts linking a doctor's calendar and returns the
+// Google consent URL to open: POST /admin/doctors/{id}/google
+func connectGoogleCalendar(w http.ResponseWriter, r *http.Request, doctorID primitive.ObjectID) {
+    if gcalClient == nil {
+        localizedError(w, r, http.StatusNotImplemented, "google_not_configured")
+        return
+    }
+
+    ctx := r.Context()
+
+    if _, err := doctorRepo.GetByID(ctx, doctorID); err != nil {
+        localizedError(w, r, http.StatusNotFound, "doctor_not_found")
+        return
+    }
+
+    now := time.Now()
+    actor := actorFromContext(ctx)
+    state := randomToken(16)
+    _, err := calendarLinkCollection.UpdateOne(ctx,
+        bson.M{"doctorId": doctorID},
+        bson.M{
+            "$setOnInsert": bson.M{"createdAt": now, "createdBy": actor, "calendarId": "primary", "conflicts": bson.A{}},
+            "$set":         bson.M{"state": state, "updatedAt": now, "updatedBy": actor, "deletedAt": nil},
+        },
+        options.Update().SetUpsert(true),
+    )
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"authUrl": gcalClient.AuthURL(state)})
+}
+
+// googleCalendarCallback completes the OAuth consent started by
+// connectGoogleCalendar and runs a first sync.
+func googleCalendarCallback(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if gcalClient == nil {
+        localizedError(w, r, http.StatusNotImplemented, "google_not_configured")
+        return
+    }
+
+    state, code := r.URL.Query().Get("state"), r.URL.Query().Get("code")
+    if state == "" || code == "" {
+        localizedError(w, r, http.StatusBadRequest, "google_consent_failed", r.URL.Query().Get("error"))
+        return
+    }
+
+    ctx := r.Context()
+
+    var link CalendarLink
+    err := calendarLinkCollection.FindOne(ctx, bson.M{"state": state, "deletedAt": nil}).Decode(&link)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusBadRequest, "google_consent_failed", "state")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    token, err := gcalClient.Exchange(ctx, code)
+    if err != nil {
+        localizedError(w, r, http.StatusBadGateway, "google_consent_failed", err.Error())
+        return
+    }
+
+    now := time.Now()
+    link.Token = calendarToken(token)
+    link.ConnectedAt = &now
+    err = calendarLinkRepo.UpdateFields(ctx, link.ID, bson.M{"state": state}, bson.M{
+        "state":       "",
+        "token":       link.Token,
+        "connectedAt": now,
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+        defer cancel()
+        if err := syncCalendarLink(ctx, &link); err != nil {
+            log.Printf("Error syncing calendar of doctor %s: %v\n", link.DoctorID.Hex(), err)
+        }
+    }()
+
+    lang := requestLanguage(r)
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Header().Set("Content-Language", lang)
+    w.Write([]byte(i18n.Message(lang, "gcal.connected")))
+}
+
+func getGoogleCalendarLink(w http.ResponseWriter, r *http.Request, doctorID primitive.ObjectID) {
+    ctx := r.Context()
+
+    link, err := calendarLinkOf(ctx, doctorID)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "calendar_not_connected")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(link)
+}
+
+// disconnectGoogleCalendar removes the pushed events, revokes the token
+// and drops the imported unavailability of a doctor.
+func disconnectGoogleCalendar(w http.ResponseWriter, r *http.Request, doctorID primitive.ObjectID) {
+    ctx := r.Context()
+
+    link, err := calendarLinkOf(ctx, doctorID)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "calendar_not_connected")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if gcalClient != nil {
+        session := gcalClient.Session(ctx, link.Token.oauth())
+        pushed, err := appointmentRepo.List(ctx, bson.M{
+            "doctorId":        doctorID,
+            "calendarEventId": bson.M{"$nin": bson.A{nil, ""}},
+            "dateTime":        bson.M{"$gte": time.Now()},
+        }, Page{})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        for _, a := range pushed {
+            if err := session.DeleteEvent(ctx, link.CalendarID, a.CalendarEventID); err != nil {
+                log.Printf("Error deleting calendar event of appointment %s: %v\n", a.ID.Hex(), err)
+            }
+        }
+        if err := gcalClient.Revoke(ctx, link.Token.oauth()); err != nil {
+            log.Printf("Error revoking calendar token of doctor %s: %v\n", doctorID.Hex(), err)
+        }
+    }
+
+    if _, err := appointmentCollection.UpdateMany(ctx,
+        bson.M{"doctorId": doctorID, "calendarEventId": bson.M{"$exists": true}},
+        bson.M{"$unset": bson.M{"calendarEventId": ""}},
+    ); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if _, err := unavailabilityCollection.DeleteMany(ctx, bson.M{"doctorId": doctorID, "source": SourceGoogle}); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if _, err := calendarLinkCollection.DeleteOne(ctx, bson.M{"_id": link.ID}); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// adminDoctorGoogle dispatches /admin/doctors/{id}/google.
+func adminDoctorGoogle(w http.ResponseWriter, r *http.Request) {
+    doctorID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_doctor_id")
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        getGoogleCalendarLink(w, r, doctorID)
+    case http.MethodPost:
+        connectGoogleCalendar(w, r, doctorID)
+    case http.MethodDelete:
+        disconnectGoogleCalendar(w, r, doctorID)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
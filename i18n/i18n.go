@@ -0,0 +1,156 @@
+// Package i18n holds the message catalogs of the API and negotiates the
+// language of a request from its Accept-Language header.
+//
+// Catalogs are JSON objects mapping message keys to fmt format strings,
+// one file per language under catalogs/. Keys missing from a catalog fall
+// back to the Default language.
+package i18n
+
+import (
+    "embed"
+    "encoding/json"
+    "fmt"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Default is the language used when no supported language is requested.
+const Default = "en"
+
+//go:embed catalogs/*.json
+var files embed.FS
+
+var catalogs = map[string]map[string]string{}
+
+func init() {
+    entries, err := files.ReadDir("catalogs")
+    if err != nil {
+        panic(err)
+    }
+    for _, entry := range entries {
+        data, err := files.ReadFile(path.Join("catalogs", entry.Name()))
+        if err != nil {
+            panic(err)
+        }
+        messages := map[string]string{}
+        if err := json.Unmarshal(data, &messages); err != nil {
+            panic(fmt.Sprintf("i18n: %s: %v", entry.Name(), err))
+        }
+        catalogs[strings.TrimSuffix(entry.Name(), ".json")] = messages
+    }
+}
+
+// Languages lists the supported languages.
+func Languages() []string {
+    langs := make([]string, 0, len(catalogs))
+    for lang := range catalogs {
+        langs = append(langs, lang)
+    }
+    sort.Strings(langs)
+    return langs
+}
+
+// Supported reports whether lang has a catalog.
+func Supported(lang string) bool {
+    _, ok := catalogs[lang]
+    return ok
+}
+
+// Match returns the supported language of a language tag, matching on the
+// primary subtag so es-MX selects es.
+func Match(tag string) (string, bool) {
+    primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+    return primary, primary != "" && Supported(primary)
+}
+
+// Resolve returns the supported language of the first of tags that has
+// one, in order of preference, or Default.
+func Resolve(tags ...string) string {
+    for _, tag := range tags {
+        if lang, ok := Match(tag); ok {
+            return lang
+        }
+    }
+    return Default
+}
+
+// Negotiate picks the supported language with the highest quality in an
+// Accept-Language header, matching on the primary subtag so es-MX selects
+// es. It returns Default when nothing matches.
+func Negotiate(acceptLanguage string) string {
+    best, bestQ := Default, 0.0
+    for _, part := range strings.Split(acceptLanguage, ",") {
+        tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            parsed, err := strconv.ParseFloat(v, 64)
+            if err != nil {
+                continue
+            }
+            q = parsed
+        }
+
+        if lang, ok := Match(tag); ok && q > bestQ {
+            best, bestQ = lang, q
+        }
+    }
+    return best
+}
+
+// Message formats the message key in lang with args. Unknown keys are
+// returned as is.
+func Message(lang, key string, args ...interface{}) string {
+    format, ok := catalogs[lang][key]
+    if !ok {
+        format, ok = catalogs[Default][key]
+    }
+    if !ok {
+        format = key
+    }
+    if len(args) == 0 {
+        return format
+    }
+    return fmt.Sprintf(format, args...)
+}
+
+// StatusLabel is the display name of an appointment status.
+func StatusLabel(lang, status string) string {
+    key := "status." + status
+    if label := Message(lang, key); label != key {
+        return label
+    }
+    return status
+}
+
+// Term is the display name of a coded term of a kind, e.g. the invoice
+// status Paid, or the code itself if the catalogs have none.
+func Term(lang, kind, code string) string {
+    key := "term." + kind + "." + code
+    if label := Message(lang, key); label != key {
+        return label
+    }
+    return code
+}
+
+// FormatDate formats the date part of t in the conventions of lang.
+func FormatDate(lang string, t time.Time) string {
+    return t.Format(Message(lang, "format.date"))
+}
+
+// FormatTime formats the time of day of t in the conventions of lang.
+func FormatTime(lang string, t time.Time) string {
+    return t.Format(Message(lang, "format.time"))
+}
+
+// FormatAmount formats an amount of cents with the decimal separator of
+// lang, e.g. 1250 as "12.50" or "12,50".
+func FormatAmount(lang string, cents int64) string {
+    sign := ""
+    if cents < 0 {
+        sign, cents = "-", -cents
+    }
+    return fmt.Sprintf("%s%d%s%02d", sign, cents/100, Message(lang, "format.decimal"), cents%100)
+}
@@ -0,0 +1,157 @@
+// Package icd10 provides lookup and search over a table of ICD-10 diagnosis
+// codes.
+//
+// Tables use the layout of the CMS order files (icd10cm_codes_YYYY.txt): one
+// code per line without the dot, followed by whitespace and the description.
+// A small table of common codes is bundled; the full CMS release can be
+// loaded with Load.
+package icd10
+
+import (
+    "bufio"
+    _ "embed"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+)
+
+//go:embed codes.txt
+var bundled string
+
+// Code is a single diagnosis code in its dotted form, e.g. E11.9.
+type Code struct {
+    Code        string `json:"code"`
+    Description string `json:"description"`
+}
+
+type Table struct {
+    codes  []Code
+    byCode map[string]int
+}
+
+// Bundled returns the table of common codes shipped with the service.
+func Bundled() *Table {
+    table, err := Parse(strings.NewReader(bundled))
+    if err != nil {
+        panic(fmt.Sprintf("icd10: bundled table: %v", err))
+    }
+    return table
+}
+
+// Load reads a table from a code file.
+func Load(path string) (*Table, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return Parse(f)
+}
+
+func Parse(r io.Reader) (*Table, error) {
+    table := &Table{byCode: map[string]int{}}
+
+    scanner := bufio.NewScanner(r)
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(scanner.Text())
+        if text == "" || strings.HasPrefix(text, "#") {
+            continue
+        }
+        fields := strings.Fields(text)
+        if len(fields) < 2 {
+            return nil, fmt.Errorf("line %d: missing description", line)
+        }
+        code := Normalize(fields[0])
+        if _, ok := table.byCode[code]; ok {
+            continue
+        }
+        table.codes = append(table.codes, Code{
+            Code:        code,
+            Description: strings.Join(fields[1:], " "),
+        })
+        table.byCode[code] = -1
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    sort.Slice(table.codes, func(i, j int) bool {
+        return table.codes[i].Code < table.codes[j].Code
+    })
+    for i, c := range table.codes {
+        table.byCode[c.Code] = i
+    }
+    return table, nil
+}
+
+// Normalize converts a code to its canonical dotted upper case form, so
+// "e119", "E119" and "E11.9" all become "E11.9".
+func Normalize(code string) string {
+    code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), ".", ""))
+    if len(code) > 3 {
+        code = code[:3] + "." + code[3:]
+    }
+    return code
+}
+
+func (t *Table) Len() int {
+    return len(t.codes)
+}
+
+// Lookup finds a code in any accepted spelling.
+func (t *Table) Lookup(code string) (Code, bool) {
+    i, ok := t.byCode[Normalize(code)]
+    if !ok {
+        return Code{}, false
+    }
+    return t.codes[i], true
+}
+
+// Search returns up to limit codes for a typeahead query. Codes starting
+// with the query come first, followed by codes whose description contains
+// every word of the query.
+func (t *Table) Search(query string, limit int) []Code {
+    query = strings.TrimSpace(query)
+    results := []Code{}
+    if query == "" || limit <= 0 {
+        return results
+    }
+
+    seen := map[string]bool{}
+    prefix := Normalize(query)
+    start := sort.Search(len(t.codes), func(i int) bool {
+        return t.codes[i].Code >= prefix
+    })
+    for i := start; i < len(t.codes) && len(results) < limit; i++ {
+        // The dot is only inserted after the third character, so a
+        // three character query also matches its dotted subcodes.
+        if !strings.HasPrefix(t.codes[i].Code, prefix) {
+            break
+        }
+        results = append(results, t.codes[i])
+        seen[t.codes[i].Code] = true
+    }
+
+    words := strings.Fields(strings.ToLower(query))
+    for _, c := range t.codes {
+        if len(results) >= limit {
+            break
+        }
+        if seen[c.Code] || !containsAll(strings.ToLower(c.Description), words) {
+            continue
+        }
+        results = append(results, c)
+    }
+    return results
+}
+
+func containsAll(s string, words []string) bool {
+    for _, w := range words {
+        if !strings.Contains(s, w) {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,118 @@
+// Package ics writes iCalendar (RFC 5545) files: single event invites and
+// subscribable calendar feeds.
+package ics
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Methods of a calendar object (RFC 5546). Feeds and "add to calendar"
+// invites use Publish.
+const (
+    Publish = "PUBLISH"
+    Request = "REQUEST"
+    Cancel  = "CANCEL"
+)
+
+// Event statuses
+const (
+    Confirmed = "CONFIRMED"
+    Cancelled = "CANCELLED"
+)
+
+// Event is a VEVENT.
+type Event struct {
+    UID         string
+    Start       time.Time
+    End         time.Time
+    Stamp       time.Time // last modification
+    Summary     string
+    Description string
+    Location    string
+    Status      string
+    Sequence    int
+}
+
+// Calendar is a VCALENDAR with a display name, as shown by clients for
+// subscribed feeds.
+type Calendar struct {
+    Name   string
+    Method string
+    Events []Event
+}
+
+const dateTime = "20060102T150405Z"
+
+// Marshal encodes c with CRLF line endings and lines folded at 75 octets.
+func (c *Calendar) Marshal() []byte {
+    var buf bytes.Buffer
+    line := func(name, value string) {
+        fold(&buf, name+":"+value)
+    }
+
+    line("BEGIN", "VCALENDAR")
+    line("VERSION", "2.0")
+    line("PRODID", "-//hospital//appointments//EN")
+    line("CALSCALE", "GREGORIAN")
+    if c.Method != "" {
+        line("METHOD", c.Method)
+    }
+    if c.Name != "" {
+        line("X-WR-CALNAME", escape(c.Name))
+    }
+
+    for _, e := range c.Events {
+        line("BEGIN", "VEVENT")
+        line("UID", e.UID)
+        line("DTSTAMP", e.Stamp.UTC().Format(dateTime))
+        line("DTSTART", e.Start.UTC().Format(dateTime))
+        line("DTEND", e.End.UTC().Format(dateTime))
+        line("SUMMARY", escape(e.Summary))
+        if e.Description != "" {
+            line("DESCRIPTION", escape(e.Description))
+        }
+        if e.Location != "" {
+            line("LOCATION", escape(e.Location))
+        }
+        if e.Status != "" {
+            line("STATUS", e.Status)
+        }
+        line("SEQUENCE", fmt.Sprint(e.Sequence))
+        line("END", "VEVENT")
+    }
+
+    line("END", "VCALENDAR")
+    return buf.Bytes()
+}
+
+// escape escapes a TEXT value.
+func escape(s string) string {
+    return strings.NewReplacer(
+        `\`, `\\`,
+        ";", `\;`,
+        ",", `\,`,
+        "\r\n", `\n`,
+        "\n", `\n`,
+    ).Replace(s)
+}
+
+// fold writes a content line, continuing it on new lines starting with a
+// space every 75 octets without splitting UTF-8 sequences.
+func fold(buf *bytes.Buffer, s string) {
+    limit := 75
+    for len(s) > limit {
+        cut := limit
+        for cut > 0 && s[cut]&0xc0 == 0x80 {
+            cut--
+        }
+        buf.WriteString(s[:cut])
+        buf.WriteString("\r\n ")
+        s = s[cut:]
+        limit = 74 // the leading space counts
+    }
+    buf.WriteString(s)
+    buf.WriteString("\r\n")
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Vaccination is a dose of a vaccine given to a patient.
+type Vaccination struct {
+    Document       `bson:",inline"`
+    PatientID      primitive.ObjectID `json:"patientId" bson:"patientId"`
+    Vaccine        string             `json:"vaccine" bson:"vaccine"` // code of the schedule
+    Dose           int                `json:"dose" bson:"dose"`       // from 1
+    Lot            string             `json:"lot" bson:"lot"`
+    AdministeredBy string             `json:"administeredBy" bson:"administeredBy"`
+    AdministeredAt time.Time          `json:"administeredAt" bson:"administeredAt"`
+}
+
+// Vaccine is an entry of the immunization schedule: a primary series of
+// Doses, the days between them, and boosters every BoosterDays after it.
+// Patients from MinAge to MaxAge (years, 0 for none) are due it.
+type Vaccine struct {
+    Code         string `json:"code"`
+    Name         string `json:"name"`
+    MinAge       int    `json:"minAge"`
+    MaxAge       int    `json:"maxAge,omitempty"`
+    Doses        int    `json:"doses"`
+    IntervalDays []int  `json:"intervalDays,omitempty"` // before doses 2 to Doses
+    BoosterDays  int    `json:"boosterDays,omitempty"`
+}
+
+// defaultVaccineSchedule is an adult schedule, used without
+// IMMUNIZATION_SCHEDULE_FILE.
+var defaultVaccineSchedule = []Vaccine{
+    {Code: "td", Name: "Tetanus and diphtheria", MinAge: 18, Doses: 1, BoosterDays: 3650},
+    {Code: "flu", Name: "Influenza", MinAge: 18, Doses: 1, BoosterDays: 365},
+    {Code: "hepb", Name: "Hepatitis B", MinAge: 18, MaxAge: 59, Doses: 3, IntervalDays: []int{28, 140}},
+    {Code: "mmr", Name: "Measles, mumps and rubella", MinAge: 18, MaxAge: 65, Doses: 2, IntervalDays: []int{28}},
+    {Code: "zoster", Name: "Recombinant zoster", MinAge: 50, Doses: 2, IntervalDays: []int{60}},
+    {Code: "pcv", Name: "Pneumococcal conjugate", MinAge: 65, Doses: 1},
+}
+
+// DueDose is the next dose of a vaccine a patient is due.
+type DueDose struct {
+    Vaccine string    `json:"vaccine"`
+    Name    string    `json:"name"`
+    Dose    int       `json:"dose"`
+    Booster bool      `json:"booster"`
+    DueAt   time.Time `json:"dueAt"`
+    Overdue bool      `json:"overdue"`
+}
+
+var (
+    vaccinationCollection *mongo.Collection
+    vaccinationRepo       *Repository[Vaccination, *Vaccination]
+    vaccineSchedule       = map[string]Vaccine{}
+    vaccineCodes          []string // in schedule order
+)
+
+func initImmunizations(ctx context.Context, db *mongo.Database) {
+    vaccinationCollection = db.Collection("vaccinations")
+    vaccinationRepo = NewRepository[Vaccination](vaccinationCollection, defaultHooks)
+
+    schedule := defaultVaccineSchedule
+    if config.ImmunizationScheduleFile != "" {
+        var err error
+        if schedule, err = loadVaccineSchedule(config.ImmunizationScheduleFile); err != nil {
+            log.Fatalf("Error loading immunization schedule: %v", err)
+        }
+    }
+    for _, vaccine := range schedule {
+        vaccineSchedule[vaccine.Code] = vaccine
+        vaccineCodes = append(vaccineCodes, vaccine.Code)
+    }
+
+    index := mongo.IndexModel{
+        Keys:    bson.D{{Key: "patientId", Value: 1}, {Key: "vaccine", Value: 1}, {Key: "dose", Value: 1}},
+        Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"deletedAt": bson.M{"$exists": false}}),
+    }
+    if _, err := vaccinationCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating vaccination index: %v\n", err)
+    }
+}
+
+// loadVaccineSchedule reads a schedule from a JSON array of Vaccine.
+func loadVaccineSchedule(path string) ([]Vaccine, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var schedule []Vaccine
+    if err := json.Unmarshal(data, &schedule); err != nil {
+        return nil, err
+    }
+    seen := map[string]bool{}
+    for _, vaccine := range schedule {
+        if vaccine.Code == "" || seen[vaccine.Code] {
+            return nil, errors.New("vaccine codes must be unique and not empty")
+        }
+        if vaccine.Doses < 1 || len(vaccine.IntervalDays) != vaccine.Doses-1 {
+            return nil, errors.New(vaccine.Code + ": a vaccine has doses and an interval before each after the first")
+        }
+        seen[vaccine.Code] = true
+    }
+    return schedule, nil
+}
+
+// dueDoses returns the next doses a patient is due, given their
+// vaccinations, in order of due date. Without a date of birth, eligible
+// patients are due first doses from their registration. Doses are overdue
+// IMMUNIZATION_GRACE after their due date.
+func dueDoses(patient *Patient, vaccinations []Vaccination, now time.Time) []DueDose {
+    type history struct {
+        doses int
+        last  time.Time
+    }
+    given := map[string]*history{}
+    for _, v := range vaccinations {
+        h, ok := given[v.Vaccine]
+        if !ok {
+            h = &history{}
+            given[v.Vaccine] = h
+        }
+        h.doses = max(h.doses, v.Dose)
+        if v.AdministeredAt.After(h.last) {
+            h.last = v.AdministeredAt
+        }
+    }
+
+    due := []DueDose{}
+    for _, code := range vaccineCodes {
+        vaccine := vaccineSchedule[code]
+        h := given[code]
+        if h == nil {
+            if patient.Age < vaccine.MinAge || (vaccine.MaxAge > 0 && patient.Age > vaccine.MaxAge) {
+                continue
+            }
+            h = &history{}
+        }
+
+        next := DueDose{Vaccine: code, Name: vaccine.Name, Dose: h.doses + 1}
+        switch {
+        case h.doses == 0:
+            next.DueAt = patient.CreatedAt
+        case h.doses < vaccine.Doses:
+            next.DueAt = h.last.AddDate(0, 0, vaccine.IntervalDays[h.doses-1])
+        case vaccine.BoosterDays > 0:
+            next.Booster = true
+            next.DueAt = h.last.AddDate(0, 0, vaccine.BoosterDays)
+        default:
+            continue
+        }
+        next.Overdue = now.After(next.DueAt.Add(config.ImmunizationGrace))
+        due = append(due, next)
+    }
+    sort.SliceStable(due, func(i, j int) bool { return due[i].DueAt.Before(due[j].DueAt) })
+    return due
+}
+
+// patientVaccinations returns the vaccinations of a patient.
+func patientVaccinations(ctx context.Context, patientID primitive.ObjectID) ([]Vaccination, error) {
+    return vaccinationRepo.List(ctx, bson.M{"patientId": patientID}, Page{})
+}
+
+// validateVaccination checks a vaccination, numbering it as the next dose
+// when it has no number.
+func validateVaccination(ctx context.Context, v *Vaccination) error {
+    if _, ok := vaccineSchedule[v.Vaccine]; !ok {
+        return newAPIError("invalid_choice", "vaccine", strings.Join(vaccineCodes, ", "))
+    }
+    v.Lot = strings.TrimSpace(v.Lot)
+    if v.Lot == "" {
+        return newAPIError("field_required", "lot")
+    }
+    if v.AdministeredBy == "" {
+        v.AdministeredBy = actorFromContext(ctx)
+    }
+    if v.AdministeredAt.IsZero() {
+        v.AdministeredAt = time.Now()
+    }
+    if v.AdministeredAt.After(time.Now()) {
+        return newAPIError("future_date", "administeredAt")
+    }
+    if v.Dose < 0 {
+        return newAPIError("invalid_dose")
+    }
+    if v.Dose == 0 {
+        n, err := vaccinationCollection.CountDocuments(ctx, bson.M{"patientId": v.PatientID, "vaccine": v.Vaccine, "deletedAt": nil})
+        if err != nil {
+            return err
+        }
+        v.Dose = int(n) + 1
+    }
+    return nil
+}
+
+// Immunization handlers
+
+// patientVaccinationsHandler lists the vaccinations of a patient and
+// records them: GET, POST /patients/{id}/vaccinations
+func patientVaccinationsHandler(w http.ResponseWriter, r *http.Request) {
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        getVaccinations(w, r, patientID)
+    case http.MethodPost:
+        recordVaccination(w, r, patientID)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getVaccinations(w http.ResponseWriter, r *http.Request, patientID primitive.ObjectID) {
+    filter := bson.M{"patientId": patientID}
+    if vaccine := r.URL.Query().Get("vaccine"); vaccine != "" {
+        filter["vaccine"] = vaccine
+    }
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    vaccinations, err := vaccinationRepo.List(ctx, filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, vaccinations)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(vaccinations)
+}
+
+func recordVaccination(w http.ResponseWriter, r *http.Request, patientID primitive.ObjectID) {
+    var vaccination Vaccination
+    if !decodeJSON(w, r, &vaccination) {
+        return
+    }
+    vaccination.PatientID = patientID
+
+    ctx := r.Context()
+
+    if _, err := patientRepo.GetByID(ctx, patientID); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "patient_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := validateVaccination(ctx, &vaccination); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    if err := vaccinationRepo.Create(ctx, &vaccination); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            localizedError(w, r, http.StatusConflict, "dose_recorded", vaccination.Dose, vaccination.Vaccine)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(vaccination)
+}
+
+// getDueVaccinations lists the next doses a patient is due:
+// GET /patients/{id}/vaccinations/due
+func getDueVaccinations(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    patient, err := patientRepo.GetByID(ctx, patientID)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "patient_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    vaccinations, err := patientVaccinations(ctx, patientID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(dueDoses(patient, vaccinations, time.Now()))
+}
+
+// getVaccines lists the immunization schedule: GET /vaccines
+func getVaccines(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    vaccines := make([]Vaccine, len(vaccineCodes))
+    for i, code := range vaccineCodes {
+        vaccines[i] = vaccineSchedule[code]
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(vaccines)
+}
+
+// OverduePatient is a patient with overdue doses.
+type OverduePatient struct {
+    Patient PatientSummary `json:"patient"`
+    Overdue []DueDose      `json:"overdue"`
+}
+
+// overdueReportLimit bounds the patients of the overdue report.
+const overdueReportLimit = 1000
+
+// overdueBatchSize is the number of patients whose vaccinations are read at
+// once for the overdue report.
+const overdueBatchSize = 500
+
+// getOverdueReport lists the patients overdue for doses, for ?vaccine=, up
+// to ?limit=: GET /reports/immunizations/overdue
+func getOverdueReport(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := r.URL.Query()
+    vaccine := query.Get("vaccine")
+    if _, ok := vaccineSchedule[vaccine]; vaccine != "" && !ok {
+        localizedError(w, r, http.StatusBadRequest, "invalid_choice", "vaccine", strings.Join(vaccineCodes, ", "))
+        return
+    }
+    limit := overdueReportLimit
+    if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 {
+        limit = min(n, overdueReportLimit)
+    }
+
+    ctx := r.Context()
+
+    now := time.Now()
+    report := []OverduePatient{}
+    filter := bson.M{"deletedAt": nil, "anonymizedAt": nil}
+    for len(report) < limit {
+        patients, err := patientRepo.List(ctx, filter, Page{Number: 1, Size: overdueBatchSize})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if len(patients) == 0 {
+            break
+        }
+        filter["_id"] = bson.M{"$gt": patients[len(patients)-1].ID}
+
+        ids := make([]primitive.ObjectID, len(patients))
+        for i, patient := range patients {
+            ids[i] = patient.ID
+        }
+        vaccinations, err := vaccinationRepo.List(ctx, bson.M{"patientId": bson.M{"$in": ids}}, Page{})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        byPatient := map[primitive.ObjectID][]Vaccination{}
+        for _, v := range vaccinations {
+            byPatient[v.PatientID] = append(byPatient[v.PatientID], v)
+        }
+
+        for i := 0; i < len(patients) && len(report) < limit; i++ {
+            patient := &patients[i]
+            var overdue []DueDose
+            for _, dose := range dueDoses(patient, byPatient[patient.ID], now) {
+                if dose.Overdue && (vaccine == "" || dose.Vaccine == vaccine) {
+                    overdue = append(overdue, dose)
+                }
+            }
+            if len(overdue) == 0 {
+                continue
+            }
+            report = append(report, OverduePatient{
+                Patient: PatientSummary{ID: patient.ID, Name: patient.Name, Email: patient.Email, ContactNo: patient.ContactNo},
+                Overdue: overdue,
+            })
+            notePatientAccess(ctx, patient.ID)
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,200 @@
+// Package interactions checks medications against a table of drug
+// interactions and drug classes.
+//
+// Tables are text files. Interaction lines name two drugs or classes, a
+// severity and a description, separated by |:
+//
+//	warfarin | nsaid | severe | Increased risk of serious bleeding
+//
+// Class lines list the drugs of a class:
+//
+//	class nsaid: ibuprofen, naproxen
+//
+// A small table of common interactions is bundled; a local formulary can be
+// loaded with Load.
+package interactions
+
+import (
+    "bufio"
+    _ "embed"
+    "fmt"
+    "io"
+    "os"
+    "slices"
+    "strings"
+)
+
+//go:embed table.txt
+var bundled string
+
+// Severities of interactions
+const (
+    Minor    = "minor"
+    Moderate = "moderate"
+    Severe   = "severe"
+)
+
+// Interaction is a known interaction between two drugs or classes.
+type Interaction struct {
+    Between     [2]string `json:"between"`
+    Severity    string    `json:"severity"`
+    Description string    `json:"description"`
+}
+
+// Match is an interaction found between two medications.
+type Match struct {
+    Interaction
+    Medications [2]string `json:"medications"`
+}
+
+type Table struct {
+    interactions map[[2]string]Interaction // by names in order
+    classes      map[string][]string       // of drugs
+    known        map[string]bool           // drug and class names
+}
+
+// Bundled returns the table shipped with the service.
+func Bundled() *Table {
+    table, err := Parse(strings.NewReader(bundled))
+    if err != nil {
+        panic(fmt.Sprintf("interactions: bundled table: %v", err))
+    }
+    return table
+}
+
+// Load reads a table from a file.
+func Load(path string) (*Table, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return Parse(f)
+}
+
+func Parse(r io.Reader) (*Table, error) {
+    table := &Table{
+        interactions: map[[2]string]Interaction{},
+        classes:      map[string][]string{},
+        known:        map[string]bool{},
+    }
+
+    scanner := bufio.NewScanner(r)
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(scanner.Text())
+        if text == "" || strings.HasPrefix(text, "#") {
+            continue
+        }
+
+        if rest, ok := strings.CutPrefix(text, "class "); ok {
+            class, drugs, ok := strings.Cut(rest, ":")
+            class = Normalize(class)
+            if !ok || class == "" {
+                return nil, fmt.Errorf("line %d: expected class <name>: <drugs>", line)
+            }
+            table.known[class] = true
+            for _, drug := range strings.Split(drugs, ",") {
+                if drug = Normalize(drug); drug != "" {
+                    table.classes[drug] = append(table.classes[drug], class)
+                    table.known[drug] = true
+                }
+            }
+            continue
+        }
+
+        fields := strings.Split(text, "|")
+        if len(fields) != 4 {
+            return nil, fmt.Errorf("line %d: expected drug | drug | severity | description", line)
+        }
+        a, b := Normalize(fields[0]), Normalize(fields[1])
+        severity := Normalize(fields[2])
+        if a == "" || b == "" {
+            return nil, fmt.Errorf("line %d: missing drug", line)
+        }
+        if severity != Minor && severity != Moderate && severity != Severe {
+            return nil, fmt.Errorf("line %d: unknown severity %q", line, severity)
+        }
+        table.interactions[pair(a, b)] = Interaction{
+            Between:     [2]string{a, b},
+            Severity:    severity,
+            Description: strings.TrimSpace(fields[3]),
+        }
+        table.known[a], table.known[b] = true, true
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    return table, nil
+}
+
+// Normalize converts a drug name to the lower case form of the table.
+func Normalize(name string) string {
+    return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+func pair(a, b string) [2]string {
+    if a > b {
+        a, b = b, a
+    }
+    return [2]string{a, b}
+}
+
+// Identify returns the drugs and classes of the table a medication is,
+// such as amoxicillin and penicillin for "Amoxicillin 500 mg". Names of
+// several words match as a whole or by any of their words.
+func (t *Table) Identify(medication string) []string {
+    name := Normalize(medication)
+    candidates := []string{name}
+    words := strings.Fields(name)
+    for i := range words {
+        for j := i + 1; j <= len(words); j++ {
+            candidates = append(candidates, strings.Join(words[i:j], " "))
+        }
+    }
+
+    var names []string
+    for _, candidate := range candidates {
+        if !t.known[candidate] || slices.Contains(names, candidate) {
+            continue
+        }
+        names = append(names, candidate)
+        for _, class := range t.classes[candidate] {
+            if !slices.Contains(names, class) {
+                names = append(names, class)
+            }
+        }
+    }
+    return names
+}
+
+// Check returns the interactions between the medications, each pair once
+// at its most severe.
+func (t *Table) Check(medications []string) []Match {
+    identified := make([][]string, len(medications))
+    for i, medication := range medications {
+        identified[i] = t.Identify(medication)
+    }
+
+    var matches []Match
+    for i := range medications {
+        for j := i + 1; j < len(medications); j++ {
+            var found *Interaction
+            for _, a := range identified[i] {
+                for _, b := range identified[j] {
+                    interaction, ok := t.interactions[pair(a, b)]
+                    if ok && (found == nil || rank(interaction.Severity) > rank(found.Severity)) {
+                        found = &interaction
+                    }
+                }
+            }
+            if found != nil {
+                matches = append(matches, Match{Interaction: *found, Medications: [2]string{medications[i], medications[j]}})
+            }
+        }
+    }
+    return matches
+}
+
+func rank(severity string) int {
+    return slices.Index([]string{Minor, Moderate, Severe}, severity)
+}
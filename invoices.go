@@ -0,0 +1,147 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Invoice statuses. Charges accumulate on the patient's Open invoice until
+// it is issued.
+const (
+    InvoiceOpen   = "Open"
+    InvoiceIssued = "Issued"
+    InvoicePaid   = "Paid"
+)
+
+// LineItem is a single charge on an invoice. Amounts are in cents.
+type LineItem struct {
+    Description   string              `json:"description" bson:"description"`
+    AmountCents   int64               `json:"amountCents" bson:"amountCents"`
+    AppointmentID *primitive.ObjectID `json:"appointmentId,omitempty" bson:"appointmentId,omitempty"`
+    AddedAt       time.Time           `json:"addedAt" bson:"addedAt"`
+}
+
+type Invoice struct {
+    Document   `bson:",inline"`
+    PatientID  primitive.ObjectID `json:"patientId" bson:"patientId"`
+    Status     string             `json:"status" bson:"status"`
+    LineItems  []LineItem         `json:"lineItems" bson:"lineItems"`
+    TotalCents int64              `json:"totalCents" bson:"totalCents"`
+    IssuedAt   *time.Time         `json:"issuedAt,omitempty" bson:"issuedAt,omitempty"`
+}
+
+var (
+    invoiceCollection *mongo.Collection
+    invoiceRepo       *Repository[Invoice, *Invoice]
+)
+
+func initInvoices(db *mongo.Database) {
+    invoiceCollection = db.Collection("invoices")
+    invoiceRepo = NewRepository[Invoice](invoiceCollection, streamedHooks("invoices"))
+}
+
+// addToNextInvoice appends a charge to the patient's open invoice, opening
+// one if necessary, and returns the invoice id.
+func addToNextInvoice(ctx context.Context, patientID primitive.ObjectID, item LineItem) (primitive.ObjectID, error) {
+    now := time.Now()
+    actor := actorFromContext(ctx)
+    item.AddedAt = now
+
+    filter := bson.M{"patientId": patientID, "status": InvoiceOpen, "deletedAt": nil}
+    update := bson.M{
+        "$setOnInsert": bson.M{"createdAt": now, "createdBy": actor},
+        "$set":         bson.M{"updatedAt": now, "updatedBy": actor},
+        "$push":        bson.M{"lineItems": item},
+        "$inc":         bson.M{"totalCents": item.AmountCents},
+    }
+    opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+    var invoice Invoice
+    err := withTransaction(ctx, func(ctx context.Context) error {
+        if err := invoiceCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&invoice); err != nil {
+            return err
+        }
+        op := OpUpdate
+        if len(invoice.LineItems) == 1 {
+            // The first charge opened the invoice
+            op = OpCreate
+        }
+        return streamWrite(ctx, invoiceCollection.Name(), op, &invoice.Document)
+    })
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+    if err := auditWrite(ctx, invoiceCollection.Name(), OpUpdate, &invoice.Document); err != nil {
+        log.Printf("Error auditing invoice %s: %v\n", invoice.ID.Hex(), err)
+    }
+    return invoice.ID, nil
+}
+
+// Invoice handlers
+func getInvoice(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_invoice_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    invoice, err := invoiceRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "invoice_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    notePatientAccess(ctx, invoice.PatientID)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(invoice)
+}
+
+func getPatientInvoices(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    invoices, err := invoiceRepo.List(ctx, bson.M{"patientId": patientID}, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, invoices)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(invoices)
+}
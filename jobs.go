@@ -0,0 +1,36 @@
+package main
+
+import (
+    "context"
+    "log"
+    "time"
+)
+
+// runEvery runs job every interval until ctx is cancelled. Each run gets
+// its own timeout of one interval; failures are logged and retried on the
+// next tick. Runs are skipped while the service is read-only.
+func runEvery(ctx context.Context, name string, interval time.Duration, job func(context.Context) error) {
+    if interval <= 0 {
+        log.Printf("Job %s disabled\n", name)
+        return
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if readOnly() {
+                continue
+            }
+            runCtx, cancel := context.WithTimeout(ctx, interval)
+            if err := job(runCtx); err != nil {
+                log.Printf("Job %s failed: %v\n", name, err)
+            }
+            cancel()
+        }
+    }
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+    "net/http"
+    "regexp"
+
+    "new/i18n"
+)
+
+// languageTagPattern accepts BCP 47 language tags such as es or es-MX.
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// patientLanguage is the language patient communications are written in:
+// the patient's preferred language, else DEFAULT_LANGUAGE, else English.
+func patientLanguage(patient *Patient) string {
+    return i18n.Resolve(patient.Language, config.DefaultLanguage)
+}
+
+// documentLanguage is the language a document printed for a patient is
+// rendered in: ?lang=, else the patient's preferred language, else the
+// language of the request.
+func documentLanguage(r *http.Request, patient *Patient) string {
+    if lang, ok := i18n.Match(r.URL.Query().Get("lang")); ok {
+        return lang
+    }
+    if lang, ok := i18n.Match(patient.Language); ok {
+        return lang
+    }
+    return requestLanguage(r)
+}
+
+// language is the language of a notification: the patient's, or
+// DEFAULT_LANGUAGE for account emails.
+func (data notificationData) language() string {
+    if data.User == nil && data.Patient != nil {
+        return patientLanguage(data.Patient)
+    }
+    return i18n.Resolve(config.DefaultLanguage)
+}
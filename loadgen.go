@@ -0,0 +1,424 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// loadgen drives synthetic traffic at a running server: a mix of reads
+// and bookings at a steady rate, with bursts of bookings on one doctor's
+// day to contend for the same slots, then reports latency percentiles per
+// operation. It fails when the p99 or error rate exceed the given bounds,
+// to gate releases on the performance of the scheduling engine. Bookings
+// are real, so it is run against staging; they are cancelled at the end.
+type loadgen struct {
+    target   *url.URL
+    token    string
+    tenant   string
+    client   *http.Client
+    doctors  []Doctor
+    patients []Patient
+
+    mu        sync.Mutex
+    latencies map[string][]time.Duration
+    errors    map[string]int
+    conflicts map[string]int
+    booked    []string
+}
+
+// Outcomes of operations that are not errors
+var (
+    errNoSlot   = errors.New("no free slot")
+    errConflict = errors.New("conflict")
+)
+
+// loadgenCommand runs loadgen with the flags in args.
+func loadgenCommand(ctx context.Context, args []string) error {
+    flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+    target := flags.String("url", "", "base URL of the server to load")
+    token := flags.String("token", os.Getenv("LOADGEN_TOKEN"), "bearer token of a user allowed to book (default $LOADGEN_TOKEN)")
+    tenant := flags.String("tenant", "", "tenant to send in "+tenantHeader)
+    duration := flags.Duration("duration", time.Minute, "how long to run")
+    rate := flags.Float64("rate", 50, "operations per second")
+    workers := flags.Int("workers", 32, "concurrent operations at most")
+    reads := flags.Float64("reads", 0.8, "share of operations that are reads, the others book")
+    burstEvery := flags.Duration("burst-every", 30*time.Second, "interval of booking bursts, 0 for none")
+    burst := flags.Int("burst", 20, "concurrent bookings of a burst")
+    cleanup := flags.Bool("cleanup", true, "cancel the appointments booked")
+    maxP99 := flags.Duration("max-p99", 0, "fail if the p99 of an operation exceeds it, 0 for no bound")
+    maxErrors := flags.Float64("max-errors", 0.01, "fail if the share of failed operations exceeds it")
+    asJSON := flags.Bool("json", false, "print the report as JSON")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if *target == "" {
+        return errors.New("loadgen: -url is required")
+    }
+    base, err := url.Parse(strings.TrimSuffix(*target, "/"))
+    if err != nil {
+        return fmt.Errorf("loadgen: invalid -url: %v", err)
+    }
+    if *rate <= 0 || *workers <= 0 || *reads < 0 || *reads > 1 {
+        return errors.New("loadgen: -rate and -workers must be positive and -reads between 0 and 1")
+    }
+
+    g := &loadgen{
+        target:    base,
+        token:     *token,
+        tenant:    *tenant,
+        client:    &http.Client{Timeout: 30 * time.Second},
+        latencies: map[string][]time.Duration{},
+        errors:    map[string]int{},
+        conflicts: map[string]int{},
+    }
+    if err := g.loadFixtures(ctx); err != nil {
+        return fmt.Errorf("loadgen: %v", err)
+    }
+    fmt.Fprintf(os.Stderr, "Loading %s for %s at %.0f/s with %d doctors and %d patients\n",
+        base, *duration, *rate, len(g.doctors), len(g.patients))
+
+    runCtx, cancel := context.WithTimeout(ctx, *duration)
+    defer cancel()
+    started := time.Now()
+    dropped := g.run(runCtx, *rate, *workers, *reads, *burstEvery, *burst)
+    elapsed := time.Since(started)
+
+    if *cleanup {
+        g.cancelBooked(ctx)
+    }
+
+    report := g.report(elapsed, dropped)
+    if *asJSON {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        enc.Encode(report)
+    } else {
+        report.print(os.Stdout)
+    }
+    return report.check(*maxP99, *maxErrors)
+}
+
+// loadFixtures reads the doctors and patients operations pick from.
+func (g *loadgen) loadFixtures(ctx context.Context) error {
+    if err := g.getJSON(ctx, "", "/doctors", &g.doctors); err != nil {
+        return err
+    }
+    if err := g.getJSON(ctx, "", "/patients/list?pageSize=100", &g.patients); err != nil {
+        return err
+    }
+    if len(g.doctors) == 0 || len(g.patients) == 0 {
+        return errors.New("the target needs at least one doctor and one patient")
+    }
+    return nil
+}
+
+// run dispatches operations at rate until ctx is done and returns how
+// many were dropped because every worker was busy.
+func (g *loadgen) run(ctx context.Context, rate float64, workers int, reads float64, burstEvery time.Duration, burst int) int {
+    ops := make(chan func(context.Context), workers)
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for op := range ops {
+                op(ctx)
+            }
+        }()
+    }
+
+    ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+    defer ticker.Stop()
+    var bursts <-chan time.Time
+    if burstEvery > 0 && burst > 0 {
+        burstTicker := time.NewTicker(burstEvery)
+        defer burstTicker.Stop()
+        bursts = burstTicker.C
+    }
+
+    dropped := 0
+    dispatch := func(op func(context.Context)) {
+        select {
+        case ops <- op:
+        default:
+            dropped++
+        }
+    }
+    for {
+        select {
+        case <-ctx.Done():
+            close(ops)
+            wg.Wait()
+            return dropped
+        case <-ticker.C:
+            if rand.Float64() < reads {
+                dispatch(g.read)
+            } else {
+                dispatch(func(ctx context.Context) { g.book(ctx, g.randomDoctor(), randomDay(14)) })
+            }
+        case <-bursts:
+            // Bursts bypass the workers: they are the contention measured
+            doctor, day := g.randomDoctor(), randomDay(3)
+            for i := 0; i < burst; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    g.book(ctx, doctor, day)
+                }()
+            }
+        }
+    }
+}
+
+func (g *loadgen) randomDoctor() Doctor {
+    return g.doctors[rand.Intn(len(g.doctors))]
+}
+
+// randomDay returns one of the next days, from tomorrow.
+func randomDay(days int) time.Time {
+    today, _ := dayBounds(time.Now())
+    return today.AddDate(0, 0, 1+rand.Intn(days))
+}
+
+// read runs one of the reads of the mix.
+func (g *loadgen) read(ctx context.Context) {
+    patient := g.patients[rand.Intn(len(g.patients))]
+    switch rand.Intn(5) {
+    case 0:
+        g.getJSON(ctx, "list-doctors", "/doctors", nil)
+    case 1:
+        path := fmt.Sprintf("/doctors/%s/slots?date=%s", g.randomDoctor().ID.Hex(), randomDay(14).Format(time.DateOnly))
+        g.getJSON(ctx, "doctor-slots", path, nil)
+    case 2:
+        g.getJSON(ctx, "list-appointments", "/appointments/list?pageSize=20", nil)
+    case 3:
+        g.getJSON(ctx, "get-patient", "/patients/"+patient.ID.Hex(), nil)
+    default:
+        words := strings.Fields(patient.Name)
+        if len(words) == 0 {
+            words = []string{"a"}
+        }
+        g.getJSON(ctx, "search-patients", "/patients/search?q="+url.QueryEscape(words[len(words)-1]), nil)
+    }
+}
+
+// book books a free slot of the doctor on day as clients do: listing the
+// slots, holding one and booking it with the hold.
+func (g *loadgen) book(ctx context.Context, doctor Doctor, day time.Time) {
+    started := time.Now()
+    err := g.bookOnce(ctx, doctor, day)
+    if ctx.Err() == nil {
+        g.record("book", time.Since(started), err)
+    }
+}
+
+func (g *loadgen) bookOnce(ctx context.Context, doctor Doctor, day time.Time) error {
+    var slots struct {
+        Slots []time.Time `json:"slots"`
+    }
+    path := fmt.Sprintf("/doctors/%s/slots?date=%s", doctor.ID.Hex(), day.Format(time.DateOnly))
+    if err := g.getJSON(ctx, "doctor-slots", path, &slots); err != nil {
+        return err
+    }
+    if len(slots.Slots) == 0 {
+        return errNoSlot
+    }
+    slot := slots.Slots[rand.Intn(len(slots.Slots))]
+
+    var hold SlotHold
+    if err := g.postJSON(ctx, "hold-slot", "/slots/hold", map[string]interface{}{"doctorId": doctor.ID, "dateTime": slot}, &hold); err != nil {
+        return err
+    }
+    var appointment Appointment
+    err := g.postJSON(ctx, "create-appointment", "/appointments", map[string]interface{}{
+        "patientId":   g.patients[rand.Intn(len(g.patients))].ID,
+        "doctorId":    doctor.ID,
+        "dateTime":    slot,
+        "holdId":      hold.ID,
+        "description": "loadgen",
+    }, &appointment)
+    if err != nil {
+        return err
+    }
+    g.mu.Lock()
+    g.booked = append(g.booked, appointment.ID.Hex())
+    g.mu.Unlock()
+    return nil
+}
+
+// cancelBooked cancels the appointments booked during the run.
+func (g *loadgen) cancelBooked(ctx context.Context) {
+    failed := 0
+    for _, id := range g.booked {
+        if err := g.postJSON(ctx, "", "/appointments/"+id+"/cancel", map[string]string{"reason": "loadgen"}, nil); err != nil {
+            failed++
+        }
+    }
+    fmt.Fprintf(os.Stderr, "Cancelled %d of %d appointments booked\n", len(g.booked)-failed, len(g.booked))
+}
+
+func (g *loadgen) getJSON(ctx context.Context, op, path string, out interface{}) error {
+    return g.do(ctx, op, http.MethodGet, path, nil, out)
+}
+
+func (g *loadgen) postJSON(ctx context.Context, op, path string, body, out interface{}) error {
+    data, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+    return g.do(ctx, op, http.MethodPost, path, data, out)
+}
+
+// do sends a request and records its latency under op, unless op is empty
+// for requests outside the run. 409s, and 400s of slots taken meanwhile,
+// are conflicts rather than errors.
+func (g *loadgen) do(ctx context.Context, op, method, path string, body []byte, out interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, method, g.target.String()+path, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if g.token != "" {
+        req.Header.Set("Authorization", "Bearer "+g.token)
+    }
+    if g.tenant != "" {
+        req.Header.Set(tenantHeader, g.tenant)
+    }
+
+    started := time.Now()
+    resp, err := g.client.Do(req)
+    if err != nil {
+        if ctx.Err() != nil {
+            return err // the run ended: not a failure of the server
+        }
+        g.record(op, time.Since(started), err)
+        return err
+    }
+    defer resp.Body.Close()
+
+    switch {
+    case resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusBadRequest && op == "create-appointment":
+        err = errConflict
+    case resp.StatusCode >= 300:
+        message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        err = fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(message))
+    case out != nil:
+        err = json.NewDecoder(resp.Body).Decode(out)
+    default:
+        io.Copy(io.Discard, resp.Body)
+    }
+    g.record(op, time.Since(started), err)
+    return err
+}
+
+func (g *loadgen) record(op string, latency time.Duration, err error) {
+    if op == "" {
+        return
+    }
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    switch {
+    case errors.Is(err, errConflict), errors.Is(err, errNoSlot):
+        g.conflicts[op]++
+    case err != nil:
+        g.errors[op]++
+        if g.errors[op] <= 3 {
+            fmt.Fprintf(os.Stderr, "%s: %v\n", op, err)
+        }
+    }
+    g.latencies[op] = append(g.latencies[op], latency)
+}
+
+// Reporting
+
+// LoadgenStats are the results of an operation.
+type LoadgenStats struct {
+    Operation string        `json:"operation"`
+    Count     int           `json:"count"`
+    Errors    int           `json:"errors"`
+    Conflicts int           `json:"conflicts"` // slots taken or none free
+    P50       time.Duration `json:"p50"`
+    P90       time.Duration `json:"p90"`
+    P99       time.Duration `json:"p99"`
+    Max       time.Duration `json:"max"`
+}
+
+// LoadgenReport is the report of a run.
+type LoadgenReport struct {
+    Elapsed    time.Duration  `json:"elapsed"`
+    Throughput float64        `json:"throughput"` // requests per second
+    Dropped    int            `json:"dropped"`    // operations not started, every worker busy
+    Operations []LoadgenStats `json:"operations"`
+}
+
+func (g *loadgen) report(elapsed time.Duration, dropped int) LoadgenReport {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    report := LoadgenReport{Elapsed: elapsed, Dropped: dropped, Operations: []LoadgenStats{}}
+    requests := 0
+    for op, latencies := range g.latencies {
+        sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+        report.Operations = append(report.Operations, LoadgenStats{
+            Operation: op,
+            Count:     len(latencies),
+            Errors:    g.errors[op],
+            Conflicts: g.conflicts[op],
+            P50:       percentile(latencies, 50),
+            P90:       percentile(latencies, 90),
+            P99:       percentile(latencies, 99),
+            Max:       latencies[len(latencies)-1],
+        })
+        if op != "book" {
+            requests += len(latencies)
+        }
+    }
+    sort.Slice(report.Operations, func(i, j int) bool { return report.Operations[i].Operation < report.Operations[j].Operation })
+    report.Throughput = float64(requests) / elapsed.Seconds()
+    return report
+}
+
+// percentile returns the nearest-rank percentile p of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+    rank := (p*len(sorted) + 99) / 100
+    return sorted[max(rank, 1)-1]
+}
+
+func (r LoadgenReport) print(w io.Writer) {
+    fmt.Fprintf(w, "%-20s %8s %7s %9s %9s %9s %9s %9s\n", "operation", "count", "errors", "conflicts", "p50", "p90", "p99", "max")
+    for _, s := range r.Operations {
+        fmt.Fprintf(w, "%-20s %8d %7d %9d %9s %9s %9s %9s\n", s.Operation, s.Count, s.Errors, s.Conflicts,
+            s.P50.Round(time.Millisecond/10), s.P90.Round(time.Millisecond/10), s.P99.Round(time.Millisecond/10), s.Max.Round(time.Millisecond/10))
+    }
+    fmt.Fprintf(w, "%.1f requests/s over %s, %d operations dropped\n", r.Throughput, r.Elapsed.Round(time.Second), r.Dropped)
+}
+
+// check fails when an operation's p99 exceeds maxP99 or the share of
+// failed operations exceeds maxErrors.
+func (r LoadgenReport) check(maxP99 time.Duration, maxErrors float64) error {
+    count, failed := 0, 0
+    for _, s := range r.Operations {
+        if maxP99 > 0 && s.P99 > maxP99 {
+            return fmt.Errorf("loadgen: p99 of %s is %s, over %s", s.Operation, s.P99, maxP99)
+        }
+        count += s.Count
+        failed += s.Errors
+    }
+    if count > 0 && float64(failed)/float64(count) > maxErrors {
+        return fmt.Errorf("loadgen: %d of %d operations failed", failed, count)
+    }
+    return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "net/textproto"
+    "slices"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+
+    "new/email"
+    "new/i18n"
+    "new/resilience"
+)
+
+var (
+    emailTemplates *email.Templates
+    mailer         *email.Sender // nil without SMTP_ADDR
+)
+
+func initEmail() {
+    templates, err := email.LoadTemplates(config.EmailBrand)
+    if err != nil {
+        log.Fatalf("Error loading email templates: %v", err)
+    }
+    emailTemplates = templates
+
+    if config.SMTPAddr != "" {
+        mailer = email.NewSender(email.SMTPConfig{
+            Addr:     config.SMTPAddr,
+            Username: config.SMTPUsername,
+            Password: config.SMTPPassword,
+            From:     config.SMTPFrom,
+            PoolSize: int(config.SMTPPoolSize),
+            Timeout:  emailPolicy.Timeout,
+        })
+    }
+}
+
+// sendEmail renders the template name and sends it to the patient, or to
+// the user of account emails. Without SMTP_ADDR emails are dropped.
+func sendEmail(name string, data notificationData, attachments ...email.Attachment) error {
+    to := ""
+    if data.User != nil {
+        to = data.User.Email
+    } else if data.Patient != nil {
+        to = data.Patient.Email
+    }
+    if mailer == nil || to == "" {
+        return nil
+    }
+
+    msg, err := emailTemplates.Render(data.language(), name, data)
+    if err != nil {
+        return err
+    }
+    msg.To = []string{to}
+    msg.Attachments = attachments
+    return emailPolicy.Do(context.Background(), func(context.Context) error {
+        err := mailer.Send(msg)
+        var reply *textproto.Error
+        if errors.As(err, &reply) && reply.Code >= 500 {
+            // Rejected, e.g. an unknown recipient
+            return resilience.Permanent(err)
+        }
+        return err
+    })
+}
+
+// emailNotifier notifies patients by email, for the kinds of notification
+// that have an email template. Confirmations carry a calendar invite.
+type emailNotifier struct{}
+
+func (emailNotifier) Channel() string { return "email" }
+
+func (emailNotifier) Notify(ctx context.Context, kind string, data notificationData) error {
+    if !slices.Contains(emailTemplates.Names(), kind) {
+        return nil
+    }
+
+    var attachments []email.Attachment
+    if kind == "confirmation" && data.Appointment != nil {
+        attachments = append(attachments, appointmentInvite(data.language(), data.Appointment, data.Doctor))
+    }
+    return sendEmail(kind, data, attachments...)
+}
+
+// Email admin handlers
+func getEmailTemplates(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(emailTemplates.Names())
+}
+
+// previewEmailTemplate renders a template with sample data, in ?lang= or
+// the language of the request:
+// GET /admin/email/templates/reminder/preview?lang=es
+func previewEmailTemplate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    lang := requestLanguage(r)
+    if q := r.URL.Query().Get("lang"); i18n.Supported(q) {
+        lang = q
+    }
+
+    name := r.PathValue("name")
+    if !slices.Contains(emailTemplates.Names(), name) {
+        localizedError(w, r, http.StatusNotFound, "email_template_not_found", name)
+        return
+    }
+    msg, err := emailTemplates.Render(lang, name, sampleEmailData())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    // Emails are styled inline
+    w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src https: data:")
+    w.Header().Set("Content-Language", lang)
+    w.Header().Set("X-Email-Subject", msg.Subject)
+    w.Write([]byte(msg.HTML))
+}
+
+func sampleEmailData() notificationData {
+    at := time.Now().AddDate(0, 0, 1).Truncate(time.Hour)
+    appointmentID := primitive.NewObjectID()
+    return notificationData{
+        Patient: &Patient{Name: "Jane Doe", Email: "jane.doe@example.com"},
+        Doctor:  &Doctor{Name: "John Smith", Specialization: "cardiology", Department: "Cardiology"},
+        Appointment: &Appointment{
+            Document: Document{ID: appointmentID},
+            DateTime: at,
+            Status:   StatusScheduled,
+        },
+        Invoice: &Invoice{
+            Document: Document{ID: primitive.NewObjectID()},
+            Status:   InvoiceOpen,
+            LineItems: []LineItem{
+                {Description: "Consultation", AmountCents: 8000, AppointmentID: &appointmentID, AddedAt: at},
+                {Description: "Blood panel", AmountCents: 4550, AppointmentID: &appointmentID, AddedAt: at},
+            },
+            TotalCents: 12550,
+        },
+        User:     &User{Name: "John Smith", Email: "john.smith@example.com", Role: RoleDoctor},
+        ResetURL: config.PublicURL + "/reset-password?token=sample",
+        SavedSearch: &SavedSearchDigest{
+            Name:    "Tomorrow's cardiology appointments",
+            Columns: []string{"Time", "Patient", "Doctor", "Status"},
+            Rows:    [][]string{{at.Format(time.DateTime), "Jane Doe", "John Smith", StatusScheduled}},
+            Total:   1,
+            URL:     config.PublicURL + "/saved-searches/sample/results",
+        },
+        Waitlist: &WaitlistEntry{
+            Document: Document{ID: primitive.NewObjectID()},
+            Date:     at.Format(time.DateOnly),
+            Status:   WaitlistOffered,
+            Offer:    &WaitlistOffer{DateTime: at, OfferedAt: time.Now(), ExpiresAt: time.Now().Add(config.WaitlistOfferWindow)},
+        },
+        PortalURL: config.PublicURL + "/portal?waitlist=sample",
+        Outreach: &Outreach{Subject: "Flu vaccination", Message: "Flu vaccines are now available. Reply to book yours."},
+    }
+}
@@ -3,54 +3,113 @@ package main
 import (
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
     "net/http"
+    "os"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
     "time"
 
     "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/i18n"
+    "new/phonetic"
 )
 
 // Models
 type Patient struct {
-    ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-    Name        string            `json:"name" bson:"name"`
-    Email       string            `json:"email" bson:"email"`
-    Age         int               `json:"age" bson:"age"`
-    Gender      string            `json:"gender" bson:"gender"`
-    BloodGroup  string            `json:"bloodGroup" bson:"bloodGroup"`
-    ContactNo   string            `json:"contactNo" bson:"contactNo"`
-    CreatedAt   time.Time         `json:"createdAt" bson:"createdAt"`
+    Document     `bson:",inline"`
+    Name         string            `json:"name" bson:"name"`
+    Email        string            `json:"email" bson:"email"`
+    Age          int               `json:"age" bson:"age"`
+    Gender       string            `json:"gender" bson:"gender"`
+    BloodGroup   string            `json:"bloodGroup" bson:"bloodGroup"`
+    ContactNo    string            `json:"contactNo" bson:"contactNo"`
+    TenantID     string            `json:"tenantId,omitempty" bson:"tenantId,omitempty"`
+    Language     string            `json:"language,omitempty" bson:"language,omitempty"` // preferred, e.g. es or es-MX
+    Custom       map[string]interface{} `json:"custom,omitempty" bson:"custom,omitempty"` // defined by CustomField
+    Tags         []string          `json:"tags,omitempty" bson:"tags,omitempty"`
+    Allergies    []string          `json:"allergies,omitempty" bson:"allergies,omitempty"` // drugs or classes, e.g. penicillin
+    AnonymizedAt *time.Time        `json:"anonymizedAt,omitempty" bson:"anonymizedAt,omitempty"` // by the retention policy
+    NameKeys     []string          `json:"-" bson:"nameKeys,omitempty"` // phonetic keys of the name, for search
+    Address      string            `json:"address,omitempty" bson:"address,omitempty"`
+    Location     *GeoPoint         `json:"location,omitempty" bson:"location,omitempty"` // geocoded from Address
+    GeocodedAddress string         `json:"-" bson:"geocodedAddress,omitempty"`
 }
 
 type Doctor struct {
-    ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    Document     `bson:",inline"`
     Name         string            `json:"name" bson:"name"`
     Email        string            `json:"email" bson:"email"`
     Specialization string          `json:"specialization" bson:"specialization"`
     Department    string           `json:"department" bson:"department"`
     ContactNo    string            `json:"contactNo" bson:"contactNo"`
-    CreatedAt    time.Time         `json:"createdAt" bson:"createdAt"`
+    CalendarToken string           `json:"-" bson:"calendarToken,omitempty"`
+    FacilityID   *primitive.ObjectID `json:"facilityId,omitempty" bson:"facilityId,omitempty"` // where they see patients
 }
 
 type Appointment struct {
-    ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-    PatientID   primitive.ObjectID `json:"patientId" bson:"patientId"`
-    DoctorID    primitive.ObjectID `json:"doctorId" bson:"doctorId"`
-    DateTime    time.Time          `json:"dateTime" bson:"dateTime"`
-    Status      string            `json:"status" bson:"status"` // Scheduled, Completed, Cancelled
-    Description string            `json:"description" bson:"description"`
-    CreatedAt   time.Time         `json:"createdAt" bson:"createdAt"`
+    Document           `bson:",inline"`
+    PatientID          primitive.ObjectID `json:"patientId" bson:"patientId"`
+    DoctorID           primitive.ObjectID `json:"doctorId" bson:"doctorId"`
+    DateTime           time.Time          `json:"dateTime" bson:"dateTime"`
+    Status             string             `json:"status" bson:"status"` // Scheduled, CheckedIn, Completed, Cancelled, NoShow
+    Description        string             `json:"description" bson:"description"`
+    Mode               string             `json:"mode" bson:"mode"` // in_person or video
+    HoldID             *primitive.ObjectID `json:"holdId,omitempty" bson:"-"` // SlotHold booked with
+    Video              *VideoRoom         `json:"video,omitempty" bson:"video,omitempty"`
+    Custom             map[string]interface{} `json:"custom,omitempty" bson:"custom,omitempty"` // defined by CustomField
+    CheckedInAt        *time.Time         `json:"checkedInAt,omitempty" bson:"checkedInAt,omitempty"`
+    CancelledAt        *time.Time         `json:"cancelledAt,omitempty" bson:"cancelledAt,omitempty"`
+    CancellationReason string             `json:"cancellationReason,omitempty" bson:"cancellationReason,omitempty"`
+    ReminderSentAt     *time.Time         `json:"reminderSentAt,omitempty" bson:"reminderSentAt,omitempty"`
+    CalendarEventID    string             `json:"-" bson:"calendarEventId,omitempty"`
+}
+
+// Appointment statuses
+const (
+    StatusScheduled = "Scheduled"
+    StatusCheckedIn = "CheckedIn"
+    StatusCompleted = "Completed"
+    StatusCancelled = "Cancelled"
+    StatusNoShow    = "NoShow"
+)
+
+// Summaries embedded into expanded appointment views
+type PatientSummary struct {
+    ID        primitive.ObjectID `json:"id" bson:"_id"`
+    Name      string            `json:"name" bson:"name"`
+    Email     string            `json:"email" bson:"email"`
+    ContactNo string            `json:"contactNo" bson:"contactNo"`
+}
+
+type DoctorSummary struct {
+    ID             primitive.ObjectID `json:"id" bson:"_id"`
+    Name           string            `json:"name" bson:"name"`
+    Specialization string            `json:"specialization" bson:"specialization"`
+    Department     string            `json:"department" bson:"department"`
+}
+
+type AppointmentView struct {
+    Appointment `bson:",inline"`
+    Patient     *PatientSummary `json:"patient,omitempty" bson:"patient,omitempty"`
+    Doctor      *DoctorSummary  `json:"doctor,omitempty" bson:"doctor,omitempty"`
+    StatusLabel string          `json:"statusLabel,omitempty" bson:"-"`
 }
 
 type Department struct {
-    ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-    Name        string            `json:"name" bson:"name"`
-    Description string            `json:"description" bson:"description"`
-    CreatedAt   time.Time         `json:"createdAt" bson:"createdAt"`
+    Document       `bson:",inline"`
+    Name           string           `json:"name" bson:"name"`
+    Description    string           `json:"description" bson:"description"`
+    OperatingHours []OperatingHours `json:"operatingHours,omitempty" bson:"operatingHours,omitempty"`
+    Capacity       *Capacity        `json:"capacity,omitempty" bson:"capacity,omitempty"`
 }
 
 // Database collections
@@ -60,15 +119,31 @@ var (
     doctorCollection *mongo.Collection
     appointmentCollection *mongo.Collection
     departmentCollection *mongo.Collection
+    auditCollection *mongo.Collection
+
+    patientRepo *Repository[Patient, *Patient]
+    doctorRepo *Repository[Doctor, *Doctor]
+    appointmentRepo *Repository[Appointment, *Appointment]
+    departmentRepo *Repository[Department, *Department]
 )
 
 func init() {
+    config = loadConfig()
+    initOutbound()
+
+    // Commands that only talk to a server over HTTP need no database
+    if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+        return
+    }
+
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-    var err error
-    
+    clientOptions, err := mongoClientOptions()
+    if err != nil {
+        log.Fatal(err)
+    }
+
     client, err = mongo.Connect(ctx, clientOptions)
     if err != nil {
         log.Fatal(err)
@@ -80,16 +155,61 @@ func init() {
     }
 
     fmt.Println("Connected to MongoDB!")
+    detectTransactions(ctx)
 
     // Initialize collections
-    db := client.Database("hospitaldb")
+    db := client.Database(config.MongoDatabase)
     patientCollection = db.Collection("patients")
     doctorCollection = db.Collection("doctors")
     appointmentCollection = db.Collection("appointments")
     departmentCollection = db.Collection("departments")
+    auditCollection = db.Collection("audit_log")
+
+    patientRepo = NewRepository[Patient](patientCollection, streamedHooks("patients"))
+    doctorRepo = NewRepository[Doctor](doctorCollection, defaultHooks)
+    appointmentRepo = NewRepository[Appointment](appointmentCollection, streamedHooks("appointments"))
+    departmentRepo = NewRepository[Department](departmentCollection, defaultHooks)
 
     // Create indexes
     createIndexes(ctx)
+
+    initAuth(ctx, db)
+    initAccessLogs(ctx, db)
+    initRetention(ctx, db)
+    initBackups(ctx, db)
+    initFeatureFlags(ctx, db)
+    initServiceMode(ctx, db)
+    initSpecializations(ctx, db)
+    initRecords(ctx, db)
+    initConsents(ctx, db)
+    initInvoices(db)
+    initPrescriptions(ctx, db)
+    initEmail()
+    initNotifications(ctx, db)
+    initDeadLetters(ctx, db)
+    initOutbox(ctx, db)
+    initStreaming()
+    initVideo()
+    initDevices(ctx, db)
+    initCustomFields(ctx, db)
+    initSlotHolds(ctx, db)
+    initCapacity(ctx, db)
+    initWaitlist(ctx, db)
+    initTags(ctx, db)
+    initSavedSearches(ctx, db)
+    initWards(ctx, db)
+    initImmunizations(ctx, db)
+    initCareTeams(ctx, db)
+    initCommunications(ctx, db)
+    initAttachments(ctx, db)
+    initFacilities(ctx, db)
+    initRules(ctx, db)
+    initQuotas(ctx, db)
+    initProjections(ctx, db)
+    initCalendar(ctx, db)
+    initGoogleCalendar(ctx, db)
+    initWarehouse(ctx, db)
+    initSchemas(ctx, db)
 }
 
 func createIndexes(ctx context.Context) {
@@ -103,6 +223,13 @@ func createIndexes(ctx context.Context) {
         log.Printf("Error creating patient index: %v\n", err)
     }
 
+    // Patient phonetic name index
+    nameKeysIndex := mongo.IndexModel{Keys: bson.D{{Key: "nameKeys", Value: 1}}}
+    _, err = patientCollection.Indexes().CreateOne(ctx, nameKeysIndex)
+    if err != nil {
+        log.Printf("Error creating patient name index: %v\n", err)
+    }
+
     // Doctor email index
     doctorIndex := mongo.IndexModel{
         Keys:    bson.D{{Key: "email", Value: 1}},
@@ -112,6 +239,15 @@ func createIndexes(ctx context.Context) {
     if err != nil {
         log.Printf("Error creating doctor index: %v\n", err)
     }
+
+    // Doctor day queue index
+    queueIndex := mongo.IndexModel{
+        Keys: bson.D{{Key: "doctorId", Value: 1}, {Key: "status", Value: 1}, {Key: "dateTime", Value: 1}},
+    }
+    _, err = appointmentCollection.Indexes().CreateOne(ctx, queueIndex)
+    if err != nil {
+        log.Printf("Error creating appointment index: %v\n", err)
+    }
 }
 
 // Patient handlers
@@ -122,51 +258,255 @@ func createPatient(w http.ResponseWriter, r *http.Request) {
     }
 
     var patient Patient
-    if err := json.NewDecoder(r.Body).Decode(&patient); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    if !decodeJSON(w, r, &patient) {
         return
     }
 
-    patient.CreatedAt = time.Now()
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
+    ctx := r.Context()
 
-    result, err := patientCollection.InsertOne(ctx, patient)
-    if err != nil {
+    if err := validatePatient(ctx, &patient); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    // A given location is taken as that of the address
+    if patient.Location != nil {
+        patient.GeocodedAddress = patient.Address
+    }
+
+    if err := patientRepo.Create(ctx, &patient); err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
-    patient.ID = result.InsertedID.(primitive.ObjectID)
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(patient)
 }
 
+func validatePatient(ctx context.Context, patient *Patient) error {
+    if patient.Language != "" && !languageTagPattern.MatchString(patient.Language) {
+        return newAPIError("invalid_language")
+    }
+    tags, err := normalizeTags(ctx, patient.Tags)
+    if err != nil {
+        return err
+    }
+    patient.Tags = tags
+    patient.Allergies = normalizeAllergies(patient.Allergies)
+    patient.NameKeys = phonetic.Keys(patient.Name)
+    patient.Address = strings.TrimSpace(patient.Address)
+    if patient.Location != nil {
+        if err := patient.Location.validate(); err != nil {
+            return err
+        }
+    }
+    return validateCustom(ctx, patient.TenantID, "patients", patient.Custom)
+}
+
 func getPatients(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodGet {
         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         return
     }
 
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
+    filter, err := customFilter(r, "patients")
+    if err == nil {
+        err = applyQueryFilter(r, filter, patientFilterSchema)
+    }
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
 
-    cursor, err := patientCollection.Find(ctx, bson.M{})
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    patients, err := patientRepo.List(ctx, filter, page)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    for _, patient := range patients {
+        notePatientAccess(ctx, patient.ID)
+    }
+
+    setNextPage(w, r, page, patients)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(patients)
+}
+
+// maxNameCandidates bounds the patients sharing a phonetic key with a
+// search that are ranked.
+const maxNameCandidates = 500
+
+// PatientMatch is a result of a name search.
+type PatientMatch struct {
+    Patient
+    Score float64 `json:"score"` // 1 when every word of the query is in the name as spelt
+}
+
+// searchPatients finds patients by the sound of their name, so misspelt
+// names are found, best matches first:
+// GET /patients/search?q=jon+smyth&limit=20. ?filter= narrows the search
+// as on /patients/list.
+func searchPatients(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    query := r.URL.Query().Get("q")
+    if strings.TrimSpace(query) == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "q")
+        return
+    }
+    limit := 20
+    if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+        limit = min(n, 100)
+    }
+
+    filter := bson.M{"nameKeys": bson.M{"$in": phonetic.Keys(query)}}
+    if err := applyQueryFilter(r, filter, patientFilterSchema); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    candidates, err := patientRepo.List(ctx, filter, Page{Size: maxNameCandidates})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    matches := make([]PatientMatch, 0, len(candidates))
+    for _, patient := range candidates {
+        if score := phonetic.Score(query, patient.Name); score > 0 {
+            matches = append(matches, PatientMatch{Patient: patient, Score: score})
+        }
+    }
+    sort.SliceStable(matches, func(i, j int) bool {
+        if matches[i].Score != matches[j].Score {
+            return matches[i].Score > matches[j].Score
+        }
+        return matches[i].Name < matches[j].Name
+    })
+    matches = matches[:min(limit, len(matches))]
+    for _, match := range matches {
+        notePatientAccess(ctx, match.ID)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(matches)
+}
+
+// indexPatientNames recomputes the phonetic keys of every patient name,
+// for patients stored before names were indexed. It returns the number of
+// patients updated.
+func indexPatientNames(ctx context.Context) (int, error) {
+    cursor, err := patientCollection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"name": 1, "nameKeys": 1}))
+    if err != nil {
+        return 0, err
+    }
     defer cursor.Close(ctx)
 
-    var patients []Patient
-    if err = cursor.All(ctx, &patients); err != nil {
+    updated := 0
+    var batch []mongo.WriteModel
+    flush := func() error {
+        if len(batch) == 0 {
+            return nil
+        }
+        _, err := patientCollection.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+        updated += len(batch)
+        batch = batch[:0]
+        return err
+    }
+    for cursor.Next(ctx) {
+        var patient Patient
+        if err := cursor.Decode(&patient); err != nil {
+            return updated, err
+        }
+        keys := phonetic.Keys(patient.Name)
+        if slices.Equal(keys, patient.NameKeys) {
+            continue
+        }
+        batch = append(batch, mongo.NewUpdateOneModel().
+            SetFilter(bson.M{"_id": patient.ID}).
+            SetUpdate(bson.M{"$set": bson.M{"nameKeys": keys}}))
+        if len(batch) == 500 {
+            if err := flush(); err != nil {
+                return updated, err
+            }
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return updated, err
+    }
+    return updated, flush()
+}
+
+func getPatient(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    patient, err := patientRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "patient_not_found")
+            return
+        }
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    notePatientAccess(ctx, patient.ID)
+    if notModified(w, r, &patient.Document) {
+        return
+    }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(patients)
+    json.NewEncoder(w).Encode(patient)
+}
+
+// patchPatient updates a patient with a JSON Merge Patch.
+func patchPatient(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    patient, ok := patchDocument(w, r, patientRepo, id, patchable[Patient]{
+        notFound: "patient_not_found",
+        readOnly: []string{"tenantId", "anonymizedAt", "location"},
+        check:    validatePatient,
+        derived:  []string{"nameKeys"},
+    })
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(patient)
+}
+
+func patient(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getPatient(w, r)
+    case http.MethodPatch:
+        patchPatient(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
 }
 
 // Doctor handlers
@@ -177,27 +517,143 @@ func createDoctor(w http.ResponseWriter, r *http.Request) {
     }
 
     var doctor Doctor
-    if err := json.NewDecoder(r.Body).Decode(&doctor); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    if !decodeJSON(w, r, &doctor) {
         return
     }
 
-    doctor.CreatedAt = time.Now()
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
+    ctx := r.Context()
 
-    result, err := doctorCollection.InsertOne(ctx, doctor)
-    if err != nil {
+    if err := validateDoctor(ctx, &doctor); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    if err := doctorRepo.Create(ctx, &doctor); err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
-    doctor.ID = result.InsertedID.(primitive.ObjectID)
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(doctor)
 }
 
+// validateDoctor normalizes the specialization of a doctor and checks it
+// and their facility.
+func validateDoctor(ctx context.Context, doctor *Doctor) error {
+    doctor.Specialization = normalizeSpecialization(doctor.Specialization)
+    if err := validateSpecialization(ctx, doctor.Specialization); err != nil {
+        return err
+    }
+    return validateFacilityID(ctx, doctor.FacilityID)
+}
+
+// getDoctors lists doctors, optionally narrowed by ?specialization= and
+// ?department=.
+func getDoctors(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    filter := bson.M{}
+    if specialization := r.URL.Query().Get("specialization"); specialization != "" {
+        filter["specialization"] = normalizeSpecialization(specialization)
+    }
+    if department := r.URL.Query().Get("department"); department != "" {
+        filter["department"] = department
+    }
+    if err := applyQueryFilter(r, filter, doctorFilterSchema); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    doctors, err := doctorRepo.List(ctx, filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, doctors)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(doctors)
+}
+
+func getDoctor(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_doctor_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    doctor, err := doctorRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "doctor_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if notModified(w, r, &doctor.Document) {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(doctor)
+}
+
+// patchDoctor updates a doctor with a JSON Merge Patch.
+func patchDoctor(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_doctor_id")
+        return
+    }
+
+    doctor, ok := patchDocument(w, r, doctorRepo, id, patchable[Doctor]{
+        notFound: "doctor_not_found",
+        check:    validateDoctor,
+    })
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(doctor)
+}
+
+func doctor(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getDoctor(w, r)
+    case http.MethodPatch:
+        patchDoctor(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func doctors(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getDoctors(w, r)
+    case http.MethodPost:
+        createDoctor(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
 // Appointment handlers
 func createAppointment(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
@@ -206,51 +662,350 @@ func createAppointment(w http.ResponseWriter, r *http.Request) {
     }
 
     var appointment Appointment
-    if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    if !decodeJSON(w, r, &appointment) {
         return
     }
 
-    appointment.CreatedAt = time.Now()
-    appointment.Status = "Scheduled"
+    appointment.Status = StatusScheduled
+    appointment.Video = nil
     
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
+    ctx := r.Context()
 
     // Validate patient and doctor existence
     if err := validateAppointment(ctx, &appointment); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        writeError(w, r, http.StatusBadRequest, err)
         return
     }
 
-    result, err := appointmentCollection.InsertOne(ctx, appointment)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    if err := bookAppointment(ctx, &appointment); err != nil {
+        writeBookingError(w, r, err)
         return
     }
+    go notifyAppointment("confirmation", appointment)
+    go syncAppointmentCalendar(appointment)
 
-    appointment.ID = result.InsertedID.(primitive.ObjectID)
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(appointment)
 }
 
+// bookAppointment creates a validated appointment. Booking consumes the
+// hold on the slot and a booking of the quotas of the patient's tenant and
+// of the user booking.
+func bookAppointment(ctx context.Context, appointment *Appointment) error {
+    return withTransaction(ctx, func(ctx context.Context) error {
+        if err := claimSlotHold(ctx, appointment); err != nil {
+            return err
+        }
+        if err := reserveCapacity(ctx, appointment); err != nil {
+            return err
+        }
+        patient, err := patientRepo.GetByID(ctx, appointment.PatientID)
+        if err != nil {
+            return err
+        }
+        if err := chargeQuota(ctx, patient.TenantID, actorFromContext(ctx), QuotaAppointments, 1); err != nil {
+            return err
+        }
+        return appointmentRepo.Create(ctx, appointment)
+    })
+}
+
+// writeBookingError answers an error of bookAppointment.
+func writeBookingError(w http.ResponseWriter, r *http.Request, err error) {
+    var exceeded *quotaExceeded
+    if errors.As(err, &exceeded) {
+        writeQuotaError(w, r, exceeded)
+        return
+    }
+    var apiErr *apiError
+    if errors.As(err, &apiErr) {
+        status := http.StatusBadRequest
+        if apiErr.key == "hold_expired" {
+            status = http.StatusConflict
+        }
+        writeError(w, r, status, err)
+        return
+    }
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
 func validateAppointment(ctx context.Context, appointment *Appointment) error {
     // Check if patient exists
-    var patient Patient
-    err := patientCollection.FindOne(ctx, bson.M{"_id": appointment.PatientID}).Decode(&patient)
+    patient, err := patientRepo.GetByID(ctx, appointment.PatientID)
     if err != nil {
-        return fmt.Errorf("patient not found")
+        return newAPIError("patient_not_found")
     }
 
     // Check if doctor exists
-    var doctor Doctor
-    err = doctorCollection.FindOne(ctx, bson.M{"_id": appointment.DoctorID}).Decode(&doctor)
+    doctor, err := doctorRepo.GetByID(ctx, appointment.DoctorID)
+    if err != nil {
+        return newAPIError("doctor_not_found")
+    }
+
+    // Check the department is open
+    if err := checkOperatingHours(ctx, doctor, appointment.DateTime); err != nil {
+        return err
+    }
+
+    if err := checkCapacity(ctx, doctor, appointment); err != nil {
+        return err
+    }
+
+    if err := validateMode(appointment); err != nil {
+        return err
+    }
+    if err := validateCustom(ctx, patient.TenantID, "appointments", appointment.Custom); err != nil {
+        return err
+    }
+    return checkRules(ctx, patient.TenantID, appointmentRuleSubject(patient, doctor, appointment))
+}
+
+func getAppointments(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    expand, err := parseExpand(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    filter, err := customFilter(r, "appointments")
+    if err == nil {
+        err = applyQueryFilter(r, filter, appointmentFilterSchema)
+    }
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    query := r.URL.Query()
+    if date := query.Get("date"); date != "" {
+        day, err := parseDay(date)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_date", "date")
+            return
+        }
+        start, end := dayBounds(day)
+        filter["dateTime"] = bson.M{"$gte": start, "$lt": end}
+    }
+    if status := query.Get("status"); status != "" {
+        filter["status"] = status
+    }
+    if doctorID := query.Get("doctorId"); doctorID != "" {
+        id, err := primitive.ObjectIDFromHex(doctorID)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_doctor_id")
+            return
+        }
+        filter["doctorId"] = id
+    }
+    // The appointments of a day are listed whole unless paged
+    page := Page{}
+    if query.Has("page") || query.Has("pageSize") || query.Has("cursor") {
+        if page, err = parsePage(r); err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return
+        }
+    }
+
+    ctx := r.Context()
+
+    if department := query.Get("department"); department != "" && filter["doctorId"] == nil {
+        doctors, err := doctorRepo.List(ctx, bson.M{"department": department}, Page{})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        ids := make([]primitive.ObjectID, len(doctors))
+        for i, doctor := range doctors {
+            ids[i] = doctor.ID
+        }
+        filter["doctorId"] = bson.M{"$in": ids}
+    }
+
+    appointments, err := findAppointmentViews(ctx, filter, expand, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    for _, appointment := range appointments {
+        notePatientAccess(ctx, appointment.PatientID)
+    }
+    labelStatuses(appointments, requestLanguage(r))
+
+    setNextCursor(w, r, page, len(appointments), func() Cursor {
+        last := appointments[len(appointments)-1]
+        return Cursor{Key: last.DateTime, ID: last.ID}
+    })
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Language", requestLanguage(r))
+    json.NewEncoder(w).Encode(appointments)
+}
+
+func getAppointment(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_appointment_id")
+        return
+    }
+
+    expand, err := parseExpand(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    appointments, err := findAppointmentViews(ctx, bson.M{"_id": id}, expand, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if len(appointments) == 0 {
+        localizedError(w, r, http.StatusNotFound, "appointment_not_found")
+        return
+    }
+    notePatientAccess(ctx, appointments[0].PatientID)
+    if notModified(w, r, &appointments[0].Document) {
+        return
+    }
+    labelStatuses(appointments, requestLanguage(r))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Language", requestLanguage(r))
+    json.NewEncoder(w).Encode(appointments[0])
+}
+
+// patchAppointment updates a scheduled appointment with a JSON Merge
+// Patch. Status changes have their own routes, and the slot is fixed since
+// it was claimed through a hold: rescheduling is a cancel and a new booking.
+func patchAppointment(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
     if err != nil {
-        return fmt.Errorf("doctor not found")
+        localizedError(w, r, http.StatusBadRequest, "invalid_appointment_id")
+        return
+    }
+
+    lang := requestLanguage(r)
+    appointment, ok := patchDocument(w, r, appointmentRepo, id, patchable[Appointment]{
+        notFound: "appointment_not_found",
+        readOnly: []string{"patientId", "doctorId", "dateTime", "status", "holdId", "video", "checkedInAt", "cancelledAt", "cancellationReason", "reminderSentAt"},
+        editable: func(appointment *Appointment) error {
+            if appointment.Status != StatusScheduled {
+                return newAPIError("appointment_status", i18n.StatusLabel(lang, appointment.Status))
+            }
+            return nil
+        },
+        check: validateAppointment,
+    })
+    if !ok {
+        return
+    }
+    go syncAppointmentCalendar(*appointment)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(appointment)
+}
+
+func appointment(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getAppointment(w, r)
+    case http.MethodPatch:
+        patchAppointment(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
     }
+}
+
+// parseExpand reads the comma separated ?expand= option of appointment reads.
+func parseExpand(r *http.Request) (map[string]bool, error) {
+    expand := map[string]bool{}
+    for _, field := range strings.Split(r.URL.Query().Get("expand"), ",") {
+        field = strings.TrimSpace(field)
+        switch field {
+        case "":
+        case "patient", "doctor":
+            expand[field] = true
+        default:
+            return nil, newAPIError("unknown_expand_field", field)
+        }
+    }
+    return expand, nil
+}
 
-    return nil
+// labelStatuses fills in the display name of each appointment's status.
+func labelStatuses(appointments []AppointmentView, lang string) {
+    for i := range appointments {
+        appointments[i].StatusLabel = i18n.StatusLabel(lang, appointments[i].Status)
+    }
+}
+
+// findAppointmentViews runs an aggregation over appointments, embedding
+// patient and doctor summaries with $lookup when they are requested. Pages
+// are in order of time.
+func findAppointmentViews(ctx context.Context, filter bson.M, expand map[string]bool, page Page) ([]AppointmentView, error) {
+    match := bson.M{"deletedAt": nil}
+    for k, v := range filter {
+        match[k] = v
+    }
+
+    order := listOrder{Key: "dateTime"}
+    order.restrict(match, page)
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$sort", Value: order.sort()}},
+    }
+    if page.Size > 0 {
+        if page.After == nil {
+            pipeline = append(pipeline, bson.D{{Key: "$skip", Value: (max(page.Number, 1) - 1) * page.Size}})
+        }
+        pipeline = append(pipeline, bson.D{{Key: "$limit", Value: page.Size}})
+    }
+    if expand["patient"] {
+        pipeline = append(pipeline, lookupSummary(patientCollection.Name(), "patientId", "patient",
+            bson.D{{Key: "name", Value: 1}, {Key: "email", Value: 1}, {Key: "contactNo", Value: 1}})...)
+    }
+    if expand["doctor"] {
+        pipeline = append(pipeline, lookupSummary(doctorCollection.Name(), "doctorId", "doctor",
+            bson.D{{Key: "name", Value: 1}, {Key: "specialization", Value: 1}, {Key: "department", Value: 1}})...)
+    }
+
+    cursor, err := appointmentCollection.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    appointments := []AppointmentView{}
+    if err = cursor.All(ctx, &appointments); err != nil {
+        return nil, err
+    }
+    return appointments, nil
+}
+
+// lookupSummary joins a single projected document from another collection
+// into field as, leaving it absent when the referenced document is missing.
+func lookupSummary(from, localField, as string, projection bson.D) []bson.D {
+    return []bson.D{
+        {{Key: "$lookup", Value: bson.D{
+            {Key: "from", Value: from},
+            {Key: "let", Value: bson.D{{Key: "id", Value: "$" + localField}}},
+            {Key: "pipeline", Value: bson.A{
+                bson.D{{Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{"$_id", "$$id"}}}}}}},
+                bson.D{{Key: "$project", Value: projection}},
+            }},
+            {Key: "as", Value: as},
+        }}},
+        {{Key: "$unwind", Value: bson.D{
+            {Key: "path", Value: "$" + as},
+            {Key: "preserveNullAndEmptyArrays", Value: true},
+        }}},
+    }
 }
 
 // Department handlers
@@ -261,28 +1016,80 @@ func createDepartment(w http.ResponseWriter, r *http.Request) {
     }
 
     var department Department
-    if err := json.NewDecoder(r.Body).Decode(&department); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    if !decodeJSON(w, r, &department) {
         return
     }
+    if err := validateOperatingHours(department.OperatingHours); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if department.Capacity != nil {
+        if err := validateCapacity(department.Capacity); err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return
+        }
+    }
 
-    department.CreatedAt = time.Now()
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
+    ctx := r.Context()
 
-    result, err := departmentCollection.InsertOne(ctx, department)
-    if err != nil {
+    if err := departmentRepo.Create(ctx, &department); err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
-    department.ID = result.InsertedID.(primitive.ObjectID)
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(department)
 }
 
+func getDepartments(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    departments, err := departmentRepo.List(ctx, bson.M{}, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, departments)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(departments)
+}
+
+func departments(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getDepartments(w, r)
+    case http.MethodPost:
+        createDepartment(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
 func main() {
+    // Maintenance commands
+    if len(os.Args) > 1 {
+        err := runCommand(os.Args[1:])
+        if client != nil {
+            client.Disconnect(context.Background())
+        }
+        if err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
     defer func() {
         if client != nil {
             if err := client.Disconnect(context.Background()); err != nil {
@@ -291,21 +1098,25 @@ func main() {
         }
     }()
 
-    // Patient routes
-    http.HandleFunc("/patients", createPatient)
-    http.HandleFunc("/patients/list", getPatients)
-
-    // Doctor routes
-    http.HandleFunc("/doctors", createDoctor)
-
-    // Appointment routes
-    http.HandleFunc("/appointments", createAppointment)
+    // Background jobs
+    go watchServiceMode(context.Background())
+    startScheduleCache(context.Background())
+    go runEvery(context.Background(), "no-show", config.NoShowCheckInterval, markNoShows)
+    go runEvery(context.Background(), "reminders", config.ReminderCheckInterval, sendReminders)
+    go runEvery(context.Background(), "saved-search-digests", config.SavedSearchInterval, sendSavedSearchDigests)
+    go runEvery(context.Background(), "notification-retries", config.NotificationRetryInterval, retryFailedNotifications)
+    go runEvery(context.Background(), "google-calendar", config.GoogleSyncInterval, syncGoogleCalendars)
+    go runEvery(context.Background(), "retention", config.RetentionCheckInterval, applyRetention)
+    go runEvery(context.Background(), "backup", config.BackupInterval, scheduledBackup)
+    go runEvery(context.Background(), "outbox", config.OutboxRelayInterval, relayOutbox)
+    go runEvery(context.Background(), "geocoding", config.GeocodeInterval, geocodeAddresses)
+    go runEvery(context.Background(), "waitlist", config.WaitlistCheckInterval, expireWaitlist)
+    go runEvery(context.Background(), "warehouse", config.WarehouseInterval, exportWarehouse)
+    go runEvery(context.Background(), "schema-write-back", config.SchemaWriteBackInterval, writeBackSchemas)
 
-    // Department routes
-    http.HandleFunc("/departments", createDepartment)
+    registerRoutes(http.DefaultServeMux, routes)
 
-    fmt.Println("Starting hospital management service on http://localhost:8080")
-    if err := http.ListenAndServe(":8080", nil); err != nil {
+    if err := serve(securityHeaders(withDebugAuth(withChaos(withServiceMode(withTimeouts(http.DefaultServeMux)))))); err != nil {
         fmt.Printf("Error starting server: %v\n", err)
     }
 } 
\ No newline at end of file
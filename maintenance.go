@@ -0,0 +1,228 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/i18n"
+)
+
+// Service modes
+const (
+    ServiceNormal      = "normal"
+    ServiceMaintenance = "maintenance"
+    ServiceReadOnly    = "read_only"
+)
+
+var serviceModes = []string{ServiceNormal, ServiceMaintenance, ServiceReadOnly}
+
+// serviceModeID is the id of the document holding the mode.
+const serviceModeID = "current"
+
+// ServiceMode is the operating mode of every instance, switched by admins
+// for maintenance and database migrations. Both modes refuse writes with
+// a 503 while reads go on; maintenance still lets people sign in, read-only
+// mode also pauses the background jobs so the database is left alone.
+type ServiceMode struct {
+    Mode       string    `json:"mode" bson:"mode"`
+    Message    string    `json:"message,omitempty" bson:"message,omitempty"`
+    RetryAfter int64     `json:"retryAfter,omitempty" bson:"retryAfter,omitempty"` // seconds
+    Since      time.Time `json:"since" bson:"since"`
+    By         string    `json:"by,omitempty" bson:"by,omitempty"`
+}
+
+// ServiceModeError is the body of the 503 answered to writes outside the
+// normal mode.
+type ServiceModeError struct {
+    Error   string `json:"error"`
+    Message string `json:"message"`
+    Mode    string `json:"mode"`
+    Notice  string `json:"notice,omitempty"`
+}
+
+// Readiness is the body of /readyz.
+type Readiness struct {
+    Status   string `json:"status"` // ready or unavailable
+    Database string `json:"database"`
+    ServiceMode
+}
+
+var (
+    serviceModeCollection *mongo.Collection
+    serviceMode           atomic.Pointer[ServiceMode]
+)
+
+func initServiceMode(ctx context.Context, db *mongo.Database) {
+    serviceModeCollection = db.Collection("service_mode")
+    serviceMode.Store(&ServiceMode{Mode: ServiceNormal})
+    if err := refreshServiceMode(ctx); err != nil {
+        log.Printf("Error loading service mode: %v\n", err)
+    }
+}
+
+// refreshServiceMode loads the mode other instances may have switched.
+func refreshServiceMode(ctx context.Context) error {
+    mode := ServiceMode{Mode: ServiceNormal}
+    err := serviceModeCollection.FindOne(ctx, bson.M{"_id": serviceModeID}).Decode(&mode)
+    if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+        return err
+    }
+    serviceMode.Store(&mode)
+    return nil
+}
+
+// watchServiceMode refreshes the mode every SERVICE_MODE_REFRESH. Unlike
+// the jobs of runEvery it keeps running in read-only mode.
+func watchServiceMode(ctx context.Context) {
+    ticker := time.NewTicker(config.ServiceModeRefresh)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            refreshCtx, cancel := context.WithTimeout(ctx, config.ServiceModeRefresh)
+            if err := refreshServiceMode(refreshCtx); err != nil {
+                log.Printf("Error refreshing service mode: %v\n", err)
+            }
+            cancel()
+        }
+    }
+}
+
+func currentServiceMode() ServiceMode {
+    return *serviceMode.Load()
+}
+
+// readOnly reports whether the service is in read-only mode.
+func readOnly() bool {
+    return currentServiceMode().Mode == ServiceReadOnly
+}
+
+// modeExempt reports whether a write is allowed in a mode: switching the
+// mode back always is, signing in only during maintenance.
+func modeExempt(mode string, r *http.Request) bool {
+    if r.URL.Path == "/admin/mode" {
+        return true
+    }
+    return mode == ServiceMaintenance && strings.HasPrefix(r.URL.Path, "/auth/")
+}
+
+// withServiceMode refuses writes outside the normal mode with a 503 and
+// the Retry-After set with the mode. Responses name the mode in
+// X-Service-Mode so clients can show a banner.
+func withServiceMode(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mode := currentServiceMode()
+        if mode.Mode == ServiceNormal {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("X-Service-Mode", mode.Mode)
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+            next.ServeHTTP(w, r)
+            return
+        }
+        if modeExempt(mode.Mode, r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        if mode.RetryAfter > 0 {
+            w.Header().Set("Retry-After", strconv.FormatInt(mode.RetryAfter, 10))
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusServiceUnavailable)
+        json.NewEncoder(w).Encode(ServiceModeError{
+            Error:   "service_" + mode.Mode,
+            Message: i18n.Message(requestLanguage(r), "error.service_"+mode.Mode),
+            Mode:    mode.Mode,
+            Notice:  mode.Message,
+        })
+    })
+}
+
+// adminServiceMode returns the mode or switches it, with a body of
+// {"mode": ..., "message": ..., "retryAfter": seconds}: GET, PUT /admin/mode
+func adminServiceMode(w http.ResponseWriter, r *http.Request) {
+    ctx := r.Context()
+
+    switch r.Method {
+    case http.MethodGet:
+        if err := refreshServiceMode(ctx); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    case http.MethodPut:
+        var mode ServiceMode
+        if !decodeJSON(w, r, &mode) {
+            return
+        }
+        if !slices.Contains(serviceModes, mode.Mode) {
+            writeError(w, r, http.StatusBadRequest, newAPIError("invalid_choice", "mode", strings.Join(serviceModes, ", ")))
+            return
+        }
+        if mode.RetryAfter < 0 {
+            writeError(w, r, http.StatusBadRequest, newAPIError("invalid_retry_after"))
+            return
+        }
+        mode.Since = time.Now()
+        mode.By = actorFromContext(ctx)
+
+        _, err := serviceModeCollection.ReplaceOne(ctx, bson.M{"_id": serviceModeID}, mode, options.Replace().SetUpsert(true))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        serviceMode.Store(&mode)
+        log.Printf("Service mode set to %s by %s\n", mode.Mode, mode.By)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(currentServiceMode())
+}
+
+// getReadiness reports whether the instance can serve requests, and in
+// which mode: GET /readyz. It answers 503 while the database is
+// unreachable; in maintenance and read-only mode reads are still served,
+// so the instance stays ready.
+func getReadiness(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+    defer cancel()
+
+    readiness := Readiness{Status: "ready", Database: "ok", ServiceMode: currentServiceMode()}
+    status := http.StatusOK
+    if err := client.Ping(ctx, nil); err != nil {
+        readiness.Status = "unavailable"
+        readiness.Database = err.Error()
+        status = http.StatusServiceUnavailable
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(readiness)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "golang.org/x/crypto/bcrypt"
+
+    "new/totp"
+)
+
+// MFA handlers
+
+// setupTOTP generates a new authenticator secret for the account, which
+// takes effect once confirmed with enableTOTP: POST /auth/mfa/totp
+func setupTOTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    user := userFromContext(r.Context())
+    if !mfaRoles[user.Role] {
+        localizedError(w, r, http.StatusForbidden, "mfa_not_allowed", user.Role)
+        return
+    }
+    if user.TOTPEnabled {
+        localizedError(w, r, http.StatusConflict, "mfa_already_enabled")
+        return
+    }
+
+    ctx := r.Context()
+
+    secret := totp.NewSecret()
+    if err := userRepo.UpdateFields(ctx, user.ID, nil, bson.M{"totpSecret": secret}); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(map[string]string{
+        "secret": secret,
+        "url":    totp.URL(config.EmailBrand, user.Email, secret),
+    })
+}
+
+// enableTOTP turns on the second factor after checking a code of the new
+// secret: POST /auth/mfa/totp/enable
+func enableTOTP(w http.ResponseWriter, r *http.Request) {
+    updateTOTP(w, r, true)
+}
+
+// disableTOTP turns off the second factor, given the password and a
+// current code: POST /auth/mfa/totp/disable
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+    updateTOTP(w, r, false)
+}
+
+func updateTOTP(w http.ResponseWriter, r *http.Request, enable bool) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var body struct {
+        Code     string `json:"code"`
+        Password string `json:"password"` // when disabling
+    }
+    if !decodeJSON(w, r, &body) {
+        return
+    }
+
+    user := userFromContext(r.Context())
+    switch {
+    case enable && user.TOTPEnabled:
+        localizedError(w, r, http.StatusConflict, "mfa_already_enabled")
+        return
+    case enable && user.TOTPSecret == "":
+        localizedError(w, r, http.StatusConflict, "mfa_not_set_up")
+        return
+    case !enable && !user.TOTPEnabled:
+        localizedError(w, r, http.StatusConflict, "mfa_not_enabled")
+        return
+    }
+    // A stolen session alone must not strip the second factor
+    if !enable && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(body.Password)) != nil {
+        localizedError(w, r, http.StatusForbidden, "invalid_credentials")
+        return
+    }
+    if !totp.Validate(body.Code, user.TOTPSecret, time.Now()) {
+        localizedError(w, r, http.StatusBadRequest, "invalid_mfa_code")
+        return
+    }
+
+    ctx := r.Context()
+
+    fields := bson.M{"totpEnabled": enable}
+    if !enable {
+        fields["totpSecret"] = ""
+    }
+    if err := userRepo.UpdateFields(ctx, user.ID, nil, fields); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/i18n"
+)
+
+// noShowBatchSize bounds the appointments handled per run.
+const noShowBatchSize = 100
+
+// SlotOffer is published to offer a no-show patient a new appointment.
+type SlotOffer struct {
+    AppointmentID primitive.ObjectID `json:"appointmentId"`
+    PatientID     primitive.ObjectID `json:"patientId"`
+    DoctorID      primitive.ObjectID `json:"doctorId"`
+    DateTime      time.Time          `json:"dateTime"`
+    Message       string             `json:"message"`
+}
+
+// markNoShows marks scheduled appointments that were never checked in as
+// NoShow once NO_SHOW_GRACE has passed, publishing an appointment.no_show
+// event for each and, with NO_SHOW_OFFER_SLOT, an appointment.slot_offered
+// event with the doctor's next free slot.
+func markNoShows(ctx context.Context) error {
+    cutoff := time.Now().Add(-config.NoShowGrace)
+    appointments, err := appointmentRepo.List(ctx, bson.M{
+        "status":   StatusScheduled,
+        "dateTime": bson.M{"$lt": cutoff},
+    }, Page{Number: 1, Size: noShowBatchSize})
+    if err != nil {
+        return err
+    }
+
+    for _, appointment := range appointments {
+        err := withTransaction(ctx, func(ctx context.Context) error {
+            err := appointmentRepo.UpdateFields(ctx, appointment.ID,
+                bson.M{"status": StatusScheduled},
+                bson.M{"status": StatusNoShow},
+            )
+            if err != nil {
+                return err
+            }
+            appointment.Status = StatusNoShow
+            return publishEvent(ctx, "appointment.no_show", appointment.ID, appointment)
+        })
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            // Checked in or cancelled since it was listed
+            continue
+        }
+        if err != nil {
+            return err
+        }
+
+        if config.NoShowOfferSlot {
+            offerNextSlot(ctx, &appointment)
+        }
+    }
+    return nil
+}
+
+func offerNextSlot(ctx context.Context, appointment *Appointment) {
+    doctor, err := doctorRepo.GetByID(ctx, appointment.DoctorID)
+    if err != nil {
+        log.Printf("Error loading doctor of appointment %s: %v\n", appointment.ID.Hex(), err)
+        return
+    }
+
+    slot, ok, err := nextFreeSlot(ctx, doctor, time.Now())
+    if err != nil || !ok {
+        if err != nil {
+            log.Printf("Error finding slot for appointment %s: %v\n", appointment.ID.Hex(), err)
+        }
+        return
+    }
+
+    patient, err := patientRepo.GetByID(ctx, appointment.PatientID)
+    if err != nil {
+        log.Printf("Error loading patient of appointment %s: %v\n", appointment.ID.Hex(), err)
+        return
+    }
+
+    lang := patientLanguage(patient)
+    offer := SlotOffer{
+        AppointmentID: appointment.ID,
+        PatientID:     appointment.PatientID,
+        DoctorID:      appointment.DoctorID,
+        DateTime:      slot,
+        Message: i18n.Message(lang, "slot_offer.body", patient.Name, doctor.Name,
+            i18n.FormatDate(lang, slot.Local()), i18n.FormatTime(lang, slot.Local())),
+    }
+    if err := publishEvent(ctx, "appointment.slot_offered", offer.AppointmentID, offer); err != nil {
+        log.Printf("Error publishing slot offer for appointment %s: %v\n", appointment.ID.Hex(), err)
+    }
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/i18n"
+    "new/sms"
+)
+
+// reminderBatchSize bounds the reminders sent per run.
+const reminderBatchSize = 100
+
+// notificationData is what notifications are rendered from. Fields
+// irrelevant to a kind of notification are left nil.
+type notificationData struct {
+    Patient     *Patient
+    Doctor      *Doctor
+    Appointment *Appointment
+    Invoice     *Invoice
+    CheckIn     *CheckIn
+    User        *User // account emails, sent to the user instead of a patient
+    ResetURL    string
+    JoinURL     string // of a video consultation
+    PortalURL   string // of the patient's secure messages
+    Outreach    *Outreach
+    SavedSearch *SavedSearchDigest
+    Waitlist    *WaitlistEntry // with the slot offered
+    // Specialization of the doctor in the patient's language
+    Specialization string
+}
+
+// Notifier delivers patient notifications over one channel. kind names
+// the notification: confirmation, reminder, queue, ...
+type Notifier interface {
+    Channel() string
+    Notify(ctx context.Context, kind string, data notificationData) error
+}
+
+// SMSStatus is one delivery status report of a text message.
+type SMSStatus struct {
+    Status string    `json:"status" bson:"status"`
+    Error  string    `json:"error,omitempty" bson:"error,omitempty"`
+    At     time.Time `json:"at" bson:"at"`
+}
+
+// SMSMessage records a text message sent to a patient and its delivery.
+type SMSMessage struct {
+    Document      `bson:",inline"`
+    PatientID     primitive.ObjectID  `json:"patientId" bson:"patientId"`
+    AppointmentID *primitive.ObjectID `json:"appointmentId,omitempty" bson:"appointmentId,omitempty"`
+    Kind          string              `json:"kind" bson:"kind"`
+    To            string              `json:"to" bson:"to"`
+    Body          string              `json:"body" bson:"body"`
+    Provider      string              `json:"provider" bson:"provider"`
+    ProviderID    string              `json:"providerId,omitempty" bson:"providerId,omitempty"`
+    Status        string              `json:"status" bson:"status"`
+    Error         string              `json:"error,omitempty" bson:"error,omitempty"`
+    StatusHistory []SMSStatus         `json:"statusHistory" bson:"statusHistory"`
+}
+
+var (
+    smsCollection *mongo.Collection
+    smsRepo       *Repository[SMSMessage, *SMSMessage]
+    smsProvider   sms.Provider // nil without SMS_PROVIDER
+    notifiers     []Notifier
+)
+
+func initNotifications(ctx context.Context, db *mongo.Database) {
+    smsCollection = db.Collection("sms_messages")
+    smsRepo = NewRepository[SMSMessage](smsCollection, defaultHooks)
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "provider", Value: 1}, {Key: "providerId", Value: 1}}}
+    if _, err := smsCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating SMS message index: %v\n", err)
+    }
+
+    switch config.SMSProvider {
+    case "twilio":
+        smsProvider = sms.NewTwilio(config.TwilioAccountSID, config.TwilioAuthToken, config.TwilioFrom, smsPolicy.Client())
+    case "webhook":
+        smsProvider = sms.NewWebhook(config.SMSWebhookURL, config.SMSWebhookSecret, smsPolicy.Client())
+    }
+
+    notifiers = []Notifier{emailNotifier{}}
+    if smsProvider != nil {
+        notifiers = append(notifiers, smsNotifier{provider: smsProvider})
+    }
+}
+
+// notifyPatient sends a notification over every configured channel.
+// Failed deliveries are dead-lettered for retry.
+func notifyPatient(ctx context.Context, kind string, data notificationData) error {
+    var errs []error
+    for _, n := range notifiers {
+        err := n.Notify(ctx, kind, data)
+        if err == nil {
+            continue
+        }
+        errs = append(errs, fmt.Errorf("%s: %w", n.Channel(), err))
+        if err := recordFailedNotification(ctx, n.Channel(), kind, data, err); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// appointmentNotificationData loads the patient and doctor of an
+// appointment.
+func appointmentNotificationData(ctx context.Context, appointment *Appointment) (notificationData, error) {
+    patient, err := patientRepo.GetByID(ctx, appointment.PatientID)
+    if err != nil {
+        return notificationData{}, err
+    }
+    doctor, err := doctorRepo.GetByID(ctx, appointment.DoctorID)
+    if err != nil {
+        return notificationData{}, err
+    }
+    return notificationData{
+        Patient:        patient,
+        Doctor:         doctor,
+        Appointment:    appointment,
+        JoinURL:        videoJoinURL(appointment),
+        Specialization: specializationName(ctx, doctor.Specialization, patientLanguage(patient)),
+    }, nil
+}
+
+// notifyAppointment notifies the patient of an appointment in the
+// background of a request, logging failures.
+func notifyAppointment(kind string, appointment Appointment) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    data, err := appointmentNotificationData(ctx, &appointment)
+    if err == nil {
+        err = notifyPatient(ctx, kind, data)
+    }
+    if err != nil {
+        log.Printf("Error sending %s notification for appointment %s: %v\n", kind, appointment.ID.Hex(), err)
+    }
+}
+
+// notifyQueue tells a checked in patient their place in the queue.
+func notifyQueue(checkIn CheckIn) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    data, err := appointmentNotificationData(ctx, &checkIn.Appointment)
+    if err == nil {
+        data.CheckIn = &checkIn
+        err = notifyPatient(ctx, "queue", data)
+    }
+    if err != nil {
+        log.Printf("Error sending queue notification for appointment %s: %v\n", checkIn.Appointment.ID.Hex(), err)
+    }
+}
+
+// sendReminders notifies the patient of each scheduled appointment
+// starting within REMINDER_LEAD, once per appointment.
+func sendReminders(ctx context.Context) error {
+    now := time.Now()
+    appointments, err := appointmentRepo.List(ctx, bson.M{
+        "status":         StatusScheduled,
+        "dateTime":       bson.M{"$gt": now, "$lte": now.Add(config.ReminderLead)},
+        "reminderSentAt": nil,
+    }, Page{Number: 1, Size: reminderBatchSize})
+    if err != nil {
+        return err
+    }
+
+    for _, appointment := range appointments {
+        err := appointmentRepo.UpdateFields(ctx, appointment.ID,
+            bson.M{"reminderSentAt": nil},
+            bson.M{"reminderSentAt": now},
+        )
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            // Claimed by another instance
+            continue
+        }
+        if err != nil {
+            return err
+        }
+
+        data, err := appointmentNotificationData(ctx, &appointment)
+        if err == nil {
+            err = notifyPatient(ctx, "reminder", data)
+        }
+        if err != nil {
+            log.Printf("Error sending reminder for appointment %s: %v\n", appointment.ID.Hex(), err)
+        }
+    }
+    return nil
+}
+
+// smsNotifier notifies patients by text message at their contact number,
+// recording every message with its delivery status.
+type smsNotifier struct {
+    provider sms.Provider
+}
+
+func (smsNotifier) Channel() string { return "sms" }
+
+// smsBody renders the text of a notification, or "" for kinds not sent by
+// SMS.
+func smsBody(lang, kind string, data notificationData) string {
+    switch kind {
+    case "confirmation", "reminder":
+        at := data.Appointment.DateTime.Local()
+        body := i18n.Message(lang, kind+".body", data.Patient.Name, data.Doctor.Name,
+            i18n.FormatDate(lang, at), i18n.FormatTime(lang, at))
+        if data.JoinURL != "" {
+            body += " " + i18n.Message(lang, "video.join", data.JoinURL)
+        }
+        return body
+    case "queue":
+        return i18n.Message(lang, "queue.body", data.Patient.Name, data.Doctor.Name,
+            data.CheckIn.QueuePosition, data.CheckIn.EstimatedWaitMinutes)
+    case "outreach":
+        return data.Outreach.Message
+    case "message":
+        return i18n.Message(lang, "message.body", data.Patient.Name, data.PortalURL)
+    case "waitlist_offer":
+        at, until := data.Waitlist.Offer.DateTime.Local(), data.Waitlist.Offer.ExpiresAt.Local()
+        body := i18n.Message(lang, "waitlist_offer.body", data.Patient.Name, data.Doctor.Name,
+            i18n.FormatDate(lang, at), i18n.FormatTime(lang, at), i18n.FormatDate(lang, until), i18n.FormatTime(lang, until))
+        if data.PortalURL != "" {
+            body += " " + i18n.Message(lang, "waitlist_offer.link", data.PortalURL)
+        }
+        return body
+    }
+    return ""
+}
+
+func (n smsNotifier) Notify(ctx context.Context, kind string, data notificationData) error {
+    body := smsBody(data.language(), kind, data)
+    if body == "" || data.Patient.ContactNo == "" {
+        return nil
+    }
+
+    // Messages over the tenant's quota are dropped, not retried
+    err := chargeQuota(ctx, data.Patient.TenantID, "", QuotaSMS, 1)
+    var exceeded *quotaExceeded
+    if errors.As(err, &exceeded) {
+        log.Printf("Not sending %s SMS to patient %s: %v\n", kind, data.Patient.ID.Hex(), err)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    msg := SMSMessage{
+        PatientID: data.Patient.ID,
+        Kind:      kind,
+        To:        data.Patient.ContactNo,
+        Body:      body,
+        Provider:  n.provider.Name(),
+        Status:    sms.StatusQueued,
+    }
+    if data.Appointment != nil {
+        msg.AppointmentID = &data.Appointment.ID
+    }
+    if err := smsRepo.Create(ctx, &msg); err != nil {
+        return err
+    }
+
+    receipt, sendErr := n.provider.Send(ctx, sms.Message{
+        To:             msg.To,
+        Body:           msg.Body,
+        StatusCallback: config.PublicURL + "/webhooks/sms/status",
+    })
+    status := SMSStatus{Status: receipt.Status, At: time.Now()}
+    if sendErr != nil {
+        status = SMSStatus{Status: sms.StatusFailed, Error: sendErr.Error(), At: time.Now()}
+    }
+
+    _, err = smsCollection.UpdateOne(ctx, bson.M{"_id": msg.ID}, bson.M{
+        "$set":  bson.M{"providerId": receipt.ID, "status": status.Status, "error": status.Error, "updatedAt": status.At},
+        "$push": bson.M{"statusHistory": status},
+    })
+    if sendErr != nil {
+        return sendErr
+    }
+    return err
+}
+
+// smsStatusCallback records delivery status reports of the SMS provider:
+// POST /webhooks/sms/status
+func smsStatusCallback(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if smsProvider == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    update, err := smsProvider.ParseStatus(r)
+    if errors.Is(err, sms.ErrInvalidSignature) {
+        localizedError(w, r, http.StatusUnauthorized, "unauthorized")
+        return
+    }
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, newAPIError("invalid_body", err.Error()))
+        return
+    }
+
+    ctx := r.Context()
+
+    status := SMSStatus{Status: update.Status, Error: update.Error, At: time.Now()}
+    result, err := smsCollection.UpdateOne(ctx,
+        bson.M{"provider": smsProvider.Name(), "providerId": update.ID},
+        bson.M{
+            "$set":  bson.M{"status": status.Status, "error": status.Error, "updatedAt": status.At},
+            "$push": bson.M{"statusHistory": status},
+        },
+    )
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if result.MatchedCount == 0 {
+        localizedError(w, r, http.StatusNotFound, "sms_not_found")
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,369 @@
+// Package oidc implements OpenID Connect sign-in against an identity
+// provider such as Azure AD or Keycloak: discovery, the authorization code
+// flow and ID token validation against the provider's signing keys.
+package oidc
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/oauth2"
+)
+
+// leeway tolerates clock skew with the provider.
+const leeway = time.Minute
+
+// keyRefreshInterval limits JWKS refetches on unknown key IDs.
+const keyRefreshInterval = time.Minute
+
+// Config identifies the service to the provider.
+type Config struct {
+    DiscoveryURL string // .../.well-known/openid-configuration
+    ClientID     string
+    ClientSecret string
+    RedirectURL  string
+    Scopes       []string
+    HTTPClient   *http.Client // calls to the provider; a default client if nil
+}
+
+// Provider is an OpenID provider. Its metadata is discovered on first use
+// so a provider outage at startup does not disable sign-in for good.
+type Provider struct {
+    config Config
+
+    mu        sync.Mutex
+    metadata  *metadata
+    keys      map[string]crypto.PublicKey
+    fetchedAt time.Time
+}
+
+type metadata struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+func New(config Config) *Provider {
+    if config.HTTPClient == nil {
+        config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &Provider{config: config}
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.metadata != nil {
+        return p.metadata, nil
+    }
+
+    var m metadata
+    if err := getJSON(ctx, p.config.HTTPClient, p.config.DiscoveryURL, &m); err != nil {
+        return nil, fmt.Errorf("oidc discovery: %w", err)
+    }
+    if m.Issuer == "" || m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+        return nil, errors.New("oidc discovery: incomplete provider metadata")
+    }
+    p.metadata = &m
+    return p.metadata, nil
+}
+
+func (p *Provider) oauth(m *metadata) *oauth2.Config {
+    return &oauth2.Config{
+        ClientID:     p.config.ClientID,
+        ClientSecret: p.config.ClientSecret,
+        RedirectURL:  p.config.RedirectURL,
+        Endpoint:     oauth2.Endpoint{AuthURL: m.AuthorizationEndpoint, TokenURL: m.TokenEndpoint},
+        Scopes:       p.config.Scopes,
+    }
+}
+
+// AuthURL is the provider sign-in page a user is sent to. nonce is echoed
+// in the ID token and must be checked by Exchange.
+func (p *Provider) AuthURL(ctx context.Context, state, nonce string) (string, error) {
+    m, err := p.discover(ctx)
+    if err != nil {
+        return "", err
+    }
+    return p.oauth(m).AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+// Exchange trades the authorization code of the callback for the ID token
+// and returns its validated claims.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (Claims, error) {
+    m, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    token, err := p.oauth(m).Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.config.HTTPClient), code)
+    if err != nil {
+        return nil, err
+    }
+    raw, _ := token.Extra("id_token").(string)
+    if raw == "" {
+        return nil, errors.New("oidc: token response has no id_token")
+    }
+    return p.Verify(ctx, raw, nonce)
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of an ID
+// token.
+func (p *Provider) Verify(ctx context.Context, raw, nonce string) (Claims, error) {
+    m, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    parts := strings.Split(raw, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("oidc: malformed id token")
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeSegment(parts[0], &header); err != nil {
+        return nil, fmt.Errorf("oidc: id token header: %w", err)
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, fmt.Errorf("oidc: id token signature: %w", err)
+    }
+    key, err := p.key(ctx, m, header.Kid)
+    if err != nil {
+        return nil, err
+    }
+    if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+        return nil, err
+    }
+
+    var claims Claims
+    if err := decodeSegment(parts[1], &claims); err != nil {
+        return nil, fmt.Errorf("oidc: id token claims: %w", err)
+    }
+    now := time.Now()
+    switch {
+    case claims.String("iss") != m.Issuer:
+        return nil, fmt.Errorf("oidc: unexpected issuer %q", claims.String("iss"))
+    case !claims.hasAudience(p.config.ClientID):
+        return nil, errors.New("oidc: id token not issued for this client")
+    case now.After(claims.time("exp").Add(leeway)):
+        return nil, errors.New("oidc: id token expired")
+    case now.Add(leeway).Before(claims.time("iat")):
+        return nil, errors.New("oidc: id token issued in the future")
+    case claims.String("nonce") != nonce:
+        return nil, errors.New("oidc: nonce mismatch")
+    }
+    return claims, nil
+}
+
+// key returns the signing key kid, refetching the key set when the
+// provider rotated its keys.
+func (p *Provider) key(ctx context.Context, m *metadata, kid string) (crypto.PublicKey, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if key, ok := p.keys[kid]; ok {
+        return key, nil
+    }
+    if time.Since(p.fetchedAt) < keyRefreshInterval {
+        return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+    }
+
+    keys, err := fetchKeys(ctx, p.config.HTTPClient, m.JWKSURI)
+    if err != nil {
+        return nil, err
+    }
+    p.keys, p.fetchedAt = keys, time.Now()
+    if key, ok := keys[kid]; ok {
+        return key, nil
+    }
+    return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+    Crv string `json:"crv"`
+    X   string `json:"x"`
+    Y   string `json:"y"`
+}
+
+func fetchKeys(ctx context.Context, client *http.Client, url string) (map[string]crypto.PublicKey, error) {
+    var set struct {
+        Keys []jsonWebKey `json:"keys"`
+    }
+    if err := getJSON(ctx, client, url, &set); err != nil {
+        return nil, fmt.Errorf("oidc keys: %w", err)
+    }
+
+    keys := map[string]crypto.PublicKey{}
+    for _, k := range set.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        key, err := k.publicKey()
+        if err != nil {
+            // Skip key types we do not support
+            continue
+        }
+        keys[k.Kid] = key
+    }
+    return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+    switch k.Kty {
+    case "RSA":
+        n, err := base64.RawURLEncoding.DecodeString(k.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := base64.RawURLEncoding.DecodeString(k.E)
+        if err != nil {
+            return nil, err
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+    case "EC":
+        var curve elliptic.Curve
+        switch k.Crv {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        default:
+            return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+        }
+        x, err := base64.RawURLEncoding.DecodeString(k.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := base64.RawURLEncoding.DecodeString(k.Y)
+        if err != nil {
+            return nil, err
+        }
+        return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+    }
+    return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+    var hash crypto.Hash
+    switch alg {
+    case "RS256", "ES256":
+        hash = crypto.SHA256
+    case "RS384", "ES384":
+        hash = crypto.SHA384
+    case "RS512":
+        hash = crypto.SHA512
+    default:
+        return fmt.Errorf("oidc: unsupported signing algorithm %q", alg)
+    }
+    h := hash.New()
+    h.Write(signed)
+    digest := h.Sum(nil)
+
+    switch key := key.(type) {
+    case *rsa.PublicKey:
+        if alg[0] != 'R' {
+            break
+        }
+        if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+            return errors.New("oidc: invalid id token signature")
+        }
+        return nil
+    case *ecdsa.PublicKey:
+        size := (key.Curve.Params().BitSize + 7) / 8
+        if alg[0] != 'E' || len(signature) != 2*size {
+            break
+        }
+        r := new(big.Int).SetBytes(signature[:size])
+        s := new(big.Int).SetBytes(signature[size:])
+        if !ecdsa.Verify(key, digest, r, s) {
+            return errors.New("oidc: invalid id token signature")
+        }
+        return nil
+    }
+    return fmt.Errorf("oidc: key does not match algorithm %q", alg)
+}
+
+// Claims are the claims of a validated ID token.
+type Claims map[string]interface{}
+
+// String returns a string claim, or "".
+func (c Claims) String(name string) string {
+    s, _ := c[name].(string)
+    return s
+}
+
+// Strings returns a claim holding a list of strings, such as groups. A
+// single string is returned as a list of one.
+func (c Claims) Strings(name string) []string {
+    switch v := c[name].(type) {
+    case string:
+        return []string{v}
+    case []interface{}:
+        var list []string
+        for _, item := range v {
+            if s, ok := item.(string); ok {
+                list = append(list, s)
+            }
+        }
+        return list
+    }
+    return nil
+}
+
+func (c Claims) time(name string) time.Time {
+    n, _ := c[name].(float64)
+    return time.Unix(int64(n), 0)
+}
+
+func (c Claims) hasAudience(clientID string) bool {
+    for _, aud := range c.Strings("aud") {
+        if aud == clientID {
+            return true
+        }
+    }
+    return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s: %s", url, resp.Status)
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "time"
+
+    "new/resilience"
+)
+
+// Policies of the outbound dependencies
+var (
+    smsPolicy       *resilience.Policy
+    emailPolicy     *resilience.Policy
+    calendarPolicy  *resilience.Policy
+    webhookPolicy   *resilience.Policy
+    ssoPolicy       *resilience.Policy
+    backupPolicy    *resilience.Policy
+    streamPolicy    *resilience.Policy
+    videoPolicy     *resilience.Policy
+    geocodePolicy   *resilience.Policy
+    warehousePolicy *resilience.Policy
+
+    webhookClient *http.Client
+)
+
+func initOutbound() {
+    smsPolicy = outboundPolicy("sms", 10*time.Second)
+    emailPolicy = outboundPolicy("email", 30*time.Second)
+    calendarPolicy = outboundPolicy("calendar", 15*time.Second)
+    webhookPolicy = outboundPolicy("webhook", 10*time.Second)
+    ssoPolicy = outboundPolicy("sso", 10*time.Second)
+    // Uploads of large backups take long; the backup as a whole is bounded
+    // by BACKUP_TIMEOUT
+    backupPolicy = outboundPolicy("backup", 0)
+    streamPolicy = outboundPolicy("stream", 10*time.Second)
+    videoPolicy = outboundPolicy("video", 10*time.Second)
+    geocodePolicy = outboundPolicy("geocode", 10*time.Second)
+    warehousePolicy = outboundPolicy("warehouse", 30*time.Second)
+
+    webhookClient = webhookPolicy.Client()
+}
+
+// outboundPolicy builds the policy of a dependency from the OUTBOUND_* and
+// BREAKER_* settings, with a timeout of def unless OUTBOUND_TIMEOUTS sets
+// one.
+func outboundPolicy(name string, def time.Duration) *resilience.Policy {
+    timeout, ok := config.OutboundTimeouts[name]
+    if !ok {
+        timeout = def
+    }
+    return &resilience.Policy{
+        Name:    name,
+        Timeout: timeout,
+        Retries: int(config.OutboundRetries),
+        Backoff: config.OutboundBackoff,
+        Breaker: resilience.NewBreaker(name, int(config.BreakerThreshold), config.BreakerCooldown),
+    }
+}
+
+// getMetrics exposes the circuit breakers and the schedule cache in the
+// Prometheus text format:
+// GET /metrics
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    stats := resilience.Stats()
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+    fmt.Fprintln(w, "# HELP circuit_breaker_state State of the circuit breaker of an outbound dependency: 0 closed, 1 half-open, 2 open.")
+    fmt.Fprintln(w, "# TYPE circuit_breaker_state gauge")
+    for _, s := range stats {
+        fmt.Fprintf(w, "circuit_breaker_state{dependency=%q} %d\n", s.Name, s.State)
+    }
+    counters := []struct {
+        name, help string
+        value      func(resilience.BreakerStats) uint64
+    }{
+        {"circuit_breaker_successes_total", "Successful calls to an outbound dependency.", func(s resilience.BreakerStats) uint64 { return s.Successes }},
+        {"circuit_breaker_failures_total", "Failed calls to an outbound dependency.", func(s resilience.BreakerStats) uint64 { return s.Failures }},
+        {"circuit_breaker_rejections_total", "Calls rejected by an open circuit breaker.", func(s resilience.BreakerStats) uint64 { return s.Rejections }},
+    }
+    for _, c := range counters {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+        for _, s := range stats {
+            fmt.Fprintf(w, "%s{dependency=%q} %d\n", c.name, s.Name, c.value(s))
+        }
+    }
+    writeScheduleCacheMetrics(w)
+    writeWarehouseMetrics(w)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outbox event statuses. Pending events are relayed until they are
+// delivered or reach OUTBOX_MAX_ATTEMPTS and become Failed.
+const (
+    OutboxPending   = "pending"
+    OutboxDelivered = "delivered"
+    OutboxFailed    = "failed"
+)
+
+// Outbox sinks, each relayed independently
+const (
+    SinkWebhook     = "webhook"
+    SinkStream      = "stream"
+    SinkProjections = "projections"
+)
+
+// outboxBatchSize bounds the events relayed per run and sink.
+const outboxBatchSize = 100
+
+// outboxLease is how long a claimed event is hidden from other instances.
+const outboxLease = time.Minute
+
+// OutboxEvent is an event waiting in the outbox for delivery to a sink, or
+// kept there for OUTBOX_RETENTION once delivered. Payload is the JSON
+// envelope of the event, an events.Event fixed when the event is
+// published.
+type OutboxEvent struct {
+    ID            primitive.ObjectID `json:"id" bson:"_id"`
+    Sink          string             `json:"sink" bson:"sink"`
+    Type          string             `json:"type" bson:"type"`
+    Key           string             `json:"key,omitempty" bson:"key,omitempty"`
+    OccurredAt    time.Time          `json:"occurredAt" bson:"occurredAt"`
+    Payload       json.RawMessage    `json:"payload" bson:"payload"`
+    Status        string             `json:"status" bson:"status"`
+    Attempts      int64              `json:"attempts" bson:"attempts"`
+    LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+    NextAttemptAt *time.Time         `json:"nextAttemptAt,omitempty" bson:"nextAttemptAt,omitempty"`
+    DeliveredAt   *time.Time         `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+}
+
+var outboxCollection *mongo.Collection
+
+func initOutbox(ctx context.Context, db *mongo.Database) {
+    outboxCollection = db.Collection("outbox")
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "status", Value: 1}, {Key: "sink", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+    }
+    if config.OutboxRetention > 0 {
+        indexes = append(indexes, mongo.IndexModel{
+            Keys:    bson.D{{Key: "deliveredAt", Value: 1}},
+            Options: options.Index().SetExpireAfterSeconds(int32(config.OutboxRetention.Seconds())),
+        })
+    }
+    if _, err := outboxCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating outbox indexes: %v\n", err)
+    }
+}
+
+// enqueueEvent writes an event to the outbox, due for delivery at once.
+func enqueueEvent(ctx context.Context, event OutboxEvent) error {
+    event.Status, event.NextAttemptAt = OutboxPending, &event.OccurredAt
+    _, err := outboxCollection.InsertOne(ctx, event)
+    return err
+}
+
+// outboxBackoff is the delay before the next attempt after attempts
+// failures: OUTBOX_RETRY_BACKOFF doubled per failure, capped at
+// OUTBOX_RETRY_MAX_BACKOFF.
+func outboxBackoff(attempts int64) time.Duration {
+    backoff := config.OutboxRetryBackoff
+    for i := int64(1); i < attempts && backoff < config.OutboxRetryMaxBackoff; i++ {
+        backoff *= 2
+    }
+    return min(backoff, config.OutboxRetryMaxBackoff)
+}
+
+// deliverOutboxEvent makes one delivery attempt of an event and records
+// the outcome.
+func deliverOutboxEvent(ctx context.Context, event *OutboxEvent) error {
+    var err error
+    switch event.Sink {
+    case SinkStream:
+        err = deliverStreamEvent(ctx, event)
+    case SinkProjections:
+        err = applyProjections(ctx, event)
+    default:
+        err = deliverEvent(ctx, event.ID.Hex(), event.Type, event.Payload)
+    }
+
+    now := time.Now()
+    event.Attempts++
+    if err == nil {
+        event.Status, event.NextAttemptAt, event.DeliveredAt = OutboxDelivered, nil, &now
+    } else {
+        event.LastError = err.Error()
+        next := now.Add(outboxBackoff(event.Attempts))
+        event.Status, event.NextAttemptAt = OutboxPending, &next
+        if event.Attempts >= config.OutboxMaxAttempts {
+            event.Status, event.NextAttemptAt = OutboxFailed, nil
+        }
+    }
+
+    _, err = outboxCollection.UpdateOne(ctx, bson.M{"_id": event.ID}, bson.M{"$set": bson.M{
+        "status":        event.Status,
+        "attempts":      event.Attempts,
+        "lastError":     event.LastError,
+        "nextAttemptAt": event.NextAttemptAt,
+        "deliveredAt":   event.DeliveredAt,
+    }})
+    return err
+}
+
+// relayOutbox delivers the due events of each configured sink.
+func relayOutbox(ctx context.Context) error {
+    var errs []error
+    if config.WebhookURL != "" {
+        errs = append(errs, relaySink(ctx, SinkWebhook))
+    }
+    if eventPublisher != nil {
+        errs = append(errs, relaySink(ctx, SinkStream))
+    }
+    if config.Projections {
+        errs = append(errs, relaySink(ctx, SinkProjections))
+    }
+    return errors.Join(errs...)
+}
+
+// relaySink delivers the due events of a sink oldest first. Each event is
+// claimed before it is sent so that concurrent instances deliver it once;
+// an instance dying between the send and recording it leads to a
+// redelivery, which receivers detect by the event id. A failed delivery
+// ends the run, leaving later events for the next one.
+func relaySink(ctx context.Context, sink string) error {
+    for range outboxBatchSize {
+        now := time.Now()
+        var event OutboxEvent
+        err := outboxCollection.FindOneAndUpdate(ctx,
+            bson.M{"status": OutboxPending, "sink": sink, "nextAttemptAt": bson.M{"$lte": now}},
+            bson.M{"$set": bson.M{"nextAttemptAt": now.Add(outboxLease)}},
+            options.FindOneAndUpdate().SetSort(bson.D{{Key: "_id", Value: 1}}),
+        ).Decode(&event)
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        if err := deliverOutboxEvent(ctx, &event); err != nil {
+            return err
+        }
+        if event.Status != OutboxDelivered {
+            log.Printf("Error delivering event %s (%s) to %s: %s\n", event.ID.Hex(), event.Type, sink, event.LastError)
+            return nil
+        }
+    }
+    return nil
+}
+
+// Outbox handlers
+
+// getOutbox lists the outbox oldest first, optionally filtered by
+// ?status=pending|delivered|failed and ?sink=webhook|stream|projections:
+// GET /admin/outbox
+func getOutbox(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    filter := bson.M{}
+    if status := r.URL.Query().Get("status"); status != "" {
+        filter["status"] = status
+    }
+    if sink := r.URL.Query().Get("sink"); sink != "" {
+        filter["sink"] = sink
+    }
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    cursor, err := outboxCollection.Find(ctx, filter, findPage(filter, page, byID))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    events := []OutboxEvent{}
+    if err := cursor.All(ctx, &events); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextCursor(w, r, page, len(events), func() Cursor {
+        return Cursor{ID: events[len(events)-1].ID}
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(events)
+}
+
+// retryOutboxEvent makes an immediate delivery attempt of a failed or due
+// event, giving failed events one more attempt: POST /admin/outbox/{id}/retry
+// The event is claimed as the relay claims it, so events that are not due,
+// which a relay or another retry may be delivering, are refused.
+func retryOutboxEvent(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_event_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    now := time.Now()
+    var event OutboxEvent
+    err = outboxCollection.FindOneAndUpdate(ctx,
+        bson.M{
+            "_id":           id,
+            "status":        bson.M{"$in": bson.A{OutboxPending, OutboxFailed}},
+            "nextAttemptAt": bson.M{"$not": bson.M{"$gt": now}},
+        },
+        bson.M{"$set": bson.M{"nextAttemptAt": now.Add(outboxLease)}},
+    ).Decode(&event)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        err = outboxCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&event)
+        switch {
+        case errors.Is(err, mongo.ErrNoDocuments):
+            localizedError(w, r, http.StatusNotFound, "event_not_found")
+        case err != nil:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        case event.Status == OutboxDelivered:
+            localizedError(w, r, http.StatusConflict, "event_delivered")
+        default:
+            localizedError(w, r, http.StatusConflict, "event_not_due")
+        }
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if event.Status == OutboxFailed {
+        // A manual retry grants one more attempt
+        event.Attempts = min(event.Attempts, config.OutboxMaxAttempts-1)
+    }
+
+    if err := deliverOutboxEvent(ctx, &event); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(event)
+}
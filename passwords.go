@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// PasswordReset is a single-use password reset token sent by email. Only
+// the SHA-256 of the token is stored; expired resets are purged by a TTL
+// index.
+type PasswordReset struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty"`
+    UserID    primitive.ObjectID `bson:"userId"`
+    TokenHash string             `bson:"tokenHash"`
+    ExpiresAt time.Time          `bson:"expiresAt"`
+    UsedAt    *time.Time         `bson:"usedAt,omitempty"`
+}
+
+var passwordResetCollection *mongo.Collection
+
+func initPasswordResets(ctx context.Context, db *mongo.Database) {
+    passwordResetCollection = db.Collection("password_resets")
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    }
+    if _, err := passwordResetCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating password reset indexes: %v\n", err)
+    }
+}
+
+// hashToken is the form secret tokens are stored in.
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// sendPasswordReset emails a reset link to the account of an address, if
+// there is one and it does not sign in through SSO. It runs in the
+// background of the request so the response does not reveal whether the
+// account exists.
+func sendPasswordReset(address string) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    user, err := userByEmail(ctx, address)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return
+    }
+    if err != nil {
+        log.Printf("Error looking up account for password reset: %v\n", err)
+        return
+    }
+    if user.SSOSubject != "" {
+        // Passwords of single sign-on accounts are managed by the provider
+        return
+    }
+
+    token := randomToken(32)
+    _, err = passwordResetCollection.InsertOne(ctx, PasswordReset{
+        UserID:    user.ID,
+        TokenHash: hashToken(token),
+        ExpiresAt: time.Now().Add(config.PasswordResetTTL),
+    })
+    if err == nil {
+        err = sendEmail("password_reset", notificationData{
+            User:     user,
+            ResetURL: config.PublicURL + "/reset-password?" + url.Values{"token": {token}}.Encode(),
+        })
+    }
+    if err != nil {
+        log.Printf("Error sending password reset to user %s: %v\n", user.ID.Hex(), err)
+    }
+}
+
+// Password handlers
+
+// changePassword replaces the password of the authenticated account given
+// the current one, logging out its other sessions: POST /auth/password
+func changePassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var body struct {
+        CurrentPassword string `json:"currentPassword"`
+        NewPassword     string `json:"newPassword"`
+    }
+    if !decodeJSON(w, r, &body) {
+        return
+    }
+
+    user := userFromContext(r.Context())
+    if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(body.CurrentPassword)) != nil {
+        localizedError(w, r, http.StatusForbidden, "invalid_credentials")
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := storePassword(ctx, user, body.NewPassword); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    // Log out the other devices
+    session := sessionFromContext(ctx)
+    if _, err := revokeSessions(ctx, user.ID, bson.M{"_id": bson.M{"$ne": session.ID}}); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// forgotPassword starts a password reset: POST /auth/password/forgot. It
+// always answers 202.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var body struct {
+        Email string `json:"email"`
+    }
+    if !decodeJSON(w, r, &body) {
+        return
+    }
+
+    go sendPasswordReset(body.Email)
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// resetPassword sets a new password with the token of a reset email and
+// logs the account out everywhere: POST /auth/password/reset
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var body struct {
+        Token    string `json:"token"`
+        Password string `json:"password"`
+    }
+    if !decodeJSON(w, r, &body) {
+        return
+    }
+    if err := validatePassword(body.Password); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    // Redeem the token, once
+    now := time.Now()
+    var reset PasswordReset
+    err := passwordResetCollection.FindOneAndUpdate(ctx,
+        bson.M{"tokenHash": hashToken(body.Token), "usedAt": nil, "expiresAt": bson.M{"$gt": now}},
+        bson.M{"$set": bson.M{"usedAt": now}},
+    ).Decode(&reset)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusBadRequest, "invalid_reset_token")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    user, err := userRepo.GetByID(ctx, reset.UserID)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusBadRequest, "invalid_reset_token")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    ctx = contextWithUser(ctx, user)
+    if err := storePassword(ctx, user, body.Password); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if _, err := revokeSessions(ctx, user.ID, bson.M{}); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "mime"
+    "net/http"
+    "reflect"
+    "slices"
+    "strconv"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// mergePatchType is the media type of JSON Merge Patch (RFC 7386).
+const mergePatchType = "application/merge-patch+json"
+
+// etag is the entity tag of the stored version of a document. Every write
+// through a repository moves updatedAt, so it changes with the document.
+// Documents created before repositories kept updatedAt have none until
+// their first write and are tagged by createdAt.
+func etag(doc *Document) string {
+    stamp := doc.UpdatedAt
+    if stamp.IsZero() {
+        stamp = doc.CreatedAt
+    }
+    return `"` + strconv.FormatInt(stamp.UnixMilli(), 36) + `"`
+}
+
+// unchangedSince matches the stored version of a document as read into
+// doc. Documents without updatedAt, which decode with a zero one or, when
+// versioned, with their createdAt, are matched while they still have none.
+func unchangedSince(doc *Document) bson.M {
+    if !doc.UpdatedAt.IsZero() && !doc.UpdatedAt.Equal(doc.CreatedAt) {
+        return bson.M{"updatedAt": doc.UpdatedAt}
+    }
+    return bson.M{"$or": bson.A{
+        bson.M{"updatedAt": doc.UpdatedAt},
+        bson.M{"updatedAt": bson.M{"$exists": false}, "createdAt": doc.CreatedAt},
+    }}
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists
+// tag, or is "*".
+func etagMatches(header, tag string) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" || candidate == tag {
+            return true
+        }
+    }
+    return false
+}
+
+// notModified sets the ETag of a read document and answers 304 if the
+// client's copy, named by If-None-Match, is current. It reports whether the
+// response has been written.
+func notModified(w http.ResponseWriter, r *http.Request, doc *Document) bool {
+    tag := etag(doc)
+    w.Header().Set("ETag", tag)
+    if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, tag) {
+        w.WriteHeader(http.StatusNotModified)
+        return true
+    }
+    return false
+}
+
+// mergePatch applies a JSON Merge Patch to a decoded JSON value: objects
+// are merged recursively, null removes a member and anything else replaces
+// the target.
+func mergePatch(target, patch interface{}) interface{} {
+    patchObject, ok := patch.(map[string]interface{})
+    if !ok {
+        return patch
+    }
+    targetObject, ok := target.(map[string]interface{})
+    if !ok {
+        targetObject = map[string]interface{}{}
+    }
+    for name, value := range patchObject {
+        if value == nil {
+            delete(targetObject, name)
+        } else {
+            targetObject[name] = mergePatch(targetObject[name], value)
+        }
+    }
+    return targetObject
+}
+
+// Members of every document that patches cannot change
+var readOnlyMembers = []string{"id", "createdAt", "updatedAt", "createdBy", "updatedBy", "deletedAt"}
+
+// patchable describes how the documents of a repository are patched.
+type patchable[T any] struct {
+    notFound string   // error key of a missing document
+    readOnly []string // members beyond readOnlyMembers
+    // editable returns an error, answered with 409, if the document cannot
+    // be changed in its current state
+    editable func(doc *T) error
+    // check validates, and may normalize, the patched document before it is
+    // stored
+    check func(ctx context.Context, patched *T) error
+    // derived names the BSON fields check computes from others, which are
+    // written with every patch
+    derived []string
+}
+
+// patchDocument applies a JSON Merge Patch to document id of repo:
+// PATCH with Content-Type application/merge-patch+json. With If-Match the
+// patch only applies to the version the client has, otherwise to the
+// version it was merged into; either way concurrent writes are not lost.
+// Only the members named by the patch are written.
+func patchDocument[T any, PT model[T]](w http.ResponseWriter, r *http.Request, repo *Repository[T, PT], id primitive.ObjectID, p patchable[T]) (*T, bool) {
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType != mergePatchType && mediaType != "application/json" {
+        localizedError(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", mergePatchType)
+        return nil, false
+    }
+
+    var patch map[string]interface{}
+    if !decodeJSON(w, r, &patch) {
+        return nil, false
+    }
+    names := bsonNames(reflect.TypeFor[T]())
+    for name := range patch {
+        // Members not stored, such as the hold of an appointment, cannot be
+        // patched either
+        bsonName, known := names[name]
+        if slices.Contains(readOnlyMembers, name) || slices.Contains(p.readOnly, name) || known && bsonName == "" {
+            localizedError(w, r, http.StatusBadRequest, "read_only_field", name)
+            return nil, false
+        }
+    }
+
+    ctx := r.Context()
+
+    original, err := repo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, p.notFound)
+            return nil, false
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    if p.editable != nil {
+        if err := p.editable(original); err != nil {
+            writeError(w, r, http.StatusConflict, err)
+            return nil, false
+        }
+    }
+    meta := PT(original).document()
+    ifMatch := r.Header.Get("If-Match")
+    if ifMatch != "" && !etagMatches(ifMatch, etag(meta)) {
+        localizedError(w, r, http.StatusPreconditionFailed, "precondition_failed")
+        return nil, false
+    }
+
+    // Merge into the JSON form of the document and decode the result
+    // strictly, so that unknown members and mistyped values are rejected
+    data, err := json.Marshal(original)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    var current interface{}
+    if err := json.Unmarshal(data, &current); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    if data, err = json.Marshal(mergePatch(current, patch)); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    patched := new(T)
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(patched); err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_body", err.Error())
+        return nil, false
+    }
+
+    if p.check != nil {
+        if err := p.check(ctx, patched); err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return nil, false
+        }
+    }
+
+    stored, err := toBSONMap(patched)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    fields := bson.M{}
+    for name := range patch {
+        // Members left out of the BSON form are zero
+        fields[names[name]] = stored[names[name]]
+    }
+    for _, name := range p.derived {
+        fields[name] = stored[name]
+    }
+
+    err = repo.UpdateFields(ctx, id, unchangedSince(meta), fields)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        if ifMatch != "" {
+            localizedError(w, r, http.StatusPreconditionFailed, "precondition_failed")
+        } else {
+            localizedError(w, r, http.StatusConflict, "document_changed")
+        }
+        return nil, false
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+
+    updated, err := repo.GetByID(ctx, id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    w.Header().Set("ETag", etag(PT(updated).document()))
+    return updated, true
+}
+
+// bsonNames maps the JSON member names of a struct type to its BSON field
+// names, looking into inline structs. Members that are not stored map to
+// "".
+func bsonNames(t reflect.Type) map[string]string {
+    names := map[string]string{}
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        bsonTag := field.Tag.Get("bson")
+        if field.Anonymous && strings.Contains(bsonTag, "inline") {
+            for k, v := range bsonNames(field.Type) {
+                names[k] = v
+            }
+            continue
+        }
+        jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+        bsonName, _, _ := strings.Cut(bsonTag, ",")
+        if jsonName == "" || jsonName == "-" {
+            continue
+        }
+        if bsonName == "-" {
+            bsonName = ""
+        }
+        names[jsonName] = bsonName
+    }
+    return names
+}
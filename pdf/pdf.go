@@ -0,0 +1,222 @@
+// Package pdf renders printable documents (invoices, prescriptions,
+// appointment slips) from text templates into plain Helvetica PDF files.
+//
+// Templates live under templates/ and produce plain text, one output line
+// per printed line. A few line prefixes control the layout:
+//
+//	# Title      large bold heading
+//	## Heading   bold heading
+//	---          horizontal rule
+//
+// Tabs split a line into equal-width columns. Long lines are wrapped and
+// documents flow onto as many A4 pages as needed.
+package pdf
+
+import (
+    "bytes"
+    "embed"
+    "fmt"
+    "strings"
+    "text/template"
+    "time"
+
+    "new/i18n"
+)
+
+//go:embed templates/*.tmpl
+var files embed.FS
+
+var templates = template.Must(template.New("").Funcs(funcs(i18n.Default)).ParseFS(files, "templates/*.tmpl"))
+
+// Page geometry in points (A4).
+const (
+    pageWidth    = 595.0
+    pageHeight   = 842.0
+    margin       = 56.0
+    contentWidth = pageWidth - 2*margin
+)
+
+// funcs are the template functions, formatting in lang.
+func funcs(lang string) template.FuncMap {
+    return template.FuncMap{
+        "t":      func(key string, args ...interface{}) string { return i18n.Message(lang, "pdf."+key, args...) },
+        "date":   func(t time.Time) string { return i18n.FormatDate(lang, t.Local()) },
+        "time":   func(t time.Time) string { return i18n.FormatTime(lang, t.Local()) },
+        "amount": func(cents int64) string { return i18n.FormatAmount(lang, cents) },
+        "status": func(status string) string { return i18n.StatusLabel(lang, status) },
+        "term":   func(kind, code string) string { return i18n.Term(lang, kind, code) },
+    }
+}
+
+// Render executes the template name (e.g. "invoice") with data, localized
+// in lang, and returns the PDF file. A variant of the template for the
+// language, e.g. invoice.es.tmpl, is preferred to the template itself.
+func Render(lang, name string, data interface{}) ([]byte, error) {
+    tmpl, err := templates.Clone()
+    if err != nil {
+        return nil, err
+    }
+    tmpl = tmpl.Funcs(funcs(lang))
+
+    file := name + ".tmpl"
+    if tmpl.Lookup(name+"."+lang+".tmpl") != nil {
+        file = name + "." + lang + ".tmpl"
+    }
+    var text bytes.Buffer
+    if err := tmpl.ExecuteTemplate(&text, file, data); err != nil {
+        return nil, err
+    }
+    return layout(strings.TrimRight(text.String(), "\n")).write(), nil
+}
+
+// line is a positioned run of text on a page.
+type line struct {
+    x, y float64
+    font string
+    size float64
+    text string
+    rule bool
+}
+
+type document struct {
+    pages [][]line
+}
+
+// layout places each line of text on pages, top to bottom.
+func layout(text string) *document {
+    doc := &document{pages: [][]line{nil}}
+    y := pageHeight - margin
+
+    // advance moves to the next line, starting a new page when full.
+    advance := func(leading float64) {
+        if y-leading < margin {
+            doc.pages = append(doc.pages, nil)
+            y = pageHeight - margin
+        }
+        y -= leading
+    }
+    place := func(l line) {
+        l.y = y
+        doc.pages[len(doc.pages)-1] = append(doc.pages[len(doc.pages)-1], l)
+    }
+
+    for _, raw := range strings.Split(text, "\n") {
+        font, size := "F1", 11.0
+        switch {
+        case raw == "---":
+            advance(10)
+            place(line{rule: true})
+            continue
+        case strings.HasPrefix(raw, "# "):
+            font, size, raw = "F2", 18, raw[2:]
+        case strings.HasPrefix(raw, "## "):
+            font, size, raw = "F2", 12, raw[3:]
+        }
+
+        cells := strings.Split(raw, "\t")
+        width := contentWidth / float64(len(cells))
+        wrapped := make([][]string, len(cells))
+        rows := 1
+        for i, cell := range cells {
+            wrapped[i] = wrap(cell, width-6, size)
+            rows = max(rows, len(wrapped[i]))
+        }
+        for row := 0; row < rows; row++ {
+            advance(size * 1.45)
+            for i := range cells {
+                if row < len(wrapped[i]) {
+                    place(line{x: margin + float64(i)*width, font: font, size: size, text: wrapped[i][row]})
+                }
+            }
+        }
+    }
+    return doc
+}
+
+// wrap breaks s into lines no wider than width at the given font size,
+// estimating Helvetica glyphs at half an em.
+func wrap(s string, width, size float64) []string {
+    limit := max(int(width/(size*0.5)), 1)
+    var lines []string
+    current := ""
+    for _, word := range strings.Fields(s) {
+        switch {
+        case current == "":
+            current = word
+        case len([]rune(current))+1+len([]rune(word)) <= limit:
+            current += " " + word
+        default:
+            lines = append(lines, current)
+            current = word
+        }
+    }
+    return append(lines, current)
+}
+
+// write serializes the document: catalog, page tree, the two Helvetica
+// fonts and a page and content stream per page.
+func (d *document) write() []byte {
+    var buf bytes.Buffer
+    var offsets []int
+    object := func(body string) {
+        offsets = append(offsets, buf.Len())
+        fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+    }
+
+    buf.WriteString("%PDF-1.4\n")
+
+    kids := make([]string, len(d.pages))
+    for i := range d.pages {
+        kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+    }
+    object("<< /Type /Catalog /Pages 2 0 R >>")
+    object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+    object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+    object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+    for i, page := range d.pages {
+        object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] "+
+            "/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+            pageWidth, pageHeight, 6+2*i))
+
+        var content bytes.Buffer
+        for _, l := range page {
+            if l.rule {
+                fmt.Fprintf(&content, "0.5 w %.2f %.2f m %.2f %.2f l S\n", margin, l.y+4, pageWidth-margin, l.y+4)
+                continue
+            }
+            fmt.Fprintf(&content, "BT /%s %g Tf %.2f %.2f Td (%s) Tj ET\n", l.font, l.size, l.x, l.y, escape(l.text))
+        }
+        object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+    }
+
+    xref := buf.Len()
+    fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+    for _, offset := range offsets {
+        fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+    }
+    fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+    return buf.Bytes()
+}
+
+// escape encodes s as the body of a PDF string literal in WinAnsiEncoding.
+// Characters outside Latin-1 print as '?'.
+func escape(s string) string {
+    var b strings.Builder
+    for _, r := range s {
+        switch {
+        case r == '(' || r == ')' || r == '\\':
+            b.WriteByte('\\')
+            b.WriteRune(r)
+        case r < 0x20:
+            b.WriteByte(' ')
+        case r < 0x80:
+            b.WriteRune(r)
+        case r >= 0xa0 && r <= 0xff:
+            fmt.Fprintf(&b, "\\%03o", r)
+        default:
+            b.WriteByte('?')
+        }
+    }
+    return b.String()
+}
@@ -0,0 +1,51 @@
+package phonetic
+
+// Weights of how a word of a query matches a word of a name
+const (
+    sameWord      = 1.0 // spelt the same, ignoring case and accents
+    samePrimary   = 0.8 // Smith and Smyth
+    sameAlternate = 0.6 // Smith and Schmidt, through an alternate key
+)
+
+// Score rates how well a name matches a query from 0, no word sounds
+// alike, to 1, every word of the query is in the name as spelt. Each word
+// of the query counts its best match among the words of the name, so
+// "jon smyth" matches "John Smith" and "Smith, John" alike.
+func Score(query, name string) float64 {
+    queryWords, nameWords := Words(query), Words(name)
+    if len(queryWords) == 0 {
+        return 0
+    }
+
+    type encoded struct {
+        word               string
+        primary, alternate string
+    }
+    encode := func(words []string) []encoded {
+        out := make([]encoded, len(words))
+        for i, word := range words {
+            primary, alternate := DoubleMetaphone(word)
+            out[i] = encoded{string(fold(word)), primary, alternate}
+        }
+        return out
+    }
+    names := encode(nameWords)
+
+    total := 0.0
+    for _, q := range encode(queryWords) {
+        best := 0.0
+        for _, n := range names {
+            switch {
+            case q.word == n.word:
+                best = max(best, sameWord)
+            case q.primary != "" && q.primary == n.primary:
+                best = max(best, samePrimary)
+            case q.primary != "" && (q.primary == n.alternate || q.alternate == n.primary || q.alternate == n.alternate):
+                best = max(best, sameAlternate)
+            }
+        }
+        total += best
+    }
+    return total / float64(len(queryWords))
+}
+
@@ -0,0 +1,562 @@
+// Package phonetic encodes names by how they sound, so that misspelt
+// names can be matched: Smith, Smyth and Schmidt share a key.
+//
+// Encoding uses the Double Metaphone algorithm of Lawrence Philips, which
+// returns a primary key and, for names of uncertain origin, an alternate
+// one: Schmidt is XMT and SMT.
+package phonetic
+
+import (
+    "strings"
+    "unicode"
+)
+
+// maxKeyLength bounds keys, as in the reference implementation.
+const maxKeyLength = 4
+
+// DoubleMetaphone returns the primary and alternate keys of a word. The
+// alternate equals the primary for most words; both are "" for words
+// without letters.
+func DoubleMetaphone(word string) (primary, alternate string) {
+    e := encoder{word: fold(word)}
+    if len(e.word) == 0 {
+        return "", ""
+    }
+    e.encode()
+    return e.primary.String(), e.alternate.String()
+}
+
+// Keys returns the distinct keys of the words of a name, primary and
+// alternate, for indexing and lookup.
+func Keys(name string) []string {
+    var keys []string
+    seen := map[string]bool{}
+    for _, word := range Words(name) {
+        primary, alternate := DoubleMetaphone(word)
+        for _, key := range []string{primary, alternate} {
+            if key != "" && !seen[key] {
+                seen[key] = true
+                keys = append(keys, key)
+            }
+        }
+    }
+    return keys
+}
+
+// Words splits a name into its words, dropping punctuation: "O'Brien-Smith"
+// is OBrien and Smith.
+func Words(name string) []string {
+    name = strings.ReplaceAll(name, "'", "")
+    name = strings.ReplaceAll(name, "’", "")
+    return strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) })
+}
+
+// fold upper cases a word and strips the accents the algorithm does not
+// know; it knows Ç and Ñ.
+func fold(word string) []rune {
+    var runes []rune
+    for _, r := range strings.ToUpper(word) {
+        switch r {
+        case 'Á', 'À', 'Â', 'Ä', 'Ã', 'Å':
+            r = 'A'
+        case 'É', 'È', 'Ê', 'Ë':
+            r = 'E'
+        case 'Í', 'Ì', 'Î', 'Ï':
+            r = 'I'
+        case 'Ó', 'Ò', 'Ô', 'Ö', 'Õ', 'Ø':
+            r = 'O'
+        case 'Ú', 'Ù', 'Û', 'Ü':
+            r = 'U'
+        case 'Ý', 'Ÿ':
+            r = 'Y'
+        }
+        if unicode.IsLetter(r) {
+            runes = append(runes, r)
+        }
+    }
+    return runes
+}
+
+type encoder struct {
+    word               []rune
+    slavoGermanic      bool
+    primary, alternate strings.Builder
+}
+
+func (e *encoder) done() bool {
+    return e.primary.Len() >= maxKeyLength && e.alternate.Len() >= maxKeyLength
+}
+
+func (e *encoder) add(primary, alternate string) {
+    e.addPrimary(primary)
+    e.addAlternate(alternate)
+}
+
+func (e *encoder) both(s string) {
+    e.add(s, s)
+}
+
+func (e *encoder) addPrimary(s string) {
+    if n := maxKeyLength - e.primary.Len(); n > 0 {
+        e.primary.WriteString(s[:min(n, len(s))])
+    }
+}
+
+func (e *encoder) addAlternate(s string) {
+    if n := maxKeyLength - e.alternate.Len(); n > 0 {
+        e.alternate.WriteString(s[:min(n, len(s))])
+    }
+}
+
+// at returns the letter at i, or 0 outside the word.
+func (e *encoder) at(i int) rune {
+    if i < 0 || i >= len(e.word) {
+        return 0
+    }
+    return e.word[i]
+}
+
+// is reports whether the letters from start are one of options, all of
+// the same length.
+func (e *encoder) is(start int, options ...string) bool {
+    n := len([]rune(options[0]))
+    if start < 0 || start+n > len(e.word) {
+        return false
+    }
+    s := string(e.word[start : start+n])
+    for _, option := range options {
+        if s == option {
+            return true
+        }
+    }
+    return false
+}
+
+func (e *encoder) vowel(i int) bool {
+    return strings.ContainsRune("AEIOUY", e.at(i))
+}
+
+func (e *encoder) last() int {
+    return len(e.word) - 1
+}
+
+func (e *encoder) encode() {
+    s := string(e.word)
+    e.slavoGermanic = strings.ContainsAny(s, "WK") || strings.Contains(s, "CZ") || strings.Contains(s, "WITZ")
+
+    i := 0
+    if e.is(0, "GN", "KN", "PN", "WR", "PS") {
+        i = 1
+    }
+    if e.at(0) == 'X' {
+        e.both("S")
+        i = 1
+    }
+
+    for !e.done() && i < len(e.word) {
+        switch e.at(i) {
+        case 'A', 'E', 'I', 'O', 'U', 'Y':
+            if i == 0 {
+                e.both("A")
+            }
+            i++
+        case 'B':
+            e.both("P")
+            i = e.skip(i, 'B')
+        case 'Ç':
+            e.both("S")
+            i++
+        case 'C':
+            i = e.c(i)
+        case 'D':
+            i = e.d(i)
+        case 'F':
+            e.both("F")
+            i = e.skip(i, 'F')
+        case 'G':
+            i = e.g(i)
+        case 'H':
+            if (i == 0 || e.vowel(i-1)) && e.vowel(i+1) {
+                e.both("H")
+                i += 2
+            } else {
+                i++
+            }
+        case 'J':
+            i = e.j(i)
+        case 'K':
+            e.both("K")
+            i = e.skip(i, 'K')
+        case 'L':
+            i = e.l(i)
+        case 'M':
+            e.both("M")
+            if e.at(i+1) == 'M' || (e.is(i-1, "UMB") && (i+1 == e.last() || e.is(i+2, "ER"))) {
+                i += 2
+            } else {
+                i++
+            }
+        case 'N':
+            e.both("N")
+            i = e.skip(i, 'N')
+        case 'Ñ':
+            e.both("N")
+            i++
+        case 'P':
+            if e.at(i+1) == 'H' {
+                e.both("F")
+                i += 2
+            } else {
+                e.both("P")
+                i = e.skip(i, 'P', 'B')
+            }
+        case 'Q':
+            e.both("K")
+            i = e.skip(i, 'Q')
+        case 'R':
+            if i == e.last() && !e.slavoGermanic && e.is(i-2, "IE") && !e.is(i-4, "ME", "MA") {
+                e.addAlternate("R")
+            } else {
+                e.both("R")
+            }
+            i = e.skip(i, 'R')
+        case 'S':
+            i = e.s(i)
+        case 'T':
+            i = e.t(i)
+        case 'V':
+            e.both("F")
+            i = e.skip(i, 'V')
+        case 'W':
+            i = e.w(i)
+        case 'X':
+            if i == 0 {
+                e.both("S")
+                i++
+                break
+            }
+            if !(i == e.last() && (e.is(i-3, "IAU", "EAU") || e.is(i-2, "AU", "OU"))) {
+                e.both("KS")
+            }
+            i = e.skip(i, 'C', 'X')
+        case 'Z':
+            i = e.z(i)
+        default:
+            i++
+        }
+    }
+}
+
+// skip steps over the letter at i and the next one if it is one of next.
+func (e *encoder) skip(i int, next ...rune) int {
+    for _, r := range next {
+        if e.at(i+1) == r {
+            return i + 2
+        }
+    }
+    return i + 1
+}
+
+func (e *encoder) c(i int) int {
+    switch {
+    case e.cAsK(i):
+        e.both("K")
+        return i + 2
+    case i == 0 && e.is(i, "CAESAR"):
+        e.both("S")
+        return i + 2
+    case e.is(i, "CH"):
+        return e.ch(i)
+    case e.is(i, "CZ") && !e.is(i-2, "WICZ"):
+        e.add("S", "X")
+        return i + 2
+    case e.is(i+1, "CIA"):
+        e.both("X")
+        return i + 3
+    case e.is(i, "CC") && !(i == 1 && e.at(0) == 'M'):
+        if e.is(i+2, "I", "E", "H") && !e.is(i+2, "HU") {
+            if (i == 1 && e.at(0) == 'A') || e.is(i-1, "UCCEE", "UCCES") {
+                e.both("KS")
+            } else {
+                e.both("X")
+            }
+            return i + 3
+        }
+        e.both("K")
+        return i + 2
+    case e.is(i, "CK", "CG", "CQ"):
+        e.both("K")
+        return i + 2
+    case e.is(i, "CI", "CE", "CY"):
+        if e.is(i, "CIO", "CIE", "CIA") {
+            e.add("S", "X")
+        } else {
+            e.both("S")
+        }
+        return i + 2
+    }
+    e.both("K")
+    if e.is(i+1, "C", "K", "Q") && !e.is(i+1, "CE", "CI") {
+        return i + 2
+    }
+    return i + 1
+}
+
+// cAsK reports a C sounded K in Germanic -ACH-, as in Bacher, or CHIA.
+func (e *encoder) cAsK(i int) bool {
+    if e.is(i, "CHIA") {
+        return true
+    }
+    if i <= 1 || e.vowel(i-2) || !e.is(i-1, "ACH") {
+        return false
+    }
+    c := e.at(i + 2)
+    return (c != 'I' && c != 'E') || e.is(i-2, "BACHER", "MACHER")
+}
+
+func (e *encoder) ch(i int) int {
+    switch {
+    case i > 0 && e.is(i, "CHAE"):
+        e.add("K", "X")
+    case i == 0 && (e.is(i+1, "HARAC", "HARIS") || e.is(i+1, "HOR", "HYM", "HIA", "HEM")) && !e.is(0, "CHORE"):
+        // Greek roots: Charis, Chemie
+        e.both("K")
+    case e.is(0, "VAN ", "VON ") || e.is(0, "SCH") ||
+        e.is(i-2, "ORCHES", "ARCHIT", "ORCHID") || e.is(i+2, "T", "S") ||
+        ((e.is(i-1, "A", "O", "U", "E") || i == 0) &&
+            (e.is(i+2, "L", "R", "N", "M", "B", "H", "F", "V", "W", " ") || i+1 == e.last())):
+        e.both("K")
+    case i > 0 && e.is(0, "MC"):
+        e.both("K")
+    case i > 0:
+        e.add("X", "K")
+    default:
+        e.both("X")
+    }
+    return i + 2
+}
+
+func (e *encoder) d(i int) int {
+    switch {
+    case e.is(i, "DG"):
+        if e.is(i+2, "I", "E", "Y") {
+            e.both("J")
+            return i + 3
+        }
+        e.both("TK")
+        return i + 2
+    case e.is(i, "DT", "DD"):
+        e.both("T")
+        return i + 2
+    }
+    e.both("T")
+    return i + 1
+}
+
+func (e *encoder) g(i int) int {
+    switch {
+    case e.at(i+1) == 'H':
+        return e.gh(i)
+    case e.at(i+1) == 'N':
+        switch {
+        case i == 1 && e.vowel(0) && !e.slavoGermanic:
+            e.add("KN", "N")
+        case !e.is(i+2, "EY") && e.at(i+1) != 'Y' && !e.slavoGermanic:
+            e.add("N", "KN")
+        default:
+            e.both("KN")
+        }
+        return i + 2
+    case e.is(i+1, "LI") && !e.slavoGermanic:
+        e.add("KL", "L")
+        return i + 2
+    case i == 0 && (e.at(i+1) == 'Y' || e.is(i+1, "ES", "EP", "EB", "EL", "EY", "IB", "IL", "IN", "IE", "EI", "ER")):
+        e.add("K", "J")
+        return i + 2
+    case (e.is(i+1, "ER") || e.at(i+1) == 'Y') && !e.is(0, "DANGER", "RANGER", "MANGER") &&
+        !e.is(i-1, "E", "I") && !e.is(i-1, "RGY", "OGY"):
+        e.add("K", "J")
+        return i + 2
+    case e.is(i+1, "E", "I", "Y") || e.is(i-1, "AGGI", "OGGI"):
+        switch {
+        case e.is(0, "VAN ", "VON ") || e.is(0, "SCH") || e.is(i+1, "ET"):
+            e.both("K")
+        case e.is(i+1, "IER"):
+            e.both("J")
+        default:
+            e.add("J", "K")
+        }
+        return i + 2
+    }
+    e.both("K")
+    return e.skip(i, 'G')
+}
+
+func (e *encoder) gh(i int) int {
+    switch {
+    case i > 0 && !e.vowel(i-1):
+        e.both("K")
+    case i == 0:
+        if e.at(i+2) == 'I' {
+            e.both("J")
+        } else {
+            e.both("K")
+        }
+    case (i > 1 && e.is(i-2, "B", "H", "D")) || (i > 2 && e.is(i-3, "B", "H", "D")) || (i > 3 && e.is(i-4, "B", "H")):
+        // Silent: Hugh, bough, broughton
+    case i > 2 && e.at(i-1) == 'U' && e.is(i-3, "C", "G", "L", "R", "T"):
+        // Laugh, tough
+        e.both("F")
+    case i > 0 && e.at(i-1) != 'I':
+        e.both("K")
+    }
+    return i + 2
+}
+
+func (e *encoder) j(i int) int {
+    if e.is(i, "JOSE") || e.is(0, "SAN ") {
+        if (i == 0 && e.at(i+4) == ' ') || len(e.word) == 4 || e.is(0, "SAN ") {
+            e.both("H")
+        } else {
+            e.add("J", "H")
+        }
+        return i + 1
+    }
+    switch {
+    case i == 0:
+        e.add("J", "A")
+    case e.vowel(i-1) && !e.slavoGermanic && (e.at(i+1) == 'A' || e.at(i+1) == 'O'):
+        e.add("J", "H")
+    case i == e.last():
+        e.addPrimary("J")
+    case !e.is(i+1, "L", "T", "K", "S", "N", "M", "B", "Z") && !e.is(i-1, "S", "K", "L"):
+        e.both("J")
+    }
+    return e.skip(i, 'J')
+}
+
+func (e *encoder) l(i int) int {
+    if e.at(i+1) != 'L' {
+        e.both("L")
+        return i + 1
+    }
+    // Spanish -LL-, as in Cabrillo, sounds Y
+    n := len(e.word)
+    if (i == n-3 && e.is(i-1, "ILLO", "ILLA", "ALLE")) ||
+        ((e.is(n-2, "AS", "OS") || e.is(n-1, "A", "O")) && e.is(i-1, "ALLE")) {
+        e.addPrimary("L")
+    } else {
+        e.both("L")
+    }
+    return i + 2
+}
+
+func (e *encoder) s(i int) int {
+    switch {
+    case e.is(i-1, "ISL", "YSL"):
+        // Silent: island, carlysle
+        return i + 1
+    case i == 0 && e.is(i, "SUGAR"):
+        e.add("X", "S")
+        return i + 1
+    case e.is(i, "SH"):
+        if e.is(i+1, "HEIM", "HOEK", "HOLM", "HOLZ") {
+            e.both("S")
+        } else {
+            e.both("X")
+        }
+        return i + 2
+    case e.is(i, "SIO", "SIA") || e.is(i, "SIAN"):
+        if e.slavoGermanic {
+            e.both("S")
+        } else {
+            e.add("S", "X")
+        }
+        return i + 3
+    case (i == 0 && e.is(i+1, "M", "N", "L", "W")) || e.is(i+1, "Z"):
+        e.add("S", "X")
+        return e.skip(i, 'Z')
+    case e.is(i, "SC"):
+        return e.sc(i)
+    }
+    if i == e.last() && e.is(i-2, "AI", "OI") {
+        // French: Artois
+        e.addAlternate("S")
+    } else {
+        e.both("S")
+    }
+    return e.skip(i, 'S', 'Z')
+}
+
+func (e *encoder) sc(i int) int {
+    switch {
+    case e.at(i+2) == 'H':
+        switch {
+        case e.is(i+3, "ER", "EN"):
+            e.add("X", "SK")
+        case e.is(i+3, "OO", "UY", "ED", "EM"):
+            e.both("SK")
+        case i == 0 && !e.vowel(3) && e.at(3) != 'W':
+            e.add("X", "S")
+        default:
+            e.both("X")
+        }
+    case e.is(i+2, "I", "E", "Y"):
+        e.both("S")
+    default:
+        e.both("SK")
+    }
+    return i + 3
+}
+
+func (e *encoder) t(i int) int {
+    switch {
+    case e.is(i, "TION"), e.is(i, "TIA", "TCH"):
+        e.both("X")
+        return i + 3
+    case e.is(i, "TH") || e.is(i, "TTH"):
+        if e.is(i+2, "OM", "AM") || e.is(0, "VAN ", "VON ") || e.is(0, "SCH") {
+            e.both("T")
+        } else {
+            e.add("0", "T")
+        }
+        return i + 2
+    }
+    e.both("T")
+    return e.skip(i, 'T', 'D')
+}
+
+func (e *encoder) w(i int) int {
+    switch {
+    case e.is(i, "WR"):
+        e.both("R")
+        return i + 2
+    case i == 0 && (e.vowel(i+1) || e.is(i, "WH")):
+        if e.vowel(i + 1) {
+            e.add("A", "F")
+        } else {
+            e.both("A")
+        }
+    case (i == e.last() && e.vowel(i-1)) || e.is(i-1, "EWSKI", "EWSKY", "OWSKI", "OWSKY") || e.is(0, "SCH"):
+        // Polish: Filipowicz
+        e.addAlternate("F")
+    case e.is(i, "WICZ", "WITZ"):
+        e.add("TS", "FX")
+        return i + 4
+    }
+    return i + 1
+}
+
+func (e *encoder) z(i int) int {
+    if e.at(i+1) == 'H' {
+        // Chinese: Zhao
+        e.both("J")
+        return i + 2
+    }
+    if e.is(i+1, "ZO", "ZI", "ZA") || (e.slavoGermanic && i > 0 && e.at(i-1) != 'T') {
+        e.add("S", "TS")
+    } else {
+        e.both("S")
+    }
+    return e.skip(i, 'Z')
+}
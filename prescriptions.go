@@ -0,0 +1,264 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "slices"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/i18n"
+    "new/interactions"
+)
+
+// Medication is one line of a prescription.
+type Medication struct {
+    Name      string `json:"name" bson:"name"`
+    Dosage    string `json:"dosage" bson:"dosage"`       // 500 mg
+    Frequency string `json:"frequency" bson:"frequency"` // twice daily
+    Duration  string `json:"duration" bson:"duration"`   // 7 days
+}
+
+type Prescription struct {
+    Document      `bson:",inline"`
+    PatientID     primitive.ObjectID  `json:"patientId" bson:"patientId"`
+    DoctorID      primitive.ObjectID  `json:"doctorId" bson:"doctorId"`
+    AppointmentID *primitive.ObjectID `json:"appointmentId,omitempty" bson:"appointmentId,omitempty"`
+    Medications   []Medication        `json:"medications" bson:"medications"`
+    Notes         string              `json:"notes" bson:"notes"`
+    // Warnings the prescriber overrode, giving OverrideReason
+    Alerts         []PrescriptionAlert `json:"alerts,omitempty" bson:"alerts,omitempty"`
+    OverrideReason string              `json:"overrideReason,omitempty" bson:"overrideReason,omitempty"`
+}
+
+// Kinds of prescription alerts
+const (
+    AlertAllergy     = "allergy"
+    AlertInteraction = "interaction"
+)
+
+// PrescriptionAlert is an allergy of the patient to a medication or an
+// interaction between two. Severe interactions block the prescription;
+// other alerts are warnings the prescriber can override with a reason.
+type PrescriptionAlert struct {
+    Kind        string   `json:"kind" bson:"kind"`
+    Severity    string   `json:"severity" bson:"severity"`
+    Medications []string `json:"medications" bson:"medications"`
+    Allergy     string   `json:"allergy,omitempty" bson:"allergy,omitempty"`
+    Description string   `json:"description,omitempty" bson:"description,omitempty"`
+}
+
+// PrescriptionAlertsError is the body of the 409 answered to prescriptions
+// that are blocked or need an override.
+type PrescriptionAlertsError struct {
+    Error   string              `json:"error"`
+    Message string              `json:"message"`
+    Alerts  []PrescriptionAlert `json:"alerts"`
+}
+
+var (
+    prescriptionCollection *mongo.Collection
+    prescriptionRepo       *Repository[Prescription, *Prescription]
+    drugInteractions       *interactions.Table
+)
+
+func initPrescriptions(ctx context.Context, db *mongo.Database) {
+    prescriptionCollection = db.Collection("prescriptions")
+    prescriptionRepo = NewRepository[Prescription](prescriptionCollection, defaultHooks)
+
+    drugInteractions = interactions.Bundled()
+    if config.DrugInteractionsFile != "" {
+        table, err := interactions.Load(config.DrugInteractionsFile)
+        if err != nil {
+            log.Fatalf("Error loading drug interactions: %v", err)
+        }
+        drugInteractions = table
+    }
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "patientId", Value: 1}, {Key: "createdAt", Value: -1}}}
+    if _, err := prescriptionCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating prescription index: %v\n", err)
+    }
+}
+
+func validatePrescription(ctx context.Context, prescription *Prescription) error {
+    if _, err := patientRepo.GetByID(ctx, prescription.PatientID); err != nil {
+        return newAPIError("patient_not_found")
+    }
+    if _, err := doctorRepo.GetByID(ctx, prescription.DoctorID); err != nil {
+        return newAPIError("doctor_not_found")
+    }
+
+    if len(prescription.Medications) == 0 {
+        return newAPIError("medication_required")
+    }
+    for _, medication := range prescription.Medications {
+        if medication.Name == "" {
+            return newAPIError("field_required", "medications.name")
+        }
+        if medication.Dosage == "" {
+            return newAPIError("field_required", "medications.dosage")
+        }
+    }
+    return nil
+}
+
+// normalizeAllergies trims the recorded allergies of a patient to the form
+// of the interaction table, dropping empty and repeated ones.
+func normalizeAllergies(allergies []string) []string {
+    var normalized []string
+    for _, allergy := range allergies {
+        allergy = interactions.Normalize(allergy)
+        if allergy != "" && !slices.Contains(normalized, allergy) {
+            normalized = append(normalized, allergy)
+        }
+    }
+    return normalized
+}
+
+// prescriptionAlerts checks the medications of a prescription against the
+// allergies of its patient and against each other. A medication matches an
+// allergy to it or to its class.
+func prescriptionAlerts(ctx context.Context, prescription *Prescription) ([]PrescriptionAlert, error) {
+    patient, err := patientRepo.GetByID(ctx, prescription.PatientID)
+    if err != nil {
+        return nil, err
+    }
+
+    var alerts []PrescriptionAlert
+    names := make([]string, len(prescription.Medications))
+    for i, medication := range prescription.Medications {
+        names[i] = medication.Name
+        identified := append(drugInteractions.Identify(medication.Name), interactions.Normalize(medication.Name))
+        for _, allergy := range patient.Allergies {
+            if slices.Contains(identified, allergy) {
+                alerts = append(alerts, PrescriptionAlert{
+                    Kind:        AlertAllergy,
+                    Severity:    interactions.Moderate,
+                    Medications: []string{medication.Name},
+                    Allergy:     allergy,
+                })
+            }
+        }
+    }
+    for _, match := range drugInteractions.Check(names) {
+        alerts = append(alerts, PrescriptionAlert{
+            Kind:        AlertInteraction,
+            Severity:    match.Severity,
+            Medications: match.Medications[:],
+            Description: match.Description,
+        })
+    }
+    return alerts, nil
+}
+
+// checkPrescriptionAlerts records the alerts of a prescription, or answers
+// with them and returns false if it is blocked by a severe interaction or
+// has warnings without an override reason.
+func checkPrescriptionAlerts(w http.ResponseWriter, r *http.Request, prescription *Prescription) bool {
+    alerts, err := prescriptionAlerts(r.Context(), prescription)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return false
+    }
+
+    key := ""
+    prescription.OverrideReason = strings.TrimSpace(prescription.OverrideReason)
+    if slices.ContainsFunc(alerts, func(a PrescriptionAlert) bool { return a.Severity == interactions.Severe }) {
+        key = "interaction_blocked"
+    } else if len(alerts) > 0 && prescription.OverrideReason == "" {
+        key = "override_required"
+    }
+    if key == "" {
+        prescription.Alerts = alerts
+        if len(alerts) == 0 {
+            prescription.OverrideReason = ""
+        }
+        return true
+    }
+
+    lang := requestLanguage(r)
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Language", lang)
+    w.WriteHeader(http.StatusConflict)
+    json.NewEncoder(w).Encode(PrescriptionAlertsError{
+        Error:   key,
+        Message: i18n.Message(lang, "error."+key),
+        Alerts:  alerts,
+    })
+    return false
+}
+
+// Prescription handlers
+
+// createPrescription records a prescription once its medications pass the
+// allergy and interaction checks: POST /prescriptions. Warnings are
+// overridden with overrideReason.
+func createPrescription(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var prescription Prescription
+    if !decodeJSON(w, r, &prescription) {
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := validatePrescription(ctx, &prescription); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if !checkPatientAccess(w, r, prescription.PatientID) {
+        return
+    }
+    if !checkPrescriptionAlerts(w, r, &prescription) {
+        return
+    }
+
+    if err := prescriptionRepo.Create(ctx, &prescription); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(prescription)
+}
+
+func getPatientPrescriptions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    prescriptions, err := prescriptionRepo.List(ctx, bson.M{"patientId": patientID}, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, prescriptions)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(prescriptions)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "slices"
+    "sort"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/events"
+)
+
+// Projected reports
+const (
+    ReportUtilization = "utilization"
+    ReportRevenue     = "revenue"
+)
+
+// ProjectionCell holds the precomputed values of a report for one day,
+// doctor and department. Cells are maintained with $inc, so events of
+// different entities may be applied in any order and concurrently.
+type ProjectionCell struct {
+    ID         string             `json:"-" bson:"_id"`
+    Report     string             `json:"report" bson:"report"`
+    Day        string             `json:"day" bson:"day"` // YYYY-MM-DD, server time
+    DoctorID   primitive.ObjectID `json:"doctorId,omitempty" bson:"doctorId,omitempty"`
+    Department string             `json:"department,omitempty" bson:"department,omitempty"`
+    Values     map[string]int64   `json:"values" bson:"values"`
+}
+
+func (c *ProjectionCell) key() string {
+    return strings.Join([]string{c.Report, c.Day, c.DoctorID.Hex(), c.Department}, "|")
+}
+
+// projectionState is what an entity currently contributes to the cells,
+// as of the last event applied. Events older than that are stale.
+type projectionState struct {
+    ID         string           `bson:"_id"` // <collection>:<id>
+    OccurredAt time.Time        `bson:"occurredAt"`
+    Cells      []ProjectionCell `bson:"cells"`
+}
+
+var (
+    projectionCollection      *mongo.Collection
+    projectionStateCollection *mongo.Collection
+)
+
+func initProjections(ctx context.Context, db *mongo.Database) {
+    projectionCollection = db.Collection("report_projections")
+    projectionStateCollection = db.Collection("projection_state")
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "report", Value: 1}, {Key: "day", Value: 1}}}
+    if _, err := projectionCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating projection index: %v\n", err)
+    }
+}
+
+// projectedModels are the collections the reports are projected from.
+var projectedModels = map[string]bool{"appointments": true, "invoices": true}
+
+// applyProjections applies a domain event to the report cells: the cells
+// get the difference between what the entity contributes now and what it
+// contributed before.
+func applyProjections(ctx context.Context, event *OutboxEvent) error {
+    var envelope events.Event
+    if err := json.Unmarshal(event.Payload, &envelope); err != nil {
+        return err
+    }
+    entity, _, _ := strings.Cut(envelope.Type, ".")
+    var coll string
+    for name, model := range streamedModels {
+        if model.entity == entity {
+            coll = name
+        }
+    }
+
+    cells, err := projectionCells(ctx, coll, envelope.Data)
+    if err != nil {
+        return err
+    }
+    return withTransaction(ctx, func(ctx context.Context) error {
+        return projectEntity(ctx, coll+":"+envelope.EntityID, envelope.OccurredAt, cells)
+    })
+}
+
+// projectEntity replaces the contribution of an entity by cells, unless
+// a newer one has been recorded.
+func projectEntity(ctx context.Context, stateID string, at time.Time, cells []ProjectionCell) error {
+    var state projectionState
+    err := projectionStateCollection.FindOne(ctx, bson.M{"_id": stateID}).Decode(&state)
+    if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+        return err
+    }
+    if state.OccurredAt.After(at) {
+        return nil
+    }
+
+    deltas := map[string]*ProjectionCell{}
+    add := func(cells []ProjectionCell, sign int64) {
+        for _, cell := range cells {
+            delta, ok := deltas[cell.key()]
+            if !ok {
+                delta = &ProjectionCell{Report: cell.Report, Day: cell.Day, DoctorID: cell.DoctorID,
+                    Department: cell.Department, Values: map[string]int64{}}
+                deltas[cell.key()] = delta
+            }
+            for name, value := range cell.Values {
+                delta.Values[name] += sign * value
+            }
+        }
+    }
+    add(state.Cells, -1)
+    add(cells, 1)
+
+    for key, delta := range deltas {
+        inc := bson.M{}
+        for name, value := range delta.Values {
+            if value != 0 {
+                inc["values."+name] = value
+            }
+        }
+        if len(inc) == 0 {
+            continue
+        }
+        _, err := projectionCollection.UpdateOne(ctx, bson.M{"_id": key}, bson.M{
+            "$setOnInsert": bson.M{"report": delta.Report, "day": delta.Day, "doctorId": delta.DoctorID, "department": delta.Department},
+            "$inc":         inc,
+        }, options.Update().SetUpsert(true))
+        if err != nil {
+            return err
+        }
+    }
+
+    _, err = projectionStateCollection.ReplaceOne(ctx, bson.M{"_id": stateID},
+        projectionState{ID: stateID, OccurredAt: at, Cells: cells},
+        options.Replace().SetUpsert(true))
+    return err
+}
+
+// projectionCells computes the contribution of an entity of coll from its
+// JSON representation. Deleted entities contribute nothing.
+func projectionCells(ctx context.Context, coll string, data json.RawMessage) ([]ProjectionCell, error) {
+    if data == nil {
+        return nil, nil
+    }
+    switch coll {
+    case "appointments":
+        var appointment Appointment
+        if err := json.Unmarshal(data, &appointment); err != nil {
+            return nil, err
+        }
+        return appointmentCells(ctx, &appointment)
+    case "invoices":
+        var invoice Invoice
+        if err := json.Unmarshal(data, &invoice); err != nil {
+            return nil, err
+        }
+        return invoiceCells(ctx, &invoice)
+    }
+    return nil, fmt.Errorf("no projection of %s", coll)
+}
+
+// appointmentCells counts an appointment on its day, in total and by
+// status.
+func appointmentCells(ctx context.Context, appointment *Appointment) ([]ProjectionCell, error) {
+    if appointment.DeletedAt != nil {
+        return nil, nil
+    }
+    department, err := departmentOfDoctor(ctx, appointment.DoctorID)
+    if err != nil {
+        return nil, err
+    }
+    return []ProjectionCell{{
+        Report:     ReportUtilization,
+        Day:        appointment.DateTime.Local().Format(time.DateOnly),
+        DoctorID:   appointment.DoctorID,
+        Department: department,
+        Values:     map[string]int64{"appointments": 1, appointment.Status: 1},
+    }}, nil
+}
+
+// invoiceCells sums the charges of an invoice on the day they were added,
+// attributed to the doctor of the appointment they are for.
+func invoiceCells(ctx context.Context, invoice *Invoice) ([]ProjectionCell, error) {
+    if invoice.DeletedAt != nil {
+        return nil, nil
+    }
+    byKey := map[string]*ProjectionCell{}
+    var cells []*ProjectionCell
+    for _, item := range invoice.LineItems {
+        cell := &ProjectionCell{Report: ReportRevenue, Day: item.AddedAt.Local().Format(time.DateOnly)}
+        if item.AppointmentID != nil {
+            var appointment Appointment
+            err := appointmentCollection.FindOne(ctx, bson.M{"_id": item.AppointmentID}).Decode(&appointment)
+            if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+                return nil, err
+            }
+            cell.DoctorID = appointment.DoctorID
+            if cell.Department, err = departmentOfDoctor(ctx, appointment.DoctorID); err != nil {
+                return nil, err
+            }
+        }
+        if existing, ok := byKey[cell.key()]; ok {
+            cell = existing
+        } else {
+            cell.Values = map[string]int64{}
+            byKey[cell.key()] = cell
+            cells = append(cells, cell)
+        }
+        cell.Values["amountCents"] += item.AmountCents
+        cell.Values["charges"]++
+    }
+
+    result := make([]ProjectionCell, len(cells))
+    for i, cell := range cells {
+        result[i] = *cell
+    }
+    return result, nil
+}
+
+// departmentOfDoctor returns the department name of a doctor, deleted or not, or
+// "" if unknown.
+func departmentOfDoctor(ctx context.Context, doctorID primitive.ObjectID) (string, error) {
+    if doctorID.IsZero() {
+        return "", nil
+    }
+    var doctor Doctor
+    err := doctorCollection.FindOne(ctx, bson.M{"_id": doctorID}).Decode(&doctor)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return "", nil
+    }
+    return doctor.Department, err
+}
+
+// rebuildProjections recomputes the reports from the appointments and
+// invoices. Events applied while it runs may be counted twice, so it is
+// best run with the relay stopped.
+func rebuildProjections(ctx context.Context) (int, error) {
+    started := time.Now()
+    for _, coll := range []*mongo.Collection{projectionCollection, projectionStateCollection} {
+        if _, err := coll.DeleteMany(ctx, bson.M{}); err != nil {
+            return 0, err
+        }
+    }
+
+    var entities int
+    for _, coll := range []*mongo.Collection{appointmentCollection, invoiceCollection} {
+        cursor, err := coll.Find(ctx, bson.M{"deletedAt": nil})
+        if err != nil {
+            return entities, err
+        }
+        for cursor.Next(ctx) {
+            var cells []ProjectionCell
+            var id primitive.ObjectID
+            switch coll {
+            case appointmentCollection:
+                var appointment Appointment
+                if err = cursor.Decode(&appointment); err == nil {
+                    id = appointment.ID
+                    cells, err = appointmentCells(ctx, &appointment)
+                }
+            default:
+                var invoice Invoice
+                if err = cursor.Decode(&invoice); err == nil {
+                    id = invoice.ID
+                    cells, err = invoiceCells(ctx, &invoice)
+                }
+            }
+            if err == nil {
+                err = projectEntity(ctx, coll.Name()+":"+id.Hex(), started, cells)
+            }
+            if err != nil {
+                cursor.Close(ctx)
+                return entities, err
+            }
+            entities++
+        }
+        err = cursor.Err()
+        cursor.Close(ctx)
+        if err != nil {
+            return entities, err
+        }
+    }
+    return entities, nil
+}
+
+// Report handlers
+
+// ReportRow is a row of a projected report. The fields that are not
+// grouped by are omitted.
+type ReportRow struct {
+    Day        string              `json:"day,omitempty"`
+    DoctorID   *primitive.ObjectID `json:"doctorId,omitempty"`
+    Department *string             `json:"department,omitempty"`
+    Values     map[string]int64    `json:"values"`
+}
+
+var reportGroups = []string{"day", "doctor", "department", "month"}
+
+// getReport returns a handler serving a projected report for the days of
+// ?month=YYYY-MM or within ?from= and ?to= (YYYY-MM-DD, inclusive), grouped
+// by ?groupBy=day|doctor|department|month (day by default).
+func getReport(report string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        query := r.URL.Query()
+        groupBy := query.Get("groupBy")
+        if groupBy == "" {
+            groupBy = "day"
+        }
+        if !slices.Contains(reportGroups, groupBy) {
+            localizedError(w, r, http.StatusBadRequest, "invalid_group_by", strings.Join(reportGroups, ", "))
+            return
+        }
+
+        days := bson.M{}
+        if month := query.Get("month"); month != "" {
+            if _, err := time.Parse("2006-01", month); err != nil {
+                localizedError(w, r, http.StatusBadRequest, "invalid_month", "month")
+                return
+            }
+            days["$gte"], days["$lte"] = month+"-01", month+"-31"
+        }
+        for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+            if day := query.Get(param); day != "" {
+                if _, err := time.Parse(time.DateOnly, day); err != nil {
+                    localizedError(w, r, http.StatusBadRequest, "invalid_date", param)
+                    return
+                }
+                days[op] = day
+            }
+        }
+        filter := bson.M{"report": report}
+        if len(days) > 0 {
+            filter["day"] = days
+        }
+
+        ctx := r.Context()
+
+        cursor, err := projectionCollection.Find(ctx, filter)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        var cells []ProjectionCell
+        if err := cursor.All(ctx, &cells); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        rows := map[string]*ReportRow{}
+        for _, cell := range cells {
+            var row ReportRow
+            var key string
+            switch groupBy {
+            case "day":
+                row.Day, key = cell.Day, cell.Day
+            case "month":
+                row.Day, key = cell.Day[:7], cell.Day[:7]
+            case "doctor":
+                row.DoctorID, key = &cell.DoctorID, cell.DoctorID.Hex()
+            case "department":
+                row.Department, key = &cell.Department, cell.Department
+            }
+            existing, ok := rows[key]
+            if !ok {
+                row.Values = map[string]int64{}
+                existing = &row
+                rows[key] = existing
+            }
+            for name, value := range cell.Values {
+                existing.Values[name] += value
+            }
+        }
+
+        keys := make([]string, 0, len(rows))
+        for key := range rows {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        result := make([]ReportRow, 0, len(rows))
+        for _, key := range keys {
+            result = append(result, *rows[key])
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+    }
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/i18n"
+)
+
+// Quota kinds
+const (
+    QuotaAppointments = "appointments_per_day" // bookings made in a day
+    QuotaSMS          = "sms_per_month"        // text messages sent in a month
+    QuotaStorage      = "storage_bytes"        // bytes of attachments stored
+)
+
+var quotaKinds = []string{QuotaAppointments, QuotaSMS, QuotaStorage}
+
+// Quota scopes
+const (
+    ScopeTenant = "tenant"
+    ScopeUser   = "user"
+)
+
+// quotaUsageRetention is how long past counters are kept for billing.
+const quotaUsageRetention = 400 * 24 * time.Hour
+
+// QuotaPlan limits the use of each kind by a tenant as a whole and by each
+// of its users. Kinds without a limit are unlimited, but still counted.
+type QuotaPlan struct {
+    Tenant map[string]int64 `json:"tenant"`
+    User   map[string]int64 `json:"user,omitempty"`
+}
+
+// TenantQuota puts a tenant on a plan of QUOTA_PLANS_FILE, with tenant
+// limits overriding those of the plan. Tenants without one are on
+// QUOTA_DEFAULT_PLAN.
+type TenantQuota struct {
+    TenantID  string           `json:"tenantId" bson:"_id"`
+    Plan      string           `json:"plan" bson:"plan"`
+    Limits    map[string]int64 `json:"limits,omitempty" bson:"limits,omitempty"`
+    UpdatedAt time.Time        `json:"updatedAt" bson:"updatedAt"`
+    UpdatedBy string           `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+}
+
+// QuotaUsage counts the use of a kind by a tenant, or by a user for a
+// tenant, in a period: a day, a month, or all time for storage.
+type QuotaUsage struct {
+    ID        string    `json:"-" bson:"_id"`
+    TenantID  string    `json:"tenantId" bson:"tenantId"`
+    Scope     string    `json:"scope" bson:"scope"`
+    Subject   string    `json:"subject" bson:"subject"` // tenant id or actor
+    Kind      string    `json:"kind" bson:"kind"`
+    Period    string    `json:"period" bson:"period"`
+    Used      int64     `json:"used" bson:"used"`
+    Limit     *int64    `json:"limit,omitempty" bson:"-"`
+    ExpiresAt time.Time `json:"-" bson:"expiresAt,omitempty"`
+}
+
+// QuotaError is the body of the 429, or 402 for storage, answered when a
+// quota is used up.
+type QuotaError struct {
+    Error   string     `json:"error"`
+    Message string     `json:"message"`
+    Kind    string     `json:"kind"`
+    Scope   string     `json:"scope"`
+    Limit   int64      `json:"limit"`
+    ResetAt *time.Time `json:"resetAt,omitempty"`
+}
+
+// quotaExceeded is returned by chargeQuota when a charge would go over a
+// limit.
+type quotaExceeded struct {
+    kind, scope string
+    limit       int64
+    reset       time.Time
+}
+
+func (e *quotaExceeded) Error() string {
+    return fmt.Sprintf("%s quota of %d %s used up", e.scope, e.limit, e.kind)
+}
+
+var (
+    quotaPlans           map[string]QuotaPlan
+    tenantQuotaCollection *mongo.Collection
+    quotaUsageCollection  *mongo.Collection
+)
+
+func initQuotas(ctx context.Context, db *mongo.Database) {
+    tenantQuotaCollection = db.Collection("tenant_quotas")
+    quotaUsageCollection = db.Collection("quota_usage")
+
+    quotaPlans = map[string]QuotaPlan{}
+    if config.QuotaPlansFile != "" {
+        var err error
+        if quotaPlans, err = loadQuotaPlans(config.QuotaPlansFile); err != nil {
+            log.Fatalf("Error loading quota plans: %v", err)
+        }
+    }
+    if _, ok := quotaPlans[config.QuotaDefaultPlan]; config.QuotaDefaultPlan != "" && !ok {
+        log.Fatalf("QUOTA_DEFAULT_PLAN %q is not in QUOTA_PLANS_FILE", config.QuotaDefaultPlan)
+    }
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "tenantId", Value: 1}, {Key: "period", Value: 1}}},
+        {Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    }
+    if _, err := quotaUsageCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating quota usage indexes: %v\n", err)
+    }
+}
+
+// loadQuotaPlans reads plans from a JSON object of QuotaPlan by name.
+func loadQuotaPlans(path string) (map[string]QuotaPlan, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var plans map[string]QuotaPlan
+    if err := json.Unmarshal(data, &plans); err != nil {
+        return nil, err
+    }
+    for name, plan := range plans {
+        for _, limits := range []map[string]int64{plan.Tenant, plan.User} {
+            if err := validateQuotaLimits(limits); err != nil {
+                return nil, fmt.Errorf("plan %s: %w", name, err)
+            }
+        }
+    }
+    return plans, nil
+}
+
+// validateQuotaLimits checks the kinds and values of limits.
+func validateQuotaLimits(limits map[string]int64) error {
+    for kind, limit := range limits {
+        if !slices.Contains(quotaKinds, kind) {
+            return newAPIError("invalid_choice", "kind", strings.Join(quotaKinds, ", "))
+        }
+        if limit < 0 {
+            return newAPIError("invalid_quota_limit", kind)
+        }
+    }
+    return nil
+}
+
+// quotaPeriod names the period a use at now counts in, and when the next
+// one starts. Storage is not periodic.
+func quotaPeriod(kind string, now time.Time) (string, time.Time) {
+    now = now.Local()
+    switch kind {
+    case QuotaAppointments:
+        day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+        return day.Format(time.DateOnly), day.AddDate(0, 0, 1)
+    case QuotaSMS:
+        month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+        return month.Format("2006-01"), month.AddDate(0, 1, 0)
+    }
+    return "total", time.Time{}
+}
+
+// tenantQuota returns the quota assignment of a tenant, or the default
+// plan.
+func tenantQuota(ctx context.Context, tenant string) (TenantQuota, error) {
+    quota := TenantQuota{TenantID: tenant, Plan: config.QuotaDefaultPlan}
+    err := tenantQuotaCollection.FindOne(ctx, bson.M{"_id": tenant}).Decode(&quota)
+    if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+        return TenantQuota{}, err
+    }
+    return quota, nil
+}
+
+// limits returns the limits of the tenant of an assignment in a scope.
+func (q TenantQuota) limits(scope string) map[string]int64 {
+    plan := quotaPlans[q.Plan]
+    if scope == ScopeUser {
+        return plan.User
+    }
+    limits := map[string]int64{}
+    for kind, limit := range plan.Tenant {
+        limits[kind] = limit
+    }
+    for kind, limit := range q.Limits {
+        limits[kind] = limit
+    }
+    return limits
+}
+
+// chargeQuota counts n uses of a kind against a tenant and, unless it is
+// "", an actor of it, failing with *quotaExceeded when that goes over a
+// limit of their plan. Negative charges give back what was charged, e.g. the
+// bytes of a deleted attachment. Called within withTransaction, the charge
+// is undone with the write it was made for.
+func chargeQuota(ctx context.Context, tenant, actor, kind string, n int64) error {
+    quota, err := tenantQuota(ctx, tenant)
+    if err != nil {
+        return err
+    }
+    period, reset := quotaPeriod(kind, time.Now())
+
+    subjects := [][2]string{{ScopeTenant, tenant}}
+    if actor != "" {
+        subjects = append(subjects, [2]string{ScopeUser, actor})
+    }
+    var charged []string
+    for _, subject := range subjects {
+        scope := subject[0]
+        limit, limited := quota.limits(scope)[kind]
+        usage := QuotaUsage{
+            ID:       quotaUsageID(tenant, scope, subject[1], kind, period),
+            TenantID: tenant,
+            Scope:    scope,
+            Subject:  subject[1],
+            Kind:     kind,
+            Period:   period,
+        }
+        if !reset.IsZero() {
+            usage.ExpiresAt = reset.Add(quotaUsageRetention)
+        }
+
+        err := incrementUsage(ctx, usage, n, limit, limited && n > 0)
+        if errors.Is(err, errQuotaExceeded) {
+            err = &quotaExceeded{kind: kind, scope: scope, limit: limit, reset: reset}
+        }
+        if err != nil {
+            for _, id := range charged {
+                quotaUsageCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"used": -n}})
+            }
+            return err
+        }
+        charged = append(charged, usage.ID)
+    }
+    return nil
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaUsageID is the id of the counter of a subject, e.g.
+// "user:acme/ana@example.com:sms_per_month:2026-10".
+func quotaUsageID(tenant, scope, subject, kind, period string) string {
+    if scope == ScopeUser {
+        subject = tenant + "/" + subject
+    }
+    return scope + ":" + subject + ":" + kind + ":" + period
+}
+
+// incrementUsage adds n to a counter, creating it if needed. With enforce,
+// it fails with errQuotaExceeded instead of going over limit.
+func incrementUsage(ctx context.Context, usage QuotaUsage, n, limit int64, enforce bool) error {
+    filter := bson.M{"_id": usage.ID}
+    if enforce {
+        if n > limit {
+            return errQuotaExceeded
+        }
+        filter["used"] = bson.M{"$lte": limit - n}
+    }
+    setOnInsert := bson.M{"tenantId": usage.TenantID, "scope": usage.Scope, "subject": usage.Subject, "kind": usage.Kind, "period": usage.Period}
+    if !usage.ExpiresAt.IsZero() {
+        setOnInsert["expiresAt"] = usage.ExpiresAt
+    }
+    _, err := quotaUsageCollection.UpdateOne(ctx, filter,
+        bson.M{"$inc": bson.M{"used": n}, "$setOnInsert": setOnInsert},
+        options.Update().SetUpsert(true))
+    // The counter exists but has no room: the upsert collides with it
+    if enforce && mongo.IsDuplicateKeyError(err) {
+        return errQuotaExceeded
+    }
+    return err
+}
+
+// writeQuotaError answers a used up quota: 429 with Retry-After until the
+// next period, or 402 for storage, which only a larger plan frees.
+func writeQuotaError(w http.ResponseWriter, r *http.Request, err *quotaExceeded) {
+    body := QuotaError{
+        Error:   "quota_exceeded",
+        Message: i18n.Message(requestLanguage(r), "error.quota_exceeded", err.kind, err.limit),
+        Kind:    err.kind,
+        Scope:   err.scope,
+        Limit:   err.limit,
+    }
+    status := http.StatusPaymentRequired
+    if !err.reset.IsZero() {
+        status = http.StatusTooManyRequests
+        body.ResetAt = &err.reset
+        w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(err.reset).Seconds())+1))
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
+
+// Quota handlers
+
+// tenantQuotaHandler returns the plan, limits and current usage of a
+// tenant (GET) or puts it on a plan (PUT, with a body of {"plan": ...,
+// "limits": {...}}): /admin/quotas/{tenant}
+func tenantQuotaHandler(w http.ResponseWriter, r *http.Request) {
+    tenant := r.PathValue("tenant")
+    ctx := r.Context()
+
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut:
+        var quota TenantQuota
+        if !decodeJSON(w, r, &quota) {
+            return
+        }
+        if _, ok := quotaPlans[quota.Plan]; !ok {
+            localizedError(w, r, http.StatusBadRequest, "quota_plan_not_found", quota.Plan)
+            return
+        }
+        if err := validateQuotaLimits(quota.Limits); err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return
+        }
+        quota.TenantID = tenant
+        quota.UpdatedAt = time.Now()
+        quota.UpdatedBy = actorFromContext(ctx)
+        _, err := tenantQuotaCollection.ReplaceOne(ctx, bson.M{"_id": tenant}, quota, options.Replace().SetUpsert(true))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    quota, err := tenantQuota(ctx, tenant)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    limits := quota.limits(ScopeTenant)
+    usage := make([]QuotaUsage, 0, len(quotaKinds))
+    for _, kind := range quotaKinds {
+        period, _ := quotaPeriod(kind, time.Now())
+        current := QuotaUsage{TenantID: tenant, Scope: ScopeTenant, Subject: tenant, Kind: kind, Period: period}
+        err := quotaUsageCollection.FindOne(ctx, bson.M{"_id": quotaUsageID(tenant, ScopeTenant, tenant, kind, period)}).Decode(&current)
+        if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if limit, ok := limits[kind]; ok {
+            current.Limit = &limit
+        }
+        usage = append(usage, current)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "tenantId":   tenant,
+        "plan":       quota.Plan,
+        "limits":     limits,
+        "userLimits": quotaPlans[quota.Plan].User,
+        "usage":      usage,
+    })
+}
+
+// getQuotaUsage reports the use of a tenant in a month, ?month=YYYY-MM or
+// the current one, for billing: the totals of the tenant, its counters and
+// those of its users for each day and the month, and the storage held now:
+// GET /admin/quotas/{tenant}/usage
+func getQuotaUsage(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    tenant := r.PathValue("tenant")
+    month := time.Now().Format("2006-01")
+    if m := r.URL.Query().Get("month"); m != "" {
+        if _, err := time.Parse("2006-01", m); err != nil {
+            writeError(w, r, http.StatusBadRequest, newAPIError("invalid_month", "month"))
+            return
+        }
+        month = m
+    }
+
+    ctx := r.Context()
+
+    quota, err := tenantQuota(ctx, tenant)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    cursor, err := quotaUsageCollection.Find(ctx, bson.M{
+        "tenantId": tenant,
+        "period":   bson.M{"$in": bson.A{month, "total", primitive.Regex{Pattern: "^" + month + "-"}}},
+    }, options.Find().SetSort(bson.D{{Key: "scope", Value: 1}, {Key: "subject", Value: 1}, {Key: "kind", Value: 1}, {Key: "period", Value: 1}}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    counters := []QuotaUsage{}
+    if err := cursor.All(ctx, &counters); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    totals := map[string]int64{}
+    for _, counter := range counters {
+        if counter.Scope == ScopeTenant {
+            totals[counter.Kind] += counter.Used
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "tenantId": tenant,
+        "plan":     quota.Plan,
+        "month":    month,
+        "totals":   totals,
+        "counters": counters,
+    })
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// rateLimiter is a token bucket per key: a key may make burst requests at
+// once and then rate per second. Limits are per instance.
+type rateLimiter struct {
+    rate  float64 // tokens per second
+    burst float64
+
+    mu      sync.Mutex
+    buckets map[string]*bucket
+    swept   time.Time
+}
+
+type bucket struct {
+    tokens float64
+    at     time.Time
+}
+
+// newRateLimiter returns a limiter of perMinute requests a minute with
+// bursts of burst.
+func newRateLimiter(perMinute, burst int64) *rateLimiter {
+    return &rateLimiter{
+        rate:    float64(perMinute) / 60,
+        burst:   float64(max(burst, 1)),
+        buckets: map[string]*bucket{},
+    }
+}
+
+// allow takes a token for key. When none is left it returns false and how
+// long until one is.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+    if l.rate <= 0 {
+        return true, 0
+    }
+    now := time.Now()
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.sweep(now)
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &bucket{tokens: l.burst, at: now}
+        l.buckets[key] = b
+    }
+    b.tokens = min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+    b.at = now
+    if b.tokens < 1 {
+        return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+    }
+    b.tokens--
+    return true, 0
+}
+
+// sweep forgets the buckets that have refilled, once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+    if now.Sub(l.swept) < time.Minute {
+        return
+    }
+    l.swept = now
+    full := time.Duration(l.burst / l.rate * float64(time.Second))
+    for key, b := range l.buckets {
+        if now.Sub(b.at) >= full {
+            delete(l.buckets, key)
+        }
+    }
+}
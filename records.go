@@ -0,0 +1,247 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/icd10"
+)
+
+// Diagnosis is an ICD-10 coded diagnosis. The description is filled in from
+// the code table when the record is created.
+type Diagnosis struct {
+    Code        string `json:"code" bson:"code"`
+    Description string `json:"description" bson:"description"`
+}
+
+type MedicalRecord struct {
+    Document      `bson:",inline"`
+    PatientID     primitive.ObjectID  `json:"patientId" bson:"patientId"`
+    DoctorID      primitive.ObjectID  `json:"doctorId" bson:"doctorId"`
+    AppointmentID *primitive.ObjectID `json:"appointmentId,omitempty" bson:"appointmentId,omitempty"`
+    Diagnoses     []Diagnosis         `json:"diagnoses" bson:"diagnoses"`
+    Procedures    []string            `json:"procedures,omitempty" bson:"procedures,omitempty"`
+    Notes         string              `json:"notes" bson:"notes"`
+}
+
+var (
+    recordCollection *mongo.Collection
+    recordRepo       *Repository[MedicalRecord, *MedicalRecord]
+    icd10Codes       *icd10.Table
+)
+
+func initRecords(ctx context.Context, db *mongo.Database) {
+    recordCollection = db.Collection("medical_records")
+    recordRepo = NewRepository[MedicalRecord](recordCollection, defaultHooks)
+
+    icd10Codes = icd10.Bundled()
+    if config.ICD10CodesFile != "" {
+        table, err := icd10.Load(config.ICD10CodesFile)
+        if err != nil {
+            log.Fatalf("Error loading ICD-10 codes: %v", err)
+        }
+        icd10Codes = table
+    }
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "patientId", Value: 1}, {Key: "createdAt", Value: -1}}},
+        {Keys: bson.D{{Key: "diagnoses.code", Value: 1}}},
+    }
+    if _, err := recordCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating medical record indexes: %v\n", err)
+    }
+}
+
+// validateRecord checks the referenced patient and doctor and replaces each
+// diagnosis with its canonical code table entry.
+func validateRecord(ctx context.Context, record *MedicalRecord) error {
+    patient, err := patientRepo.GetByID(ctx, record.PatientID)
+    if err != nil {
+        return newAPIError("patient_not_found")
+    }
+    doctor, err := doctorRepo.GetByID(ctx, record.DoctorID)
+    if err != nil {
+        return newAPIError("doctor_not_found")
+    }
+
+    for i, diagnosis := range record.Diagnoses {
+        code, ok := icd10Codes.Lookup(diagnosis.Code)
+        if !ok {
+            return newAPIError("unknown_icd10_code", diagnosis.Code)
+        }
+        record.Diagnoses[i] = Diagnosis{Code: code.Code, Description: code.Description}
+    }
+
+    if err := requireConsentForProcedures(ctx, record.PatientID, record.Procedures); err != nil {
+        return err
+    }
+    return checkRules(ctx, patient.TenantID, recordRuleSubject(patient, doctor, record))
+}
+
+// Medical record handlers
+func createRecord(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var record MedicalRecord
+    if !decodeJSON(w, r, &record) {
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := validateRecord(ctx, &record); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if !checkPatientAccess(w, r, record.PatientID) {
+        return
+    }
+
+    if err := recordRepo.Create(ctx, &record); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(record)
+}
+
+func getPatientRecords(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    patientID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_patient_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    records, err := recordRepo.List(ctx, bson.M{"patientId": patientID}, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, records)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(records)
+}
+
+// searchICD10Codes serves typeahead lookups: GET /codes/icd10?q=diab&limit=10
+func searchICD10Codes(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    limit := 20
+    if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+        limit = min(n, 100)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(icd10Codes.Search(r.URL.Query().Get("q"), limit))
+}
+
+// DiagnosisCount is a row of the diagnosis report.
+type DiagnosisCount struct {
+    Code        string `json:"code" bson:"_id"`
+    Description string `json:"description" bson:"description"`
+    Records     int    `json:"records" bson:"records"`
+    Patients    int    `json:"patients" bson:"patients"`
+}
+
+// getDiagnosisReport counts records and distinct patients per diagnosis
+// code, optionally within ?from= and ?to= dates (YYYY-MM-DD, inclusive).
+func getDiagnosisReport(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    match := bson.M{"deletedAt": nil}
+    created, err := dateRangeFilter(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if len(created) > 0 {
+        match["createdAt"] = created
+    }
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$unwind", Value: "$diagnoses"}},
+        {{Key: "$group", Value: bson.D{
+            {Key: "_id", Value: "$diagnoses.code"},
+            {Key: "description", Value: bson.D{{Key: "$first", Value: "$diagnoses.description"}}},
+            {Key: "records", Value: bson.D{{Key: "$sum", Value: 1}}},
+            {Key: "patientIds", Value: bson.D{{Key: "$addToSet", Value: "$patientId"}}},
+        }}},
+        {{Key: "$project", Value: bson.D{
+            {Key: "description", Value: 1},
+            {Key: "records", Value: 1},
+            {Key: "patients", Value: bson.D{{Key: "$size", Value: "$patientIds"}}},
+        }}},
+        {{Key: "$sort", Value: bson.D{{Key: "records", Value: -1}, {Key: "_id", Value: 1}}}},
+    }
+
+    ctx := r.Context()
+
+    cursor, err := recordCollection.Aggregate(ctx, pipeline)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer cursor.Close(ctx)
+
+    report := []DiagnosisCount{}
+    if err = cursor.All(ctx, &report); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
+
+// dateRangeFilter builds a range condition from the ?from= and ?to= dates.
+func dateRangeFilter(r *http.Request) (bson.M, error) {
+    cond := bson.M{}
+    if from := r.URL.Query().Get("from"); from != "" {
+        t, err := time.Parse(time.DateOnly, from)
+        if err != nil {
+            return nil, newAPIError("invalid_date", "from")
+        }
+        cond["$gte"] = t
+    }
+    if to := r.URL.Query().Get("to"); to != "" {
+        t, err := time.Parse(time.DateOnly, to)
+        if err != nil {
+            return nil, newAPIError("invalid_date", "to")
+        }
+        cond["$lt"] = t.AddDate(0, 0, 1)
+    }
+    return cond, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Document holds the identity and bookkeeping fields shared by all models.
+// Models embed it inline so the fields stay at the top level of both the
+// JSON and BSON representations.
+type Document struct {
+    ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+    UpdatedAt     time.Time          `json:"updatedAt" bson:"updatedAt"`
+    CreatedBy     string             `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+    UpdatedBy     string             `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+    DeletedAt     *time.Time         `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+    SchemaVersion int                `json:"-" bson:"schemaVersion,omitempty"` // of versioned collections, see schemas
+}
+
+func (d *Document) document() *Document { return d }
+
+// model is satisfied by pointers to structs embedding Document.
+type model[T any] interface {
+    *T
+    document() *Document
+}
+
+// Write operations reported to repository hooks
+type Operation string
+
+const (
+    OpCreate Operation = "create"
+    OpUpdate Operation = "update"
+    OpDelete Operation = "delete"
+)
+
+// Hooks run around every write of a repository. Before hooks may modify
+// the document and abort the write by returning an error; after hooks see
+// the stored document and only log their failures. Transactional hooks
+// instead run the write and the after hooks in one transaction, which
+// fails with them.
+type Hook func(ctx context.Context, coll string, op Operation, doc *Document) error
+
+type Hooks struct {
+    Before        []Hook
+    After         []Hook
+    Transactional bool
+}
+
+// defaultHooks maintain timestamps, authorship and schema versions and
+// record every write in the audit log.
+var defaultHooks = Hooks{
+    Before: []Hook{stampTimestamps, stampActor, stampSchemaVersion},
+    After:  []Hook{auditWrite},
+}
+
+// Page selects a window of a list: the page numbered from 1 or, with a
+// cursor, the one after it. A zero Size selects the whole list.
+type Page struct {
+    Number int64
+    Size   int64
+    After  *Cursor
+}
+
+const (
+    defaultPageSize = 50
+    maxPageSize     = 200
+)
+
+// parsePage reads the ?page=, ?pageSize= and ?cursor= query parameters.
+// A cursor takes precedence over the page number.
+func parsePage(r *http.Request) (Page, error) {
+    page := Page{Number: 1, Size: defaultPageSize}
+    if n, err := strconv.ParseInt(r.URL.Query().Get("page"), 10, 64); err == nil && n > 0 {
+        page.Number = n
+    }
+    if n, err := strconv.ParseInt(r.URL.Query().Get("pageSize"), 10, 64); err == nil && n > 0 {
+        page.Size = min(n, maxPageSize)
+    }
+    if token := r.URL.Query().Get("cursor"); token != "" {
+        after, err := parseCursor(token)
+        if err != nil {
+            return page, err
+        }
+        page.After = after
+    }
+    return page, nil
+}
+
+// Repository stores one model type in a collection. Soft deleted
+// documents are invisible to all reads.
+type Repository[T any, PT model[T]] struct {
+    coll  *mongo.Collection
+    hooks Hooks
+}
+
+func NewRepository[T any, PT model[T]](coll *mongo.Collection, hooks Hooks) *Repository[T, PT] {
+    return &Repository[T, PT]{coll: coll, hooks: hooks}
+}
+
+func (repo *Repository[T, PT]) Collection() *mongo.Collection {
+    return repo.coll
+}
+
+func (repo *Repository[T, PT]) Create(ctx context.Context, doc *T) error {
+    meta := PT(doc).document()
+    meta.ID = primitive.NewObjectID()
+    meta.DeletedAt = nil
+
+    if err := repo.before(ctx, OpCreate, meta); err != nil {
+        return err
+    }
+    return repo.write(ctx, func(ctx context.Context) error {
+        if _, err := repo.coll.InsertOne(ctx, doc); err != nil {
+            return err
+        }
+        return repo.after(ctx, OpCreate, meta)
+    })
+}
+
+// GetByID returns mongo.ErrNoDocuments when the document does not exist or
+// has been soft deleted.
+func (repo *Repository[T, PT]) GetByID(ctx context.Context, id primitive.ObjectID) (*T, error) {
+    var doc T
+    err := repo.coll.FindOne(ctx, bson.M{"_id": id, "deletedAt": nil}).Decode(&doc)
+    if err != nil {
+        return nil, err
+    }
+    return &doc, nil
+}
+
+func (repo *Repository[T, PT]) List(ctx context.Context, filter bson.M, page Page) ([]T, error) {
+    query := bson.M{"deletedAt": nil}
+    for k, v := range filter {
+        query[k] = v
+    }
+
+    cursor, err := repo.coll.Find(ctx, query, findPage(query, page, byID))
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    docs := []T{}
+    if err = cursor.All(ctx, &docs); err != nil {
+        return nil, err
+    }
+    return docs, nil
+}
+
+// Update overwrites the stored fields of document id with those of doc.
+// The identity and creation fields of the stored document are kept.
+func (repo *Repository[T, PT]) Update(ctx context.Context, id primitive.ObjectID, doc *T) error {
+    meta := PT(doc).document()
+    meta.ID = id
+
+    if err := repo.before(ctx, OpUpdate, meta); err != nil {
+        return err
+    }
+
+    fields, err := toBSONMap(doc)
+    if err != nil {
+        return err
+    }
+    delete(fields, "_id")
+    delete(fields, "createdAt")
+    delete(fields, "createdBy")
+    delete(fields, "deletedAt")
+
+    return repo.write(ctx, func(ctx context.Context) error {
+        result, err := repo.coll.UpdateOne(ctx, bson.M{"_id": id, "deletedAt": nil}, bson.M{"$set": fields})
+        if err != nil {
+            return err
+        }
+        if result.MatchedCount == 0 {
+            return mongo.ErrNoDocuments
+        }
+        return repo.after(ctx, OpUpdate, meta)
+    })
+}
+
+// UpdateFields sets fields on document id, provided it still matches cond.
+// It returns mongo.ErrNoDocuments when it does not, which makes it suitable
+// for guarded state transitions.
+func (repo *Repository[T, PT]) UpdateFields(ctx context.Context, id primitive.ObjectID, cond bson.M, fields bson.M) error {
+    return repo.Modify(ctx, id, cond, bson.M{"$set": fields})
+}
+
+// Modify applies the update operators of update to document id, provided
+// it still matches cond, like UpdateFields.
+func (repo *Repository[T, PT]) Modify(ctx context.Context, id primitive.ObjectID, cond bson.M, update bson.M) error {
+    meta := &Document{ID: id}
+    if err := repo.before(ctx, OpUpdate, meta); err != nil {
+        return err
+    }
+
+    filter := bson.M{"deletedAt": nil}
+    for k, v := range cond {
+        filter[k] = v
+    }
+    filter["_id"] = id
+
+    set := bson.M{"updatedAt": meta.UpdatedAt, "updatedBy": meta.UpdatedBy}
+    if fields, ok := update["$set"].(bson.M); ok {
+        for k, v := range fields {
+            set[k] = v
+        }
+    }
+    ops := bson.M{"$set": set}
+    for op, v := range update {
+        if op != "$set" {
+            ops[op] = v
+        }
+    }
+
+    return repo.write(ctx, func(ctx context.Context) error {
+        result, err := repo.coll.UpdateOne(ctx, filter, ops)
+        if err != nil {
+            return err
+        }
+        if result.MatchedCount == 0 {
+            return mongo.ErrNoDocuments
+        }
+        return repo.after(ctx, OpUpdate, meta)
+    })
+}
+
+func (repo *Repository[T, PT]) SoftDelete(ctx context.Context, id primitive.ObjectID) error {
+    meta := &Document{ID: id}
+    if err := repo.before(ctx, OpDelete, meta); err != nil {
+        return err
+    }
+
+    now := time.Now()
+    return repo.write(ctx, func(ctx context.Context) error {
+        result, err := repo.coll.UpdateOne(ctx,
+            bson.M{"_id": id, "deletedAt": nil},
+            bson.M{"$set": bson.M{"deletedAt": now, "updatedAt": meta.UpdatedAt, "updatedBy": meta.UpdatedBy}},
+        )
+        if err != nil {
+            return err
+        }
+        if result.MatchedCount == 0 {
+            return mongo.ErrNoDocuments
+        }
+        meta.DeletedAt = &now
+        return repo.after(ctx, OpDelete, meta)
+    })
+}
+
+func (repo *Repository[T, PT]) before(ctx context.Context, op Operation, meta *Document) error {
+    for _, hook := range repo.hooks.Before {
+        if err := hook(ctx, repo.coll.Name(), op, meta); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (repo *Repository[T, PT]) after(ctx context.Context, op Operation, meta *Document) error {
+    for _, hook := range repo.hooks.After {
+        err := hook(ctx, repo.coll.Name(), op, meta)
+        if err != nil && repo.hooks.Transactional {
+            return err
+        }
+        if err != nil {
+            log.Printf("Error running %s hook on %s: %v\n", op, repo.coll.Name(), err)
+        }
+    }
+    return nil
+}
+
+// write runs a write and its after hooks, in a transaction if the hooks
+// are transactional.
+func (repo *Repository[T, PT]) write(ctx context.Context, fn func(ctx context.Context) error) error {
+    if !repo.hooks.Transactional {
+        return fn(ctx)
+    }
+    return withTransaction(ctx, fn)
+}
+
+func toBSONMap(v any) (bson.M, error) {
+    data, err := bson.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+    var m bson.M
+    err = bson.Unmarshal(data, &m)
+    return m, err
+}
+
+// Hooks
+
+func stampTimestamps(ctx context.Context, coll string, op Operation, doc *Document) error {
+    now := time.Now()
+    if op == OpCreate {
+        doc.CreatedAt = now
+    }
+    doc.UpdatedAt = now
+    return nil
+}
+
+// stampActor records the authenticated user making the write.
+func stampActor(ctx context.Context, coll string, op Operation, doc *Document) error {
+    actor := actorFromContext(ctx)
+    if op == OpCreate {
+        doc.CreatedBy = actor
+    }
+    doc.UpdatedBy = actor
+    return nil
+}
+
+// AuditEntry records a single write made through a repository.
+type AuditEntry struct {
+    ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    Collection string             `json:"collection" bson:"collection"`
+    DocumentID primitive.ObjectID `json:"documentId" bson:"documentId"`
+    Operation  Operation          `json:"operation" bson:"operation"`
+    Actor      string             `json:"actor,omitempty" bson:"actor,omitempty"`
+    At         time.Time          `json:"at" bson:"at"`
+}
+
+func auditWrite(ctx context.Context, coll string, op Operation, doc *Document) error {
+    _, err := auditCollection.InsertOne(ctx, AuditEntry{
+        Collection: coll,
+        DocumentID: doc.ID,
+        Operation:  op,
+        Actor:      actorFromContext(ctx),
+        At:         time.Now(),
+    })
+    return err
+}
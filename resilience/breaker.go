@@ -0,0 +1,160 @@
+// Package resilience protects callers from slow or failing dependencies
+// with circuit breakers, bounded retries and timeouts.
+package resilience
+
+import (
+    "errors"
+    "sort"
+    "sync"
+    "time"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+    Closed   State = iota // calls pass
+    HalfOpen              // one trial call passes
+    Open                  // calls fail fast
+)
+
+func (s State) String() string {
+    switch s {
+    case HalfOpen:
+        return "half-open"
+    case Open:
+        return "open"
+    }
+    return "closed"
+}
+
+// ErrOpen is returned for calls rejected by an open breaker.
+var ErrOpen = errors.New("circuit breaker open")
+
+// Breaker stops calls to a dependency after Threshold consecutive failures.
+// After Cooldown it lets one trial call through, which closes it again on
+// success.
+type Breaker struct {
+    Name      string
+    Threshold int
+    Cooldown  time.Duration
+
+    mu       sync.Mutex
+    state    State
+    failures int // consecutive
+    openedAt time.Time
+    trial    bool // a half-open trial call is in flight
+
+    successes  uint64
+    failed     uint64
+    rejections uint64
+}
+
+var (
+    registryMu sync.Mutex
+    registry   = map[string]*Breaker{}
+)
+
+// NewBreaker returns the breaker of a dependency, registered for Stats.
+func NewBreaker(name string, threshold int, cooldown time.Duration) *Breaker {
+    b := &Breaker{Name: name, Threshold: threshold, Cooldown: cooldown}
+    registryMu.Lock()
+    registry[name] = b
+    registryMu.Unlock()
+    return b
+}
+
+// Allow reports whether a call may proceed, returning ErrOpen if not.
+// Allowed calls must report their outcome with Record. A nil breaker
+// allows everything.
+func (b *Breaker) Allow() error {
+    if b == nil {
+        return nil
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.state == Open && time.Since(b.openedAt) >= b.Cooldown {
+        b.state = HalfOpen
+    }
+    switch {
+    case b.state == Open, b.state == HalfOpen && b.trial:
+        b.rejections++
+        return ErrOpen
+    case b.state == HalfOpen:
+        b.trial = true
+    }
+    return nil
+}
+
+// Record reports the outcome of an allowed call.
+func (b *Breaker) Record(success bool) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.trial = false
+    if success {
+        b.successes++
+        b.failures = 0
+        b.state = Closed
+        return
+    }
+    b.failed++
+    b.failures++
+    if b.state == HalfOpen || b.Threshold > 0 && b.failures >= b.Threshold {
+        b.state = Open
+        b.openedAt = time.Now()
+    }
+}
+
+// BreakerStats is a snapshot of a breaker.
+type BreakerStats struct {
+    Name                string    `json:"name"`
+    State               State     `json:"-"`
+    StateName           string    `json:"state"`
+    ConsecutiveFailures int       `json:"consecutiveFailures"`
+    Successes           uint64    `json:"successes"`
+    Failures            uint64    `json:"failures"`
+    Rejections          uint64    `json:"rejections"`
+    OpenedAt            time.Time `json:"openedAt,omitempty"`
+}
+
+func (b *Breaker) Stats() BreakerStats {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    state := b.state
+    if state == Open && time.Since(b.openedAt) >= b.Cooldown {
+        state = HalfOpen
+    }
+    return BreakerStats{
+        Name:                b.Name,
+        State:               state,
+        StateName:           state.String(),
+        ConsecutiveFailures: b.failures,
+        Successes:           b.successes,
+        Failures:            b.failed,
+        Rejections:          b.rejections,
+        OpenedAt:            b.openedAt,
+    }
+}
+
+// Stats returns the snapshots of all breakers, sorted by name.
+func Stats() []BreakerStats {
+    registryMu.Lock()
+    breakers := make([]*Breaker, 0, len(registry))
+    for _, b := range registry {
+        breakers = append(breakers, b)
+    }
+    registryMu.Unlock()
+
+    stats := make([]BreakerStats, len(breakers))
+    for i, b := range breakers {
+        stats[i] = b.Stats()
+    }
+    sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+    return stats
+}
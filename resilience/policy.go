@@ -0,0 +1,141 @@
+package resilience
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand/v2"
+    "net/http"
+    "time"
+)
+
+// Policy is how calls to one dependency are made: bounded by Timeout,
+// retried up to Retries times after a doubling, jittered Backoff, and cut
+// off by Breaker while the dependency is failing.
+type Policy struct {
+    Name    string
+    Timeout time.Duration // of a whole call, retries included; 0 for none
+    Retries int
+    Backoff time.Duration
+    Breaker *Breaker
+}
+
+// permanentError is a failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error that must not be retried, such as a rejected
+// request. It does not count against the breaker: the dependency answered.
+func Permanent(err error) error {
+    if err == nil {
+        return nil
+    }
+    return &permanentError{err}
+}
+
+// Do calls fn under the policy.
+func (p *Policy) Do(ctx context.Context, fn func(context.Context) error) error {
+    if p.Timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+        defer cancel()
+    }
+    return p.do(ctx, p.Retries, fn)
+}
+
+func (p *Policy) do(ctx context.Context, retries int, fn func(context.Context) error) error {
+    backoff := p.Backoff
+    for attempt := 0; ; attempt++ {
+        if err := p.Breaker.Allow(); err != nil {
+            return fmt.Errorf("%s: %w", p.Name, err)
+        }
+        err := fn(ctx)
+        var permanent *permanentError
+        p.Breaker.Record(err == nil || errors.As(err, &permanent))
+        if err == nil || permanent != nil || attempt >= retries || ctx.Err() != nil {
+            return err
+        }
+
+        wait := backoff/2 + rand.N(backoff/2+1)
+        backoff *= 2
+        select {
+        case <-ctx.Done():
+            return err
+        case <-time.After(wait):
+        }
+    }
+}
+
+// Client returns an HTTP client making its requests under the policy.
+func (p *Policy) Client() *http.Client {
+    return &http.Client{Timeout: p.Timeout, Transport: &Transport{Policy: p}}
+}
+
+// statusError is a response status that counts as a failure of the
+// dependency.
+type statusError struct{ status string }
+
+func (e *statusError) Error() string { return e.status }
+
+// Transport is an http.RoundTripper applying a policy to each request.
+// Only requests that are safe to repeat are retried: idempotent methods
+// whose body can be replayed. 5xx and 429 responses count as failures and
+// the last one is returned to the caller as is.
+type Transport struct {
+    Base   http.RoundTripper // http.DefaultTransport if nil
+    Policy *Policy
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    base := t.Base
+    if base == nil {
+        base = http.DefaultTransport
+    }
+    retries := t.Policy.Retries
+    if !replayable(req) {
+        retries = 0
+    }
+
+    var resp *http.Response
+    first := true
+    err := t.Policy.do(req.Context(), retries, func(ctx context.Context) error {
+        if resp != nil {
+            resp.Body.Close()
+            resp = nil
+        }
+        attempt := req
+        if !first && req.Body != nil && req.Body != http.NoBody {
+            body, err := req.GetBody()
+            if err != nil {
+                return Permanent(err)
+            }
+            attempt = req.Clone(ctx)
+            attempt.Body = body
+        }
+        first = false
+
+        r, err := base.RoundTrip(attempt)
+        if err != nil {
+            return err
+        }
+        resp = r
+        if r.StatusCode >= 500 || r.StatusCode == http.StatusTooManyRequests {
+            return &statusError{r.Status}
+        }
+        return nil
+    })
+    if resp != nil {
+        return resp, nil
+    }
+    return nil, err
+}
+
+func replayable(req *http.Request) bool {
+    switch req.Method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+        return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+    }
+    return false
+}
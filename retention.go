@@ -0,0 +1,498 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// What happens to the data of inactive patients
+const (
+    RetentionAnonymize = "anonymize"
+    RetentionPurge     = "purge"
+)
+
+// retentionSampleSize bounds the patient IDs listed per tenant in a report.
+const retentionSampleSize = 1000
+
+// RetentionPolicy overrides the RETENTION_* defaults for the patients of a
+// tenant. InactiveYears 0 keeps their data forever.
+type RetentionPolicy struct {
+    Document      `bson:",inline"`
+    TenantID      string `json:"tenantId" bson:"tenantId"`
+    InactiveYears int64  `json:"inactiveYears" bson:"inactiveYears"`
+    Action        string `json:"action" bson:"action"`
+}
+
+// RetentionResult is the outcome of one policy in a retention run.
+type RetentionResult struct {
+    TenantID      string               `json:"tenantId,omitempty" bson:"tenantId,omitempty"`
+    InactiveYears int64                `json:"inactiveYears" bson:"inactiveYears"`
+    Action        string               `json:"action" bson:"action"`
+    Cutoff        *time.Time           `json:"cutoff,omitempty" bson:"cutoff,omitempty"`
+    Candidates    int64                `json:"candidates" bson:"candidates"`
+    Processed     int64                `json:"processed" bson:"processed"`
+    PatientIDs    []primitive.ObjectID `json:"patientIds" bson:"patientIds"`
+    Errors        []string             `json:"errors,omitempty" bson:"errors,omitempty"`
+}
+
+// RetentionReport records a retention run. Dry runs only report the
+// patients a run would process.
+type RetentionReport struct {
+    ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    DryRun     bool               `json:"dryRun" bson:"dryRun"`
+    Actor      string             `json:"actor" bson:"actor"`
+    StartedAt  time.Time          `json:"startedAt" bson:"startedAt"`
+    FinishedAt time.Time          `json:"finishedAt" bson:"finishedAt"`
+    Results    []RetentionResult  `json:"results" bson:"results"`
+}
+
+var (
+    retentionPolicyCollection *mongo.Collection
+    retentionReportCollection *mongo.Collection
+    retentionPolicyRepo       *Repository[RetentionPolicy, *RetentionPolicy]
+)
+
+func initRetention(ctx context.Context, db *mongo.Database) {
+    retentionPolicyCollection = db.Collection("retention_policies")
+    retentionReportCollection = db.Collection("retention_reports")
+    retentionPolicyRepo = NewRepository[RetentionPolicy](retentionPolicyCollection, defaultHooks)
+
+    index := mongo.IndexModel{
+        Keys:    bson.D{{Key: "tenantId", Value: 1}},
+        Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"deletedAt": bson.M{"$exists": false}}),
+    }
+    if _, err := retentionPolicyCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating retention policy index: %v\n", err)
+    }
+    index = mongo.IndexModel{Keys: bson.D{{Key: "startedAt", Value: -1}}}
+    if _, err := retentionReportCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating retention report index: %v\n", err)
+    }
+}
+
+func validateRetentionPolicy(policy *RetentionPolicy) error {
+    if policy.InactiveYears < 0 {
+        return newAPIError("invalid_retention_years")
+    }
+    if policy.Action != RetentionAnonymize && policy.Action != RetentionPurge {
+        return newAPIError("invalid_retention_action", policy.Action)
+    }
+    return nil
+}
+
+// runRetention applies the retention policies: the patients of each tenant
+// without activity since the cutoff of its policy are anonymized or
+// purged. Tenants without a policy of their own, and patients without a
+// tenant, fall under the RETENTION_* defaults.
+func runRetention(ctx context.Context, dryRun bool) (*RetentionReport, error) {
+    overrides, err := retentionPolicyRepo.List(ctx, bson.M{}, Page{})
+    if err != nil {
+        return nil, err
+    }
+
+    report := &RetentionReport{DryRun: dryRun, Actor: actorFromContext(ctx), StartedAt: time.Now()}
+    tenants := make([]string, 0, len(overrides))
+    for _, policy := range overrides {
+        tenants = append(tenants, policy.TenantID)
+        result, err := applyRetentionPolicy(ctx, policy, bson.M{"tenantId": policy.TenantID}, dryRun)
+        if err != nil {
+            return nil, err
+        }
+        report.Results = append(report.Results, result)
+    }
+    defaults := RetentionPolicy{InactiveYears: config.RetentionInactiveYears, Action: config.RetentionAction}
+    result, err := applyRetentionPolicy(ctx, defaults, bson.M{"tenantId": bson.M{"$nin": tenants}}, dryRun)
+    if err != nil {
+        return nil, err
+    }
+    report.Results = append(report.Results, result)
+
+    report.FinishedAt = time.Now()
+    inserted, err := retentionReportCollection.InsertOne(ctx, report)
+    if err != nil {
+        return nil, err
+    }
+    report.ID = inserted.InsertedID.(primitive.ObjectID)
+    return report, nil
+}
+
+func applyRetentionPolicy(ctx context.Context, policy RetentionPolicy, filter bson.M, dryRun bool) (RetentionResult, error) {
+    result := RetentionResult{
+        TenantID:      policy.TenantID,
+        InactiveYears: policy.InactiveYears,
+        Action:        policy.Action,
+        PatientIDs:    []primitive.ObjectID{},
+    }
+    if policy.InactiveYears <= 0 {
+        return result, nil
+    }
+    cutoff := time.Now().AddDate(-int(policy.InactiveYears), 0, 0)
+    result.Cutoff = &cutoff
+
+    // Soft deleted patients are included: their data is held all the same
+    filter["anonymizedAt"] = nil
+    filter["updatedAt"] = bson.M{"$lt": cutoff}
+    cursor, err := patientCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+    if err != nil {
+        return result, err
+    }
+    var candidates []primitive.ObjectID
+    for cursor.Next(ctx) {
+        var patient struct {
+            ID primitive.ObjectID `bson:"_id"`
+        }
+        if err := cursor.Decode(&patient); err != nil {
+            cursor.Close(ctx)
+            return result, err
+        }
+        candidates = append(candidates, patient.ID)
+    }
+    err = cursor.Err()
+    cursor.Close(ctx)
+    if err != nil {
+        return result, err
+    }
+
+    for _, id := range candidates {
+        active, err := activeSince(ctx, id, cutoff)
+        if err != nil {
+            return result, err
+        }
+        if active {
+            continue
+        }
+        result.Candidates++
+        if len(result.PatientIDs) < retentionSampleSize {
+            result.PatientIDs = append(result.PatientIDs, id)
+        }
+        if dryRun {
+            continue
+        }
+
+        process := anonymizePatient
+        if policy.Action == RetentionPurge {
+            process = purgePatient
+            // Time series collections take no part in transactions; a
+            // purge that fails after this is retried on the next run
+            if _, err := vitalCollection.DeleteMany(ctx, bson.M{"meta.patientId": id}); err != nil {
+                result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", id.Hex(), err))
+                continue
+            }
+        }
+        err = withTransaction(ctx, func(ctx context.Context) error { return process(ctx, id) })
+        if err != nil {
+            result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", id.Hex(), err))
+            continue
+        }
+        result.Processed++
+    }
+    return result, nil
+}
+
+// activeSince reports whether a patient had appointments, records,
+// prescriptions, consents, invoices or communications created or changed or
+// device readings taken since cutoff, or has an appointment after it.
+func activeSince(ctx context.Context, patientID primitive.ObjectID, cutoff time.Time) (bool, error) {
+    since := bson.M{"$gte": cutoff}
+    checks := []struct {
+        coll   *mongo.Collection
+        filter bson.M
+    }{
+        {appointmentCollection, bson.M{"patientId": patientID, "$or": bson.A{bson.M{"updatedAt": since}, bson.M{"dateTime": since}}}},
+        {recordCollection, bson.M{"patientId": patientID, "updatedAt": since}},
+        {prescriptionCollection, bson.M{"patientId": patientID, "updatedAt": since}},
+        {consentCollection, bson.M{"patientId": patientID, "updatedAt": since}},
+        {invoiceCollection, bson.M{"patientId": patientID, "updatedAt": since}},
+        {vitalCollection, bson.M{"meta.patientId": patientID, "takenAt": since}},
+        {communicationCollection, bson.M{"patientId": patientID, "updatedAt": since}},
+    }
+    for _, check := range checks {
+        n, err := check.coll.CountDocuments(ctx, check.filter, options.Count().SetLimit(1))
+        if err != nil {
+            return false, err
+        }
+        if n > 0 {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// anonymizePatient removes what identifies a patient and keeps what
+// statistics need: age, gender, blood group, diagnoses, procedures,
+// medications and invoice amounts. Call notes and secure messages lose
+// their text; text messages, which quote names and numbers, and attachments
+// are deleted.
+func anonymizePatient(ctx context.Context, patientID primitive.ObjectID) error {
+    now := time.Now()
+    actor := actorFromContext(ctx)
+    _, err := patientCollection.UpdateOne(ctx, bson.M{"_id": patientID}, bson.M{"$set": bson.M{
+        "name":            "",
+        "nameKeys":        nil,
+        "address":         "",
+        "location":        nil,
+        "geocodedAddress": "",
+        "email":           "anonymized-" + patientID.Hex() + "@invalid", // unique
+        "contactNo":       "",
+        "custom":          nil, // tenants may record anything in it
+        "tags":            nil,
+        "anonymizedAt":    now,
+        "updatedAt":       now,
+        "updatedBy":       actor,
+    }})
+    if err != nil {
+        return err
+    }
+
+    byPatient := bson.M{"patientId": patientID}
+    scrub := []struct {
+        coll   *mongo.Collection
+        fields bson.M
+    }{
+        {appointmentCollection, bson.M{"description": "", "cancellationReason": "", "custom": nil}},
+        {recordCollection, bson.M{"notes": ""}},
+        {prescriptionCollection, bson.M{"notes": ""}},
+        {consentCollection, bson.M{"signatureRef": ""}},
+        {communicationCollection, bson.M{"subject": "", "body": ""}},
+    }
+    for _, c := range scrub {
+        c.fields["updatedAt"], c.fields["updatedBy"] = now, actor
+        if _, err := c.coll.UpdateMany(ctx, byPatient, bson.M{"$set": c.fields}); err != nil {
+            return err
+        }
+    }
+    for _, coll := range []*mongo.Collection{smsCollection, failedNotificationCollection} {
+        if _, err := coll.DeleteMany(ctx, byPatient); err != nil {
+            return err
+        }
+    }
+    if err := deletePatientAttachments(ctx, patientID); err != nil {
+        return err
+    }
+    if err := streamWrite(ctx, patientCollection.Name(), OpUpdate, &Document{ID: patientID}); err != nil {
+        return err
+    }
+    return auditWrite(ctx, patientCollection.Name(), OpUpdate, &Document{ID: patientID})
+}
+
+// purgePatient deletes a patient and everything recorded about them,
+// except the access log, which must outlive the data it audits.
+func purgePatient(ctx context.Context, patientID primitive.ObjectID) error {
+    byPatient := bson.M{"patientId": patientID}
+    colls := []*mongo.Collection{
+        appointmentCollection, recordCollection, prescriptionCollection, consentCollection,
+        invoiceCollection, smsCollection, failedNotificationCollection, deviceCollection,
+        communicationCollection, vaccinationCollection, admissionCollection, wardEventCollection,
+        careTeamCollection, waitlistCollection,
+    }
+    for _, coll := range colls {
+        if _, err := coll.DeleteMany(ctx, byPatient); err != nil {
+            return err
+        }
+    }
+    if err := deletePatientAttachments(ctx, patientID); err != nil {
+        return err
+    }
+    if _, err := patientCollection.DeleteOne(ctx, bson.M{"_id": patientID}); err != nil {
+        return err
+    }
+    if err := streamWrite(ctx, patientCollection.Name(), OpDelete, &Document{ID: patientID}); err != nil {
+        return err
+    }
+    if err := recordWarehouseTombstone(ctx, patientID); err != nil {
+        return err
+    }
+    return auditWrite(ctx, patientCollection.Name(), OpDelete, &Document{ID: patientID})
+}
+
+// applyRetention is the scheduled retention run. With RETENTION_DRY_RUN it
+// only reports.
+func applyRetention(ctx context.Context) error {
+    report, err := runRetention(contextWithActor(ctx, "retention"), config.RetentionDryRun)
+    if err != nil {
+        return err
+    }
+    for _, result := range report.Results {
+        if result.Candidates > 0 {
+            log.Printf("Retention: %d of %d inactive patients of tenant %q %sd (dry run: %t)\n",
+                result.Processed, result.Candidates, result.TenantID, result.Action, report.DryRun)
+        }
+    }
+    return nil
+}
+
+// Retention handlers
+
+// getRetentionPolicies lists the default policy and the tenant overrides:
+// GET /admin/retention/policies
+func getRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    overrides, err := retentionPolicyRepo.List(ctx, bson.M{}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "default":   RetentionPolicy{InactiveYears: config.RetentionInactiveYears, Action: config.RetentionAction},
+        "overrides": overrides,
+    })
+}
+
+// tenantRetentionPolicy sets (PUT) or removes (DELETE) the policy of a
+// tenant: /admin/retention/policies/{tenant}
+func tenantRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+    tenant := r.PathValue("tenant")
+    switch r.Method {
+    case http.MethodPut:
+        putRetentionPolicy(w, r, tenant)
+    case http.MethodDelete:
+        deleteRetentionPolicy(w, r, tenant)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func putRetentionPolicy(w http.ResponseWriter, r *http.Request, tenant string) {
+    var policy RetentionPolicy
+    if !decodeJSON(w, r, &policy) {
+        return
+    }
+    policy.TenantID = tenant
+    if err := validateRetentionPolicy(&policy); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    existing, err := retentionPolicyRepo.List(ctx, bson.M{"tenantId": tenant}, Page{Number: 1, Size: 1})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if len(existing) == 0 {
+        err = retentionPolicyRepo.Create(ctx, &policy)
+    } else {
+        policy.Document = existing[0].Document
+        err = retentionPolicyRepo.UpdateFields(ctx, policy.ID, nil, bson.M{
+            "inactiveYears": policy.InactiveYears,
+            "action":        policy.Action,
+        })
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(policy)
+}
+
+func deleteRetentionPolicy(w http.ResponseWriter, r *http.Request, tenant string) {
+    ctx := r.Context()
+
+    existing, err := retentionPolicyRepo.List(ctx, bson.M{"tenantId": tenant}, Page{Number: 1, Size: 1})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if len(existing) == 0 {
+        localizedError(w, r, http.StatusNotFound, "retention_policy_not_found")
+        return
+    }
+    if err := retentionPolicyRepo.SoftDelete(ctx, existing[0].ID); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "retention_policy_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// runRetentionNow runs the retention policies and answers with the report:
+// POST /admin/retention/run. It is a dry run unless ?dryRun=false.
+func runRetentionNow(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    dryRun := true
+    if v := r.URL.Query().Get("dryRun"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_dry_run")
+            return
+        }
+        dryRun = b
+    }
+
+    ctx := r.Context()
+
+    report, err := runRetention(ctx, dryRun)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
+
+// getRetentionReports lists past retention runs, latest first:
+// GET /admin/retention/reports
+func getRetentionReports(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    filter := bson.M{}
+    cursor, err := retentionReportCollection.Find(ctx, filter, findPage(filter, page, listOrder{Key: "startedAt", Desc: true}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    reports := []RetentionReport{}
+    if err := cursor.All(ctx, &reports); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextCursor(w, r, page, len(reports), func() Cursor {
+        last := reports[len(reports)-1]
+        return Cursor{Key: last.StartedAt, ID: last.ID}
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(reports)
+}
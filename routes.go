@@ -0,0 +1,318 @@
+package main
+
+import (
+    "log"
+    "math"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "new/adminui"
+)
+
+// Route declares a route and the policies it is served with, so they are
+// read in one place rather than in wrappers around each handler. Requests
+// pass the policies in this order: methods, feature flag, access log,
+// authentication, rate limit and body policy.
+type Route struct {
+    Methods   []string // all when empty; GET does not imply HEAD
+    Path      string   // pattern of the mux, also the route of BODY_LIMITS and ROUTE_TIMEOUTS
+    Handler   http.HandlerFunc
+    Auth      authLevel
+    Flag      string        // feature flag the route needs
+    Audit     string        // resource reads are recorded as in the access log
+    Body      bool          // bodies are bounded and decoded by the body policy
+    RateLimit string        // class of RATE_LIMITS, unlimited if not configured
+    Timeout   time.Duration // REQUEST_TIMEOUT if 0, none if noTimeout
+}
+
+// authLevel is who may call a route.
+type authLevel int
+
+const (
+    authNone     authLevel = iota
+    authUser               // any signed in user
+    authCareTeam           // the care team of the patient {id}
+    authAdmin              // admins and the admin token
+    authPortal             // the portal key of the patient {id}
+)
+
+// noTimeout leaves a route without a time budget, e.g. for streams.
+const noTimeout time.Duration = -1
+
+// registerRoutes builds the chain of each route and registers it on mux.
+func registerRoutes(mux *http.ServeMux, routes []Route) {
+    limiters := map[string]*rateLimiter{}
+    for class, limit := range config.RateLimits {
+        limiters[class] = newRateLimiter(limit.PerMinute, limit.Burst)
+    }
+
+    for _, route := range routes {
+        h := route.Handler
+        if route.Body {
+            h = withBodyPolicy(route.Path, h)
+        }
+        if route.RateLimit != "" {
+            if limiter, ok := limiters[route.RateLimit]; ok {
+                h = withRateLimit(limiter, h)
+            }
+        }
+        switch route.Auth {
+        case authUser:
+            h = requireAuth(h)
+        case authCareTeam:
+            h = requireCareTeam(h)
+        case authAdmin:
+            h = requireAdmin(h)
+        case authPortal:
+            h = requirePortalKey(h)
+        }
+        if route.Audit != "" {
+            h = logAccess(route.Audit, h)
+        }
+        if route.Flag != "" {
+            h = requireFlag(route.Flag, h)
+        }
+        if len(route.Methods) > 0 {
+            h = allowMethods(route.Methods, h)
+        }
+
+        if route.Timeout != 0 {
+            defaultRouteTimeouts[route.Path] = max(route.Timeout, 0)
+        }
+        mux.HandleFunc(route.Path, h)
+    }
+
+    for class := range limiters {
+        if !slices.ContainsFunc(routes, func(route Route) bool { return route.RateLimit == class }) {
+            log.Printf("No route has the rate limit class %s of RATE_LIMITS\n", class)
+        }
+    }
+}
+
+// allowMethods answers other methods than methods with 405 and the Allow
+// header.
+func allowMethods(methods []string, next http.HandlerFunc) http.HandlerFunc {
+    allow := strings.Join(methods, ", ")
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !slices.Contains(methods, r.Method) {
+            w.Header().Set("Allow", allow)
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// withRateLimit limits the requests of each user, or of each client IP
+// before sign in, answering 429 with Retry-After past the limit.
+func withRateLimit(limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        key := "ip:" + clientIP(r)
+        if user := userFromContext(r.Context()); user != nil {
+            key = "user:" + user.ID.Hex()
+        }
+        if ok, wait := limiter.allow(key); !ok {
+            seconds := int64(math.Ceil(wait.Seconds()))
+            w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+            localizedError(w, r, http.StatusTooManyRequests, "rate_limited", seconds)
+            return
+        }
+        next(w, r)
+    }
+}
+
+var routes = []Route{
+    // Auth routes
+    {Methods: []string{http.MethodPost}, Path: "/auth/login", Handler: login, Body: true, RateLimit: "auth"},
+    {Methods: []string{http.MethodGet}, Path: "/auth/oidc/login", Handler: startSSOLogin, Timeout: 15 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/auth/oidc/callback", Handler: ssoCallback, Timeout: 15 * time.Second},
+    {Methods: []string{http.MethodPost}, Path: "/auth/refresh", Handler: refreshSession, Body: true, RateLimit: "auth"},
+    {Methods: []string{http.MethodPost}, Path: "/auth/logout", Handler: logout, Auth: authUser},
+    {Methods: []string{http.MethodGet, http.MethodDelete}, Path: "/auth/sessions", Handler: mySessions, Auth: authUser},
+    {Methods: []string{http.MethodDelete}, Path: "/auth/sessions/{id}", Handler: revokeMySession, Auth: authUser},
+    {Methods: []string{http.MethodGet}, Path: "/auth/me", Handler: getCurrentUser, Auth: authUser},
+    {Methods: []string{http.MethodPost}, Path: "/auth/password", Handler: changePassword, Auth: authUser, Body: true, RateLimit: "auth"},
+    {Methods: []string{http.MethodPost}, Path: "/auth/password/forgot", Handler: forgotPassword, Body: true, RateLimit: "auth"},
+    {Methods: []string{http.MethodPost}, Path: "/auth/password/reset", Handler: resetPassword, Body: true, RateLimit: "auth"},
+    {Methods: []string{http.MethodPost}, Path: "/auth/mfa/totp", Handler: setupTOTP, Auth: authUser},
+    {Methods: []string{http.MethodPost}, Path: "/auth/mfa/totp/enable", Handler: enableTOTP, Auth: authUser, Body: true, RateLimit: "auth"},
+    {Methods: []string{http.MethodPost}, Path: "/auth/mfa/totp/disable", Handler: disableTOTP, Auth: authUser, Body: true, RateLimit: "auth"},
+
+    // Patient routes
+    {Methods: []string{http.MethodPost}, Path: "/patients", Handler: createPatient, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/patients/list", Handler: getPatients, Audit: "patients"},
+    {Methods: []string{http.MethodGet}, Path: "/patients/search", Handler: searchPatients, Audit: "patients", RateLimit: "search"},
+    {Methods: []string{http.MethodPost}, Path: "/patients/tags", Handler: tagPatients, Auth: authUser, Body: true, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/patients/cohort", Handler: getCohort, Audit: "cohort"},
+    {Methods: []string{http.MethodGet}, Path: "/tags", Handler: getTags},
+    {Methods: []string{http.MethodGet, http.MethodPatch}, Path: "/patients/{id}", Handler: patient, Auth: authCareTeam, Audit: "patient", Body: true},
+
+    // Doctor routes
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/doctors", Handler: doctors, Body: true},
+    {Methods: []string{http.MethodGet, http.MethodPatch}, Path: "/doctors/{id}", Handler: doctor, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/doctors/nearest", Handler: getNearestDoctors, Audit: "patient_location", RateLimit: "search"},
+    {Methods: []string{http.MethodGet}, Path: "/doctors/{id}/slots", Handler: getDoctorSlots, RateLimit: "search"},
+    {Methods: []string{http.MethodGet}, Path: "/doctors/suggestions", Handler: getDoctorSuggestions, RateLimit: "search"},
+    {Methods: []string{http.MethodPost}, Path: "/slots/hold", Handler: slotHold, Body: true, RateLimit: "booking"},
+    {Methods: []string{http.MethodDelete}, Path: "/slots/hold/{id}", Handler: releaseSlotHold},
+    {Methods: []string{http.MethodGet}, Path: "/doctors/{id}/calendar.ics", Handler: getDoctorCalendar, Audit: "calendar"},
+    {Methods: []string{http.MethodGet}, Path: "/specializations", Handler: getSpecializations},
+
+    // Waitlist
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/waitlist", Handler: waitlist, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodDelete}, Path: "/waitlist/{id}", Handler: removeWaitlistEntry, Auth: authUser},
+    {Methods: []string{http.MethodPost}, Path: "/waitlist/{id}/confirm", Handler: confirmWaitlistOffer, Auth: authUser, RateLimit: "booking"},
+
+    // Appointment routes
+    {Methods: []string{http.MethodPost}, Path: "/appointments", Handler: createAppointment, Body: true, RateLimit: "booking"},
+    {Methods: []string{http.MethodGet}, Path: "/appointments/list", Handler: getAppointments, Audit: "appointments"},
+    {Methods: []string{http.MethodGet, http.MethodPatch}, Path: "/appointments/{id}", Handler: appointment, Auth: authUser, Audit: "appointment", Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/appointments/{id}/check-in", Handler: checkInAppointment},
+    {Methods: []string{http.MethodPost}, Path: "/appointments/{id}/cancel", Handler: cancelAppointment, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/appointments/{id}/video/doctor", Handler: joinVideoAsDoctor, Auth: authUser, Timeout: 15 * time.Second},
+    {Methods: []string{http.MethodPost}, Path: "/appointments/{id}/video/patient", Handler: joinVideoAsPatient, Timeout: 15 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/appointments/{id}/pdf", Handler: getAppointmentSlip, Audit: "appointment_slip"},
+
+    // Saved search routes
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/saved-searches", Handler: savedSearches, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodGet, http.MethodPatch, http.MethodDelete}, Path: "/saved-searches/{id}", Handler: savedSearch, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/saved-searches/{id}/results", Handler: getSavedSearchResults, Auth: authUser},
+
+    // Department routes
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/departments", Handler: departments, Body: true},
+
+    // Facilities
+    {Methods: []string{http.MethodGet}, Path: "/facilities", Handler: facilities},
+    {Methods: []string{http.MethodGet}, Path: "/facilities/nearest", Handler: getNearestFacilities, Audit: "patient_location", RateLimit: "search"},
+
+    // Medical record routes
+    {Methods: []string{http.MethodPost}, Path: "/records", Handler: createRecord, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/patients/{id}/devices", Handler: patientDevices, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodDelete}, Path: "/patients/{id}/devices/{deviceId}", Handler: revokeDevice, Auth: authUser},
+    {Methods: []string{http.MethodPost}, Path: "/patients/{id}/device-data", Handler: ingestDeviceData, Body: true, Timeout: 10 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/vitals", Handler: getPatientVitals, Auth: authCareTeam, Audit: "vitals", Timeout: 10 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/records", Handler: getPatientRecords, Auth: authCareTeam, Audit: "records"},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/patients/{id}/vaccinations", Handler: patientVaccinationsHandler, Auth: authCareTeam, Audit: "vaccinations", Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/vaccinations/due", Handler: getDueVaccinations, Auth: authCareTeam, Audit: "vaccinations"},
+    {Methods: []string{http.MethodGet}, Path: "/vaccines", Handler: getVaccines},
+
+    // Care teams
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/patients/{id}/care-team", Handler: patientCareTeam, Auth: authUser, Audit: "care_team", Body: true},
+    {Methods: []string{http.MethodPatch, http.MethodDelete}, Path: "/patients/{id}/care-team/{userId}", Handler: careTeamMemberHandler, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/care-team/patients", Handler: getMyPatients, Auth: authUser, Audit: "patients"},
+
+    // Communications
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/patients/{id}/communications", Handler: patientCommunications, Auth: authCareTeam, Audit: "communications", Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/communications/threads", Handler: getCommunicationThreads, Auth: authCareTeam, Audit: "communications"},
+    {Methods: []string{http.MethodPost}, Path: "/patients/{id}/communications/threads/{threadId}/read", Handler: readCommunicationThread, Auth: authCareTeam},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/portal-link", Handler: getPortalLink, Auth: authCareTeam, Audit: "portal_link"},
+    {Methods: []string{http.MethodGet}, Path: "/communications/unread", Handler: getUnreadCommunications, Auth: authUser},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/portal/{id}/messages", Handler: portalMessages, Auth: authPortal, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/portal/{id}/messages/{threadId}/read", Handler: readPortalThread, Auth: authPortal},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/portal/{id}/waitlist", Handler: portalWaitlist, Auth: authPortal, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/portal/{id}/waitlist/{entryId}/confirm", Handler: confirmPortalWaitlistOffer, Auth: authPortal, RateLimit: "booking"},
+    {Methods: []string{http.MethodPost}, Path: "/portal/{id}/waitlist/{entryId}/decline", Handler: declinePortalWaitlistEntry, Auth: authPortal},
+
+    // Attachments
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/patients/{id}/attachments", Handler: patientAttachments, Auth: authCareTeam, Audit: "attachments", RateLimit: "upload", Timeout: 2 * time.Minute},
+    {Methods: []string{http.MethodGet, http.MethodHead, http.MethodDelete}, Path: "/attachments/{id}", Handler: attachment, Auth: authUser, Audit: "attachment", Timeout: 2 * time.Minute},
+
+    // Wards
+    {Methods: []string{http.MethodGet}, Path: "/wards", Handler: wards},
+    {Methods: []string{http.MethodGet}, Path: "/wards/{id}/board", Handler: getWardBoard, Auth: authUser, Audit: "ward_board"},
+    {Methods: []string{http.MethodGet}, Path: "/wards/{id}/events", Handler: streamWardEvents, Auth: authUser, Audit: "ward_events", Timeout: noTimeout},
+    {Methods: []string{http.MethodPost}, Path: "/wards/{id}/admissions", Handler: admitPatient, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/admissions/{id}/transfer", Handler: transferPatient, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/admissions/{id}/discharge", Handler: dischargePatient, Auth: authUser},
+    {Methods: []string{http.MethodGet}, Path: "/codes/icd10", Handler: searchICD10Codes, RateLimit: "search"},
+    {Methods: []string{http.MethodGet}, Path: "/reports/diagnoses", Handler: getDiagnosisReport},
+    {Methods: []string{http.MethodGet}, Path: "/reports/utilization", Handler: getReport(ReportUtilization), Auth: authAdmin},
+    {Methods: []string{http.MethodGet}, Path: "/reports/capacity", Handler: getCapacityReport, Auth: authAdmin, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/reports/immunizations/overdue", Handler: getOverdueReport, Auth: authAdmin, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/reports/revenue", Handler: getReport(ReportRevenue), Auth: authAdmin, Flag: FlagBilling},
+
+    // Prescription routes
+    {Methods: []string{http.MethodPost}, Path: "/prescriptions", Handler: createPrescription, Auth: authUser, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/prescriptions/{id}/pdf", Handler: getPrescriptionPDF, Auth: authUser, Audit: "prescription"},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/prescriptions", Handler: getPatientPrescriptions, Auth: authCareTeam, Audit: "prescriptions"},
+
+    // Consent routes
+    {Methods: []string{http.MethodPost}, Path: "/consents", Handler: createConsent, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/consents/{id}/revoke", Handler: revokeConsent},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/consents", Handler: getPatientConsents, Audit: "consents"},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/consents/verify", Handler: verifyConsent, Audit: "consents"},
+
+    // Billing routes
+    {Methods: []string{http.MethodGet}, Path: "/invoices/{id}", Handler: getInvoice, Flag: FlagBilling, Audit: "invoice"},
+    {Methods: []string{http.MethodGet}, Path: "/invoices/{id}/pdf", Handler: getInvoicePDF, Flag: FlagBilling, Audit: "invoice"},
+    {Methods: []string{http.MethodGet}, Path: "/patients/{id}/invoices", Handler: getPatientInvoices, Flag: FlagBilling, Audit: "invoices"},
+
+    // Admin routes
+    {Methods: []string{http.MethodGet}, Path: "/admin/summary", Handler: getAdminSummary, Auth: authAdmin},
+    {Methods: []string{http.MethodGet}, Path: "/admin/stats", Handler: getAdminStats, Auth: authAdmin},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/admin/custom-fields", Handler: adminCustomFields, Auth: authAdmin, Body: true, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodPatch, http.MethodDelete}, Path: "/admin/custom-fields/{id}", Handler: adminCustomField, Auth: authAdmin, Body: true, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodPost}, Path: "/admin/tags", Handler: createTag, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodDelete}, Path: "/admin/tags/{id}", Handler: deleteTag, Auth: authAdmin},
+    {Methods: []string{http.MethodPost}, Path: "/admin/wards", Handler: createWard, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPatch}, Path: "/admin/wards/{id}", Handler: patchWard, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/admin/facilities", Handler: createFacility, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPatch}, Path: "/admin/facilities/{id}", Handler: patchFacility, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/admin/rules", Handler: adminRules, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/admin/rules/evaluate", Handler: evaluateRules, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPatch, http.MethodDelete}, Path: "/admin/rules/{id}", Handler: adminRule, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/admin/outreach", Handler: sendOutreach, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/admin/specializations", Handler: adminSpecializations, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodDelete}, Path: "/admin/specializations/{id}", Handler: deleteSpecialization, Auth: authAdmin},
+    {Methods: []string{http.MethodPut}, Path: "/admin/departments/{id}/hours", Handler: setDepartmentHours, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPut}, Path: "/admin/departments/{id}/capacity", Handler: putDepartmentCapacity, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/admin/holidays", Handler: adminHolidays, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodDelete}, Path: "/admin/holidays/{id}", Handler: deleteHoliday, Auth: authAdmin},
+    {Methods: []string{http.MethodPost}, Path: "/admin/doctors/{id}/calendar-token", Handler: rotateCalendarToken, Auth: authAdmin},
+    {Methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, Path: "/admin/doctors/{id}/google", Handler: adminDoctorGoogle, Auth: authAdmin, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/admin/notifications/failed", Handler: getFailedNotifications, Auth: authAdmin},
+    {Methods: []string{http.MethodPost}, Path: "/admin/notifications/failed/{id}/retry", Handler: retryFailedNotification, Auth: authAdmin, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodGet}, Path: "/admin/outbox", Handler: getOutbox, Auth: authAdmin},
+    {Methods: []string{http.MethodPost}, Path: "/admin/outbox/{id}/retry", Handler: retryOutboxEvent, Auth: authAdmin, Timeout: 30 * time.Second},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/admin/users", Handler: adminUsers, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodPost}, Path: "/admin/users/{id}/unlock", Handler: unlockUser, Auth: authAdmin},
+    {Methods: []string{http.MethodDelete}, Path: "/admin/users/{id}/mfa", Handler: resetUserMFA, Auth: authAdmin},
+    {Methods: []string{http.MethodGet, http.MethodDelete}, Path: "/admin/users/{id}/sessions", Handler: adminUserSessions, Auth: authAdmin},
+    {Methods: []string{http.MethodGet}, Path: "/admin/access-logs", Handler: exportAccessLogs, Auth: authAdmin, Audit: "access_log", Timeout: time.Minute},
+    {Methods: []string{http.MethodGet}, Path: "/admin/retention/policies", Handler: getRetentionPolicies, Auth: authAdmin},
+    {Methods: []string{http.MethodPut, http.MethodDelete}, Path: "/admin/retention/policies/{tenant}", Handler: tenantRetentionPolicy, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodGet, http.MethodPut}, Path: "/admin/quotas/{tenant}", Handler: tenantQuotaHandler, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/admin/quotas/{tenant}/usage", Handler: getQuotaUsage, Auth: authAdmin},
+    {Methods: []string{http.MethodPost}, Path: "/admin/retention/run", Handler: runRetentionNow, Auth: authAdmin, Timeout: 10 * time.Minute},
+    {Methods: []string{http.MethodGet}, Path: "/admin/retention/reports", Handler: getRetentionReports, Auth: authAdmin},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/admin/backups", Handler: adminBackups, Auth: authAdmin},
+    {Methods: []string{http.MethodGet}, Path: "/admin/backups/{id}", Handler: getBackup, Auth: authAdmin},
+    {Methods: []string{http.MethodGet, http.MethodPost}, Path: "/admin/warehouse", Handler: adminWarehouse, Auth: authAdmin, Timeout: 10 * time.Minute},
+    {Methods: []string{http.MethodDelete}, Path: "/admin/warehouse/{table}", Handler: resetWarehouseMark, Auth: authAdmin},
+    {Methods: []string{http.MethodGet}, Path: "/admin/schemas", Handler: getSchemas, Auth: authAdmin},
+    {Methods: []string{http.MethodPost}, Path: "/admin/schemas/{collection}/upgrade", Handler: upgradeSchema, Auth: authAdmin, Timeout: 10 * time.Minute},
+    {Methods: []string{http.MethodGet, http.MethodPut}, Path: "/admin/mode", Handler: adminServiceMode, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/admin/flags", Handler: getFlags, Auth: authAdmin},
+    {Methods: []string{http.MethodPut, http.MethodDelete}, Path: "/admin/flags/{name}", Handler: adminFlag, Auth: authAdmin, Body: true},
+    {Methods: []string{http.MethodGet}, Path: "/admin/email/templates", Handler: getEmailTemplates, Auth: authAdmin},
+    {Methods: []string{http.MethodGet}, Path: "/admin/email/templates/{name}/preview", Handler: previewEmailTemplate, Auth: authAdmin},
+
+    // Admin app
+    {Methods: []string{http.MethodGet}, Path: "/admin/{$}", Handler: adminui.Handler("/admin/").ServeHTTP},
+    {Methods: []string{http.MethodGet}, Path: "/admin/app.js", Handler: adminui.Handler("/admin/").ServeHTTP},
+    {Methods: []string{http.MethodGet}, Path: "/admin/app.css", Handler: adminui.Handler("/admin/").ServeHTTP},
+    {Path: "/admin", Handler: http.RedirectHandler("/admin/", http.StatusMovedPermanently).ServeHTTP},
+
+    // Integrations
+    {Methods: []string{http.MethodGet}, Path: "/integrations/google/callback", Handler: googleCalendarCallback, Timeout: 15 * time.Second},
+    {Methods: []string{http.MethodPost}, Path: "/webhooks/sms/status", Handler: smsStatusCallback},
+
+    // Diagnostics; withDebugAuth keeps /debug to admins
+    {Methods: []string{http.MethodGet, http.MethodHead}, Path: "/readyz", Handler: getReadiness},
+    {Methods: []string{http.MethodGet}, Path: "/debug/dbstats", Handler: getDBStats},
+    {Methods: []string{http.MethodGet}, Path: "/debug/snapshot", Handler: getDebugSnapshot},
+    {Methods: []string{http.MethodGet}, Path: "/metrics", Handler: getMetrics},
+}
@@ -0,0 +1,171 @@
+package rsql
+
+import (
+    "fmt"
+    "regexp"
+    "time"
+)
+
+// Match reports whether doc matches a filter returned by Filter, as
+// MongoDB would match a document with the fields of doc. Fields are looked
+// up by their Name as is, dots included. As in MongoDB, a constraint on a
+// field holding a list holds if it holds for an element, and missing
+// fields only match != and =out=.
+func Match(filter map[string]interface{}, doc map[string]interface{}) bool {
+    for key, cond := range filter {
+        switch key {
+        case "$and":
+            for _, term := range cond.([]interface{}) {
+                if !Match(term.(map[string]interface{}), doc) {
+                    return false
+                }
+            }
+        case "$or":
+            matched := false
+            for _, term := range cond.([]interface{}) {
+                if Match(term.(map[string]interface{}), doc) {
+                    matched = true
+                    break
+                }
+            }
+            if !matched {
+                return false
+            }
+        default:
+            if !matchField(cond.(map[string]interface{}), doc[key]) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// matchField reports whether value meets the operators of a constraint.
+func matchField(ops map[string]interface{}, value interface{}) bool {
+    for op, arg := range ops {
+        var ok bool
+        switch op {
+        case "$not":
+            ok = !matchField(arg.(map[string]interface{}), value)
+        case "$ne":
+            ok = !anyElement(value, func(v interface{}) bool { return compare(v, arg) == 0 })
+        case "$nin":
+            ok = !anyElement(value, func(v interface{}) bool { return in(v, arg.([]interface{})) })
+        case "$in":
+            ok = anyElement(value, func(v interface{}) bool { return in(v, arg.([]interface{})) })
+        case "$regex":
+            pattern := regexp.MustCompile(arg.(string))
+            ok = anyElement(value, func(v interface{}) bool {
+                s, isString := v.(string)
+                return isString && pattern.MatchString(s)
+            })
+        default:
+            ok = anyElement(value, func(v interface{}) bool {
+                c := compare(v, arg)
+                switch op {
+                case "$eq":
+                    return c == 0
+                case "$lt":
+                    return c == -1
+                case "$lte":
+                    return c == -1 || c == 0
+                case "$gt":
+                    return c == 1
+                case "$gte":
+                    return c == 1 || c == 0
+                }
+                return false
+            })
+        }
+        if !ok {
+            return false
+        }
+    }
+    return true
+}
+
+func in(v interface{}, list []interface{}) bool {
+    for _, item := range list {
+        if compare(v, item) == 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// anyElement applies test to value or, for lists, to each element.
+func anyElement(value interface{}, test func(interface{}) bool) bool {
+    switch list := value.(type) {
+    case []string:
+        for _, v := range list {
+            if test(v) {
+                return true
+            }
+        }
+        return false
+    case []interface{}:
+        for _, v := range list {
+            if test(v) {
+                return true
+            }
+        }
+        return false
+    case nil:
+        return false
+    }
+    return test(value)
+}
+
+// compare orders a and b: -1, 0 or 1, or 2 when they are of types that do
+// not compare.
+func compare(a, b interface{}) int {
+    if x, ok := number(a); ok {
+        if y, ok := number(b); ok {
+            return order(x < y, x > y)
+        }
+        return 2
+    }
+    switch x := a.(type) {
+    case string:
+        if y, ok := b.(string); ok {
+            return order(x < y, x > y)
+        }
+    case bool:
+        if y, ok := b.(bool); ok && x == y {
+            return 0
+        }
+    case time.Time:
+        if y, ok := b.(time.Time); ok {
+            return order(x.Before(y), x.After(y))
+        }
+    default:
+        if fmt.Sprint(a) == fmt.Sprint(b) {
+            return 0
+        }
+    }
+    return 2
+}
+
+func order(less, greater bool) int {
+    switch {
+    case less:
+        return -1
+    case greater:
+        return 1
+    }
+    return 0
+}
+
+func number(v interface{}) (float64, bool) {
+    switch n := v.(type) {
+    case int:
+        return float64(n), true
+    case int32:
+        return float64(n), true
+    case int64:
+        return float64(n), true
+    case float64:
+        return n, true
+    }
+    return 0, false
+}
@@ -0,0 +1,331 @@
+// Package rsql parses a subset of RSQL/FIQL filter expressions, such as
+// age=ge=65;bloodGroup=="O+", into MongoDB filters. Only the fields of a
+// Schema can be filtered on, with the operators their types allow, so
+// expressions from clients cannot reach other fields or query operators.
+//
+// Constraints are selector, operator and argument: ==, !=, <, =lt=, <=,
+// =le=, >, =gt=, >=, =ge=, and =in= and =out= with a parenthesized list.
+// ; (or "and") joins constraints that must all hold and , (or "or")
+// alternatives; ; binds tighter, and parentheses group. Arguments with
+// reserved characters or spaces are quoted with ' or ". == and != on text
+// accept * as a wildcard.
+package rsql
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Limits on expressions
+const (
+    MaxLength      = 2000
+    MaxConstraints = 50
+)
+
+// Type is the type of a field, which decides how arguments are parsed and
+// which operators apply.
+type Type int
+
+const (
+    String Type = iota
+    Int
+    Float
+    Bool
+    Time // RFC 3339 or YYYY-MM-DD
+    // Custom parses arguments with the Parse function of the field and
+    // allows equality operators only.
+    Custom
+)
+
+// Field is a field clients may filter on.
+type Field struct {
+    Name  string // in the documents
+    Type  Type
+    Parse func(string) (interface{}, error) // of Custom fields
+}
+
+// Schema maps the selectors of expressions to fields.
+type Schema map[string]Field
+
+// Error describes an invalid expression.
+type Error struct {
+    Pos int // byte offset in the expression
+    Msg string
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+}
+
+var mongoOps = map[string]string{
+    "==": "$eq", "!=": "$ne",
+    "<": "$lt", "=lt=": "$lt", "<=": "$lte", "=le=": "$lte",
+    ">": "$gt", "=gt=": "$gt", ">=": "$gte", "=ge=": "$gte",
+    "=in=": "$in", "=out=": "$nin",
+}
+
+// Operators in the order they are matched, longest first
+var operators = []string{"=out=", "=in=", "=lt=", "=le=", "=gt=", "=ge=", "==", "!=", "<=", ">=", "<", ">"}
+
+// Filter parses expr and returns the equivalent filter. An empty
+// expression matches every document.
+func (s Schema) Filter(expr string) (map[string]interface{}, error) {
+    if strings.TrimSpace(expr) == "" {
+        return map[string]interface{}{}, nil
+    }
+    if len(expr) > MaxLength {
+        return nil, &Error{Pos: MaxLength, Msg: fmt.Sprintf("expression longer than %d characters", MaxLength)}
+    }
+    p := &parser{schema: s, input: expr}
+    filter, err := p.or()
+    if err != nil {
+        return nil, err
+    }
+    p.skipSpace()
+    if p.pos < len(p.input) {
+        return nil, p.errorf("unexpected %q", p.input[p.pos])
+    }
+    return filter, nil
+}
+
+type parser struct {
+    schema      Schema
+    input       string
+    pos         int
+    constraints int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+    return &Error{Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpace() {
+    for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+        p.pos++
+    }
+}
+
+// separator consumes the symbol or keyword of a logical operator.
+func (p *parser) separator(symbol byte, keyword string) bool {
+    p.skipSpace()
+    if p.pos < len(p.input) && p.input[p.pos] == symbol {
+        p.pos++
+        return true
+    }
+    rest := p.input[p.pos:]
+    if strings.HasPrefix(rest, keyword+" ") && p.pos > 0 && p.input[p.pos-1] == ' ' {
+        p.pos += len(keyword)
+        return true
+    }
+    return false
+}
+
+func (p *parser) or() (map[string]interface{}, error) {
+    return p.list(',', "or", "$or", p.and)
+}
+
+func (p *parser) and() (map[string]interface{}, error) {
+    return p.list(';', "and", "$and", p.constraint)
+}
+
+func (p *parser) list(symbol byte, keyword, op string, next func() (map[string]interface{}, error)) (map[string]interface{}, error) {
+    first, err := next()
+    if err != nil {
+        return nil, err
+    }
+    terms := []interface{}{first}
+    for p.separator(symbol, keyword) {
+        term, err := next()
+        if err != nil {
+            return nil, err
+        }
+        terms = append(terms, term)
+    }
+    if len(terms) == 1 {
+        return first, nil
+    }
+    return map[string]interface{}{op: terms}, nil
+}
+
+func (p *parser) constraint() (map[string]interface{}, error) {
+    p.skipSpace()
+    if p.pos < len(p.input) && p.input[p.pos] == '(' {
+        p.pos++
+        filter, err := p.or()
+        if err != nil {
+            return nil, err
+        }
+        p.skipSpace()
+        if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+            return nil, p.errorf("missing )")
+        }
+        p.pos++
+        return filter, nil
+    }
+
+    p.constraints++
+    if p.constraints > MaxConstraints {
+        return nil, p.errorf("more than %d constraints", MaxConstraints)
+    }
+
+    start := p.pos
+    for p.pos < len(p.input) && isSelectorChar(p.input[p.pos]) {
+        p.pos++
+    }
+    selector := p.input[start:p.pos]
+    if selector == "" {
+        return nil, p.errorf("expected a field")
+    }
+    field, ok := p.schema[selector]
+    if !ok {
+        p.pos = start
+        return nil, p.errorf("unknown field %s", selector)
+    }
+
+    opStart := p.pos
+    var op string
+    for _, candidate := range operators {
+        if strings.HasPrefix(p.input[p.pos:], candidate) {
+            op = candidate
+            break
+        }
+    }
+    if op == "" {
+        return nil, p.errorf("expected an operator after %s", selector)
+    }
+    p.pos += len(op)
+    if !field.allows(op) {
+        p.pos = opStart
+        return nil, p.errorf("operator %s does not apply to %s", op, selector)
+    }
+
+    var args []string
+    if op == "=in=" || op == "=out=" {
+        if p.pos >= len(p.input) || p.input[p.pos] != '(' {
+            return nil, p.errorf("expected ( after %s", op)
+        }
+        p.pos++
+        for {
+            arg, err := p.argument()
+            if err != nil {
+                return nil, err
+            }
+            args = append(args, arg)
+            if p.pos < len(p.input) && p.input[p.pos] == ',' {
+                p.pos++
+                continue
+            }
+            if p.pos < len(p.input) && p.input[p.pos] == ')' {
+                p.pos++
+                break
+            }
+            return nil, p.errorf("expected , or )")
+        }
+    } else {
+        arg, err := p.argument()
+        if err != nil {
+            return nil, err
+        }
+        args = []string{arg}
+    }
+
+    values := make([]interface{}, len(args))
+    for i, arg := range args {
+        value, err := field.parse(arg)
+        if err != nil {
+            return nil, &Error{Pos: opStart + len(op), Msg: fmt.Sprintf("invalid value %q for %s", arg, selector)}
+        }
+        values[i] = value
+    }
+
+    if field.Type == String && (op == "==" || op == "!=") && strings.Contains(args[0], "*") {
+        match := map[string]interface{}{"$regex": wildcard(args[0])}
+        if op == "!=" {
+            return map[string]interface{}{field.Name: map[string]interface{}{"$not": match}}, nil
+        }
+        return map[string]interface{}{field.Name: match}, nil
+    }
+    if op == "=in=" || op == "=out=" {
+        return map[string]interface{}{field.Name: map[string]interface{}{mongoOps[op]: values}}, nil
+    }
+    return map[string]interface{}{field.Name: map[string]interface{}{mongoOps[op]: values[0]}}, nil
+}
+
+// argument reads a quoted or unquoted argument.
+func (p *parser) argument() (string, error) {
+    if p.pos < len(p.input) && (p.input[p.pos] == '\'' || p.input[p.pos] == '"') {
+        quote := p.input[p.pos]
+        p.pos++
+        var b strings.Builder
+        for p.pos < len(p.input) {
+            c := p.input[p.pos]
+            if c == '\\' && p.pos+1 < len(p.input) {
+                b.WriteByte(p.input[p.pos+1])
+                p.pos += 2
+                continue
+            }
+            if c == quote {
+                p.pos++
+                return b.String(), nil
+            }
+            b.WriteByte(c)
+            p.pos++
+        }
+        return "", p.errorf("unterminated string")
+    }
+
+    start := p.pos
+    for p.pos < len(p.input) && !strings.ContainsRune(`"'();, `, rune(p.input[p.pos])) {
+        p.pos++
+    }
+    if p.pos == start {
+        return "", p.errorf("expected a value")
+    }
+    return p.input[start:p.pos], nil
+}
+
+func isSelectorChar(c byte) bool {
+    return c == '.' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// allows reports whether op applies to fields of the type of f.
+func (f Field) allows(op string) bool {
+    switch op {
+    case "==", "!=", "=in=", "=out=":
+        return true
+    }
+    return f.Type == Int || f.Type == Float || f.Type == Time
+}
+
+// parse converts an argument to a value of the type of f.
+func (f Field) parse(arg string) (interface{}, error) {
+    switch f.Type {
+    case Int:
+        return strconv.ParseInt(arg, 10, 64)
+    case Float:
+        return strconv.ParseFloat(arg, 64)
+    case Bool:
+        return strconv.ParseBool(arg)
+    case Time:
+        if t, err := time.Parse(time.RFC3339, arg); err == nil {
+            return t, nil
+        }
+        return time.ParseInLocation(time.DateOnly, arg, time.Local)
+    case Custom:
+        return f.Parse(arg)
+    }
+    return arg, nil
+}
+
+// wildcard converts an argument with * wildcards to an anchored, case
+// insensitive pattern matching it literally otherwise.
+func wildcard(arg string) string {
+    parts := strings.Split(arg, "*")
+    for i, part := range parts {
+        parts[i] = regexp.QuoteMeta(part)
+    }
+    return "(?i)^" + strings.Join(parts, ".*") + "$"
+}
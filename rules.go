@@ -0,0 +1,500 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/rsql"
+)
+
+// What rules are evaluated on
+const (
+    RuleAppointment = "appointment" // bookings and their changes
+    RuleRecord      = "record"      // new medical records
+)
+
+// Periods of rule limits
+var rulePeriods = []string{"day", "week", "month"}
+
+// ValidationRule is a clinical constraint of a tenant, checked when
+// appointments are booked or records written. A rule applies to those
+// matching When, an RSQL expression over the facts of ruleFacts, or to all
+// without one, and either requires them to match Require or limits how
+// many the patient has in a period:
+//
+//	{"on": "appointment", "when": "doctor.department==Pediatrics",
+//	 "require": "patient.age=lt=18"}
+//	{"on": "appointment", "limit": {"max": 2, "per": "day"}}
+type ValidationRule struct {
+    Document `bson:",inline"`
+    TenantID string     `json:"tenantId,omitempty" bson:"tenantId,omitempty"`
+    Name     string     `json:"name" bson:"name"`
+    On       string     `json:"on" bson:"on"`
+    When     string     `json:"when,omitempty" bson:"when,omitempty"`
+    Require  string     `json:"require,omitempty" bson:"require,omitempty"`
+    Limit    *RuleLimit `json:"limit,omitempty" bson:"limit,omitempty"`
+    Message  string     `json:"message,omitempty" bson:"message,omitempty"` // replaces the generic one
+    Disabled bool       `json:"disabled,omitempty" bson:"disabled,omitempty"`
+}
+
+// RuleLimit bounds the appointments or records of a patient in a day,
+// week or month, counting the one checked.
+type RuleLimit struct {
+    Max int64  `json:"max" bson:"max"`
+    Per string `json:"per" bson:"per"`
+}
+
+// RuleResult is the outcome of a rule for one appointment or record.
+type RuleResult struct {
+    RuleID  *primitive.ObjectID `json:"ruleId,omitempty"` // nil for draft rules
+    Name    string              `json:"name"`
+    Applies bool                `json:"applies"`
+    Passed  bool                `json:"passed"`
+    Message string              `json:"message,omitempty"`
+}
+
+// Facts rules can test, by what they are evaluated on
+var (
+    patientFacts = rsql.Schema{
+        "patient.age":        {Name: "patient.age", Type: rsql.Int},
+        "patient.gender":     {Name: "patient.gender"},
+        "patient.bloodGroup": {Name: "patient.bloodGroup"},
+        "patient.language":   {Name: "patient.language"},
+        "patient.tags":       {Name: "patient.tags"},
+        "patient.allergies":  {Name: "patient.allergies"},
+    }
+    doctorFacts = rsql.Schema{
+        "doctor.specialization": {Name: "doctor.specialization"},
+        "doctor.department":     {Name: "doctor.department"},
+    }
+    ruleSchemas = map[string]rsql.Schema{
+        RuleAppointment: factSchema(patientFacts, doctorFacts, rsql.Schema{
+            "appointment.mode":     {Name: "appointment.mode"},
+            "appointment.dateTime": {Name: "appointment.dateTime", Type: rsql.Time},
+            "appointment.hour":     {Name: "appointment.hour", Type: rsql.Int}, // 0-23, local time
+            "appointment.weekday":  {Name: "appointment.weekday"},              // monday ... sunday
+        }),
+        RuleRecord: factSchema(patientFacts, doctorFacts, rsql.Schema{
+            "record.diagnoses":  {Name: "record.diagnoses"}, // ICD-10 codes, e.g. E11.9
+            "record.procedures": {Name: "record.procedures"},
+        }),
+    }
+)
+
+func factSchema(schemas ...rsql.Schema) rsql.Schema {
+    merged := rsql.Schema{}
+    for _, schema := range schemas {
+        for selector, field := range schema {
+            merged[selector] = field
+        }
+    }
+    return merged
+}
+
+var (
+    ruleCollection *mongo.Collection
+    ruleRepo       *Repository[ValidationRule, *ValidationRule]
+)
+
+func initRules(ctx context.Context, db *mongo.Database) {
+    ruleCollection = db.Collection("validation_rules")
+    ruleRepo = NewRepository[ValidationRule](ruleCollection, defaultHooks)
+
+    index := mongo.IndexModel{Keys: bson.D{{Key: "tenantId", Value: 1}, {Key: "on", Value: 1}}}
+    if _, err := ruleCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating validation rule index: %v\n", err)
+    }
+}
+
+// validateRule checks a rule and its expressions.
+func validateRule(rule *ValidationRule) error {
+    rule.Name = strings.TrimSpace(rule.Name)
+    if rule.Name == "" {
+        return newAPIError("field_required", "name")
+    }
+    schema, ok := ruleSchemas[rule.On]
+    if !ok {
+        return newAPIError("invalid_choice", "on", RuleAppointment+", "+RuleRecord)
+    }
+    if (rule.Require == "") == (rule.Limit == nil) {
+        return newAPIError("invalid_rule")
+    }
+    for name, expr := range map[string]string{"when": rule.When, "require": rule.Require} {
+        if _, err := schema.Filter(expr); err != nil {
+            return newAPIError("invalid_rule_expression", name, err.Error())
+        }
+    }
+    if rule.Limit != nil {
+        if rule.Limit.Max < 0 {
+            return newAPIError("invalid_rule_limit")
+        }
+        if !containsString(rulePeriods, rule.Limit.Per) {
+            return newAPIError("invalid_choice", "limit.per", strings.Join(rulePeriods, ", "))
+        }
+    }
+    return nil
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// ruleSubject is what rules are evaluated on: its facts and, for limits,
+// the patient, the time it counts at and its id, not to count it twice
+// when it is changed.
+type ruleSubject struct {
+    on        string
+    facts     map[string]interface{}
+    patientID primitive.ObjectID
+    at        time.Time
+    id        primitive.ObjectID
+}
+
+func patientRuleFacts(facts map[string]interface{}, patient *Patient, doctor *Doctor) {
+    facts["patient.age"] = int64(patient.Age)
+    facts["patient.gender"] = patient.Gender
+    facts["patient.bloodGroup"] = patient.BloodGroup
+    facts["patient.language"] = patient.Language
+    facts["patient.tags"] = patient.Tags
+    facts["patient.allergies"] = patient.Allergies
+    facts["doctor.specialization"] = doctor.Specialization
+    facts["doctor.department"] = doctor.Department
+}
+
+func appointmentRuleSubject(patient *Patient, doctor *Doctor, appointment *Appointment) ruleSubject {
+    at := appointment.DateTime.Local()
+    facts := map[string]interface{}{
+        "appointment.mode":     appointment.Mode,
+        "appointment.dateTime": appointment.DateTime,
+        "appointment.hour":     int64(at.Hour()),
+        "appointment.weekday":  strings.ToLower(at.Weekday().String()),
+    }
+    patientRuleFacts(facts, patient, doctor)
+    return ruleSubject{on: RuleAppointment, facts: facts, patientID: patient.ID, at: appointment.DateTime, id: appointment.ID}
+}
+
+func recordRuleSubject(patient *Patient, doctor *Doctor, record *MedicalRecord) ruleSubject {
+    codes := make([]string, len(record.Diagnoses))
+    for i, diagnosis := range record.Diagnoses {
+        codes[i] = diagnosis.Code
+    }
+    facts := map[string]interface{}{
+        "record.diagnoses":  codes,
+        "record.procedures": record.Procedures,
+    }
+    patientRuleFacts(facts, patient, doctor)
+    return ruleSubject{on: RuleRecord, facts: facts, patientID: patient.ID, at: time.Now(), id: record.ID}
+}
+
+// rulePeriod returns the day, week (from Monday) or month around t.
+func rulePeriod(per string, t time.Time) (time.Time, time.Time) {
+    t = t.Local()
+    day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+    switch per {
+    case "week":
+        start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+        return start, start.AddDate(0, 0, 7)
+    case "month":
+        start := day.AddDate(0, 0, 1-day.Day())
+        return start, start.AddDate(0, 1, 0)
+    }
+    return day, day.AddDate(0, 0, 1)
+}
+
+// countForLimit counts the other appointments or records of the patient
+// of a subject in the period of a limit.
+func countForLimit(ctx context.Context, subject ruleSubject, limit *RuleLimit) (int64, error) {
+    start, end := rulePeriod(limit.Per, subject.at)
+    filter := bson.M{"patientId": subject.patientID, "deletedAt": nil}
+    if !subject.id.IsZero() {
+        filter["_id"] = bson.M{"$ne": subject.id}
+    }
+    if subject.on == RuleAppointment {
+        filter["status"] = bson.M{"$ne": StatusCancelled}
+        filter["dateTime"] = bson.M{"$gte": start, "$lt": end}
+        return appointmentCollection.CountDocuments(ctx, filter)
+    }
+    filter["createdAt"] = bson.M{"$gte": start, "$lt": end}
+    return recordCollection.CountDocuments(ctx, filter)
+}
+
+// evaluateRule evaluates a valid rule on a subject.
+func evaluateRule(ctx context.Context, rule ValidationRule, subject ruleSubject) (RuleResult, error) {
+    result := RuleResult{Name: rule.Name}
+    if !rule.ID.IsZero() {
+        result.RuleID = &rule.ID
+    }
+    schema := ruleSchemas[rule.On]
+
+    when, err := schema.Filter(rule.When)
+    if err != nil {
+        return result, err
+    }
+    result.Applies = rsql.Match(when, subject.facts)
+    result.Passed = true
+    if !result.Applies {
+        return result, nil
+    }
+
+    if rule.Limit != nil {
+        count, err := countForLimit(ctx, subject, rule.Limit)
+        if err != nil {
+            return result, err
+        }
+        result.Passed = count+1 <= rule.Limit.Max
+    } else {
+        require, err := schema.Filter(rule.Require)
+        if err != nil {
+            return result, err
+        }
+        result.Passed = rsql.Match(require, subject.facts)
+    }
+    if !result.Passed {
+        result.Message = rule.Message
+        if result.Message == "" {
+            result.Message = ruleViolation(rule).Error()
+        }
+    }
+    return result, nil
+}
+
+// ruleViolation is the error of a failed rule.
+func ruleViolation(rule ValidationRule) error {
+    switch {
+    case rule.Message != "":
+        return newAPIError("rule_violated", rule.Name, rule.Message)
+    case rule.Limit != nil:
+        return newAPIError("rule_limit_reached", rule.Name, rule.Limit.Max, rule.Limit.Per)
+    }
+    return newAPIError("rule_requirement_unmet", rule.Name, rule.Require)
+}
+
+// tenantRules returns the enabled rules of a tenant on what a subject is.
+func tenantRules(ctx context.Context, tenant, on string) ([]ValidationRule, error) {
+    filter := bson.M{"on": on, "disabled": bson.M{"$ne": true}, "tenantId": tenant}
+    if tenant == "" {
+        filter["tenantId"] = nil
+    }
+    return ruleRepo.List(ctx, filter, Page{})
+}
+
+// checkRules fails with the error of the first rule of the tenant a
+// subject does not pass.
+func checkRules(ctx context.Context, tenant string, subject ruleSubject) error {
+    rules, err := tenantRules(ctx, tenant, subject.on)
+    if err != nil {
+        return err
+    }
+    for _, rule := range rules {
+        result, err := evaluateRule(ctx, rule, subject)
+        if err != nil {
+            return err
+        }
+        if !result.Passed {
+            return ruleViolation(rule)
+        }
+    }
+    return nil
+}
+
+// Rule handlers
+
+// adminRules lists the rules, for ?tenant= and ?on=, and creates them:
+// GET, POST /admin/rules
+func adminRules(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getRules(w, r)
+    case http.MethodPost:
+        createRule(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getRules(w http.ResponseWriter, r *http.Request) {
+    filter := bson.M{}
+    query := r.URL.Query()
+    if tenant, ok := query["tenant"]; ok {
+        filter["tenantId"] = tenant[0]
+        if tenant[0] == "" {
+            filter["tenantId"] = nil
+        }
+    }
+    if on := query.Get("on"); on != "" {
+        filter["on"] = on
+    }
+
+    ctx := r.Context()
+
+    rules, err := ruleRepo.List(ctx, filter, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(rules)
+}
+
+func createRule(w http.ResponseWriter, r *http.Request) {
+    var rule ValidationRule
+    if !decodeJSON(w, r, &rule) {
+        return
+    }
+    if err := validateRule(&rule); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := ruleRepo.Create(ctx, &rule); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(rule)
+}
+
+// adminRule updates a rule with a JSON Merge Patch or deletes it:
+// PATCH, DELETE /admin/rules/{id}
+func adminRule(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_rule_id")
+        return
+    }
+
+    switch r.Method {
+    case http.MethodPatch:
+        rule, ok := patchDocument(w, r, ruleRepo, id, patchable[ValidationRule]{
+            notFound: "rule_not_found",
+            readOnly: []string{"tenantId"},
+            check: func(ctx context.Context, rule *ValidationRule) error {
+                return validateRule(rule)
+            },
+        })
+        if !ok {
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(rule)
+    case http.MethodDelete:
+        err := ruleRepo.SoftDelete(r.Context(), id)
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "rule_not_found")
+            return
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// RuleEvaluation is the body of rule test evaluations: an appointment or
+// record to evaluate and, to try one before saving it, a draft rule.
+type RuleEvaluation struct {
+    On         string             `json:"on"`
+    PatientID  primitive.ObjectID `json:"patientId"`
+    DoctorID   primitive.ObjectID `json:"doctorId"`
+    DateTime   time.Time          `json:"dateTime,omitempty"` // of appointments
+    Mode       string             `json:"mode,omitempty"`
+    Diagnoses  []string           `json:"diagnoses,omitempty"` // ICD-10 codes of records
+    Procedures []string           `json:"procedures,omitempty"`
+    Rule       *ValidationRule    `json:"rule,omitempty"`
+}
+
+// evaluateRules evaluates the enabled rules of the patient's tenant, or a
+// draft rule, on an appointment or record without storing anything:
+// POST /admin/rules/evaluate
+func evaluateRules(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var evaluation RuleEvaluation
+    if !decodeJSON(w, r, &evaluation) {
+        return
+    }
+    if _, ok := ruleSchemas[evaluation.On]; !ok {
+        writeError(w, r, http.StatusBadRequest, newAPIError("invalid_choice", "on", RuleAppointment+", "+RuleRecord))
+        return
+    }
+    if evaluation.Rule != nil {
+        evaluation.Rule.On = evaluation.On
+        if err := validateRule(evaluation.Rule); err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return
+        }
+    }
+
+    ctx := r.Context()
+
+    patient, err := patientRepo.GetByID(ctx, evaluation.PatientID)
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "patient_not_found")
+        return
+    }
+    doctor, err := doctorRepo.GetByID(ctx, evaluation.DoctorID)
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "doctor_not_found")
+        return
+    }
+    subject := recordRuleSubject(patient, doctor, &MedicalRecord{Procedures: evaluation.Procedures})
+    if evaluation.On == RuleAppointment {
+        if evaluation.DateTime.IsZero() {
+            evaluation.DateTime = time.Now()
+        }
+        subject = appointmentRuleSubject(patient, doctor, &Appointment{DateTime: evaluation.DateTime, Mode: evaluation.Mode})
+    } else {
+        subject.facts["record.diagnoses"] = evaluation.Diagnoses
+    }
+
+    rules := []ValidationRule{}
+    if evaluation.Rule != nil {
+        rules = append(rules, *evaluation.Rule)
+    } else if rules, err = tenantRules(ctx, patient.TenantID, evaluation.On); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    results := make([]RuleResult, 0, len(rules))
+    passed := true
+    for _, rule := range rules {
+        result, err := evaluateRule(ctx, rule, subject)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        results = append(results, result)
+        passed = passed && result.Passed
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "tenantId": patient.TenantID,
+        "passed":   passed,
+        "results":  results,
+    })
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/i18n"
+)
+
+// savedSearchDigestRows bounds the results listed in a digest email.
+const savedSearchDigestRows = 100
+
+// SavedSearch is a named filter of a list endpoint kept by a user, such as
+// date=tomorrow&department=Cardiology on appointments. Subscribed searches
+// are emailed to their owner daily at SAVED_SEARCH_DIGEST_HOUR.
+type SavedSearch struct {
+    Document   `bson:",inline"`
+    OwnerID    primitive.ObjectID `json:"ownerId" bson:"ownerId"`
+    Name       string             `json:"name" bson:"name"`
+    Resource   string             `json:"resource" bson:"resource"` // appointments, patients or doctors
+    Query      string             `json:"query" bson:"query"`       // query string of the list endpoint
+    Subscribed bool               `json:"subscribed" bson:"subscribed"`
+    LastSentAt *time.Time         `json:"lastSentAt,omitempty" bson:"lastSentAt,omitempty"`
+}
+
+// searchable describes a list endpoint saved searches run against and how
+// digest emails present its results.
+type searchable struct {
+    handler http.HandlerFunc
+    path    string
+    expand  string // added to the query of digests
+    columns []string
+    row     func(lang string, item map[string]interface{}) []string
+}
+
+var searchables = map[string]searchable{
+    "appointments": {
+        handler: logAccess("appointments", getAppointments),
+        path:    "/appointments/list",
+        expand:  "patient,doctor",
+        columns: []string{"time", "patient", "doctor", "status"},
+        row: func(lang string, item map[string]interface{}) []string {
+            at := ""
+            if t, err := time.Parse(time.RFC3339, jsonString(item, "dateTime")); err == nil {
+                at = i18n.FormatDate(lang, t.Local()) + " " + i18n.FormatTime(lang, t.Local())
+            }
+            return []string{at, jsonString(item, "patient", "name"), jsonString(item, "doctor", "name"),
+                i18n.StatusLabel(lang, jsonString(item, "status"))}
+        },
+    },
+    "patients": {
+        handler: logAccess("patients", getPatients),
+        path:    "/patients/list",
+        columns: []string{"name", "email", "contact"},
+        row: func(lang string, item map[string]interface{}) []string {
+            return []string{jsonString(item, "name"), jsonString(item, "email"), jsonString(item, "contactNo")}
+        },
+    },
+    "doctors": {
+        handler: getDoctors,
+        path:    "/doctors",
+        columns: []string{"name", "specialization", "department"},
+        row: func(lang string, item map[string]interface{}) []string {
+            return []string{jsonString(item, "name"), jsonString(item, "specialization"), jsonString(item, "department")}
+        },
+    },
+}
+
+// jsonString returns the string at path in a decoded JSON object, or "".
+func jsonString(item map[string]interface{}, path ...string) string {
+    var v interface{} = item
+    for _, key := range path {
+        object, ok := v.(map[string]interface{})
+        if !ok {
+            return ""
+        }
+        v = object[key]
+    }
+    s, _ := v.(string)
+    return s
+}
+
+// SavedSearchDigest is the content of a digest email.
+type SavedSearchDigest struct {
+    Name    string
+    Columns []string
+    Rows    [][]string
+    Total   int
+    URL     string
+}
+
+var (
+    savedSearchCollection *mongo.Collection
+    savedSearchRepo       *Repository[SavedSearch, *SavedSearch]
+)
+
+func initSavedSearches(ctx context.Context, db *mongo.Database) {
+    savedSearchCollection = db.Collection("saved_searches")
+    savedSearchRepo = NewRepository[SavedSearch](savedSearchCollection, defaultHooks)
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "ownerId", Value: 1}}},
+        {Keys: bson.D{{Key: "subscribed", Value: 1}, {Key: "lastSentAt", Value: 1}}},
+    }
+    if _, err := savedSearchCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating saved search indexes: %v\n", err)
+    }
+}
+
+func validateSavedSearch(search *SavedSearch) error {
+    if strings.TrimSpace(search.Name) == "" {
+        return newAPIError("field_required", "name")
+    }
+    if _, ok := searchables[search.Resource]; !ok {
+        return newAPIError("invalid_choice", "resource", "appointments, patients, doctors")
+    }
+    query, err := url.ParseQuery(strings.TrimPrefix(search.Query, "?"))
+    if err != nil {
+        return newAPIError("invalid_query")
+    }
+    search.Query = query.Encode()
+    return nil
+}
+
+// runSavedSearch runs a search against its list endpoint as the user of
+// ctx, so the results are those the user would see, and returns the
+// response.
+func runSavedSearch(ctx context.Context, search *SavedSearch, lang string, extra url.Values) *httptest.ResponseRecorder {
+    target := searchables[search.Resource]
+    query, _ := url.ParseQuery(search.Query)
+    for key, values := range extra {
+        query[key] = values
+    }
+
+    r := httptest.NewRequest(http.MethodGet, target.path+"?"+query.Encode(), nil).WithContext(ctx)
+    r.Header.Set("Accept-Language", lang)
+    rec := httptest.NewRecorder()
+    target.handler(rec, r)
+    return rec
+}
+
+// ownSavedSearch loads a saved search of the authenticated user, writing
+// the error and returning nil when it is missing or someone else's.
+func ownSavedSearch(w http.ResponseWriter, r *http.Request) *SavedSearch {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_saved_search_id")
+        return nil
+    }
+    user := userFromContext(r.Context())
+    search, err := savedSearchRepo.GetByID(r.Context(), id)
+    if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && (user == nil || search.OwnerID != user.ID)) {
+        localizedError(w, r, http.StatusNotFound, "saved_search_not_found")
+        return nil
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil
+    }
+    return search
+}
+
+// savedSearches lists and creates the saved searches of the authenticated
+// user: GET, POST /saved-searches
+func savedSearches(w http.ResponseWriter, r *http.Request) {
+    user := userFromContext(r.Context())
+    if user == nil {
+        localizedError(w, r, http.StatusForbidden, "forbidden")
+        return
+    }
+
+    ctx := r.Context()
+
+    switch r.Method {
+    case http.MethodGet:
+        page, err := parsePage(r)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return
+        }
+        searches, err := savedSearchRepo.List(ctx, bson.M{"ownerId": user.ID}, page)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        setNextPage(w, r, page, searches)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(append([]SavedSearch{}, searches...))
+    case http.MethodPost:
+        var search SavedSearch
+        if !decodeJSON(w, r, &search) {
+            return
+        }
+        search.OwnerID = user.ID
+        search.LastSentAt = nil
+        if err := validateSavedSearch(&search); err != nil {
+            writeError(w, r, http.StatusBadRequest, err)
+            return
+        }
+        if err := savedSearchRepo.Create(ctx, &search); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(search)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// savedSearch reads, updates with a JSON Merge Patch, for instance to
+// subscribe, or deletes a saved search: GET, PATCH, DELETE
+// /saved-searches/{id}
+func savedSearch(w http.ResponseWriter, r *http.Request) {
+    search := ownSavedSearch(w, r)
+    if search == nil {
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(search)
+    case http.MethodPatch:
+        updated, ok := patchDocument(w, r, savedSearchRepo, search.ID, patchable[SavedSearch]{
+            notFound: "saved_search_not_found",
+            readOnly: []string{"ownerId", "lastSentAt"},
+            check: func(ctx context.Context, search *SavedSearch) error {
+                return validateSavedSearch(search)
+            },
+        })
+        if !ok {
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(updated)
+    case http.MethodDelete:
+        ctx := r.Context()
+        if err := savedSearchRepo.SoftDelete(ctx, search.ID); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// getSavedSearchResults runs a saved search and answers with the results
+// of its list endpoint. Query parameters of the request, such as page,
+// override those saved: GET /saved-searches/{id}/results
+func getSavedSearchResults(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    search := ownSavedSearch(w, r)
+    if search == nil {
+        return
+    }
+
+    rec := runSavedSearch(r.Context(), search, r.Header.Get("Accept-Language"), r.URL.Query())
+    for key, values := range rec.Header() {
+        w.Header()[key] = values
+    }
+    w.WriteHeader(rec.Code)
+    w.Write(rec.Body.Bytes())
+}
+
+// sendSavedSearchDigests emails the subscribed searches not yet sent today
+// to their owners, once SAVED_SEARCH_DIGEST_HOUR has passed.
+func sendSavedSearchDigests(ctx context.Context) error {
+    today, _ := dayBounds(time.Now())
+    due := today.Add(time.Duration(config.SavedSearchDigestHour) * time.Hour)
+    if time.Now().Before(due) {
+        return nil
+    }
+
+    cursor, err := savedSearchCollection.Find(ctx, bson.M{
+        "subscribed": true,
+        "deletedAt":  nil,
+        "$or":        bson.A{bson.M{"lastSentAt": nil}, bson.M{"lastSentAt": bson.M{"$lt": due}}},
+    }, options.Find().SetLimit(reminderBatchSize))
+    if err != nil {
+        return err
+    }
+    var searches []SavedSearch
+    if err := cursor.All(ctx, &searches); err != nil {
+        return err
+    }
+
+    var errs []error
+    for _, search := range searches {
+        if err := sendSavedSearchDigest(ctx, &search); err != nil {
+            errs = append(errs, fmt.Errorf("saved search %s: %w", search.ID.Hex(), err))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// sendSavedSearchDigest runs a saved search as its owner and emails them
+// the results.
+func sendSavedSearchDigest(ctx context.Context, search *SavedSearch) error {
+    owner, err := userRepo.GetByID(ctx, search.OwnerID)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        // Owner removed; stop sending
+        return savedSearchRepo.UpdateFields(ctx, search.ID, nil, bson.M{"subscribed": false})
+    }
+    if err != nil {
+        return err
+    }
+
+    lang := i18n.Resolve(config.DefaultLanguage)
+    target := searchables[search.Resource]
+    extra := url.Values{}
+    if target.expand != "" {
+        extra.Set("expand", target.expand)
+    }
+    rec := runSavedSearch(contextWithUser(ctx, owner), search, lang, extra)
+    if rec.Code != http.StatusOK {
+        return fmt.Errorf("status %d: %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+    }
+    var items []map[string]interface{}
+    if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil {
+        return err
+    }
+
+    digest := &SavedSearchDigest{
+        Name:  search.Name,
+        Total: len(items),
+        URL:   config.PublicURL + "/saved-searches/" + search.ID.Hex() + "/results",
+    }
+    for _, column := range target.columns {
+        digest.Columns = append(digest.Columns, i18n.Message(lang, "saved_search.column."+column))
+    }
+    for i, item := range items {
+        if i == savedSearchDigestRows {
+            break
+        }
+        digest.Rows = append(digest.Rows, target.row(lang, item))
+    }
+
+    if err := sendEmail("saved_search", notificationData{User: owner, SavedSearch: digest}); err != nil {
+        return err
+    }
+    return savedSearchRepo.UpdateFields(ctx, search.ID, nil, bson.M{"lastSentAt": time.Now()})
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// scheduleRetry is how long the schedule cache waits to watch again after
+// its change stream failed.
+const scheduleRetry = 5 * time.Second
+
+// schedule is what freeSlots needs of a doctor's day besides the working
+// hours: the appointments occupying slots, how many are booked on the day,
+// the held slots and the periods the doctor is unavailable.
+type schedule struct {
+    booked []time.Time
+    daily  int64
+    held   []time.Time
+    blocks []Unavailability
+}
+
+// scheduledAppointment is what the cache keeps of an appointment.
+type scheduledAppointment struct {
+    DateTime time.Time
+    Status   string
+}
+
+// doctorSchedule is the cached schedule of a doctor over the cache window.
+type doctorSchedule struct {
+    appointments map[primitive.ObjectID]scheduledAppointment
+    holds        map[primitive.ObjectID]SlotHold
+    blocks       map[primitive.ObjectID]Unavailability
+}
+
+// scheduleCache keeps the schedules of the doctors slots were asked for
+// from yesterday to SCHEDULE_CACHE_DAYS ahead, loaded on first use and
+// then kept current from a change stream on their collections. Change
+// streams need a replica set; without one, or while the stream is down,
+// every schedule is read from MongoDB. Every SCHEDULE_CACHE_RESYNC the
+// cached schedules are read again and corrected, counting the entries
+// that had drifted.
+type scheduleCache struct {
+    mu       sync.RWMutex
+    live     bool
+    from, to time.Time
+    doctors  map[primitive.ObjectID]*doctorSchedule
+
+    // A load is only kept if no change to its doctor, and no delete,
+    // which names no doctor, was seen while it ran.
+    versions map[primitive.ObjectID]uint64
+    deletes  uint64
+
+    hits, misses, updates, resyncs, drift atomic.Uint64
+}
+
+var schedules = &scheduleCache{}
+
+// startScheduleCache watches the schedule collections and resyncs the
+// cache until ctx is done.
+func startScheduleCache(ctx context.Context) {
+    if !config.ScheduleCache {
+        log.Println("Schedule cache disabled")
+        return
+    }
+    if !transactionsSupported {
+        log.Println("Schedule cache disabled: change streams need a replica set")
+        return
+    }
+    go schedules.watch(ctx)
+    go schedules.resyncEvery(ctx, config.ScheduleCacheResync)
+}
+
+// scheduleWindow returns the days the cache covers from today.
+func scheduleWindow() (time.Time, time.Time) {
+    today, _ := dayBounds(time.Now())
+    return today.AddDate(0, 0, -1), today.AddDate(0, 0, int(config.ScheduleCacheDays))
+}
+
+// reset empties the cache and sets whether it is live.
+func (c *scheduleCache) reset(live bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.live = live
+    c.from, c.to = scheduleWindow()
+    c.doctors = map[primitive.ObjectID]*doctorSchedule{}
+    c.versions = map[primitive.ObjectID]uint64{}
+}
+
+// scheduleOf returns a doctor's schedule for day, from the cache when it
+// covers the day.
+func scheduleOf(ctx context.Context, doctorID primitive.ObjectID, day time.Time, hours workingDay) (schedule, error) {
+    from, to := dayBounds(day.Local())
+    if hours.Start.Add(-config.SlotDuration).Before(from) {
+        from = hours.Start.Add(-config.SlotDuration)
+    }
+    if hours.End.After(to) {
+        to = hours.End
+    }
+
+    if cached, ok, err := schedules.lookup(ctx, doctorID, day, hours, from, to); ok || err != nil {
+        return cached, err
+    }
+    loaded, err := loadSchedule(ctx, doctorID, from, to)
+    if err != nil {
+        return schedule{}, err
+    }
+    return loaded.day(day, hours), nil
+}
+
+// lookup returns a doctor's schedule for day from the cache if it is live
+// and covers from to to, loading the doctor into it on first use.
+func (c *scheduleCache) lookup(ctx context.Context, doctorID primitive.ObjectID, day time.Time, hours workingDay, from, to time.Time) (schedule, bool, error) {
+    c.mu.RLock()
+    live, covered := c.live, !from.Before(c.from) && !to.After(c.to)
+    cached := c.doctors[doctorID]
+    if live && covered && cached != nil {
+        out := cached.day(day, hours)
+        c.mu.RUnlock()
+        c.hits.Add(1)
+        return out, true, nil
+    }
+    version, deletes, windowFrom, windowTo := c.versions[doctorID], c.deletes, c.from, c.to
+    c.mu.RUnlock()
+
+    c.misses.Add(1)
+    if !live || !covered {
+        return schedule{}, false, nil
+    }
+    loaded, err := loadSchedule(ctx, doctorID, windowFrom, windowTo)
+    if err != nil {
+        return schedule{}, false, err
+    }
+    c.mu.Lock()
+    if c.live && c.versions[doctorID] == version && c.deletes == deletes && c.from.Equal(windowFrom) {
+        c.doctors[doctorID] = loaded
+    }
+    c.mu.Unlock()
+    return loaded.day(day, hours), true, nil
+}
+
+// loadSchedule reads a doctor's schedule between from and to.
+func loadSchedule(ctx context.Context, doctorID primitive.ObjectID, from, to time.Time) (*doctorSchedule, error) {
+    loaded := newDoctorSchedule()
+
+    cursor, err := appointmentCollection.Find(ctx, bson.M{
+        "doctorId":  doctorID,
+        "status":    bookedStatuses,
+        "deletedAt": nil,
+        "dateTime":  bson.M{"$gt": from.Add(-config.SlotDuration), "$lt": to},
+    }, options.Find().SetProjection(bson.M{"dateTime": 1, "status": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var appointments []Appointment
+    if err := cursor.All(ctx, &appointments); err != nil {
+        return nil, err
+    }
+    for _, a := range appointments {
+        loaded.appointments[a.ID] = scheduledAppointment{DateTime: a.DateTime, Status: a.Status}
+    }
+
+    cursor, err = slotHoldCollection.Find(ctx, bson.M{
+        "doctorId":  doctorID,
+        "dateTime":  bson.M{"$gte": from.Add(-config.SlotDuration), "$lt": to},
+        "expiresAt": bson.M{"$gt": time.Now()},
+    })
+    if err != nil {
+        return nil, err
+    }
+    var holds []SlotHold
+    if err := cursor.All(ctx, &holds); err != nil {
+        return nil, err
+    }
+    for _, h := range holds {
+        loaded.holds[h.ID] = h
+    }
+
+    blocks, err := unavailableDuring(ctx, doctorID, from, to)
+    if err != nil {
+        return nil, err
+    }
+    for _, b := range blocks {
+        loaded.blocks[b.ID] = b
+    }
+    return loaded, nil
+}
+
+func newDoctorSchedule() *doctorSchedule {
+    return &doctorSchedule{
+        appointments: map[primitive.ObjectID]scheduledAppointment{},
+        holds:        map[primitive.ObjectID]SlotHold{},
+        blocks:       map[primitive.ObjectID]Unavailability{},
+    }
+}
+
+// day selects the schedule of a working day, as freeSlots queried it.
+func (s *doctorSchedule) day(day time.Time, hours workingDay) schedule {
+    var out schedule
+    if s == nil {
+        return out
+    }
+    midnight, next := dayBounds(day.Local())
+    start, end := hours.Start.Add(-config.SlotDuration), hours.End
+    for _, a := range s.appointments {
+        if !a.DateTime.Before(midnight) && a.DateTime.Before(next) {
+            out.daily++
+        }
+        if (a.Status == StatusScheduled || a.Status == StatusCheckedIn) && a.DateTime.After(start) && a.DateTime.Before(end) {
+            out.booked = append(out.booked, a.DateTime)
+        }
+    }
+    now := time.Now()
+    for _, h := range s.holds {
+        if !h.DateTime.Before(start) && h.DateTime.Before(end) && h.ExpiresAt.After(now) {
+            out.held = append(out.held, h.DateTime)
+        }
+    }
+    for _, b := range s.blocks {
+        if b.Start.Before(end) && b.End.After(hours.Start) {
+            out.blocks = append(out.blocks, b)
+        }
+    }
+    return out
+}
+
+// Change stream
+
+// scheduleChange is a change to the appointments, slot holds or
+// unavailability.
+type scheduleChange struct {
+    OperationType string `bson:"operationType"`
+    Namespace     struct {
+        Collection string `bson:"coll"`
+    } `bson:"ns"`
+    DocumentKey struct {
+        ID primitive.ObjectID `bson:"_id"`
+    } `bson:"documentKey"`
+    FullDocument bson.Raw `bson:"fullDocument"`
+}
+
+// watch applies changes to the cache, watching again after failures. The
+// cache is emptied and not used while the stream is down, as changes are
+// missed then.
+func (c *scheduleCache) watch(ctx context.Context) {
+    for {
+        err := c.watchOnce(ctx)
+        c.reset(false)
+        if ctx.Err() != nil {
+            return
+        }
+        log.Printf("Error watching schedules: %v\n", err)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(scheduleRetry):
+        }
+    }
+}
+
+func (c *scheduleCache) watchOnce(ctx context.Context) error {
+    pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+        "ns.coll": bson.M{"$in": bson.A{
+            appointmentCollection.Name(), slotHoldCollection.Name(), unavailabilityCollection.Name(),
+        }},
+    }}}}
+    stream, err := appointmentCollection.Database().Watch(ctx, pipeline, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+    if err != nil {
+        return err
+    }
+    defer stream.Close(context.Background())
+
+    // Changes from now on are seen, so schedules loaded from now on stay
+    // current.
+    c.reset(true)
+    for stream.Next(ctx) {
+        var change scheduleChange
+        if err := stream.Decode(&change); err != nil {
+            return err
+        }
+        if err := c.apply(change); err != nil {
+            return err
+        }
+    }
+    if err := stream.Err(); err != nil {
+        return err
+    }
+    return io.EOF
+}
+
+// apply applies a change to the cached schedules.
+func (c *scheduleCache) apply(change scheduleChange) error {
+    switch change.OperationType {
+    case "insert", "update", "replace", "delete":
+    case "drop", "rename", "dropDatabase", "invalidate":
+        return fmt.Errorf("%s of %s", change.OperationType, change.Namespace.Collection)
+    default:
+        return nil
+    }
+    c.updates.Add(1)
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    id := change.DocumentKey.ID
+    // The document may have moved to another doctor, or be gone: it is
+    // dropped everywhere, then added back to its doctor's schedule.
+    for _, s := range c.doctors {
+        delete(s.appointments, id)
+        delete(s.holds, id)
+        delete(s.blocks, id)
+    }
+    if change.FullDocument == nil {
+        c.deletes++
+        return nil
+    }
+
+    switch change.Namespace.Collection {
+    case appointmentCollection.Name():
+        var a Appointment
+        if err := bson.Unmarshal(change.FullDocument, &a); err != nil {
+            return err
+        }
+        c.versions[a.DoctorID]++
+        if s := c.doctors[a.DoctorID]; s != nil && a.DeletedAt == nil && a.Status != StatusCancelled &&
+            a.DateTime.After(c.from.Add(-config.SlotDuration)) && a.DateTime.Before(c.to) {
+            s.appointments[id] = scheduledAppointment{DateTime: a.DateTime, Status: a.Status}
+        }
+    case slotHoldCollection.Name():
+        var h SlotHold
+        if err := bson.Unmarshal(change.FullDocument, &h); err != nil {
+            return err
+        }
+        c.versions[h.DoctorID]++
+        if s := c.doctors[h.DoctorID]; s != nil && h.DateTime.Before(c.to) {
+            s.holds[id] = h
+        }
+    case unavailabilityCollection.Name():
+        var b Unavailability
+        if err := bson.Unmarshal(change.FullDocument, &b); err != nil {
+            return err
+        }
+        c.versions[b.DoctorID]++
+        if s := c.doctors[b.DoctorID]; s != nil && b.DeletedAt == nil && b.Start.Before(c.to) && b.End.After(c.from) {
+            s.blocks[id] = b
+        }
+    }
+    return nil
+}
+
+// Resync
+
+// resyncEvery resyncs the cache every interval. Unlike runEvery it keeps
+// going in read-only mode, where bookings still change.
+func (c *scheduleCache) resyncEvery(ctx context.Context, interval time.Duration) {
+    if interval <= 0 {
+        log.Println("Schedule cache resync disabled")
+        return
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            resyncCtx, cancel := context.WithTimeout(ctx, interval)
+            if err := c.resync(resyncCtx); err != nil {
+                log.Printf("Error resyncing schedules: %v\n", err)
+            }
+            cancel()
+        }
+    }
+}
+
+// resync moves the window to today and reads the cached schedules again,
+// replacing those no change was seen for meanwhile and dropping the others
+// to load on next use.
+func (c *scheduleCache) resync(ctx context.Context) error {
+    c.mu.Lock()
+    if !c.live {
+        c.mu.Unlock()
+        return nil
+    }
+    c.from, c.to = scheduleWindow()
+    from, to := c.from, c.to
+    doctors := make(map[primitive.ObjectID]uint64, len(c.doctors))
+    for id := range c.doctors {
+        doctors[id] = c.versions[id]
+    }
+    deletes := c.deletes
+    c.mu.Unlock()
+
+    c.resyncs.Add(1)
+    for id, version := range doctors {
+        loaded, err := loadSchedule(ctx, id, from, to)
+        if err != nil {
+            return err
+        }
+
+        c.mu.Lock()
+        cached := c.doctors[id]
+        switch {
+        case cached == nil:
+        case c.versions[id] != version || c.deletes != deletes || !c.from.Equal(from):
+            delete(c.doctors, id)
+        default:
+            c.drift.Add(cached.diff(loaded))
+            c.doctors[id] = loaded
+        }
+        c.mu.Unlock()
+    }
+    return nil
+}
+
+// diff counts the entries of s missing, extra or different in other.
+func (s *doctorSchedule) diff(other *doctorSchedule) uint64 {
+    var n uint64
+    for id, a := range s.appointments {
+        if b, ok := other.appointments[id]; !ok || !a.DateTime.Equal(b.DateTime) || a.Status != b.Status {
+            n++
+        }
+    }
+    for id := range other.appointments {
+        if _, ok := s.appointments[id]; !ok {
+            n++
+        }
+    }
+    now := time.Now()
+    for id, h := range s.holds {
+        // Expired holds are left for the TTL index to delete
+        if _, ok := other.holds[id]; !ok && h.ExpiresAt.After(now) {
+            n++
+        }
+    }
+    for id := range other.holds {
+        if _, ok := s.holds[id]; !ok {
+            n++
+        }
+    }
+    for id, a := range s.blocks {
+        if b, ok := other.blocks[id]; !ok || !a.Start.Equal(b.Start) || !a.End.Equal(b.End) {
+            n++
+        }
+    }
+    for id := range other.blocks {
+        if _, ok := s.blocks[id]; !ok {
+            n++
+        }
+    }
+    return n
+}
+
+// writeScheduleCacheMetrics writes the metrics of the cache for /metrics.
+func writeScheduleCacheMetrics(w io.Writer) {
+    c := schedules
+    c.mu.RLock()
+    doctors := len(c.doctors)
+    c.mu.RUnlock()
+
+    fmt.Fprintln(w, "# HELP schedule_cache_doctors Doctors whose schedules are cached.")
+    fmt.Fprintln(w, "# TYPE schedule_cache_doctors gauge")
+    fmt.Fprintf(w, "schedule_cache_doctors %d\n", doctors)
+    counters := []struct {
+        name, help string
+        value      uint64
+    }{
+        {"schedule_cache_hits_total", "Schedules served from the cache.", c.hits.Load()},
+        {"schedule_cache_misses_total", "Schedules read from MongoDB.", c.misses.Load()},
+        {"schedule_cache_updates_total", "Changes applied to the cache from the change stream.", c.updates.Load()},
+        {"schedule_cache_resyncs_total", "Resyncs of the cache with MongoDB.", c.resyncs.Load()},
+        {"schedule_cache_drift_total", "Cached entries found wrong, and corrected, by resyncs.", c.drift.Load()},
+    }
+    for _, counter := range counters {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.value)
+    }
+}
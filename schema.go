@@ -0,0 +1,411 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "reflect"
+    "sort"
+    "strconv"
+    "sync"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/phonetic"
+)
+
+// A schemaUpgrade rewrites a stored document of one schema version into
+// the shape of the next. Models evolve by appending upgrades instead of
+// migrating their collection: documents are upgraded when read and
+// written back in their current shape in the background, so old and new
+// documents coexist until the last one is read or upgraded from
+// /admin/schemas. Retiring a field is an upgrade moving or dropping it;
+// the write back then removes it from the stored document.
+//
+// Upgrades must tolerate fields left out by a projection and documents
+// already in the new shape, as documents written outside the repositories
+// are not stamped with their version.
+type schemaUpgrade func(doc bson.M) error
+
+// schemas are the upgrades of the versioned collections: upgrades[i]
+// takes a document of version i to i+1, so the current version is the
+// number of upgrades. Documents without schemaVersion are version 0.
+var schemas = map[string][]schemaUpgrade{
+    "patients":     {upgradePatientV1},
+    "appointments": {upgradeAppointmentV1},
+}
+
+var versionedCollections map[string]*mongo.Collection
+
+func initSchemas(ctx context.Context, db *mongo.Database) {
+    versionedCollections = map[string]*mongo.Collection{}
+    for name := range schemas {
+        versionedCollections[name] = db.Collection(name)
+    }
+}
+
+// schemaVersion is the version documents of coll are written in.
+func schemaVersion(coll string) int {
+    return len(schemas[coll])
+}
+
+// stampSchemaVersion records the version of the documents written whole.
+// Partial updates keep the version they find.
+func stampSchemaVersion(ctx context.Context, coll string, op Operation, doc *Document) error {
+    if op == OpCreate || op == OpUpdate {
+        doc.SchemaVersion = schemaVersion(coll)
+    }
+    return nil
+}
+
+// UnmarshalBSON upgrades patients stored in older schema versions.
+func (p *Patient) UnmarshalBSON(data []byte) error {
+    type stored Patient
+    return decodeVersioned("patients", data, (*stored)(p))
+}
+
+// UnmarshalBSON upgrades appointments stored in older schema versions.
+func (a *Appointment) UnmarshalBSON(data []byte) error {
+    type stored Appointment
+    return decodeVersioned("appointments", data, (*stored)(a))
+}
+
+// UnmarshalBSON decodes the appointment and its summaries separately, as
+// the method of the embedded Appointment would otherwise decode the whole
+// view.
+func (v *AppointmentView) UnmarshalBSON(data []byte) error {
+    if err := v.Appointment.UnmarshalBSON(data); err != nil {
+        return err
+    }
+    var summaries struct {
+        Patient *PatientSummary `bson:"patient"`
+        Doctor  *DoctorSummary  `bson:"doctor"`
+    }
+    if err := bson.Unmarshal(data, &summaries); err != nil {
+        return err
+    }
+    v.Patient, v.Doctor = summaries.Patient, summaries.Doctor
+    return nil
+}
+
+// decodeVersioned decodes a document of coll into v, upgrading it first
+// when it is stored in an older schema version and queueing its write
+// back.
+func decodeVersioned(coll string, data []byte, v interface{}) error {
+    version := storedSchemaVersion(bson.Raw(data))
+    if version >= schemaVersion(coll) {
+        return bson.Unmarshal(data, v)
+    }
+
+    var doc bson.M
+    if err := bson.Unmarshal(data, &doc); err != nil {
+        return err
+    }
+    if err := upgradeDocument(coll, doc, version); err != nil {
+        return err
+    }
+    upgraded, err := bson.Marshal(doc)
+    if err != nil {
+        return err
+    }
+    if id, ok := doc["_id"].(primitive.ObjectID); ok {
+        schemaWriteBacks.add(coll, id)
+    }
+    return bson.Unmarshal(upgraded, v)
+}
+
+func storedSchemaVersion(doc bson.Raw) int {
+    version, _ := doc.Lookup("schemaVersion").AsInt64OK()
+    return int(version)
+}
+
+// upgradeDocument runs the upgrades of coll from version on doc.
+func upgradeDocument(coll string, doc bson.M, version int) error {
+    upgrades := schemas[coll]
+    for ; version < len(upgrades); version++ {
+        if err := upgrades[version](doc); err != nil {
+            return fmt.Errorf("upgrading %s document %v to schema version %d: %w", coll, doc["_id"], version+1, err)
+        }
+    }
+    doc["schemaVersion"] = int32(version)
+    return nil
+}
+
+// Upgrades
+
+// upgradePatientV1 upgrades patients created before they had an update
+// time and phonetic keys, the latter to make them searchable by name. Ages
+// entered as text or decimals by imports decode as whole years.
+func upgradePatientV1(doc bson.M) error {
+    defaultUpdatedAt(doc)
+    if name, ok := doc["name"].(string); ok && doc["nameKeys"] == nil {
+        doc["nameKeys"] = phonetic.Keys(name)
+    }
+    return coerceInt(doc, "age")
+}
+
+// upgradeAppointmentV1 upgrades appointments created before they had an
+// update time and a mode, all of which were in person.
+func upgradeAppointmentV1(doc bson.M) error {
+    defaultUpdatedAt(doc)
+    if mode, _ := doc["mode"].(string); mode == "" {
+        doc["mode"] = ModeInPerson
+    }
+    return nil
+}
+
+// defaultUpdatedAt dates documents without an update time at their
+// creation, for the reads and exports ordered by it.
+func defaultUpdatedAt(doc bson.M) {
+    if doc["updatedAt"] == nil && doc["createdAt"] != nil {
+        doc["updatedAt"] = doc["createdAt"]
+    }
+}
+
+// coerceInt stores a number held as text or a whole decimal as an integer.
+func coerceInt(doc bson.M, key string) error {
+    switch v := doc[key].(type) {
+    case string:
+        n, err := strconv.ParseInt(v, 10, 32)
+        if err != nil {
+            return fmt.Errorf("%s: %w", key, err)
+        }
+        doc[key] = int32(n)
+    case float64:
+        if v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+            return fmt.Errorf("%s: %v is not a whole number", key, v)
+        }
+        doc[key] = int32(v)
+    }
+    return nil
+}
+
+// Write back
+
+// maxSchemaWriteBacks bounds the documents waiting to be written back;
+// those read beyond it are queued again on their next read.
+const maxSchemaWriteBacks = 10000
+
+// schemaWriteBackQueue holds the ids of documents upgraded on read, by
+// collection, until the next write back.
+type schemaWriteBackQueue struct {
+    mu      sync.Mutex
+    pending map[string]map[primitive.ObjectID]bool
+    size    int
+}
+
+var schemaWriteBacks = &schemaWriteBackQueue{pending: map[string]map[primitive.ObjectID]bool{}}
+
+func (q *schemaWriteBackQueue) add(coll string, id primitive.ObjectID) {
+    if config.SchemaWriteBackInterval <= 0 {
+        return
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.size >= maxSchemaWriteBacks || q.pending[coll][id] {
+        return
+    }
+    if q.pending[coll] == nil {
+        q.pending[coll] = map[primitive.ObjectID]bool{}
+    }
+    q.pending[coll][id] = true
+    q.size++
+}
+
+func (q *schemaWriteBackQueue) take() map[string]map[primitive.ObjectID]bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    pending := q.pending
+    q.pending, q.size = map[string]map[primitive.ObjectID]bool{}, 0
+    return pending
+}
+
+// writeBackSchemas is the scheduled write back of the documents upgraded
+// on read since the last run.
+func writeBackSchemas(ctx context.Context) error {
+    for coll, ids := range schemaWriteBacks.take() {
+        for id := range ids {
+            if _, err := writeBackSchema(ctx, versionedCollections[coll], id); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// writeBackSchema stores document id of coll in its current schema
+// version, reporting whether it needed to. The upgraded fields are set
+// and the retired ones unset only while the document is unchanged since
+// it was read, so concurrent writes win. The write back is not a change
+// of the document: it is neither audited nor streamed.
+func writeBackSchema(ctx context.Context, coll *mongo.Collection, id primitive.ObjectID) (bool, error) {
+    raw, err := coll.FindOne(ctx, bson.M{"_id": id}).Raw()
+    if err == mongo.ErrNoDocuments {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    version := storedSchemaVersion(raw)
+    if version >= schemaVersion(coll.Name()) {
+        return false, nil
+    }
+    var stored bson.M
+    if err := bson.Unmarshal(raw, &stored); err != nil {
+        return false, err
+    }
+
+    doc := bson.M{}
+    for k, v := range stored {
+        doc[k] = v
+    }
+    if err := upgradeDocument(coll.Name(), doc, version); err != nil {
+        return false, err
+    }
+    set, unset := bson.M{}, bson.M{}
+    for k, v := range doc {
+        if old, ok := stored[k]; !ok || !reflect.DeepEqual(old, v) {
+            set[k] = v
+        }
+    }
+    for k := range stored {
+        if _, ok := doc[k]; !ok {
+            unset[k] = ""
+        }
+    }
+    update := bson.M{"$set": set}
+    if len(unset) > 0 {
+        update["$unset"] = unset
+    }
+
+    result, err := coll.UpdateOne(ctx, bson.M{
+        "_id":           id,
+        "updatedAt":     stored["updatedAt"],
+        "schemaVersion": stored["schemaVersion"],
+    }, update)
+    if err != nil {
+        return false, err
+    }
+    return result.ModifiedCount > 0, nil
+}
+
+// SchemaStatus is how many documents of a versioned collection are stored
+// in each schema version.
+type SchemaStatus struct {
+    Collection string           `json:"collection"`
+    Version    int              `json:"version"`
+    Stored     map[string]int64 `json:"stored"` // by version
+    Pending    int64            `json:"pending"` // stored in older versions
+}
+
+// getSchemas reports the schema versions of the versioned collections:
+// GET /admin/schemas
+func getSchemas(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    names := make([]string, 0, len(schemas))
+    for name := range schemas {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    statuses := []SchemaStatus{}
+    for _, name := range names {
+        cursor, err := versionedCollections[name].Aggregate(ctx, mongo.Pipeline{
+            {{Key: "$group", Value: bson.M{
+                "_id":   bson.M{"$ifNull": bson.A{"$schemaVersion", 0}},
+                "count": bson.M{"$sum": 1},
+            }}},
+        })
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        var counts []struct {
+            Version int   `bson:"_id"`
+            Count   int64 `bson:"count"`
+        }
+        if err := cursor.All(ctx, &counts); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        status := SchemaStatus{Collection: name, Version: schemaVersion(name), Stored: map[string]int64{}}
+        for _, c := range counts {
+            status.Stored[strconv.Itoa(c.Version)] = c.Count
+            if c.Version < status.Version {
+                status.Pending += c.Count
+            }
+        }
+        statuses = append(statuses, status)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(statuses)
+}
+
+// upgradeSchema writes back every document of a collection stored in an
+// older schema version, for those rarely read:
+// POST /admin/schemas/{collection}/upgrade
+func upgradeSchema(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    name := r.PathValue("collection")
+    if _, ok := schemas[name]; !ok {
+        localizedError(w, r, http.StatusNotFound, "unknown_versioned_collection", name)
+        return
+    }
+
+    ctx := r.Context()
+    coll := versionedCollections[name]
+
+    filter := bson.M{"$or": bson.A{
+        bson.M{"schemaVersion": nil},
+        bson.M{"schemaVersion": bson.M{"$lt": schemaVersion(name)}},
+    }}
+    cursor, err := coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer cursor.Close(ctx)
+
+    var upgraded int64
+    for cursor.Next(ctx) {
+        var doc struct {
+            ID primitive.ObjectID `bson:"_id"`
+        }
+        if err := cursor.Decode(&doc); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        ok, err := writeBackSchema(ctx, coll, doc.ID)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if ok {
+            upgraded++
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"collection": name, "upgraded": upgraded})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Cookies of the cookie session mode, used by browser apps such as the
+// patient portal instead of bearer tokens.
+const (
+    sessionCookie = "session"
+    refreshCookie = "refresh_token"
+    csrfCookie    = "csrf_token"
+    csrfHeader    = "X-CSRF-Token"
+)
+
+// errCSRF rejects cookie authenticated writes without a valid CSRF token.
+var errCSRF = newAPIError("csrf_failed")
+
+// securityHeaders sets the standard security headers on every response.
+// HSTS is only sent over TLS, where browsers honor it.
+func securityHeaders(next http.Handler) http.Handler {
+    hsts := "max-age=" + strconv.FormatInt(int64(config.HSTSMaxAge/time.Second), 10)
+    if config.HSTSIncludeSubdomains {
+        hsts += "; includeSubDomains"
+    }
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        h := w.Header()
+        h.Set("X-Content-Type-Options", "nosniff")
+        h.Set("X-Frame-Options", "DENY")
+        h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+        h.Set("Cross-Origin-Opener-Policy", "same-origin")
+        if config.ContentSecurityPolicy != "" {
+            h.Set("Content-Security-Policy", config.ContentSecurityPolicy)
+        }
+        if r.TLS != nil && config.HSTSMaxAge > 0 {
+            h.Set("Strict-Transport-Security", hsts)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// csrfToken is the CSRF token of a session. It is derived from the session
+// ID, so it needs no storage and dies with the session.
+func csrfToken(session *Session) string {
+    mac := hmac.New(sha256.New, authKey)
+    mac.Write([]byte("csrf:" + session.ID.Hex()))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF requires the X-CSRF-Token header on state changing requests
+// authenticated by cookie. Safe methods do not change state and are
+// exempt.
+func checkCSRF(r *http.Request, session *Session) error {
+    switch r.Method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions:
+        return nil
+    }
+    if !hmac.Equal([]byte(r.Header.Get(csrfHeader)), []byte(csrfToken(session))) {
+        return errCSRF
+    }
+    return nil
+}
+
+// setSessionCookies stores the tokens of a session in cookies. The session
+// and refresh cookies are out of reach of scripts; the CSRF cookie is not,
+// so the app can echo it in the X-CSRF-Token header.
+func setSessionCookies(w http.ResponseWriter, session *Session, token string, expires time.Time, refreshToken string) {
+    http.SetCookie(w, &http.Cookie{
+        Name: sessionCookie, Value: token, Path: "/", Expires: expires,
+        HttpOnly: true, Secure: config.CookieSecure, SameSite: http.SameSiteLaxMode,
+    })
+    http.SetCookie(w, &http.Cookie{
+        Name: refreshCookie, Value: refreshToken, Path: "/auth", Expires: session.ExpiresAt,
+        HttpOnly: true, Secure: config.CookieSecure, SameSite: http.SameSiteStrictMode,
+    })
+    http.SetCookie(w, &http.Cookie{
+        Name: csrfCookie, Value: csrfToken(session), Path: "/", Expires: session.ExpiresAt,
+        Secure: config.CookieSecure, SameSite: http.SameSiteStrictMode,
+    })
+}
+
+// clearSessionCookies removes the cookies of a logged out session.
+func clearSessionCookies(w http.ResponseWriter) {
+    for name, path := range map[string]string{sessionCookie: "/", refreshCookie: "/auth", csrfCookie: "/"} {
+        http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, Secure: config.CookieSecure})
+    }
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "net"
+    "net/http"
+
+    "golang.org/x/crypto/acme/autocert"
+)
+
+// serve starts the HTTP listener and, when certificates or autocert domains
+// are configured, the HTTPS listener. With TLS enabled the plain listener
+// only redirects to HTTPS (and answers ACME challenges in autocert mode)
+// unless HTTPS_REDIRECT is turned off.
+func serve(handler http.Handler) error {
+    autocertEnabled := len(config.AutocertDomains) > 0
+    if !autocertEnabled && config.TLSCertFile == "" {
+        fmt.Printf("Starting hospital management service on http://localhost%s\n", config.HTTPAddr)
+        return http.ListenAndServe(config.HTTPAddr, handler)
+    }
+
+    httpsServer := &http.Server{
+        Addr:      config.TLSAddr,
+        Handler:   handler,
+        TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+    }
+
+    plainHandler := handler
+    if config.HTTPSRedirect {
+        plainHandler = http.HandlerFunc(redirectToHTTPS)
+    }
+
+    if autocertEnabled {
+        manager := &autocert.Manager{
+            Prompt:     autocert.AcceptTOS,
+            HostPolicy: autocert.HostWhitelist(config.AutocertDomains...),
+            Cache:      autocert.DirCache(config.AutocertCacheDir),
+            Email:      config.AutocertEmail,
+        }
+        httpsServer.TLSConfig = manager.TLSConfig()
+        httpsServer.TLSConfig.MinVersion = tls.VersionTLS12
+        plainHandler = manager.HTTPHandler(plainHandler)
+    }
+
+    errs := make(chan error, 2)
+    go func() {
+        errs <- http.ListenAndServe(config.HTTPAddr, plainHandler)
+    }()
+    go func() {
+        // Certificates come from TLSConfig.GetCertificate in autocert mode.
+        errs <- httpsServer.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+    }()
+
+    fmt.Printf("Starting hospital management service on https://localhost%s\n", config.TLSAddr)
+    return <-errs
+}
+
+// redirectToHTTPS sends clients of the plain listener to the same URL on the
+// HTTPS listener.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+    host := r.Host
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    if _, port, err := net.SplitHostPort(config.TLSAddr); err == nil && port != "443" {
+        host = net.JoinHostPort(host, port)
+    }
+
+    target := "https://" + host + r.URL.RequestURI()
+    http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
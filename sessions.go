@@ -0,0 +1,323 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Session is a signed in device of an account. Access tokens name their
+// session, so revoking it logs the device out at once; the refresh token
+// rotates on every use. Only hashes of refresh tokens are stored.
+type Session struct {
+    ID                  primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    UserID              primitive.ObjectID `json:"userId" bson:"userId"`
+    RefreshTokenHash    string             `json:"-" bson:"refreshTokenHash"`
+    PreviousRefreshHash string             `json:"-" bson:"previousRefreshHash,omitempty"`
+    UserAgent           string             `json:"userAgent" bson:"userAgent"`
+    IP                  string             `json:"ip" bson:"ip"`
+    CreatedAt           time.Time          `json:"createdAt" bson:"createdAt"`
+    LastUsedAt          time.Time          `json:"lastUsedAt" bson:"lastUsedAt"`
+    ExpiresAt           time.Time          `json:"expiresAt" bson:"expiresAt"`
+    RevokedAt           *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+    RevokedBy           string             `json:"revokedBy,omitempty" bson:"revokedBy,omitempty"`
+    Current             bool               `json:"current,omitempty" bson:"-"`
+}
+
+var sessionCollection *mongo.Collection
+
+func initSessions(ctx context.Context, db *mongo.Database) {
+    sessionCollection = db.Collection("sessions")
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "userId", Value: 1}}},
+        {Keys: bson.D{{Key: "refreshTokenHash", Value: 1}}},
+        {Keys: bson.D{{Key: "previousRefreshHash", Value: 1}}, Options: options.Index().SetSparse(true)},
+        {Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    }
+    if _, err := sessionCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating session indexes: %v\n", err)
+    }
+}
+
+type sessionKey struct{}
+
+func contextWithSession(ctx context.Context, session *Session) context.Context {
+    return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// sessionFromContext returns the session of the request, or nil.
+func sessionFromContext(ctx context.Context) *Session {
+    session, _ := ctx.Value(sessionKey{}).(*Session)
+    return session
+}
+
+// clientIP is the address of the peer of r.
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// activeSession finds an unrevoked, unexpired session matching filter.
+func activeSession(ctx context.Context, filter bson.M) (*Session, error) {
+    filter["revokedAt"] = nil
+    filter["expiresAt"] = bson.M{"$gt": time.Now()}
+
+    var session Session
+    if err := sessionCollection.FindOne(ctx, filter).Decode(&session); err != nil {
+        return nil, err
+    }
+    return &session, nil
+}
+
+// revokeSessions ends the active sessions of a user matching filter and
+// returns how many were revoked.
+func revokeSessions(ctx context.Context, userID primitive.ObjectID, filter bson.M) (int64, error) {
+    filter["userId"] = userID
+    filter["revokedAt"] = nil
+    result, err := sessionCollection.UpdateMany(ctx, filter, bson.M{
+        "$set": bson.M{"revokedAt": time.Now(), "revokedBy": actorFromContext(ctx)},
+    })
+    if err != nil {
+        return 0, err
+    }
+    return result.ModifiedCount, nil
+}
+
+// startSession records a new session of a signed in user and answers with
+// its access and refresh tokens, in cookies when cookie is set.
+func startSession(w http.ResponseWriter, r *http.Request, user *User, cookie bool) {
+    ctx := r.Context()
+
+    now := time.Now()
+    refreshToken := randomToken(32)
+    session := Session{
+        UserID:           user.ID,
+        RefreshTokenHash: hashToken(refreshToken),
+        UserAgent:        r.UserAgent(),
+        IP:               clientIP(r),
+        CreatedAt:        now,
+        LastUsedAt:       now,
+        ExpiresAt:        now.Add(config.AuthRefreshTTL),
+    }
+    result, err := sessionCollection.InsertOne(ctx, session)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    session.ID = result.InsertedID.(primitive.ObjectID)
+
+    writeTokens(w, user, &session, refreshToken, cookie)
+}
+
+func writeTokens(w http.ResponseWriter, user *User, session *Session, refreshToken string, cookie bool) {
+    token, expires := issueToken(user, session)
+    response := map[string]interface{}{
+        "expiresAt":        expires,
+        "refreshExpiresAt": session.ExpiresAt,
+        "user":             user,
+    }
+    if cookie {
+        setSessionCookies(w, session, token, expires, refreshToken)
+        response["csrfToken"] = csrfToken(session)
+    } else {
+        response["token"] = token
+        response["refreshToken"] = refreshToken
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(response)
+}
+
+// Session handlers
+
+// refreshSession trades a refresh token, from the body or the refresh
+// cookie, for a new access token and a new refresh token: POST
+// /auth/refresh. Presenting an already rotated refresh token means it was
+// stolen, so the session is revoked.
+func refreshSession(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var body struct {
+        RefreshToken string `json:"refreshToken"`
+    }
+    cookie, err := r.Cookie(refreshCookie)
+    if err == nil {
+        body.RefreshToken = cookie.Value
+    } else if !decodeJSON(w, r, &body) {
+        return
+    }
+
+    ctx := r.Context()
+
+    hash := hashToken(body.RefreshToken)
+    reused, err := activeSession(ctx, bson.M{"previousRefreshHash": hash})
+    if err == nil {
+        log.Printf("Refresh token reuse on session %s, revoking it\n", reused.ID.Hex())
+        if _, err := revokeSessions(contextWithActor(ctx, "refresh-reuse"), reused.UserID, bson.M{"_id": reused.ID}); err != nil {
+            log.Printf("Error revoking session %s: %v\n", reused.ID.Hex(), err)
+        }
+        localizedError(w, r, http.StatusUnauthorized, "invalid_refresh_token")
+        return
+    }
+
+    now := time.Now()
+    refreshToken := randomToken(32)
+    var session Session
+    err = sessionCollection.FindOneAndUpdate(ctx,
+        bson.M{"refreshTokenHash": hash, "revokedAt": nil, "expiresAt": bson.M{"$gt": now}},
+        bson.M{"$set": bson.M{
+            "refreshTokenHash":    hashToken(refreshToken),
+            "previousRefreshHash": hash,
+            "lastUsedAt":          now,
+            "ip":                  clientIP(r),
+            "userAgent":           r.UserAgent(),
+        }},
+        options.FindOneAndUpdate().SetReturnDocument(options.After),
+    ).Decode(&session)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusUnauthorized, "invalid_refresh_token")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    user, err := userRepo.GetByID(ctx, session.UserID)
+    if err != nil {
+        localizedError(w, r, http.StatusUnauthorized, "invalid_refresh_token")
+        return
+    }
+    if user.LockedUntil != nil && user.LockedUntil.After(now) {
+        localizedError(w, r, http.StatusLocked, "account_locked")
+        return
+    }
+
+    writeTokens(w, user, &session, refreshToken, cookie != nil)
+}
+
+// logout revokes the session of the request: POST /auth/logout
+func logout(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    session := sessionFromContext(ctx)
+    if _, err := revokeSessions(ctx, session.UserID, bson.M{"_id": session.ID}); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    clearSessionCookies(w)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// mySessions lists the active sessions of the authenticated account (GET)
+// or revokes all of them, logging out everywhere (DELETE):
+// /auth/sessions
+func mySessions(w http.ResponseWriter, r *http.Request) {
+    user := userFromContext(r.Context())
+    switch r.Method {
+    case http.MethodGet:
+        writeUserSessions(w, r, user.ID)
+    case http.MethodDelete:
+        revokeUserSessions(w, r, user.ID, bson.M{})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// revokeMySession logs one device of the authenticated account out:
+// DELETE /auth/sessions/{id}
+func revokeMySession(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_session_id")
+        return
+    }
+    revokeUserSessions(w, r, userFromContext(r.Context()).ID, bson.M{"_id": id})
+}
+
+// adminUserSessions lists the active sessions of an account (GET) or
+// force-logs it out of all of them (DELETE): /admin/users/{id}/sessions
+func adminUserSessions(w http.ResponseWriter, r *http.Request) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_user_id")
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        writeUserSessions(w, r, id)
+    case http.MethodDelete:
+        revokeUserSessions(w, r, id, bson.M{})
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func writeUserSessions(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+    ctx := r.Context()
+
+    cursor, err := sessionCollection.Find(ctx,
+        bson.M{"userId": userID, "revokedAt": nil, "expiresAt": bson.M{"$gt": time.Now()}},
+        options.Find().SetSort(bson.D{{Key: "lastUsedAt", Value: -1}}),
+    )
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    sessions := []Session{}
+    if err := cursor.All(ctx, &sessions); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if current := sessionFromContext(ctx); current != nil {
+        for i := range sessions {
+            sessions[i].Current = sessions[i].ID == current.ID
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(sessions)
+}
+
+func revokeUserSessions(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, filter bson.M) {
+    ctx := r.Context()
+
+    revoked, err := revokeSessions(ctx, userID, filter)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]int64{"revoked": revoked})
+}
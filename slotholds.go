@@ -0,0 +1,263 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SlotHold reserves a doctor's slot for SLOT_HOLD_TTL while a patient
+// confirms their details. Booking the slot consumes the hold; holds that
+// expire free the slot and are purged by a TTL index.
+type SlotHold struct {
+    ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+    DoctorID  primitive.ObjectID `json:"doctorId" bson:"doctorId"`
+    DateTime  time.Time          `json:"dateTime" bson:"dateTime"`
+    CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+    ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var slotHoldCollection *mongo.Collection
+
+func initSlotHolds(ctx context.Context, db *mongo.Database) {
+    slotHoldCollection = db.Collection("slot_holds")
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "doctorId", Value: 1}, {Key: "dateTime", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    }
+    if _, err := slotHoldCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating slot hold indexes: %v\n", err)
+    }
+}
+
+// heldSlots lists the start times of a doctor's slots held between from
+// and to. The TTL monitor runs once a minute, so expiry is checked here.
+func heldSlots(ctx context.Context, doctorID primitive.ObjectID, from, to time.Time) ([]time.Time, error) {
+    cursor, err := slotHoldCollection.Find(ctx, bson.M{
+        "doctorId":  doctorID,
+        "dateTime":  bson.M{"$gte": from, "$lt": to},
+        "expiresAt": bson.M{"$gt": time.Now()},
+    })
+    if err != nil {
+        return nil, err
+    }
+    var holds []SlotHold
+    if err := cursor.All(ctx, &holds); err != nil {
+        return nil, err
+    }
+    times := make([]time.Time, len(holds))
+    for i, hold := range holds {
+        times[i] = hold.DateTime
+    }
+    return times, nil
+}
+
+// claimSlotHold consumes the hold an appointment is booked with, which must
+// be for its doctor and time.
+func claimSlotHold(ctx context.Context, appointment *Appointment) error {
+    if appointment.HoldID == nil {
+        return newAPIError("field_required", "holdId")
+    }
+    var hold SlotHold
+    err := slotHoldCollection.FindOneAndDelete(ctx, bson.M{
+        "_id":       *appointment.HoldID,
+        "expiresAt": bson.M{"$gt": time.Now()},
+    }).Decode(&hold)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return newAPIError("hold_expired")
+    }
+    if err != nil {
+        return err
+    }
+
+    if appointment.DoctorID != hold.DoctorID || !appointment.DateTime.Equal(hold.DateTime) {
+        return newAPIError("hold_mismatch")
+    }
+    return nil
+}
+
+// slotHold holds a free slot of a doctor: POST /slots/hold with
+// {"doctorId", "dateTime"}. The returned id is passed as holdId when
+// booking.
+//
+// To book "any cardiologist", {"specialization"} replaces the doctor and
+// the slot, optionally with a suggestionQuery window: the first free slot
+// of the least loaded doctor is held, and the other doctors are returned
+// as alternatives ranked by earliest availability.
+func slotHold(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req struct {
+        SlotHold
+        suggestionQuery
+    }
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    ctx := r.Context()
+
+    if req.DoctorID.IsZero() && req.Specialization != "" {
+        holdBalancedSlot(w, r, req.suggestionQuery)
+        return
+    }
+
+    hold := req.SlotHold
+    if err := holdSlot(ctx, &hold); err != nil {
+        writeHoldError(w, r, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(hold)
+}
+
+// holdBalancedSlot holds the first free slot of the doctor suggested for
+// q, or of the next alternative when it was taken meanwhile.
+func holdBalancedSlot(w http.ResponseWriter, r *http.Request, q suggestionQuery) {
+    ctx := r.Context()
+
+    suggestions, err := suggestDoctors(ctx, q)
+    var apiErr *apiError
+    if errors.As(err, &apiErr) {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if suggestions.Pick == nil {
+        localizedError(w, r, http.StatusConflict, "no_doctor_available")
+        return
+    }
+
+    candidates := append([]DoctorSuggestion{*suggestions.Pick}, suggestions.Alternatives...)
+    for i, candidate := range candidates {
+        hold := SlotHold{DoctorID: candidate.Doctor.ID, DateTime: candidate.FirstSlot}
+        err := holdSlot(ctx, &hold)
+        if errors.As(err, &apiErr) && apiErr.key == "slot_unavailable" {
+            continue
+        }
+        if err != nil {
+            writeHoldError(w, r, err)
+            return
+        }
+
+        alternatives := append([]DoctorSuggestion{}, candidates[:i]...)
+        alternatives = append(alternatives, candidates[i+1:]...)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(struct {
+            SlotHold
+            Doctor       *Doctor            `json:"doctor"`
+            Booked       int64              `json:"booked"`
+            Alternatives []DoctorSuggestion `json:"alternatives"`
+        }{hold, candidate.Doctor, candidate.Booked, alternatives})
+        return
+    }
+    localizedError(w, r, http.StatusConflict, "no_doctor_available")
+}
+
+// holdSlot holds the free slot of hold for SLOT_HOLD_TTL.
+func holdSlot(ctx context.Context, hold *SlotHold) error {
+    doctor, err := doctorRepo.GetByID(ctx, hold.DoctorID)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return newAPIError("doctor_not_found")
+    }
+    if err != nil {
+        return err
+    }
+
+    slots, err := freeSlots(ctx, doctor, hold.DateTime.Local())
+    if err != nil {
+        return err
+    }
+    free := false
+    for _, slot := range slots {
+        if slot.Equal(hold.DateTime) {
+            free = true
+            break
+        }
+    }
+    if !free || !hold.DateTime.After(time.Now()) {
+        return newAPIError("slot_unavailable")
+    }
+
+    // Expired holds the TTL monitor has not purged yet would still take the
+    // unique index
+    _, err = slotHoldCollection.DeleteMany(ctx, bson.M{
+        "doctorId":  hold.DoctorID,
+        "dateTime":  hold.DateTime,
+        "expiresAt": bson.M{"$lte": time.Now()},
+    })
+    if err != nil {
+        return err
+    }
+
+    hold.ID = primitive.NewObjectID()
+    hold.CreatedAt = time.Now()
+    hold.ExpiresAt = hold.CreatedAt.Add(config.SlotHoldTTL)
+    if _, err := slotHoldCollection.InsertOne(ctx, hold); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            return newAPIError("slot_unavailable")
+        }
+        return err
+    }
+    return nil
+}
+
+// writeHoldError answers an error of holdSlot.
+func writeHoldError(w http.ResponseWriter, r *http.Request, err error) {
+    var apiErr *apiError
+    if errors.As(err, &apiErr) {
+        status := http.StatusConflict
+        if apiErr.key == "doctor_not_found" {
+            status = http.StatusNotFound
+        }
+        writeError(w, r, status, err)
+        return
+    }
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// releaseSlotHold frees a held slot before its hold expires:
+// DELETE /slots/hold/{id}
+func releaseSlotHold(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_hold_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    result, err := slotHoldCollection.DeleteOne(ctx, bson.M{"_id": id})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if result.DeletedCount == 0 {
+        localizedError(w, r, http.StatusNotFound, "hold_expired")
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
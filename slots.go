@@ -0,0 +1,129 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Statuses of appointments that occupy their slot
+var activeStatuses = bson.A{StatusScheduled, StatusCheckedIn}
+
+// slotSearchDays bounds how far ahead nextFreeSlot looks.
+const slotSearchDays = 30
+
+// freeSlots lists the start times of a doctor's slots on day that have room
+// for an appointment, skipping periods the doctor is unavailable and slots
+// that are held. Every appointment and hold occupies one SLOT_DURATION from
+// its start time. Days at their department's capacity have none. The
+// doctor's schedule comes from the schedule cache when it covers the day.
+func freeSlots(ctx context.Context, doctor *Doctor, day time.Time) ([]time.Time, error) {
+    hours, err := doctorWorkingDay(ctx, doctor, day)
+    if err != nil || !hours.Open {
+        return nil, err
+    }
+    start, end := hours.Start, hours.End
+
+    sched, err := scheduleOf(ctx, doctor.ID, day, hours)
+    if err != nil {
+        return nil, err
+    }
+    if sched.daily+int64(len(sched.held)) >= hours.Capacity.daily(hours) {
+        return nil, nil
+    }
+
+    var slots []time.Time
+    for slot := start; !slot.Add(config.SlotDuration).After(end); slot = slot.Add(config.SlotDuration) {
+        occupied := 0
+        for _, at := range sched.booked {
+            if at.Before(slot.Add(config.SlotDuration)) && slot.Before(at.Add(config.SlotDuration)) {
+                occupied++
+            }
+        }
+        free := occupied < hours.Capacity.perSlot()
+        for _, h := range sched.held {
+            if h.Before(slot.Add(config.SlotDuration)) && slot.Before(h.Add(config.SlotDuration)) {
+                free = false
+                break
+            }
+        }
+        for _, b := range sched.blocks {
+            if b.Start.Before(slot.Add(config.SlotDuration)) && slot.Before(b.End) {
+                free = false
+                break
+            }
+        }
+        if free {
+            slots = append(slots, slot)
+        }
+    }
+    return slots, nil
+}
+
+// nextFreeSlot finds the doctor's first free slot starting after after.
+func nextFreeSlot(ctx context.Context, doctor *Doctor, after time.Time) (time.Time, bool, error) {
+    day := after.Local()
+    for i := 0; i < slotSearchDays; i++ {
+        slots, err := freeSlots(ctx, doctor, day)
+        if err != nil {
+            return time.Time{}, false, err
+        }
+        for _, slot := range slots {
+            if slot.After(after) {
+                return slot, true, nil
+            }
+        }
+        _, day = dayBounds(day)
+    }
+    return time.Time{}, false, nil
+}
+
+// getDoctorSlots lists a doctor's free slots: GET /doctors/{id}/slots?date=YYYY-MM-DD
+func getDoctorSlots(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_doctor_id")
+        return
+    }
+    day, err := time.ParseInLocation(time.DateOnly, r.URL.Query().Get("date"), time.Local)
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_date", "date")
+        return
+    }
+
+    ctx := r.Context()
+
+    doctor, err := doctorRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "doctor_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    slots, err := freeSlots(ctx, doctor, day)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "doctorId": doctor.ID,
+        "date":     day.Format(time.DateOnly),
+        "slots":    append([]time.Time{}, slots...),
+    })
+}
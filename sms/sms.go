@@ -0,0 +1,51 @@
+// Package sms sends text messages through pluggable gateway providers and
+// parses their delivery status callbacks.
+package sms
+
+import (
+    "context"
+    "errors"
+    "net/http"
+)
+
+// Delivery statuses, normalized across providers.
+const (
+    StatusQueued      = "queued"
+    StatusSent        = "sent"
+    StatusDelivered   = "delivered"
+    StatusUndelivered = "undelivered"
+    StatusFailed      = "failed"
+)
+
+// Message is a text message to send.
+type Message struct {
+    To   string // E.164 phone number
+    Body string
+    // StatusCallback is the URL the provider reports delivery status to.
+    StatusCallback string
+}
+
+// Receipt is a provider's acknowledgement of a sent message.
+type Receipt struct {
+    ID     string // provider message id
+    Status string
+}
+
+// StatusUpdate is a delivery status reported to the status callback.
+type StatusUpdate struct {
+    ID     string
+    Status string
+    Error  string
+}
+
+// Provider is an SMS gateway.
+type Provider interface {
+    Name() string
+    Send(ctx context.Context, msg Message) (Receipt, error)
+    // ParseStatus authenticates and decodes a status callback request.
+    ParseStatus(r *http.Request) (StatusUpdate, error)
+}
+
+// ErrInvalidSignature is returned by ParseStatus for callbacks that were
+// not signed by the provider.
+var ErrInvalidSignature = errors.New("sms: invalid callback signature")
@@ -0,0 +1,130 @@
+package sms
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+    "time"
+)
+
+const twilioAPI = "https://api.twilio.com/2010-04-01"
+
+// Twilio sends messages through the Twilio Messaging API.
+type Twilio struct {
+    AccountSID string
+    AuthToken  string
+    From       string
+
+    client *http.Client
+}
+
+// NewTwilio returns a Twilio provider sending through client, or a
+// default client if nil.
+func NewTwilio(accountSID, authToken, from string, client *http.Client) *Twilio {
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &Twilio{
+        AccountSID: accountSID,
+        AuthToken:  authToken,
+        From:       from,
+        client:     client,
+    }
+}
+
+func (t *Twilio) Name() string { return "twilio" }
+
+func (t *Twilio) Send(ctx context.Context, msg Message) (Receipt, error) {
+    form := url.Values{"To": {msg.To}, "From": {t.From}, "Body": {msg.Body}}
+    if msg.StatusCallback != "" {
+        form.Set("StatusCallback", msg.StatusCallback)
+    }
+
+    endpoint := twilioAPI + "/Accounts/" + url.PathEscape(t.AccountSID) + "/Messages.json"
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return Receipt{}, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.SetBasicAuth(t.AccountSID, t.AuthToken)
+
+    resp, err := t.client.Do(req)
+    if err != nil {
+        return Receipt{}, err
+    }
+    defer resp.Body.Close()
+
+    var body struct {
+        SID     string `json:"sid"`
+        Status  string `json:"status"`
+        Message string `json:"message"`
+    }
+    json.NewDecoder(resp.Body).Decode(&body)
+    if resp.StatusCode >= 300 {
+        return Receipt{}, fmt.Errorf("twilio: %s: %s", resp.Status, body.Message)
+    }
+    return Receipt{ID: body.SID, Status: twilioStatus(body.Status)}, nil
+}
+
+// ParseStatus verifies the X-Twilio-Signature of a status callback: the
+// base64 HMAC-SHA1 under the auth token of the callback URL followed by
+// the sorted form parameters.
+func (t *Twilio) ParseStatus(r *http.Request) (StatusUpdate, error) {
+    if err := r.ParseForm(); err != nil {
+        return StatusUpdate{}, err
+    }
+
+    scheme := "https"
+    if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") != "https" {
+        scheme = "http"
+    }
+    signed := scheme + "://" + r.Host + r.URL.RequestURI()
+    keys := make([]string, 0, len(r.PostForm))
+    for k := range r.PostForm {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        signed += k + r.PostForm.Get(k)
+    }
+
+    mac := hmac.New(sha1.New, []byte(t.AuthToken))
+    mac.Write([]byte(signed))
+    expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+    if subtle.ConstantTimeCompare([]byte(expected), []byte(r.Header.Get("X-Twilio-Signature"))) != 1 {
+        return StatusUpdate{}, ErrInvalidSignature
+    }
+
+    update := StatusUpdate{
+        ID:     r.PostForm.Get("MessageSid"),
+        Status: twilioStatus(r.PostForm.Get("MessageStatus")),
+    }
+    if code := r.PostForm.Get("ErrorCode"); code != "" {
+        update.Error = "twilio error " + code
+    }
+    return update, nil
+}
+
+// twilioStatus maps Twilio message statuses to the package's.
+func twilioStatus(status string) string {
+    switch status {
+    case "accepted", "scheduled", "queued", "sending":
+        return StatusQueued
+    case "sent":
+        return StatusSent
+    case "delivered", "read":
+        return StatusDelivered
+    case "undelivered":
+        return StatusUndelivered
+    default:
+        return StatusFailed
+    }
+}
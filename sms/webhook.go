@@ -0,0 +1,104 @@
+package sms
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "time"
+)
+
+// Webhook hands messages to an in-house gateway over HTTP. Messages are
+// posted as JSON {"to", "body", "statusCallback"} and the gateway answers
+// {"id", "status"}. Status callbacks post {"id", "status", "error"}.
+// Both directions carry an X-Signature header, "sha256=" followed by the
+// hex HMAC-SHA256 of the body under the shared secret.
+type Webhook struct {
+    URL    string
+    Secret string
+
+    client *http.Client
+}
+
+// NewWebhook returns a webhook provider posting through client, or a
+// default client if nil.
+func NewWebhook(url, secret string, client *http.Client) *Webhook {
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &Webhook{URL: url, Secret: secret, client: client}
+}
+
+func (h *Webhook) Name() string { return "webhook" }
+
+func (h *Webhook) sign(body []byte) string {
+    mac := hmac.New(sha256.New, []byte(h.Secret))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Webhook) Send(ctx context.Context, msg Message) (Receipt, error) {
+    body, err := json.Marshal(map[string]string{
+        "to":             msg.To,
+        "body":           msg.Body,
+        "statusCallback": msg.StatusCallback,
+    })
+    if err != nil {
+        return Receipt{}, err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+    if err != nil {
+        return Receipt{}, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if h.Secret != "" {
+        req.Header.Set("X-Signature", h.sign(body))
+    }
+
+    resp, err := h.client.Do(req)
+    if err != nil {
+        return Receipt{}, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return Receipt{}, fmt.Errorf("sms webhook returned %s", resp.Status)
+    }
+
+    var receipt struct {
+        ID     string `json:"id"`
+        Status string `json:"status"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+        return Receipt{}, err
+    }
+    if receipt.Status == "" {
+        receipt.Status = StatusQueued
+    }
+    return Receipt{ID: receipt.ID, Status: receipt.Status}, nil
+}
+
+func (h *Webhook) ParseStatus(r *http.Request) (StatusUpdate, error) {
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return StatusUpdate{}, err
+    }
+    if h.Secret != "" && !hmac.Equal([]byte(h.sign(body)), []byte(r.Header.Get("X-Signature"))) {
+        return StatusUpdate{}, ErrInvalidSignature
+    }
+
+    var update struct {
+        ID     string `json:"id"`
+        Status string `json:"status"`
+        Error  string `json:"error"`
+    }
+    if err := json.Unmarshal(body, &update); err != nil {
+        return StatusUpdate{}, err
+    }
+    return StatusUpdate{ID: update.ID, Status: update.Status, Error: update.Error}, nil
+}
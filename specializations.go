@@ -0,0 +1,167 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Specialization is an entry of the managed catalog doctors are validated
+// against. Code is the stable lowercase key stored on doctor records.
+type Specialization struct {
+    Document    `bson:",inline"`
+    Code        string `json:"code" bson:"code"`
+    Name        string `json:"name" bson:"name"`
+    Description string `json:"description" bson:"description"`
+    // Names in other languages, by language
+    Names map[string]string `json:"names,omitempty" bson:"names,omitempty"`
+}
+
+var (
+    specializationCollection *mongo.Collection
+    specializationRepo       *Repository[Specialization, *Specialization]
+)
+
+func initSpecializations(ctx context.Context, db *mongo.Database) {
+    specializationCollection = db.Collection("specializations")
+    specializationRepo = NewRepository[Specialization](specializationCollection, defaultHooks)
+
+    index := mongo.IndexModel{
+        Keys:    bson.D{{Key: "code", Value: 1}},
+        Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"deletedAt": bson.M{"$exists": false}}),
+    }
+    if _, err := specializationCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating specialization index: %v\n", err)
+    }
+}
+
+func normalizeSpecialization(code string) string {
+    return strings.ToLower(strings.TrimSpace(code))
+}
+
+// validateSpecialization checks that code names a catalog entry.
+func validateSpecialization(ctx context.Context, code string) error {
+    err := specializationCollection.FindOne(ctx, bson.M{"code": code, "deletedAt": nil}).Err()
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        return newAPIError("unknown_specialization", code)
+    }
+    return err
+}
+
+// specializationName is the display name of a specialization in lang,
+// falling back to its name and then to the code.
+func specializationName(ctx context.Context, code, lang string) string {
+    var specialization Specialization
+    err := specializationCollection.FindOne(ctx, bson.M{"code": code, "deletedAt": nil}).Decode(&specialization)
+    if err != nil {
+        return code
+    }
+    if name := specialization.Names[lang]; name != "" {
+        return name
+    }
+    if specialization.Name != "" {
+        return specialization.Name
+    }
+    return code
+}
+
+// Specialization handlers
+func getSpecializations(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    specializations, err := specializationRepo.List(ctx, bson.M{}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(specializations)
+}
+
+func createSpecialization(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var specialization Specialization
+    if !decodeJSON(w, r, &specialization) {
+        return
+    }
+
+    specialization.Code = normalizeSpecialization(specialization.Code)
+    if specialization.Code == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "code")
+        return
+    }
+    if specialization.Name == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "name")
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := specializationRepo.Create(ctx, &specialization); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            localizedError(w, r, http.StatusConflict, "specialization_exists")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(specialization)
+}
+
+func adminSpecializations(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getSpecializations(w, r)
+    case http.MethodPost:
+        createSpecialization(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func deleteSpecialization(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_specialization_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := specializationRepo.SoftDelete(ctx, id); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "specialization_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
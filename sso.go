@@ -0,0 +1,245 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/oidc"
+)
+
+// ssoLoginTTL bounds the time a user has to sign in at the provider.
+const ssoLoginTTL = 10 * time.Minute
+
+// rolePrecedence picks the role of users in several mapped groups.
+var rolePrecedence = []string{RoleAdmin, RoleDoctor, RoleStaff}
+
+// SSOLogin is a sign-in in progress at the identity provider.
+type SSOLogin struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty"`
+    State     string             `bson:"state"`
+    Nonce     string             `bson:"nonce"`
+    ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+var (
+    ssoLoginCollection *mongo.Collection
+    ssoProvider        *oidc.Provider // nil without OIDC_DISCOVERY_URL
+)
+
+func initSSO(ctx context.Context, db *mongo.Database) {
+    ssoLoginCollection = db.Collection("sso_logins")
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "state", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    }
+    if _, err := ssoLoginCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating SSO login indexes: %v\n", err)
+    }
+
+    if config.OIDCDiscoveryURL != "" {
+        ssoProvider = oidc.New(oidc.Config{
+            DiscoveryURL: config.OIDCDiscoveryURL,
+            ClientID:     config.OIDCClientID,
+            ClientSecret: config.OIDCClientSecret,
+            RedirectURL:  config.OIDCRedirectURL,
+            Scopes:       config.OIDCScopes,
+            HTTPClient:   ssoPolicy.Client(),
+        })
+    }
+}
+
+// ssoRole maps the identity provider groups of a user to a role through
+// OIDC_ROLE_MAP, or returns "" when none of the groups is mapped.
+func ssoRole(groups []string) string {
+    mapped := map[string]bool{}
+    for _, group := range groups {
+        mapped[config.OIDCRoleMap[group]] = true
+    }
+    for _, role := range rolePrecedence {
+        if mapped[role] {
+            return role
+        }
+    }
+    return ""
+}
+
+// ssoEmail is the email of an ID token. Azure AD only sends email for
+// some accounts and otherwise identifies users by preferred_username.
+func ssoEmail(claims oidc.Claims) string {
+    if email := claims.String("email"); email != "" {
+        return normalizeEmail(email)
+    }
+    if name := claims.String("preferred_username"); strings.Contains(name, "@") {
+        return normalizeEmail(name)
+    }
+    return ""
+}
+
+// ssoVerifiedEmail is the email of an ID token when the provider vouches
+// for it, or "". preferred_username is never verified.
+func ssoVerifiedEmail(claims oidc.Claims) string {
+    if claims["email_verified"] != true {
+        return ""
+    }
+    return normalizeEmail(claims.String("email"))
+}
+
+// provisionSSOUser returns the account of a signed in user, creating it on
+// first login and keeping its name and role in sync with the provider.
+// Existing accounts and doctors are only linked by an email the provider
+// has verified.
+func provisionSSOUser(ctx context.Context, claims oidc.Claims, role string) (*User, error) {
+    subject := claims.String("iss") + "|" + claims.String("sub")
+    email := ssoEmail(claims)
+    verified := ssoVerifiedEmail(claims)
+
+    var user User
+    err := userCollection.FindOne(ctx, bson.M{"ssoSubject": subject, "deletedAt": nil}).Decode(&user)
+    if errors.Is(err, mongo.ErrNoDocuments) && verified != "" {
+        var existing *User
+        existing, err = userByEmail(ctx, verified)
+        if existing != nil {
+            user = *existing
+        }
+    }
+    if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+        return nil, err
+    }
+
+    name := claims.String("name")
+    if name == "" {
+        name = email
+    }
+    var doctorID *primitive.ObjectID
+    if role == RoleDoctor {
+        doctorID = user.DoctorID
+        if doctorID == nil && verified != "" {
+            doctors, err := doctorRepo.List(ctx, bson.M{"email": verified}, Page{Number: 1, Size: 1})
+            if err != nil {
+                return nil, err
+            }
+            if len(doctors) > 0 {
+                doctorID = &doctors[0].ID
+            }
+        }
+    }
+
+    ctx = contextWithActor(ctx, email)
+    if user.ID.IsZero() {
+        if email == "" {
+            return nil, newAPIError("sso_email_missing")
+        }
+        user = User{Email: email, Name: name, Role: role, DoctorID: doctorID, SSOSubject: subject}
+        if err := userRepo.Create(ctx, &user); err != nil {
+            return nil, err
+        }
+        return &user, nil
+    }
+
+    user.Name, user.Role, user.DoctorID, user.SSOSubject = name, role, doctorID, subject
+    err = userRepo.UpdateFields(ctx, user.ID, nil, bson.M{
+        "name":        user.Name,
+        "role":        user.Role,
+        "doctorId":    user.DoctorID,
+        "ssoSubject":  user.SSOSubject,
+        "lastLoginAt": time.Now(),
+    })
+    return &user, err
+}
+
+// SSO handlers
+
+// startSSOLogin redirects to the identity provider sign-in page:
+// GET /auth/oidc/login
+func startSSOLogin(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if ssoProvider == nil {
+        localizedError(w, r, http.StatusNotImplemented, "sso_not_configured")
+        return
+    }
+
+    ctx := r.Context()
+
+    login := SSOLogin{State: randomToken(16), Nonce: randomToken(16), ExpiresAt: time.Now().Add(ssoLoginTTL)}
+    url, err := ssoProvider.AuthURL(ctx, login.State, login.Nonce)
+    if err != nil {
+        localizedError(w, r, http.StatusBadGateway, "sso_failed", err.Error())
+        return
+    }
+    if _, err := ssoLoginCollection.InsertOne(ctx, login); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    http.Redirect(w, r, url, http.StatusFound)
+}
+
+// ssoCallback completes a sign-in started by startSSOLogin and starts a
+// session like login: GET /auth/oidc/callback
+func ssoCallback(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if ssoProvider == nil {
+        localizedError(w, r, http.StatusNotImplemented, "sso_not_configured")
+        return
+    }
+
+    state, code := r.URL.Query().Get("state"), r.URL.Query().Get("code")
+    if state == "" || code == "" {
+        localizedError(w, r, http.StatusBadRequest, "sso_failed", r.URL.Query().Get("error"))
+        return
+    }
+
+    ctx := r.Context()
+
+    var login SSOLogin
+    err := ssoLoginCollection.FindOneAndDelete(ctx, bson.M{"state": state, "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&login)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusBadRequest, "sso_failed", "state")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    claims, err := ssoProvider.Exchange(ctx, code, login.Nonce)
+    if err != nil {
+        localizedError(w, r, http.StatusUnauthorized, "sso_failed", err.Error())
+        return
+    }
+
+    role := ssoRole(claims.Strings(config.OIDCGroupsClaim))
+    if role == "" {
+        localizedError(w, r, http.StatusForbidden, "sso_no_role")
+        return
+    }
+
+    user, err := provisionSSOUser(ctx, claims, role)
+    if err != nil {
+        var apiErr *apiError
+        if errors.As(err, &apiErr) {
+            writeError(w, r, http.StatusForbidden, err)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    startSession(w, r, user, false)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+// adminStatsTTL is how long the statistics are served from memory.
+const adminStatsTTL = time.Minute
+
+// AdminStats are the headline figures of the service. Patients and doctors
+// are estimated from collection metadata, so they include soft deleted
+// ones.
+type AdminStats struct {
+    Patients              int64     `json:"patients"`
+    Doctors               int64     `json:"doctors"`
+    AppointmentsToday     int64     `json:"appointmentsToday"`
+    CancellationsThisWeek int64     `json:"cancellationsThisWeek"` // since Monday
+    StorageBytes          int64     `json:"storageBytes"`
+    IndexBytes            int64     `json:"indexBytes"`
+    ComputedAt            time.Time `json:"computedAt"`
+}
+
+// adminStatsCache holds the last statistics computed. Requests that find
+// them stale wait for one of them to compute the next.
+type adminStatsCache struct {
+    mu    sync.Mutex
+    stats *AdminStats
+}
+
+var adminStats = &adminStatsCache{}
+
+func (c *adminStatsCache) get(ctx context.Context) (*AdminStats, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.stats != nil && time.Since(c.stats.ComputedAt) < adminStatsTTL {
+        return c.stats, nil
+    }
+    stats, err := computeAdminStats(ctx)
+    if err != nil {
+        return nil, err
+    }
+    c.stats = stats
+    return stats, nil
+}
+
+func computeAdminStats(ctx context.Context) (*AdminStats, error) {
+    now := time.Now()
+    stats := &AdminStats{ComputedAt: now}
+
+    var err error
+    if stats.Patients, err = patientCollection.EstimatedDocumentCount(ctx); err != nil {
+        return nil, err
+    }
+    if stats.Doctors, err = doctorCollection.EstimatedDocumentCount(ctx); err != nil {
+        return nil, err
+    }
+
+    start, end := dayBounds(now)
+    stats.AppointmentsToday, err = appointmentCollection.CountDocuments(ctx, bson.M{
+        "deletedAt": nil,
+        "dateTime":  bson.M{"$gte": start, "$lt": end},
+        "status":    bookedStatuses,
+    })
+    if err != nil {
+        return nil, err
+    }
+    weekStart := start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+    stats.CancellationsThisWeek, err = appointmentCollection.CountDocuments(ctx, bson.M{
+        "deletedAt":   nil,
+        "status":      StatusCancelled,
+        "cancelledAt": bson.M{"$gte": weekStart},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var dbStats struct {
+        StorageSize float64 `bson:"storageSize"`
+        IndexSize   float64 `bson:"indexSize"`
+    }
+    err = client.Database(config.MongoDatabase).RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&dbStats)
+    if err != nil {
+        return nil, err
+    }
+    stats.StorageBytes = int64(dbStats.StorageSize)
+    stats.IndexBytes = int64(dbStats.IndexSize)
+    return stats, nil
+}
+
+// getAdminStats answers with the headline figures, computed at most once
+// a minute: GET /admin/stats
+func getAdminStats(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    stats, err := adminStats.get(r.Context())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Age", strconv.Itoa(int(time.Since(stats.ComputedAt).Seconds())))
+    json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,125 @@
+package stream
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+
+    "new/events"
+)
+
+// AvroSchema is the Avro schema of events.Event. The payload is carried as a
+// JSON string so that one schema serves all event types.
+const AvroSchema = `{
+  "type": "record",
+  "name": "DomainEvent",
+  "namespace": "hospital.events",
+  "fields": [
+    {"name": "id", "type": "string"},
+    {"name": "type", "type": "string"},
+    {"name": "version", "type": "int"},
+    {"name": "occurredAt", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "actor", "type": "string", "default": ""},
+    {"name": "entityId", "type": "string"},
+    {"name": "data", "type": ["null", "string"], "default": null}
+  ]
+}`
+
+// Avro encodes an event in the Avro binary encoding of AvroSchema,
+// prefixed with the Confluent wire format header: a zero byte and the
+// big-endian id of the schema in the registry.
+func Avro(e events.Event, schemaID int) []byte {
+    var b bytes.Buffer
+    b.WriteByte(0)
+    binary.Write(&b, binary.BigEndian, int32(schemaID))
+
+    writeString(&b, e.ID)
+    writeString(&b, e.Type)
+    writeLong(&b, int64(e.Version))
+    writeLong(&b, e.OccurredAt.UnixMilli())
+    writeString(&b, e.Actor)
+    writeString(&b, e.EntityID)
+    if e.Data == nil {
+        writeLong(&b, 0)
+    } else {
+        writeLong(&b, 1)
+        writeString(&b, string(e.Data))
+    }
+    return b.Bytes()
+}
+
+// writeLong writes an Avro int or long: a zig-zag encoded varint.
+func writeLong(b *bytes.Buffer, n int64) {
+    b.Write(binary.AppendUvarint(nil, uint64(n<<1^n>>63)))
+}
+
+func writeString(b *bytes.Buffer, s string) {
+    writeLong(b, int64(len(s)))
+    b.WriteString(s)
+}
+
+// Registry registers schemas with a Confluent compatible schema registry
+// and remembers their ids.
+type Registry struct {
+    URL string
+
+    client *http.Client
+    mu     sync.Mutex
+    ids    map[string]int
+}
+
+// NewRegistry returns a registry client making its requests through
+// client, or http.DefaultClient if nil.
+func NewRegistry(url string, client *http.Client) *Registry {
+    if client == nil {
+        client = http.DefaultClient
+    }
+    return &Registry{URL: strings.TrimSuffix(url, "/"), client: client, ids: map[string]int{}}
+}
+
+// Register returns the id of schema under subject, registering it as a new
+// version if the subject does not have it yet.
+func (r *Registry) Register(ctx context.Context, subject, schema string) (int, error) {
+    r.mu.Lock()
+    id, ok := r.ids[subject]
+    r.mu.Unlock()
+    if ok {
+        return id, nil
+    }
+
+    body, err := json.Marshal(map[string]string{"schema": schema})
+    if err != nil {
+        return 0, err
+    }
+    endpoint := r.URL + "/subjects/" + url.PathEscape(subject) + "/versions"
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+    resp, err := r.client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    var result struct {
+        ID      int    `json:"id"`
+        Message string `json:"message"`
+    }
+    json.NewDecoder(resp.Body).Decode(&result)
+    if resp.StatusCode >= 300 {
+        return 0, fmt.Errorf("schema registry: %s: %s", resp.Status, result.Message)
+    }
+
+    r.mu.Lock()
+    r.ids[subject] = result.ID
+    r.mu.Unlock()
+    return result.ID, nil
+}
@@ -0,0 +1,37 @@
+package stream
+
+import (
+    "context"
+
+    "github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes to the topics of a Kafka cluster, partitioned by key and
+// acknowledged by all in-sync replicas.
+type Kafka struct {
+    writer *kafka.Writer
+}
+
+// NewKafka returns a publisher to the cluster of brokers. Retries are left
+// to the caller.
+func NewKafka(brokers []string) *Kafka {
+    return &Kafka{writer: &kafka.Writer{
+        Addr:         kafka.TCP(brokers...),
+        Balancer:     &kafka.Hash{},
+        RequiredAcks: kafka.RequireAll,
+        MaxAttempts:  1,
+        BatchSize:    1, // messages are published one at a time
+    }}
+}
+
+func (k *Kafka) Name() string { return "kafka" }
+
+func (k *Kafka) Publish(ctx context.Context, msg Message) error {
+    m := kafka.Message{Topic: msg.Topic, Key: []byte(msg.Key), Value: msg.Value}
+    for key, value := range msg.Headers {
+        m.Headers = append(m.Headers, kafka.Header{Key: key, Value: []byte(value)})
+    }
+    return k.writer.WriteMessages(ctx, m)
+}
+
+func (k *Kafka) Close() error { return k.writer.Close() }
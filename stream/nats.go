@@ -0,0 +1,50 @@
+package stream
+
+import (
+    "context"
+
+    "github.com/nats-io/nats.go"
+)
+
+// NATS publishes to the subjects of NATS JetStream streams. The streams
+// must exist; messages carry their id as Nats-Msg-Id so that JetStream
+// drops redeliveries within its duplicate window.
+type NATS struct {
+    conn *nats.Conn
+    js   nats.JetStreamContext
+}
+
+// NewNATS connects to the server at url, reconnecting in the background
+// while it is unreachable.
+func NewNATS(url, name string) (*NATS, error) {
+    conn, err := nats.Connect(url, nats.Name(name), nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+    if err != nil {
+        return nil, err
+    }
+    js, err := conn.JetStream()
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return &NATS{conn: conn, js: js}, nil
+}
+
+func (n *NATS) Name() string { return "nats" }
+
+func (n *NATS) Publish(ctx context.Context, msg Message) error {
+    m := nats.NewMsg(msg.Topic)
+    m.Data = msg.Value
+    for key, value := range msg.Headers {
+        m.Header.Set(key, value)
+    }
+    if msg.ID != "" {
+        m.Header.Set(nats.MsgIdHdr, msg.ID)
+    }
+    _, err := n.js.PublishMsg(m, nats.Context(ctx))
+    return err
+}
+
+func (n *NATS) Close() error {
+    n.conn.Close()
+    return nil
+}
@@ -0,0 +1,22 @@
+// Package stream publishes domain events to Kafka or NATS JetStream, as
+// JSON or as Avro framed for a Confluent compatible schema registry.
+package stream
+
+import "context"
+
+// Message is a record to publish.
+type Message struct {
+    Topic   string // Kafka topic or NATS subject
+    Key     string // events with the same key keep their order
+    ID      string // for deduplication by the broker, where supported
+    Value   []byte
+    Headers map[string]string
+}
+
+// Publisher sends messages to a broker. Publish returns once the broker
+// has stored the message.
+type Publisher interface {
+    Name() string
+    Publish(ctx context.Context, msg Message) error
+    Close() error
+}
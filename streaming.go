@@ -0,0 +1,185 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+
+    "new/events"
+    "new/stream"
+)
+
+// streamedModel is a model whose changes are published to the event
+// stream, as <entity>.created|updated|deleted events.
+type streamedModel struct {
+    entity string
+    load   func(ctx context.Context, id primitive.ObjectID) (interface{}, error)
+}
+
+var streamedModels = map[string]streamedModel{
+    "patients": {"patient", func(ctx context.Context, id primitive.ObjectID) (interface{}, error) {
+        return patientRepo.GetByID(ctx, id)
+    }},
+    "appointments": {"appointment", func(ctx context.Context, id primitive.ObjectID) (interface{}, error) {
+        return appointmentRepo.GetByID(ctx, id)
+    }},
+    "invoices": {"invoice", func(ctx context.Context, id primitive.ObjectID) (interface{}, error) {
+        return invoiceRepo.GetByID(ctx, id)
+    }},
+}
+
+var changeNames = map[Operation]string{OpCreate: "created", OpUpdate: "updated", OpDelete: "deleted"}
+
+var (
+    eventPublisher stream.Publisher
+    schemaRegistry *stream.Registry
+)
+
+func initStreaming() {
+    switch config.EventStream {
+    case "kafka":
+        if len(config.EventStreamBrokers) == 0 {
+            log.Fatal("EVENT_STREAM_BROKERS is required for the kafka event stream")
+        }
+        eventPublisher = stream.NewKafka(config.EventStreamBrokers)
+    case "nats":
+        publisher, err := stream.NewNATS(config.EventStreamURL, "hospital")
+        if err != nil {
+            log.Fatalf("Error connecting to NATS: %v", err)
+        }
+        eventPublisher = publisher
+    default:
+        return
+    }
+
+    if config.EventStreamFormat == "avro" {
+        if config.EventStreamRegistry == "" {
+            log.Fatal("EVENT_STREAM_SCHEMA_REGISTRY is required for Avro events")
+        }
+        schemaRegistry = stream.NewRegistry(config.EventStreamRegistry, streamPolicy.Client())
+    }
+}
+
+// eventSinks are the outbox sinks the changes of coll go to: the event
+// stream and the report projections.
+func eventSinks(coll string) []string {
+    var sinks []string
+    if _, ok := streamedModels[coll]; ok && config.EventStream != "" {
+        sinks = append(sinks, SinkStream)
+    }
+    if projectedModels[coll] && config.Projections {
+        sinks = append(sinks, SinkProjections)
+    }
+    return sinks
+}
+
+// streamedHooks are the hooks of the repository of coll: if its changes
+// go to a sink, they are written to the outbox in the transaction of the
+// write.
+func streamedHooks(coll string) Hooks {
+    if len(eventSinks(coll)) == 0 {
+        return defaultHooks
+    }
+    return Hooks{
+        Before:        defaultHooks.Before,
+        After:         append(append([]Hook{}, defaultHooks.After...), streamWrite),
+        Transactional: true,
+    }
+}
+
+// streamWrite records the change of a streamed model in the outbox for
+// each of its sinks, with the document as stored.
+func streamWrite(ctx context.Context, coll string, op Operation, doc *Document) error {
+    sinks := eventSinks(coll)
+    if len(sinks) == 0 {
+        return nil
+    }
+    model := streamedModels[coll]
+
+    var stored interface{}
+    if op != OpDelete {
+        var err error
+        if stored, err = model.load(ctx, doc.ID); err != nil {
+            return err
+        }
+    }
+
+    now := time.Now()
+    eventType := model.entity + "." + changeNames[op]
+    event, err := events.New(eventType, stored)
+    if err != nil {
+        return err
+    }
+    event.ID = primitive.NewObjectID().Hex()
+    event.OccurredAt = now
+    event.Actor = actorFromContext(ctx)
+    event.EntityID = doc.ID.Hex()
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    for _, sink := range sinks {
+        err := enqueueEvent(ctx, OutboxEvent{
+            ID:         primitive.NewObjectID(),
+            Sink:       sink,
+            Type:       eventType,
+            Key:        doc.ID.Hex(),
+            OccurredAt: now,
+            Payload:    payload,
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// streamTopic is where events of a type go: a Kafka topic per entity, or a
+// NATS subject per event type, under EVENT_STREAM_PREFIX.
+func streamTopic(eventType string) string {
+    if config.EventStream == "nats" {
+        return config.EventStreamPrefix + "." + eventType
+    }
+    entity, _, _ := strings.Cut(eventType, ".")
+    return config.EventStreamPrefix + "." + entity
+}
+
+// deliverStreamEvent publishes an outbox event to the event stream, keyed
+// by its entity so that the changes of an entity stay in order.
+func deliverStreamEvent(ctx context.Context, event *OutboxEvent) error {
+    var envelope events.Event
+    if err := json.Unmarshal(event.Payload, &envelope); err != nil {
+        return err
+    }
+
+    msg := stream.Message{
+        Topic: streamTopic(event.Type),
+        Key:   event.Key,
+        ID:    envelope.ID,
+        Value: event.Payload,
+        Headers: map[string]string{
+            "content-type":  "application/json",
+            "event-id":      envelope.ID,
+            "event-type":    envelope.Type,
+            "event-version": strconv.Itoa(envelope.Version),
+        },
+    }
+    if schemaRegistry != nil {
+        // Subjects follow the topic name strategy of the Confluent serializers
+        schemaID, err := schemaRegistry.Register(ctx, msg.Topic+"-value", stream.AvroSchema)
+        if err != nil {
+            return err
+        }
+        msg.Value = stream.Avro(envelope, schemaID)
+        msg.Headers["content-type"] = "application/avro"
+    }
+
+    return streamPolicy.Do(ctx, func(ctx context.Context) error {
+        return eventPublisher.Publish(ctx, msg)
+    })
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "regexp"
+    "slices"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxBulkTagPatients bounds the patients tagged or untagged in one request.
+const maxBulkTagPatients = 1000
+
+// Tags are lower case, e.g. diabetic, vip or research-study-x.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_:-]{0,63}$`)
+
+// Tag is a managed tag, defined by administrators with a label and
+// description. Patients may also carry free-form tags unless
+// TAGS_MANAGED_ONLY is set. Deleting a managed tag leaves it on patients.
+type Tag struct {
+    Document    `bson:",inline"`
+    Name        string `json:"name" bson:"name"`
+    Label       string `json:"label" bson:"label"`
+    Description string `json:"description,omitempty" bson:"description,omitempty"`
+}
+
+var (
+    tagCollection *mongo.Collection
+    tagRepo       *Repository[Tag, *Tag]
+)
+
+func initTags(ctx context.Context, db *mongo.Database) {
+    tagCollection = db.Collection("tags")
+    tagRepo = NewRepository[Tag](tagCollection, defaultHooks)
+
+    index := mongo.IndexModel{
+        Keys:    bson.D{{Key: "name", Value: 1}},
+        Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"deletedAt": bson.M{"$exists": false}}),
+    }
+    if _, err := tagCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating tag index: %v\n", err)
+    }
+    index = mongo.IndexModel{Keys: bson.D{{Key: "tags", Value: 1}}}
+    if _, err := patientCollection.Indexes().CreateOne(ctx, index); err != nil {
+        log.Printf("Error creating patient tag index: %v\n", err)
+    }
+}
+
+// normalizeTags lower cases and deduplicates tags, checking their syntax
+// and, with TAGS_MANAGED_ONLY, that they are managed.
+func normalizeTags(ctx context.Context, tags []string) ([]string, error) {
+    var normalized []string
+    for _, tag := range tags {
+        tag = strings.ToLower(strings.TrimSpace(tag))
+        if !tagPattern.MatchString(tag) {
+            return nil, newAPIError("invalid_tag", tag)
+        }
+        if !slices.Contains(normalized, tag) {
+            normalized = append(normalized, tag)
+        }
+    }
+    if !config.TagsManagedOnly || len(normalized) == 0 {
+        return normalized, nil
+    }
+
+    managed, err := tagRepo.List(ctx, bson.M{"name": bson.M{"$in": normalized}}, Page{})
+    if err != nil {
+        return nil, err
+    }
+    for _, tag := range normalized {
+        if !slices.ContainsFunc(managed, func(t Tag) bool { return t.Name == tag }) {
+            return nil, newAPIError("unmanaged_tag", tag)
+        }
+    }
+    return normalized, nil
+}
+
+// TagChange tags and untags patients in bulk. Tags are added before
+// others are removed.
+type TagChange struct {
+    PatientIDs []primitive.ObjectID `json:"patientIds"`
+    Add        []string             `json:"add"`
+    Remove     []string             `json:"remove"`
+}
+
+// TagChangeResult reports the patients a TagChange was applied to and
+// those that do not exist.
+type TagChangeResult struct {
+    Updated  int64                `json:"updated"`
+    NotFound []primitive.ObjectID `json:"notFound"`
+}
+
+// tagPatients tags and untags patients: POST /patients/tags
+func tagPatients(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var change TagChange
+    if !decodeJSON(w, r, &change) {
+        return
+    }
+    if len(change.PatientIDs) == 0 {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "patientIds")
+        return
+    }
+    if len(change.PatientIDs) > maxBulkTagPatients {
+        localizedError(w, r, http.StatusBadRequest, "too_many_patients", maxBulkTagPatients)
+        return
+    }
+
+    ctx := r.Context()
+
+    add, err := normalizeTags(ctx, change.Add)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    // Tags that are no longer managed can still be removed
+    remove := make([]string, 0, len(change.Remove))
+    for _, tag := range change.Remove {
+        remove = append(remove, strings.ToLower(strings.TrimSpace(tag)))
+    }
+    if len(add) == 0 && len(remove) == 0 {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "add")
+        return
+    }
+
+    result := TagChangeResult{NotFound: []primitive.ObjectID{}}
+    for _, id := range change.PatientIDs {
+        // $addToSet and $pull cannot change the same field in one update
+        var err error
+        if len(add) > 0 {
+            err = patientRepo.Modify(ctx, id, nil, bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": add}}})
+        }
+        if err == nil && len(remove) > 0 {
+            err = patientRepo.Modify(ctx, id, nil, bson.M{"$pull": bson.M{"tags": bson.M{"$in": remove}}})
+        }
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            result.NotFound = append(result.NotFound, id)
+            continue
+        }
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        result.Updated++
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// TagUsage is a tag in use on patients, managed or not.
+type TagUsage struct {
+    Name     string `json:"name"`
+    Label    string `json:"label,omitempty"`
+    Managed  bool   `json:"managed"`
+    Patients int64  `json:"patients"`
+}
+
+// getTags lists the managed tags and the tags in use, with the number of
+// patients carrying them: GET /tags
+func getTags(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    managed, err := tagRepo.List(ctx, bson.M{}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    cursor, err := patientCollection.Aggregate(ctx, mongo.Pipeline{
+        {{Key: "$match", Value: bson.M{"deletedAt": nil, "tags.0": bson.M{"$exists": true}}}},
+        {{Key: "$unwind", Value: "$tags"}},
+        {{Key: "$group", Value: bson.M{"_id": "$tags", "patients": bson.M{"$sum": 1}}}},
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var counts []struct {
+        Name     string `bson:"_id"`
+        Patients int64  `bson:"patients"`
+    }
+    if err := cursor.All(ctx, &counts); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    usage := map[string]*TagUsage{}
+    for _, tag := range managed {
+        usage[tag.Name] = &TagUsage{Name: tag.Name, Label: tag.Label, Managed: true}
+    }
+    for _, count := range counts {
+        if _, ok := usage[count.Name]; !ok {
+            usage[count.Name] = &TagUsage{Name: count.Name}
+        }
+        usage[count.Name].Patients = count.Patients
+    }
+    tags := make([]TagUsage, 0, len(usage))
+    for _, tag := range usage {
+        tags = append(tags, *tag)
+    }
+    slices.SortFunc(tags, func(a, b TagUsage) int { return strings.Compare(a.Name, b.Name) })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(tags)
+}
+
+// createTag defines a managed tag: POST /admin/tags
+func createTag(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var tag Tag
+    if !decodeJSON(w, r, &tag) {
+        return
+    }
+    tag.Name = strings.ToLower(strings.TrimSpace(tag.Name))
+    if !tagPattern.MatchString(tag.Name) {
+        localizedError(w, r, http.StatusBadRequest, "invalid_tag", tag.Name)
+        return
+    }
+    if tag.Label == "" {
+        tag.Label = tag.Name
+    }
+
+    ctx := r.Context()
+
+    if err := tagRepo.Create(ctx, &tag); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            localizedError(w, r, http.StatusConflict, "tag_exists", tag.Name)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(tag)
+}
+
+// deleteTag removes a managed tag: DELETE /admin/tags/{id}
+func deleteTag(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_tag_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := tagRepo.SoftDelete(ctx, id); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "tag_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
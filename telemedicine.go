@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+
+    "new/i18n"
+    "new/video"
+)
+
+// Appointment modes
+const (
+    ModeInPerson = "in_person"
+    ModeVideo    = "video"
+)
+
+var appointmentModes = []string{ModeInPerson, ModeVideo}
+
+// VideoRoom is the room of a video consultation, created with the
+// provider when the first participant joins.
+type VideoRoom struct {
+    Provider  string    `json:"provider" bson:"provider"`
+    Name      string    `json:"name" bson:"name"`
+    URL       string    `json:"url,omitempty" bson:"url,omitempty"`
+    CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// VideoJoin admits a participant to the room of a consultation.
+type VideoJoin struct {
+    Provider  string    `json:"provider"`
+    Room      string    `json:"room"`
+    URL       string    `json:"url,omitempty"`
+    Token     string    `json:"token"`
+    ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var videoProvider video.Provider // nil without VIDEO_PROVIDER
+
+func initVideo() {
+    switch config.VideoProvider {
+    case "twilio":
+        videoProvider = video.NewTwilio(config.TwilioAccountSID, config.TwilioAuthToken,
+            config.TwilioAPIKey, config.TwilioAPISecret, videoPolicy.Client())
+    case "daily":
+        videoProvider = video.NewDaily(config.DailyAPIKey, videoPolicy.Client())
+    }
+}
+
+// validateMode defaults the mode of an appointment to in person. Video
+// consultations need a provider.
+func validateMode(appointment *Appointment) error {
+    switch appointment.Mode {
+    case "":
+        appointment.Mode = ModeInPerson
+    case ModeInPerson:
+    case ModeVideo:
+        if videoProvider == nil {
+            return newAPIError("video_not_configured")
+        }
+    default:
+        return newAPIError("invalid_mode", strings.Join(appointmentModes, ", "))
+    }
+    return nil
+}
+
+// videoWindow is when participants can be in the room of a consultation:
+// from VIDEO_JOIN_EARLY before the appointment to the end of its slot.
+func videoWindow(appointment *Appointment) (time.Time, time.Time) {
+    return appointment.DateTime.Add(-config.VideoJoinEarly), appointment.DateTime.Add(config.SlotDuration)
+}
+
+// videoJoinKey authenticates the patient's link to a consultation. It is
+// derived from the appointment, so it needs no storage and survives
+// reschedules.
+func videoJoinKey(id primitive.ObjectID) string {
+    mac := hmac.New(sha256.New, authKey)
+    mac.Write([]byte("video:" + id.Hex()))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// videoJoinURL is the link to a consultation sent to the patient, or ""
+// for in-person appointments or without VIDEO_JOIN_URL. The page it opens
+// exchanges the key for a token at /appointments/{id}/video/patient.
+func videoJoinURL(appointment *Appointment) string {
+    if appointment.Mode != ModeVideo || config.VideoJoinURL == "" {
+        return ""
+    }
+    query := url.Values{"appointment": {appointment.ID.Hex()}, "key": {videoJoinKey(appointment.ID)}}
+    separator := "?"
+    if strings.Contains(config.VideoJoinURL, "?") {
+        separator = "&"
+    }
+    return config.VideoJoinURL + separator + query.Encode()
+}
+
+// ensureVideoRoom returns the room of a consultation, creating it with the
+// provider on first use. Rooms close at the end of the slot.
+func ensureVideoRoom(ctx context.Context, appointment *Appointment) (*VideoRoom, error) {
+    if appointment.Video != nil {
+        return appointment.Video, nil
+    }
+    opens, closes := videoWindow(appointment)
+    room, err := videoProvider.CreateRoom(ctx, video.Room{
+        Name:      "appointment-" + appointment.ID.Hex(),
+        NotBefore: opens,
+        Expires:   closes,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    stored := &VideoRoom{Provider: videoProvider.Name(), Name: room.Name, URL: room.URL, CreatedAt: time.Now()}
+    err = appointmentRepo.UpdateFields(ctx, appointment.ID, bson.M{"video": nil}, bson.M{"video": stored})
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        // Created by the other participant at the same time
+        current, err := appointmentRepo.GetByID(ctx, appointment.ID)
+        if err != nil {
+            return nil, err
+        }
+        if current.Video != nil {
+            return current.Video, nil
+        }
+        return nil, mongo.ErrNoDocuments
+    }
+    if err != nil {
+        return nil, err
+    }
+    return stored, nil
+}
+
+// joinVideo answers a participant's request to join the consultation of
+// appointment id with a token valid until the end of the slot. participant
+// returns who is joining, or writes the error and returns false if they
+// may not.
+func joinVideo(w http.ResponseWriter, r *http.Request, participant func(*Appointment) (video.Participant, bool)) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_appointment_id")
+        return
+    }
+    if videoProvider == nil {
+        localizedError(w, r, http.StatusServiceUnavailable, "video_not_configured")
+        return
+    }
+
+    ctx := r.Context()
+
+    appointment, err := appointmentRepo.GetByID(ctx, id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "appointment_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    p, ok := participant(appointment)
+    if !ok {
+        return
+    }
+
+    lang := requestLanguage(r)
+    if appointment.Mode != ModeVideo {
+        localizedError(w, r, http.StatusConflict, "not_video_appointment")
+        return
+    }
+    if appointment.Status != StatusScheduled && appointment.Status != StatusCheckedIn {
+        localizedError(w, r, http.StatusConflict, "appointment_status", i18n.StatusLabel(lang, appointment.Status))
+        return
+    }
+    opens, closes := videoWindow(appointment)
+    now := time.Now()
+    if now.Before(opens) {
+        localizedError(w, r, http.StatusConflict, "video_not_open", i18n.FormatTime(lang, opens.Local()))
+        return
+    }
+    if !now.Before(closes) {
+        localizedError(w, r, http.StatusConflict, "video_closed")
+        return
+    }
+
+    room, err := ensureVideoRoom(ctx, appointment)
+    if err != nil {
+        log.Printf("Error creating video room for appointment %s: %v\n", id.Hex(), err)
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    }
+    token, err := videoProvider.Token(ctx, video.Room{Name: room.Name, URL: room.URL, NotBefore: opens, Expires: closes}, p, closes)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(VideoJoin{
+        Provider:  room.Provider,
+        Room:      room.Name,
+        URL:       room.URL,
+        Token:     token,
+        ExpiresAt: closes,
+    })
+}
+
+// joinVideoAsDoctor issues the doctor of an appointment a token to host
+// its consultation: POST /appointments/{id}/video/doctor
+func joinVideoAsDoctor(w http.ResponseWriter, r *http.Request) {
+    user := userFromContext(r.Context())
+    joinVideo(w, r, func(appointment *Appointment) (video.Participant, bool) {
+        if user.Role != RoleDoctor || user.DoctorID == nil || *user.DoctorID != appointment.DoctorID {
+            localizedError(w, r, http.StatusForbidden, "forbidden")
+            return video.Participant{}, false
+        }
+        return video.Participant{Identity: "doctor-" + appointment.DoctorID.Hex(), Name: user.Name, Host: true}, true
+    })
+}
+
+// joinVideoAsPatient issues the patient of an appointment a token to join
+// its consultation, authenticated by the key of their link:
+// POST /appointments/{id}/video/patient?key=
+func joinVideoAsPatient(w http.ResponseWriter, r *http.Request) {
+    joinVideo(w, r, func(appointment *Appointment) (video.Participant, bool) {
+        if !hmac.Equal([]byte(r.URL.Query().Get("key")), []byte(videoJoinKey(appointment.ID))) {
+            localizedError(w, r, http.StatusForbidden, "invalid_join_key")
+            return video.Participant{}, false
+        }
+        name := ""
+        if patient, err := patientRepo.GetByID(r.Context(), appointment.PatientID); err == nil {
+            name = patient.Name
+        }
+        return video.Participant{Identity: "patient-" + appointment.PatientID.Hex(), Name: name}, true
+    })
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "time"
+
+    "new/i18n"
+)
+
+// Time budgets of the routes that need more than REQUEST_TIMEOUT, filled
+// in from the Timeout of the route table. 0 leaves a route without one.
+var defaultRouteTimeouts = map[string]time.Duration{
+    "GET /debug/pprof/":        0, // profiles run for ?seconds=
+    "GET /debug/pprof/profile": 0,
+    "GET /debug/pprof/trace":   0,
+}
+
+// routeTimeout returns the time budget of a route: REQUEST_TIMEOUT unless
+// the route has its own, which ROUTE_TIMEOUTS overrides.
+func routeTimeout(route string) time.Duration {
+    if budget, ok := config.RouteTimeouts[route]; ok {
+        return budget
+    }
+    if budget, ok := defaultRouteTimeouts[route]; ok {
+        return budget
+    }
+    return config.RequestTimeout
+}
+
+// TimeoutError is the body of the 504 answered when a request runs out of
+// its time budget.
+type TimeoutError struct {
+    Error   string `json:"error"`
+    Message string `json:"message"`
+    Route   string `json:"route"`
+    Budget  string `json:"budget"`
+}
+
+// withTimeouts gives each request the time budget of the route of mux it
+// matches. Handlers pass the request context on to the database, which
+// gives up at the deadline; a server error answered once the budget is
+// spent is replaced with a 504.
+func withTimeouts(mux *http.ServeMux) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, route := mux.Handler(r)
+        budget := routeTimeout(route)
+        if budget <= 0 {
+            mux.ServeHTTP(w, r)
+            return
+        }
+
+        ctx, cancel := context.WithTimeout(r.Context(), budget)
+        defer cancel()
+        r = r.WithContext(ctx)
+        tw := &timeoutWriter{ResponseWriter: w, r: r, route: route, budget: budget}
+        mux.ServeHTTP(tw, r)
+        if !tw.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+            tw.WriteHeader(http.StatusInternalServerError)
+        }
+    })
+}
+
+// timeoutWriter replaces the server errors of requests past their
+// deadline with a 504.
+type timeoutWriter struct {
+    http.ResponseWriter
+    r           *http.Request
+    route       string
+    budget      time.Duration
+    wroteHeader bool
+    timedOut    bool
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+    if tw.wroteHeader {
+        return
+    }
+    tw.wroteHeader = true
+    if status < http.StatusInternalServerError || !errors.Is(tw.r.Context().Err(), context.DeadlineExceeded) {
+        tw.ResponseWriter.WriteHeader(status)
+        return
+    }
+
+    tw.timedOut = true
+    h := tw.Header()
+    h.Del("Content-Length")
+    h.Del("Content-Disposition")
+    h.Set("Content-Type", "application/json")
+    lang := requestLanguage(tw.r)
+    h.Set("Content-Language", lang)
+    tw.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+    json.NewEncoder(tw.ResponseWriter).Encode(TimeoutError{
+        Error:   "request_timeout",
+        Message: i18n.Message(lang, "error.request_timeout", tw.budget),
+        Route:   tw.route,
+        Budget:  tw.budget.String(),
+    })
+}
+
+// Write drops the body of a replaced response.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+    if !tw.wroteHeader {
+        tw.WriteHeader(http.StatusOK)
+    }
+    if tw.timedOut {
+        return len(b), nil
+    }
+    return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+    if f, ok := tw.ResponseWriter.(http.Flusher); ok && !tw.timedOut {
+        f.Flush()
+    }
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+    return tw.ResponseWriter
+}
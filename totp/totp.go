@@ -0,0 +1,78 @@
+// Package totp implements time-based one-time passwords (RFC 6238) as used
+// by authenticator apps: HMAC-SHA1, 30 second steps, 6 digits.
+package totp
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    step   = 30 * time.Second
+    digits = 6
+    // skew is the number of steps a code is accepted before and after its
+    // own, to tolerate clock drift.
+    skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random 160-bit secret, base32 encoded.
+func NewSecret() string {
+    b := make([]byte, 20)
+    rand.Read(b)
+    return encoding.EncodeToString(b)
+}
+
+// URL is the otpauth:// URI to enroll secret in an authenticator app,
+// usually shown as a QR code.
+func URL(issuer, account, secret string) string {
+    v := url.Values{"secret": {secret}, "issuer": {issuer}}
+    return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+// Code returns the code of secret at t.
+func Code(secret string, t time.Time) (string, error) {
+    key, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+    if err != nil {
+        return "", err
+    }
+    return code(key, uint64(t.Unix()/int64(step.Seconds()))), nil
+}
+
+func code(key []byte, counter uint64) string {
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], counter)
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", digits, value%1000000)
+}
+
+// Validate reports whether passcode is the code of secret at t, give or
+// take one step.
+func Validate(passcode, secret string, t time.Time) bool {
+    key, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+    if err != nil || len(passcode) != digits {
+        return false
+    }
+    counter := uint64(t.Unix() / int64(step.Seconds()))
+    for i := -skew; i <= skew; i++ {
+        expected := code(key, counter+uint64(i))
+        if subtle.ConstantTimeCompare([]byte(expected), []byte(passcode)) == 1 {
+            return true
+        }
+    }
+    return false
+}
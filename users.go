@@ -0,0 +1,269 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+    "unicode"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// User roles.
+const (
+    RoleAdmin  = "admin"
+    RoleDoctor = "doctor"
+    RoleStaff  = "staff"
+)
+
+// mfaRoles are the roles that may enroll a second factor.
+var mfaRoles = map[string]bool{RoleAdmin: true, RoleDoctor: true}
+
+// User is a staff account of the service. Doctor accounts are linked to
+// their Doctor.
+type User struct {
+    Document          `bson:",inline"`
+    Email             string              `json:"email" bson:"email"`
+    Name              string              `json:"name" bson:"name"`
+    Role              string              `json:"role" bson:"role"`
+    DoctorID          *primitive.ObjectID `json:"doctorId,omitempty" bson:"doctorId,omitempty"`
+    PasswordHash      string              `json:"-" bson:"passwordHash"`
+    PasswordChangedAt time.Time           `json:"passwordChangedAt" bson:"passwordChangedAt"`
+    FailedLogins      int64               `json:"failedLogins" bson:"failedLogins"`
+    LockedUntil       *time.Time          `json:"lockedUntil,omitempty" bson:"lockedUntil,omitempty"`
+    LastLoginAt       *time.Time          `json:"lastLoginAt,omitempty" bson:"lastLoginAt,omitempty"`
+    TOTPSecret        string              `json:"-" bson:"totpSecret,omitempty"`
+    TOTPEnabled       bool                `json:"totpEnabled" bson:"totpEnabled"`
+    SSOSubject        string              `json:"-" bson:"ssoSubject,omitempty"`
+}
+
+var (
+    userCollection *mongo.Collection
+    userRepo       *Repository[User, *User]
+)
+
+func initUsers(ctx context.Context, db *mongo.Database) {
+    userCollection = db.Collection("users")
+    userRepo = NewRepository[User](userCollection, defaultHooks)
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "ssoSubject", Value: 1}}, Options: options.Index().SetSparse(true)},
+    }
+    if _, err := userCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating user indexes: %v\n", err)
+    }
+}
+
+// userByEmail finds the account of an email address, case insensitively.
+func userByEmail(ctx context.Context, address string) (*User, error) {
+    users, err := userRepo.List(ctx, bson.M{"email": normalizeEmail(address)}, Page{Number: 1, Size: 1})
+    if err != nil {
+        return nil, err
+    }
+    if len(users) == 0 {
+        return nil, mongo.ErrNoDocuments
+    }
+    return &users[0], nil
+}
+
+func normalizeEmail(address string) string {
+    return strings.ToLower(strings.TrimSpace(address))
+}
+
+// validatePassword checks a password against the policy: at least
+// PASSWORD_MIN_LENGTH characters and one of each character class listed
+// in PASSWORD_REQUIRE (upper, lower, digit, symbol).
+func validatePassword(password string) error {
+    if int64(len([]rune(password))) < config.PasswordMinLength {
+        return newAPIError("password_too_short", config.PasswordMinLength)
+    }
+
+    classes := map[string]bool{}
+    for _, c := range password {
+        switch {
+        case unicode.IsUpper(c):
+            classes["upper"] = true
+        case unicode.IsLower(c):
+            classes["lower"] = true
+        case unicode.IsDigit(c):
+            classes["digit"] = true
+        default:
+            classes["symbol"] = true
+        }
+    }
+    for _, class := range []string{"upper", "lower", "digit", "symbol"} {
+        if config.PasswordRequire[class] && !classes[class] {
+            return newAPIError("password_requires_" + class)
+        }
+    }
+    return nil
+}
+
+// setPassword hashes a password that satisfies the policy into user.
+func setPassword(user *User, password string) error {
+    if err := validatePassword(password); err != nil {
+        return err
+    }
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+    user.PasswordHash = string(hash)
+    user.PasswordChangedAt = time.Now().Truncate(time.Second)
+    return nil
+}
+
+// storePassword saves a new password, which also unlocks the account and
+// invalidates the tokens issued before the change.
+func storePassword(ctx context.Context, user *User, password string) error {
+    if err := setPassword(user, password); err != nil {
+        return err
+    }
+    return userRepo.UpdateFields(ctx, user.ID, nil, bson.M{
+        "passwordHash":      user.PasswordHash,
+        "passwordChangedAt": user.PasswordChangedAt,
+        "failedLogins":      0,
+        "lockedUntil":       nil,
+    })
+}
+
+// User admin handlers
+
+// adminUsers lists accounts (GET) or creates one (POST) with an initial
+// password.
+func adminUsers(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getUsers(w, r)
+    case http.MethodPost:
+        createUser(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getUsers(w http.ResponseWriter, r *http.Request) {
+    filter := bson.M{}
+    if role := r.URL.Query().Get("role"); role != "" {
+        filter["role"] = role
+    }
+
+    ctx := r.Context()
+
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+    users, err := userRepo.List(ctx, filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    setNextPage(w, r, page, users)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(users)
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Email    string              `json:"email"`
+        Name     string              `json:"name"`
+        Role     string              `json:"role"`
+        DoctorID *primitive.ObjectID `json:"doctorId"`
+        Password string              `json:"password"`
+    }
+    if !decodeJSON(w, r, &body) {
+        return
+    }
+
+    user := User{Email: normalizeEmail(body.Email), Name: body.Name, Role: body.Role, DoctorID: body.DoctorID}
+    if user.Email == "" {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "email")
+        return
+    }
+    if user.Role != RoleAdmin && user.Role != RoleDoctor && user.Role != RoleStaff {
+        localizedError(w, r, http.StatusBadRequest, "invalid_role", user.Role)
+        return
+    }
+    if user.Role == RoleDoctor && user.DoctorID == nil {
+        localizedError(w, r, http.StatusBadRequest, "field_required", "doctorId")
+        return
+    }
+    if err := setPassword(&user, body.Password); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    if user.DoctorID != nil {
+        if _, err := doctorRepo.GetByID(ctx, *user.DoctorID); err != nil {
+            localizedError(w, r, http.StatusBadRequest, "doctor_not_found")
+            return
+        }
+    }
+
+    if err := userRepo.Create(ctx, &user); err != nil {
+        if mongo.IsDuplicateKeyError(err) {
+            localizedError(w, r, http.StatusConflict, "user_exists")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(user)
+}
+
+// unlockUser clears the lockout and failed login count of an account.
+func unlockUser(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    updateUserFields(w, r, bson.M{"failedLogins": 0, "lockedUntil": nil})
+}
+
+// resetUserMFA removes the second factor of an account, for users who lost
+// their authenticator: DELETE /admin/users/{id}/mfa
+func resetUserMFA(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    updateUserFields(w, r, bson.M{"totpEnabled": false, "totpSecret": ""})
+}
+
+func updateUserFields(w http.ResponseWriter, r *http.Request, fields bson.M) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_user_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := userRepo.UpdateFields(ctx, id, nil, fields); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "user_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,107 @@
+package video
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "time"
+)
+
+const dailyAPI = "https://api.daily.co/v1"
+
+// Daily hosts rooms on Daily. Rooms are private: participants join the
+// room URL with a meeting token.
+type Daily struct {
+    APIKey string
+
+    client *http.Client
+}
+
+// NewDaily returns a Daily provider calling the API through client, or a
+// default client if nil.
+func NewDaily(apiKey string, client *http.Client) *Daily {
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &Daily{APIKey: apiKey, client: client}
+}
+
+func (d *Daily) Name() string { return "daily" }
+
+func (d *Daily) CreateRoom(ctx context.Context, room Room) (Room, error) {
+    properties := map[string]interface{}{"eject_at_room_exp": true}
+    if !room.NotBefore.IsZero() {
+        properties["nbf"] = room.NotBefore.Unix()
+    }
+    if !room.Expires.IsZero() {
+        properties["exp"] = room.Expires.Unix()
+    }
+    var created struct {
+        URL string `json:"url"`
+    }
+    err := d.do(ctx, http.MethodPost, "/rooms", map[string]interface{}{
+        "name":       room.Name,
+        "privacy":    "private",
+        "properties": properties,
+    }, &created)
+    if err != nil {
+        // The room may exist from an earlier attempt
+        if getErr := d.do(ctx, http.MethodGet, "/rooms/"+url.PathEscape(room.Name), nil, &created); getErr != nil {
+            return Room{}, err
+        }
+    }
+    room.URL = created.URL
+    return room, nil
+}
+
+// Token returns a meeting token; hosts join as owners of the room.
+func (d *Daily) Token(ctx context.Context, room Room, p Participant, expires time.Time) (string, error) {
+    properties := map[string]interface{}{
+        "room_name": room.Name,
+        "user_id":   p.Identity,
+        "user_name": p.Name,
+        "is_owner":  p.Host,
+        "exp":       expires.Unix(),
+    }
+    if !room.NotBefore.IsZero() {
+        properties["nbf"] = room.NotBefore.Unix()
+    }
+    var token struct {
+        Token string `json:"token"`
+    }
+    err := d.do(ctx, http.MethodPost, "/meeting-tokens", map[string]interface{}{"properties": properties}, &token)
+    return token.Token, err
+}
+
+func (d *Daily) do(ctx context.Context, method, path string, body, result interface{}) error {
+    var payload bytes.Buffer
+    if body != nil {
+        if err := json.NewEncoder(&payload).Encode(body); err != nil {
+            return err
+        }
+    }
+    req, err := http.NewRequestWithContext(ctx, method, dailyAPI+path, &payload)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+d.APIKey)
+
+    resp, err := d.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        var apiErr struct {
+            Error string `json:"error"`
+            Info  string `json:"info"`
+        }
+        json.NewDecoder(resp.Body).Decode(&apiErr)
+        return fmt.Errorf("daily: %s: %s %s", resp.Status, apiErr.Error, apiErr.Info)
+    }
+    return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,130 @@
+package video
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const twilioAPI = "https://video.twilio.com/v1"
+
+// twilioRoomExists is the error code of creating a room whose unique name
+// is in use.
+const twilioRoomExists = 53113
+
+// Twilio hosts rooms on Twilio Video. Rooms are managed with the account
+// credentials; access tokens are signed with an API key, as the client
+// SDKs expect.
+type Twilio struct {
+    AccountSID string
+    AuthToken  string
+    APIKey     string
+    APISecret  string
+
+    client *http.Client
+}
+
+// NewTwilio returns a Twilio provider calling the API through client, or
+// a default client if nil.
+func NewTwilio(accountSID, authToken, apiKey, apiSecret string, client *http.Client) *Twilio {
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &Twilio{
+        AccountSID: accountSID,
+        AuthToken:  authToken,
+        APIKey:     apiKey,
+        APISecret:  apiSecret,
+        client:     client,
+    }
+}
+
+func (t *Twilio) Name() string { return "twilio" }
+
+// CreateRoom creates a group room. Twilio rooms have no opening time: they
+// close when empty, and tokens bound the time participants can join.
+func (t *Twilio) CreateRoom(ctx context.Context, room Room) (Room, error) {
+    form := url.Values{
+        "UniqueName":       {room.Name},
+        "Type":             {"group"},
+        "EmptyRoomTimeout": {"10"},
+    }
+    if !room.Expires.IsZero() {
+        // Seconds a participant may stay, bounded below by Twilio
+        seconds := max(int64(time.Until(room.Expires).Seconds()), 600)
+        form.Set("MaxParticipantDuration", strconv.FormatInt(seconds, 10))
+    }
+    err := t.do(ctx, http.MethodPost, twilioAPI+"/Rooms", form)
+    var apiErr *twilioError
+    if err != nil && (!errors.As(err, &apiErr) || apiErr.Code != twilioRoomExists) {
+        return Room{}, err
+    }
+    return room, nil
+}
+
+// Token returns an access token with a video grant, a JWT signed with the
+// API secret.
+func (t *Twilio) Token(ctx context.Context, room Room, p Participant, expires time.Time) (string, error) {
+    now := time.Now()
+    header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "HS256", "cty": "twilio-fpa;v=1"})
+    claims, err := json.Marshal(map[string]interface{}{
+        "jti": t.APIKey + "-" + strconv.FormatInt(now.Unix(), 10),
+        "iss": t.APIKey,
+        "sub": t.AccountSID,
+        "iat": now.Unix(),
+        "nbf": room.NotBefore.Unix(),
+        "exp": expires.Unix(),
+        "grants": map[string]interface{}{
+            "identity": p.Identity,
+            "video":    map[string]string{"room": room.Name},
+        },
+    })
+    if err != nil {
+        return "", err
+    }
+    signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+    mac := hmac.New(sha256.New, []byte(t.APISecret))
+    mac.Write([]byte(signed))
+    return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// twilioError is an error answered by the API.
+type twilioError struct {
+    Status  string
+    Code    int    `json:"code"`
+    Message string `json:"message"`
+}
+
+func (e *twilioError) Error() string {
+    return fmt.Sprintf("twilio: %s: %d %s", e.Status, e.Code, e.Message)
+}
+
+func (t *Twilio) do(ctx context.Context, method, endpoint string, form url.Values) error {
+    req, err := http.NewRequestWithContext(ctx, method, endpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.SetBasicAuth(t.AccountSID, t.AuthToken)
+
+    resp, err := t.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode < 300 {
+        return nil
+    }
+    apiErr := &twilioError{Status: resp.Status}
+    json.NewDecoder(resp.Body).Decode(apiErr)
+    return apiErr
+}
@@ -0,0 +1,33 @@
+// Package video creates the rooms of video consultations and the access
+// tokens participants join them with, through pluggable providers.
+package video
+
+import (
+    "context"
+    "time"
+)
+
+// Room is a video room. Name is chosen by the caller and unique per
+// consultation; providers hosting their own join page fill in URL.
+type Room struct {
+    Name      string
+    URL       string
+    NotBefore time.Time // participants cannot join before
+    Expires   time.Time // participants are removed at
+}
+
+// Participant is someone joining a room.
+type Participant struct {
+    Identity string // stable and unique within the room
+    Name     string // shown to the other participants
+    Host     bool   // may manage the room, e.g. remove participants
+}
+
+// Provider is a video service.
+type Provider interface {
+    Name() string
+    // CreateRoom creates a room, or returns it if it already exists.
+    CreateRoom(ctx context.Context, room Room) (Room, error)
+    // Token returns an access token admitting p to room until expires.
+    Token(ctx context.Context, room Room, p Participant, expires time.Time) (string, error)
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// waitlistBatchSize bounds the offers expired per run.
+const waitlistBatchSize = 100
+
+// Waitlist entry statuses
+const (
+    WaitlistWaiting  = "waiting"
+    WaitlistOffered  = "offered"
+    WaitlistBooked   = "booked"
+    WaitlistDeclined = "declined"
+    WaitlistExpired  = "expired"
+)
+
+// WaitlistEntry puts a patient in line for a doctor's day that is fully
+// booked. When an appointment of the day is cancelled, the freed slot is
+// held for the first patient waiting and offered to them; an offer not
+// confirmed within WAITLIST_OFFER_WINDOW passes to the next in line.
+type WaitlistEntry struct {
+    Document      `bson:",inline"`
+    PatientID     primitive.ObjectID  `json:"patientId" bson:"patientId"`
+    DoctorID      primitive.ObjectID  `json:"doctorId" bson:"doctorId"`
+    Date          string              `json:"date" bson:"date"` // YYYY-MM-DD
+    Status        string              `json:"status" bson:"status"`
+    Offer         *WaitlistOffer      `json:"offer,omitempty" bson:"offer,omitempty"`
+    AppointmentID *primitive.ObjectID `json:"appointmentId,omitempty" bson:"appointmentId,omitempty"`
+}
+
+// WaitlistOffer is a freed slot offered to a waiting patient, held for
+// them until the offer expires.
+type WaitlistOffer struct {
+    DateTime  time.Time          `json:"dateTime" bson:"dateTime"`
+    HoldID    primitive.ObjectID `json:"holdId" bson:"holdId"`
+    OfferedAt time.Time          `json:"offeredAt" bson:"offeredAt"`
+    ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
+
+var (
+    waitlistCollection *mongo.Collection
+    waitlistRepo       *Repository[WaitlistEntry, *WaitlistEntry]
+)
+
+func initWaitlist(ctx context.Context, db *mongo.Database) {
+    waitlistCollection = db.Collection("waitlist")
+    waitlistRepo = NewRepository[WaitlistEntry](waitlistCollection, defaultHooks)
+
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "doctorId", Value: 1}, {Key: "date", Value: 1}, {Key: "status", Value: 1}}},
+        {Keys: bson.D{{Key: "patientId", Value: 1}}},
+        {Keys: bson.D{{Key: "status", Value: 1}, {Key: "offer.expiresAt", Value: 1}}},
+    }
+    if _, err := waitlistCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating waitlist indexes: %v\n", err)
+    }
+}
+
+// joinWaitlist adds a patient to the waitlist of a doctor's day, which
+// must be fully booked.
+func joinWaitlist(ctx context.Context, entry *WaitlistEntry) error {
+    if _, err := patientRepo.GetByID(ctx, entry.PatientID); err != nil {
+        return newAPIError("patient_not_found")
+    }
+    doctor, err := doctorRepo.GetByID(ctx, entry.DoctorID)
+    if err != nil {
+        return newAPIError("doctor_not_found")
+    }
+    day, err := time.ParseInLocation(time.DateOnly, entry.Date, time.Local)
+    if err != nil {
+        return newAPIError("invalid_date", "date")
+    }
+    if today, _ := dayBounds(time.Now()); day.Before(today) {
+        return newAPIError("waitlist_past_date")
+    }
+
+    slots, err := freeSlots(ctx, doctor, day)
+    if err != nil {
+        return err
+    }
+    for _, slot := range slots {
+        if slot.After(time.Now()) {
+            return newAPIError("waitlist_slots_free")
+        }
+    }
+
+    waiting, err := waitlistCollection.CountDocuments(ctx, bson.M{
+        "patientId": entry.PatientID,
+        "doctorId":  entry.DoctorID,
+        "date":      entry.Date,
+        "status":    bson.M{"$in": bson.A{WaitlistWaiting, WaitlistOffered}},
+        "deletedAt": nil,
+    })
+    if err != nil {
+        return err
+    }
+    if waiting > 0 {
+        return newAPIError("waitlist_duplicate")
+    }
+
+    entry.Status = WaitlistWaiting
+    entry.Offer = nil
+    entry.AppointmentID = nil
+    return waitlistRepo.Create(ctx, entry)
+}
+
+// offerFreedSlot offers the slot of a cancelled appointment to the
+// waitlist of its day, in the background of a request.
+func offerFreedSlot(appointment Appointment) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    if err := offerSlot(ctx, appointment.DoctorID, appointment.DateTime); err != nil {
+        log.Printf("Error offering the slot of appointment %s to the waitlist: %v\n", appointment.ID.Hex(), err)
+    }
+}
+
+// offerSlot holds a freed slot of a doctor for the first patient waiting
+// for its day and notifies them. The slot is left alone if it has passed,
+// has been taken again or nobody is waiting.
+func offerSlot(ctx context.Context, doctorID primitive.ObjectID, at time.Time) error {
+    now := time.Now()
+    if !at.After(now) {
+        return nil
+    }
+    doctor, err := doctorRepo.GetByID(ctx, doctorID)
+    if err != nil {
+        return err
+    }
+    // Read from MongoDB rather than the schedule cache, which may not have
+    // seen the cancellation or the released hold yet
+    err = checkCapacity(ctx, doctor, &Appointment{DoctorID: doctorID, DateTime: at})
+    var apiErr *apiError
+    if errors.As(err, &apiErr) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    for {
+        entries, err := waitlistRepo.List(ctx, bson.M{
+            "doctorId": doctorID,
+            "date":     at.Local().Format(time.DateOnly),
+            "status":   WaitlistWaiting,
+        }, Page{Number: 1, Size: 1})
+        if err != nil || len(entries) == 0 {
+            return err
+        }
+        entry := entries[0]
+
+        // The offer holds the slot; expired holds the TTL monitor has not
+        // purged yet would still take the unique index
+        _, err = slotHoldCollection.DeleteMany(ctx, bson.M{
+            "doctorId":  doctorID,
+            "dateTime":  at,
+            "expiresAt": bson.M{"$lte": now},
+        })
+        if err != nil {
+            return err
+        }
+        offer := WaitlistOffer{
+            DateTime:  at,
+            HoldID:    primitive.NewObjectID(),
+            OfferedAt: now,
+            ExpiresAt: now.Add(config.WaitlistOfferWindow),
+        }
+        if offer.ExpiresAt.After(at) {
+            offer.ExpiresAt = at
+        }
+        hold := SlotHold{ID: offer.HoldID, DoctorID: doctorID, DateTime: at, CreatedAt: now, ExpiresAt: offer.ExpiresAt}
+        if _, err := slotHoldCollection.InsertOne(ctx, hold); err != nil {
+            if mongo.IsDuplicateKeyError(err) {
+                // Held by someone booking it
+                return nil
+            }
+            return err
+        }
+
+        err = waitlistRepo.UpdateFields(ctx, entry.ID,
+            bson.M{"status": WaitlistWaiting},
+            bson.M{"status": WaitlistOffered, "offer": offer},
+        )
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            // Left the waitlist or offered another slot meanwhile
+            if _, err := slotHoldCollection.DeleteOne(ctx, bson.M{"_id": offer.HoldID}); err != nil {
+                return err
+            }
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        entry.Status = WaitlistOffered
+        entry.Offer = &offer
+        notifyWaitlistOffer(ctx, entry, doctor)
+        return nil
+    }
+}
+
+// notifyWaitlistOffer tells a patient of the slot offered to them.
+func notifyWaitlistOffer(ctx context.Context, entry WaitlistEntry, doctor *Doctor) {
+    patient, err := patientRepo.GetByID(ctx, entry.PatientID)
+    if err == nil {
+        err = notifyPatient(ctx, "waitlist_offer", notificationData{
+            Patient:        patient,
+            Doctor:         doctor,
+            Waitlist:       &entry,
+            PortalURL:      waitlistOfferURL(entry),
+            Specialization: specializationName(ctx, doctor.Specialization, patientLanguage(patient)),
+        })
+    }
+    if err != nil {
+        log.Printf("Error sending waitlist offer %s: %v\n", entry.ID.Hex(), err)
+    }
+}
+
+// waitlistOfferURL is the link to an offer on the patient portal, or ""
+// without PORTAL_URL. The page it opens confirms the offer at
+// /portal/{id}/waitlist/{entryId}/confirm.
+func waitlistOfferURL(entry WaitlistEntry) string {
+    link := portalURL(entry.PatientID)
+    if link == "" {
+        return ""
+    }
+    return link + "&" + url.Values{"waitlist": {entry.ID.Hex()}}.Encode()
+}
+
+// passOn ends an offered or waiting entry with status and offers the slot
+// it held, if any, to the next patient waiting.
+func passOn(ctx context.Context, entry *WaitlistEntry, status string) error {
+    err := waitlistRepo.UpdateFields(ctx, entry.ID, bson.M{"status": entry.Status}, bson.M{"status": status})
+    if err != nil {
+        return err
+    }
+    if entry.Offer == nil || entry.Status != WaitlistOffered {
+        return nil
+    }
+    if _, err := slotHoldCollection.DeleteOne(ctx, bson.M{"_id": entry.Offer.HoldID}); err != nil {
+        return err
+    }
+    return offerSlot(ctx, entry.DoctorID, entry.Offer.DateTime)
+}
+
+// expireWaitlist passes on the offers not confirmed in time and ends the
+// entries of days that have passed.
+func expireWaitlist(ctx context.Context) error {
+    now := time.Now()
+    entries, err := waitlistRepo.List(ctx, bson.M{
+        "status":          WaitlistOffered,
+        "offer.expiresAt": bson.M{"$lte": now},
+    }, Page{Number: 1, Size: waitlistBatchSize})
+    if err != nil {
+        return err
+    }
+    for _, entry := range entries {
+        err := passOn(ctx, &entry, WaitlistExpired)
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            // Confirmed or passed on by another instance
+            continue
+        }
+        if err != nil {
+            return err
+        }
+    }
+
+    _, err = waitlistCollection.UpdateMany(ctx, bson.M{
+        "status":    WaitlistWaiting,
+        "date":      bson.M{"$lt": now.Format(time.DateOnly)},
+        "deletedAt": nil,
+    }, bson.M{"$set": bson.M{"status": WaitlistExpired, "updatedAt": now}})
+    return err
+}
+
+// waitlist lists the waitlist and adds patients to it:
+// GET /waitlist?doctorId=&date=&status=&patientId=, POST /waitlist with
+// {"patientId", "doctorId", "date"}
+func waitlist(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getWaitlist(w, r)
+    case http.MethodPost:
+        createWaitlistEntry(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getWaitlist(w http.ResponseWriter, r *http.Request) {
+    page, err := parsePage(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    query := r.URL.Query()
+    filter := bson.M{}
+    for _, param := range []string{"doctorId", "patientId"} {
+        if value := query.Get(param); value != "" {
+            id, err := primitive.ObjectIDFromHex(value)
+            if err != nil {
+                localizedError(w, r, http.StatusBadRequest, "invalid_"+strings.TrimSuffix(param, "Id")+"_id")
+                return
+            }
+            filter[param] = id
+        }
+    }
+    if date := query.Get("date"); date != "" {
+        day, err := parseDay(date)
+        if err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_date", "date")
+            return
+        }
+        filter["date"] = day.Format(time.DateOnly)
+    }
+    if status := query.Get("status"); status != "" {
+        filter["status"] = status
+    }
+
+    entries, err := waitlistRepo.List(r.Context(), filter, page)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(entries)
+}
+
+func createWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+    var entry WaitlistEntry
+    if !decodeJSON(w, r, &entry) {
+        return
+    }
+    if err := joinWaitlist(r.Context(), &entry); err != nil {
+        writeWaitlistError(w, r, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(entry)
+}
+
+// writeWaitlistError answers an error of joinWaitlist.
+func writeWaitlistError(w http.ResponseWriter, r *http.Request, err error) {
+    var apiErr *apiError
+    if errors.As(err, &apiErr) {
+        status := http.StatusBadRequest
+        if apiErr.key == "waitlist_slots_free" || apiErr.key == "waitlist_duplicate" {
+            status = http.StatusConflict
+        }
+        writeError(w, r, status, err)
+        return
+    }
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// removeWaitlistEntry takes a patient off the waitlist, passing on any
+// slot offered to them: DELETE /waitlist/{id}
+func removeWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    entry, ok := loadWaitlistEntry(w, r, "id")
+    if !ok {
+        return
+    }
+
+    ctx := r.Context()
+
+    if entry.Status == WaitlistWaiting || entry.Status == WaitlistOffered {
+        if err := passOn(ctx, entry, WaitlistDeclined); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    }
+    if err := waitlistRepo.SoftDelete(ctx, entry.ID); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmWaitlistOffer books the slot offered to a patient on their
+// behalf: POST /waitlist/{id}/confirm
+func confirmWaitlistOffer(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    entry, ok := loadWaitlistEntry(w, r, "id")
+    if !ok {
+        return
+    }
+    bookWaitlistOffer(w, r, entry)
+}
+
+// loadWaitlistEntry loads the waitlist entry of the path value name.
+func loadWaitlistEntry(w http.ResponseWriter, r *http.Request, name string) (*WaitlistEntry, bool) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue(name))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_waitlist_id")
+        return nil, false
+    }
+    entry, err := waitlistRepo.GetByID(r.Context(), id)
+    if err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "waitlist_entry_not_found")
+            return nil, false
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    return entry, true
+}
+
+// bookWaitlistOffer books the slot offered to entry with its hold.
+func bookWaitlistOffer(w http.ResponseWriter, r *http.Request, entry *WaitlistEntry) {
+    if entry.Status != WaitlistOffered || entry.Offer == nil || !entry.Offer.ExpiresAt.After(time.Now()) {
+        localizedError(w, r, http.StatusConflict, "waitlist_no_offer")
+        return
+    }
+
+    ctx := r.Context()
+
+    appointment := Appointment{
+        PatientID: entry.PatientID,
+        DoctorID:  entry.DoctorID,
+        DateTime:  entry.Offer.DateTime,
+        Status:    StatusScheduled,
+        HoldID:    &entry.Offer.HoldID,
+    }
+    if err := validateAppointment(ctx, &appointment); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    err := withTransaction(ctx, func(ctx context.Context) error {
+        if err := bookAppointment(ctx, &appointment); err != nil {
+            return err
+        }
+        return waitlistRepo.UpdateFields(ctx, entry.ID,
+            bson.M{"status": WaitlistOffered},
+            bson.M{"status": WaitlistBooked, "appointmentId": appointment.ID},
+        )
+    })
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusConflict, "waitlist_no_offer")
+        return
+    }
+    if err != nil {
+        writeBookingError(w, r, err)
+        return
+    }
+    go notifyAppointment("confirmation", appointment)
+    go syncAppointmentCalendar(appointment)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(appointment)
+}
+
+// portalWaitlist lists the waitlist entries of a patient and adds them to
+// the waitlist of a day: GET, POST /portal/{id}/waitlist?key= with
+// {"doctorId", "date"}
+func portalWaitlist(w http.ResponseWriter, r *http.Request) {
+    patientID, _ := primitive.ObjectIDFromHex(r.PathValue("id"))
+
+    switch r.Method {
+    case http.MethodGet:
+        entries, err := waitlistRepo.List(r.Context(), bson.M{
+            "patientId": patientID,
+            "status":    bson.M{"$in": bson.A{WaitlistWaiting, WaitlistOffered}},
+        }, Page{Number: 1, Size: maxPageSize})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(entries)
+    case http.MethodPost:
+        var entry WaitlistEntry
+        if !decodeJSON(w, r, &entry) {
+            return
+        }
+        entry.PatientID = patientID
+        if err := joinWaitlist(r.Context(), &entry); err != nil {
+            writeWaitlistError(w, r, err)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(entry)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// portalWaitlistEntry loads the waitlist entry {entryId} of the patient
+// {id} of a portal route.
+func portalWaitlistEntry(w http.ResponseWriter, r *http.Request) (*WaitlistEntry, bool) {
+    patientID, _ := primitive.ObjectIDFromHex(r.PathValue("id"))
+    entry, ok := loadWaitlistEntry(w, r, "entryId")
+    if ok && entry.PatientID != patientID {
+        localizedError(w, r, http.StatusNotFound, "waitlist_entry_not_found")
+        return nil, false
+    }
+    return entry, ok
+}
+
+// confirmPortalWaitlistOffer books the slot offered to a patient:
+// POST /portal/{id}/waitlist/{entryId}/confirm?key=
+func confirmPortalWaitlistOffer(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    entry, ok := portalWaitlistEntry(w, r)
+    if !ok {
+        return
+    }
+    bookWaitlistOffer(w, r, entry)
+}
+
+// declinePortalWaitlistEntry turns down the slot offered to a patient, or
+// leaves the waitlist before one is: POST
+// /portal/{id}/waitlist/{entryId}/decline?key=. The slot passes to the
+// next patient waiting.
+func declinePortalWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    entry, ok := portalWaitlistEntry(w, r)
+    if !ok {
+        return
+    }
+    if entry.Status != WaitlistWaiting && entry.Status != WaitlistOffered {
+        localizedError(w, r, http.StatusConflict, "waitlist_no_offer")
+        return
+    }
+
+    err := passOn(r.Context(), entry, WaitlistDeclined)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusConflict, "waitlist_no_offer")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/events"
+)
+
+// Ward is an inpatient ward and the codes of its beds.
+type Ward struct {
+    Document   `bson:",inline"`
+    Name       string   `json:"name" bson:"name"`
+    Department string   `json:"department,omitempty" bson:"department,omitempty"`
+    Beds       []string `json:"beds" bson:"beds"`
+}
+
+// Admission is a patient's stay in a bed, open until they are discharged.
+// A bed holds one open admission and a patient has at most one.
+type Admission struct {
+    Document          `bson:",inline"`
+    PatientID         primitive.ObjectID `json:"patientId" bson:"patientId"`
+    WardID            primitive.ObjectID `json:"wardId" bson:"wardId"`
+    Bed               string             `json:"bed" bson:"bed"`
+    AdmittedAt        time.Time          `json:"admittedAt" bson:"admittedAt"`
+    ExpectedDischarge *time.Time         `json:"expectedDischarge,omitempty" bson:"expectedDischarge,omitempty"`
+    DischargedAt      *time.Time         `json:"dischargedAt,omitempty" bson:"dischargedAt,omitempty"`
+}
+
+// Ward event types
+const (
+    WardAdmit     = "admit"
+    WardTransfer  = "transfer"
+    WardDischarge = "discharge"
+)
+
+// wardEventRetention is how long ward events are kept for streams to
+// catch up on.
+const wardEventRetention = 7 * 24 * time.Hour
+
+// wardKeepAlive is how often quiet event streams get a comment, which keeps
+// proxies from closing them.
+const wardKeepAlive = 15 * time.Second
+
+// WardEvent records a patient moving into, between or out of beds. A
+// transfer between wards is an event of both.
+type WardEvent struct {
+    ID                primitive.ObjectID  `json:"id" bson:"_id"`
+    Type              string              `json:"type" bson:"type"`
+    WardID            primitive.ObjectID  `json:"wardId" bson:"wardId"`
+    Bed               string              `json:"bed" bson:"bed"`
+    FromWardID        *primitive.ObjectID `json:"fromWardId,omitempty" bson:"fromWardId,omitempty"`
+    FromBed           string              `json:"fromBed,omitempty" bson:"fromBed,omitempty"`
+    AdmissionID       primitive.ObjectID  `json:"admissionId" bson:"admissionId"`
+    PatientID         primitive.ObjectID  `json:"patientId" bson:"patientId"`
+    ExpectedDischarge *time.Time          `json:"expectedDischarge,omitempty" bson:"expectedDischarge,omitempty"`
+    At                time.Time           `json:"at" bson:"at"`
+}
+
+var (
+    wardCollection      *mongo.Collection
+    wardRepo            *Repository[Ward, *Ward]
+    admissionCollection *mongo.Collection
+    admissionRepo       *Repository[Admission, *Admission]
+    wardEventCollection *mongo.Collection
+)
+
+func initWards(ctx context.Context, db *mongo.Database) {
+    wardCollection = db.Collection("wards")
+    wardRepo = NewRepository[Ward](wardCollection, defaultHooks)
+    admissionCollection = db.Collection("admissions")
+    admissionRepo = NewRepository[Admission](admissionCollection, defaultHooks)
+    wardEventCollection = db.Collection("ward_events")
+
+    open := bson.M{"dischargedAt": bson.M{"$exists": false}, "deletedAt": bson.M{"$exists": false}}
+    indexes := []mongo.IndexModel{
+        {
+            Keys:    bson.D{{Key: "wardId", Value: 1}, {Key: "bed", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(open),
+        },
+        {
+            Keys:    bson.D{{Key: "patientId", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(open),
+        },
+    }
+    if _, err := admissionCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating admission indexes: %v\n", err)
+    }
+
+    indexes = []mongo.IndexModel{
+        {Keys: bson.D{{Key: "wardId", Value: 1}, {Key: "_id", Value: 1}}},
+        {Keys: bson.D{{Key: "fromWardId", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+        {Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(wardEventRetention.Seconds()))},
+    }
+    if _, err := wardEventCollection.Indexes().CreateMany(ctx, indexes); err != nil {
+        log.Printf("Error creating ward event indexes: %v\n", err)
+    }
+}
+
+// validateWard checks a ward's name and that its bed codes are unique.
+func validateWard(ward *Ward) error {
+    ward.Name = strings.TrimSpace(ward.Name)
+    if ward.Name == "" {
+        return newAPIError("field_required", "name")
+    }
+    if len(ward.Beds) == 0 {
+        return newAPIError("field_required", "beds")
+    }
+    seen := map[string]bool{}
+    for i, bed := range ward.Beds {
+        bed = strings.TrimSpace(bed)
+        if bed == "" || seen[bed] {
+            return newAPIError("invalid_bed", bed)
+        }
+        seen[bed] = true
+        ward.Beds[i] = bed
+    }
+    return nil
+}
+
+// openAdmissions returns the admissions of a ward that are not discharged.
+func openAdmissions(ctx context.Context, wardID primitive.ObjectID) ([]Admission, error) {
+    return admissionRepo.List(ctx, bson.M{"wardId": wardID, "dischargedAt": nil}, Page{})
+}
+
+// recordWardEvent stores a movement for the boards of its wards.
+func recordWardEvent(ctx context.Context, event WardEvent) error {
+    event.ID = primitive.NewObjectID()
+    event.At = time.Now()
+    _, err := wardEventCollection.InsertOne(ctx, event)
+    return err
+}
+
+// envelope returns the domain event of a movement, a ward.<type> event.
+func (e WardEvent) envelope() (events.Event, error) {
+    event, err := events.New("ward."+e.Type, e)
+    if err != nil {
+        return events.Event{}, err
+    }
+    event.ID = e.ID.Hex()
+    event.OccurredAt = e.At
+    event.EntityID = e.AdmissionID.Hex()
+    return event, nil
+}
+
+// Ward handlers
+
+// wards lists the wards: GET /wards
+func wards(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    ctx := r.Context()
+
+    list, err := wardRepo.List(ctx, bson.M{}, Page{})
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
+
+// createWard adds a ward: POST /admin/wards
+func createWard(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var ward Ward
+    if !decodeJSON(w, r, &ward) {
+        return
+    }
+    if err := validateWard(&ward); err != nil {
+        writeError(w, r, http.StatusBadRequest, err)
+        return
+    }
+
+    ctx := r.Context()
+
+    if err := wardRepo.Create(ctx, &ward); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(ward)
+}
+
+// patchWard updates a ward with a JSON Merge Patch: PATCH /admin/wards/{id}.
+// Occupied beds cannot be removed.
+func patchWard(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPatch {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_ward_id")
+        return
+    }
+
+    ward, ok := patchDocument(w, r, wardRepo, id, patchable[Ward]{
+        notFound: "ward_not_found",
+        check: func(ctx context.Context, ward *Ward) error {
+            if err := validateWard(ward); err != nil {
+                return err
+            }
+            admissions, err := openAdmissions(ctx, ward.ID)
+            if err != nil {
+                return err
+            }
+            for _, admission := range admissions {
+                if !slices.Contains(ward.Beds, admission.Bed) {
+                    return newAPIError("bed_occupied", admission.Bed)
+                }
+            }
+            return nil
+        },
+    })
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(ward)
+}
+
+// admitPatient admits a patient to a free bed of the ward:
+// POST /wards/{id}/admissions with {"patientId", "bed", "expectedDischarge"}
+func admitPatient(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    wardID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_ward_id")
+        return
+    }
+    var admission Admission
+    if !decodeJSON(w, r, &admission) {
+        return
+    }
+
+    ctx := r.Context()
+
+    ward, err := wardRepo.GetByID(ctx, wardID)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusNotFound, "ward_not_found")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !slices.Contains(ward.Beds, admission.Bed) {
+        localizedError(w, r, http.StatusBadRequest, "invalid_bed", admission.Bed)
+        return
+    }
+    if _, err := patientRepo.GetByID(ctx, admission.PatientID); err != nil {
+        localizedError(w, r, http.StatusBadRequest, "patient_not_found")
+        return
+    }
+
+    admission.WardID = wardID
+    admission.AdmittedAt = time.Now()
+    admission.DischargedAt = nil
+    err = withTransaction(ctx, func(ctx context.Context) error {
+        if err := admissionRepo.Create(ctx, &admission); err != nil {
+            return err
+        }
+        return recordWardEvent(ctx, WardEvent{
+            Type:              WardAdmit,
+            WardID:            wardID,
+            Bed:               admission.Bed,
+            AdmissionID:       admission.ID,
+            PatientID:         admission.PatientID,
+            ExpectedDischarge: admission.ExpectedDischarge,
+        })
+    })
+    if mongo.IsDuplicateKeyError(err) {
+        admissionConflict(w, r, admission.PatientID, admission.Bed)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(admission)
+}
+
+// admissionConflict answers a write refused by the unique indexes of open
+// admissions: the patient is already admitted, or else the bed is taken.
+func admissionConflict(w http.ResponseWriter, r *http.Request, patientID primitive.ObjectID, bed string) {
+    n, err := admissionCollection.CountDocuments(r.Context(), bson.M{"patientId": patientID, "dischargedAt": nil, "deletedAt": nil})
+    if err == nil && n > 0 {
+        localizedError(w, r, http.StatusConflict, "patient_admitted")
+        return
+    }
+    localizedError(w, r, http.StatusConflict, "bed_occupied", bed)
+}
+
+// openAdmission returns an admission that has not been discharged, writing
+// the error and returning false otherwise.
+func openAdmission(w http.ResponseWriter, r *http.Request) (*Admission, bool) {
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_admission_id")
+        return nil, false
+    }
+    admission, err := admissionRepo.GetByID(r.Context(), id)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusNotFound, "admission_not_found")
+        return nil, false
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return nil, false
+    }
+    if admission.DischargedAt != nil {
+        localizedError(w, r, http.StatusConflict, "patient_discharged")
+        return nil, false
+    }
+    return admission, true
+}
+
+// transferPatient moves an admitted patient to another bed, of the same
+// ward unless wardId is given: POST /admissions/{id}/transfer with
+// {"wardId", "bed", "expectedDischarge"}
+func transferPatient(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req struct {
+        WardID            *primitive.ObjectID `json:"wardId"`
+        Bed               string              `json:"bed"`
+        ExpectedDischarge *time.Time          `json:"expectedDischarge"`
+    }
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    admission, ok := openAdmission(w, r)
+    if !ok {
+        return
+    }
+
+    ctx := r.Context()
+
+    to := admission.WardID
+    if req.WardID != nil {
+        to = *req.WardID
+    }
+    ward, err := wardRepo.GetByID(ctx, to)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusNotFound, "ward_not_found")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !slices.Contains(ward.Beds, req.Bed) || (to == admission.WardID && req.Bed == admission.Bed) {
+        localizedError(w, r, http.StatusBadRequest, "invalid_bed", req.Bed)
+        return
+    }
+
+    fields := bson.M{"wardId": to, "bed": req.Bed}
+    expected := admission.ExpectedDischarge
+    if req.ExpectedDischarge != nil {
+        expected = req.ExpectedDischarge
+        fields["expectedDischarge"] = expected
+    }
+    from := admission.WardID
+    err = withTransaction(ctx, func(ctx context.Context) error {
+        cond := bson.M{"wardId": admission.WardID, "bed": admission.Bed, "dischargedAt": nil}
+        if err := admissionRepo.UpdateFields(ctx, admission.ID, cond, fields); err != nil {
+            return err
+        }
+        return recordWardEvent(ctx, WardEvent{
+            Type:              WardTransfer,
+            WardID:            to,
+            Bed:               req.Bed,
+            FromWardID:        &from,
+            FromBed:           admission.Bed,
+            AdmissionID:       admission.ID,
+            PatientID:         admission.PatientID,
+            ExpectedDischarge: expected,
+        })
+    })
+    if mongo.IsDuplicateKeyError(err) {
+        localizedError(w, r, http.StatusConflict, "bed_occupied", req.Bed)
+        return
+    }
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        // Moved or discharged meanwhile
+        localizedError(w, r, http.StatusConflict, "admission_changed")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    admission.WardID, admission.Bed, admission.ExpectedDischarge = to, req.Bed, expected
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(admission)
+}
+
+// dischargePatient ends an admission, freeing its bed:
+// POST /admissions/{id}/discharge
+func dischargePatient(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    admission, ok := openAdmission(w, r)
+    if !ok {
+        return
+    }
+
+    ctx := r.Context()
+
+    now := time.Now()
+    err := withTransaction(ctx, func(ctx context.Context) error {
+        cond := bson.M{"wardId": admission.WardID, "bed": admission.Bed, "dischargedAt": nil}
+        if err := admissionRepo.UpdateFields(ctx, admission.ID, cond, bson.M{"dischargedAt": now}); err != nil {
+            return err
+        }
+        return recordWardEvent(ctx, WardEvent{
+            Type:        WardDischarge,
+            WardID:      admission.WardID,
+            Bed:         admission.Bed,
+            AdmissionID: admission.ID,
+            PatientID:   admission.PatientID,
+        })
+    })
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusConflict, "admission_changed")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    admission.DischargedAt = &now
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(admission)
+}
+
+// Occupancy board
+
+// BoardBed is a bed on the occupancy board, with its patient when occupied.
+type BoardBed struct {
+    Bed               string              `json:"bed"`
+    Occupied          bool                `json:"occupied"`
+    AdmissionID       *primitive.ObjectID `json:"admissionId,omitempty"`
+    Patient           *PatientSummary     `json:"patient,omitempty"`
+    AdmittedAt        *time.Time          `json:"admittedAt,omitempty"`
+    ExpectedDischarge *time.Time          `json:"expectedDischarge,omitempty"`
+}
+
+// WardBoard is the occupancy of a ward's beds, in their order. Wall
+// displays load it and then follow /wards/{id}/events from LastEventID.
+type WardBoard struct {
+    WardID      primitive.ObjectID `json:"wardId"`
+    Name        string             `json:"name"`
+    Beds        []BoardBed         `json:"beds"`
+    Occupied    int                `json:"occupied"`
+    Free        int                `json:"free"`
+    LastEventID string             `json:"lastEventId,omitempty"`
+    At          time.Time          `json:"at"`
+}
+
+// getWardBoard returns the occupancy grid of a ward: GET /wards/{id}/board
+func getWardBoard(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_ward_id")
+        return
+    }
+
+    ctx := r.Context()
+
+    ward, err := wardRepo.GetByID(ctx, id)
+    if errors.Is(err, mongo.ErrNoDocuments) {
+        localizedError(w, r, http.StatusNotFound, "ward_not_found")
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // The last event is read first, so a display following from it sees
+    // every change after the board
+    board := WardBoard{WardID: ward.ID, Name: ward.Name, Beds: []BoardBed{}, At: time.Now()}
+    var last WardEvent
+    err = wardEventCollection.FindOne(ctx, wardEventFilter(id, primitive.NilObjectID),
+        options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&last)
+    if err == nil {
+        board.LastEventID = last.ID.Hex()
+    } else if !errors.Is(err, mongo.ErrNoDocuments) {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    admissions, err := openAdmissions(ctx, id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    patientIDs := make([]primitive.ObjectID, len(admissions))
+    byBed := map[string]Admission{}
+    for i, admission := range admissions {
+        patientIDs[i] = admission.PatientID
+        byBed[admission.Bed] = admission
+    }
+    cursor, err := patientCollection.Find(ctx, bson.M{"_id": bson.M{"$in": patientIDs}},
+        options.Find().SetProjection(bson.M{"name": 1, "email": 1, "contactNo": 1}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var summaries []PatientSummary
+    if err := cursor.All(ctx, &summaries); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    patients := map[primitive.ObjectID]*PatientSummary{}
+    for i := range summaries {
+        patients[summaries[i].ID] = &summaries[i]
+        notePatientAccess(ctx, summaries[i].ID)
+    }
+
+    for _, bed := range ward.Beds {
+        entry := BoardBed{Bed: bed}
+        if admission, ok := byBed[bed]; ok {
+            entry.Occupied = true
+            entry.AdmissionID = &admission.ID
+            entry.Patient = patients[admission.PatientID]
+            entry.AdmittedAt = &admission.AdmittedAt
+            entry.ExpectedDischarge = admission.ExpectedDischarge
+            board.Occupied++
+        }
+        board.Beds = append(board.Beds, entry)
+    }
+    board.Free = len(ward.Beds) - board.Occupied
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(board)
+}
+
+// wardEventFilter selects the events of a ward after the event after.
+func wardEventFilter(wardID, after primitive.ObjectID) bson.M {
+    filter := bson.M{"$or": bson.A{bson.M{"wardId": wardID}, bson.M{"fromWardId": wardID}}}
+    if !after.IsZero() {
+        filter["_id"] = bson.M{"$gt": after}
+    }
+    return filter
+}
+
+// streamWardEvents streams the admissions, transfers and discharges of a
+// ward as server-sent events: GET /wards/{id}/events. Events are polled
+// every WARD_EVENT_POLL, so every instance sees them; streams resume
+// after Last-Event-ID, or ?after=, and otherwise start from now. The data
+// of each is an events.Event.
+func streamWardEvents(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+    if err != nil {
+        localizedError(w, r, http.StatusBadRequest, "invalid_ward_id")
+        return
+    }
+    last := primitive.NewObjectIDFromTimestamp(time.Now())
+    resume := r.Header.Get("Last-Event-ID")
+    if resume == "" {
+        resume = r.URL.Query().Get("after")
+    }
+    if resume != "" {
+        if last, err = primitive.ObjectIDFromHex(resume); err != nil {
+            localizedError(w, r, http.StatusBadRequest, "invalid_event_id")
+            return
+        }
+    }
+
+    ctx := r.Context()
+
+    if _, err := wardRepo.GetByID(ctx, id); err != nil {
+        if errors.Is(err, mongo.ErrNoDocuments) {
+            localizedError(w, r, http.StatusNotFound, "ward_not_found")
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("X-Accel-Buffering", "no")
+    rc := http.NewResponseController(w)
+    fmt.Fprintf(w, "retry: %d\n\n", config.WardEventPoll.Milliseconds())
+    if err := rc.Flush(); err != nil {
+        return
+    }
+
+    poll := time.NewTicker(config.WardEventPoll)
+    defer poll.Stop()
+    var quiet time.Duration
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-poll.C:
+        }
+
+        cursor, err := wardEventCollection.Find(ctx, wardEventFilter(id, last),
+            options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(100))
+        if err != nil {
+            if ctx.Err() == nil {
+                log.Printf("Error polling events of ward %s: %v\n", id.Hex(), err)
+            }
+            return
+        }
+        var movements []WardEvent
+        if err := cursor.All(ctx, &movements); err != nil {
+            return
+        }
+
+        for _, movement := range movements {
+            event, err := movement.envelope()
+            if err != nil {
+                log.Printf("Error encoding ward event %s: %v\n", movement.ID.Hex(), err)
+                return
+            }
+            data, _ := json.Marshal(event)
+            fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, movement.Type, data)
+            last = movement.ID
+        }
+        if len(movements) > 0 {
+            quiet = 0
+        } else if quiet += config.WardEventPoll; quiet >= wardKeepAlive {
+            fmt.Fprint(w, ": keepalive\n\n")
+            quiet = 0
+        } else {
+            continue
+        }
+        if err := rc.Flush(); err != nil {
+            return
+        }
+    }
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+
+    "new/backup"
+    "new/warehouse"
+)
+
+// warehouseTombstones is the table of patients purged by the retention
+// policy.
+const warehouseTombstones = "tombstones"
+
+// WarehouseMark is the high-water mark of a table exported to the
+// warehouse: the last document shipped, in updatedAt then _id order. A run
+// ships the documents changed after it, up to WAREHOUSE_LAG ago so writes
+// still in flight with an earlier updatedAt are not skipped.
+type WarehouseMark struct {
+    Table      string             `json:"table" bson:"_id"`
+    Through    time.Time          `json:"through" bson:"through"` // updatedAt of the last document shipped
+    LastID     primitive.ObjectID `json:"lastId" bson:"lastId"`
+    Exported   int64              `json:"exported" bson:"exported"` // documents shipped since the mark was reset
+    LastRunAt  *time.Time         `json:"lastRunAt,omitempty" bson:"lastRunAt,omitempty"`
+    Error      string             `json:"error,omitempty" bson:"error,omitempty"`
+    LeaseUntil *time.Time         `json:"leaseUntil,omitempty" bson:"leaseUntil,omitempty"` // while an instance exports the table
+}
+
+// WarehouseTombstone records a patient purged by the retention policy
+// with everything recorded about them, for the warehouse to delete the
+// rows of the patient and those with their patientId.
+type WarehouseTombstone struct {
+    ID        primitive.ObjectID `json:"id" bson:"_id"`
+    PatientID primitive.ObjectID `json:"patientId" bson:"patientId"`
+    UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// warehouseTable is a collection exported to the warehouse and how its
+// documents become rows.
+type warehouseTable struct {
+    coll *mongo.Collection
+    row  func(raw bson.Raw) (json.RawMessage, error)
+}
+
+// warehouseTableOf exports the documents of coll as the JSON of T.
+func warehouseTableOf[T any](coll *mongo.Collection) warehouseTable {
+    return warehouseTable{coll: coll, row: func(raw bson.Raw) (json.RawMessage, error) {
+        var doc T
+        if err := bson.Unmarshal(raw, &doc); err != nil {
+            return nil, err
+        }
+        return json.Marshal(doc)
+    }}
+}
+
+var (
+    warehouseMarkCollection      *mongo.Collection
+    warehouseTombstoneCollection *mongo.Collection
+    warehouseWriter              warehouse.Writer // nil without WAREHOUSE_TARGET
+    warehouseTables              map[string]warehouseTable
+    warehouseCounters            = &warehouseStats{tables: map[string]*warehouseTableStats{}}
+)
+
+func initWarehouse(ctx context.Context, db *mongo.Database) {
+    warehouseMarkCollection = db.Collection("warehouse_marks")
+    warehouseTombstoneCollection = db.Collection("warehouse_tombstones")
+
+    exportable := map[string]warehouseTable{
+        "patients":          warehouseTableOf[Patient](patientCollection),
+        "appointments":      warehouseTableOf[Appointment](appointmentCollection),
+        "invoices":          warehouseTableOf[Invoice](invoiceCollection),
+        warehouseTombstones: warehouseTableOf[WarehouseTombstone](warehouseTombstoneCollection),
+    }
+    warehouseTables = map[string]warehouseTable{warehouseTombstones: exportable[warehouseTombstones]}
+    for name := range config.WarehouseTables {
+        table, ok := exportable[name]
+        if !ok {
+            log.Printf("Ignoring unknown WAREHOUSE_TABLES table %s\n", name)
+            continue
+        }
+        warehouseTables[name] = table
+    }
+
+    switch config.WarehouseTarget {
+    case "dir":
+        warehouseWriter = warehouse.NewFiles(backup.NewDir(config.WarehouseDir), "")
+    case "s3":
+        store := backup.NewS3(config.WarehouseS3Endpoint, config.WarehouseS3Region, config.WarehouseS3Bucket,
+            config.WarehouseS3AccessKey, config.WarehouseS3SecretKey, warehousePolicy.Client())
+        warehouseWriter = warehouse.NewFiles(store, config.WarehouseS3Prefix)
+    case "bigquery":
+        key, err := os.ReadFile(config.WarehouseBigQueryKeyFile)
+        if err == nil {
+            warehouseWriter, err = warehouse.NewBigQuery(config.WarehouseBigQueryProject, config.WarehouseBigQueryDataset,
+                key, warehousePolicy.Client())
+        }
+        if err != nil {
+            log.Fatalf("Error setting up the BigQuery warehouse: %v", err)
+        }
+    }
+    if warehouseWriter == nil {
+        return
+    }
+
+    // Runs read each table in updatedAt order
+    for _, table := range warehouseTables {
+        index := mongo.IndexModel{Keys: bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}}
+        if _, err := table.coll.Indexes().CreateOne(ctx, index); err != nil {
+            log.Printf("Error creating warehouse index on %s: %v\n", table.coll.Name(), err)
+        }
+    }
+}
+
+var errWarehouseNotConfigured = newAPIError("warehouse_not_configured")
+
+// recordWarehouseTombstone records the purge of a patient for the
+// warehouse, if one is configured.
+func recordWarehouseTombstone(ctx context.Context, patientID primitive.ObjectID) error {
+    if warehouseWriter == nil {
+        return nil
+    }
+    _, err := warehouseTombstoneCollection.InsertOne(ctx, WarehouseTombstone{
+        ID:        primitive.NewObjectID(),
+        PatientID: patientID,
+        UpdatedAt: time.Now(),
+    })
+    return err
+}
+
+// exportWarehouse is the scheduled export of the changes of every table.
+func exportWarehouse(ctx context.Context) error {
+    _, err := runWarehouseExport(ctx)
+    return err
+}
+
+// runWarehouseExport ships the changes of every table and returns how many
+// documents of each it shipped.
+func runWarehouseExport(ctx context.Context) (map[string]int64, error) {
+    if warehouseWriter == nil {
+        return nil, errWarehouseNotConfigured
+    }
+    exported := map[string]int64{}
+    var errs []error
+    for name, table := range warehouseTables {
+        n, err := exportTable(ctx, name, table)
+        exported[name] = n
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", name, err))
+        }
+    }
+    return exported, errors.Join(errs...)
+}
+
+// exportTable ships the documents of a table changed since its mark, one
+// batch of WAREHOUSE_BATCH at a time, advancing the mark after each. Only
+// the instance holding the lease of the table exports it.
+func exportTable(ctx context.Context, name string, table warehouseTable) (int64, error) {
+    mark, ok, err := claimWarehouseMark(ctx, name)
+    if err != nil || !ok {
+        return 0, err
+    }
+
+    var exported int64
+    err = func() error {
+        cutoff := time.Now().Add(-config.WarehouseLag)
+        for {
+            filter := bson.M{
+                "updatedAt": bson.M{"$lte": cutoff},
+                "$or": bson.A{
+                    bson.M{"updatedAt": bson.M{"$gt": mark.Through}},
+                    bson.M{"updatedAt": mark.Through, "_id": bson.M{"$gt": mark.LastID}},
+                },
+            }
+            opts := options.Find().
+                SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}).
+                SetLimit(config.WarehouseBatch)
+            batch, through, lastID, err := readWarehouseBatch(ctx, name, table, filter, opts)
+            if err != nil || len(batch.Rows) == 0 {
+                return err
+            }
+
+            if err := warehouseWriter.Write(ctx, batch); err != nil {
+                warehouseCounters.failed(name)
+                return err
+            }
+            _, err = warehouseMarkCollection.UpdateOne(ctx, bson.M{"_id": name}, bson.M{
+                "$set": bson.M{"through": through, "lastId": lastID, "leaseUntil": time.Now().Add(warehouseLease())},
+                "$inc": bson.M{"exported": len(batch.Rows)},
+            })
+            if err != nil {
+                return err
+            }
+            mark.Through, mark.LastID = through, lastID
+            exported += int64(len(batch.Rows))
+            warehouseCounters.shipped(name, len(batch.Rows), through)
+
+            if int64(len(batch.Rows)) < config.WarehouseBatch {
+                return nil
+            }
+        }
+    }()
+
+    // Release the lease, recording the outcome
+    now := time.Now()
+    outcome := bson.M{"lastRunAt": now, "error": ""}
+    if err != nil {
+        outcome["error"] = err.Error()
+    }
+    if _, releaseErr := warehouseMarkCollection.UpdateOne(context.WithoutCancel(ctx), bson.M{"_id": name},
+        bson.M{"$set": outcome, "$unset": bson.M{"leaseUntil": ""}}); releaseErr != nil && err == nil {
+        err = releaseErr
+    }
+    return exported, err
+}
+
+// readWarehouseBatch reads the documents of filter as a batch of rows and
+// returns the updatedAt and id of the last.
+func readWarehouseBatch(ctx context.Context, name string, table warehouseTable, filter bson.M, opts *options.FindOptions) (warehouse.Batch, time.Time, primitive.ObjectID, error) {
+    batch := warehouse.Batch{Table: name, ExportedAt: time.Now()}
+    var last struct {
+        ID        primitive.ObjectID `bson:"_id"`
+        UpdatedAt time.Time          `bson:"updatedAt"`
+    }
+
+    cursor, err := table.coll.Find(ctx, filter, opts)
+    if err != nil {
+        return batch, last.UpdatedAt, last.ID, err
+    }
+    defer cursor.Close(ctx)
+    for cursor.Next(ctx) {
+        if err := cursor.Decode(&last); err != nil {
+            return batch, last.UpdatedAt, last.ID, err
+        }
+        row, err := table.row(cursor.Current)
+        if err == nil {
+            row, err = omitWarehouseFields(name, row)
+        }
+        if err != nil {
+            return batch, last.UpdatedAt, last.ID, fmt.Errorf("document %s: %w", last.ID.Hex(), err)
+        }
+        batch.Rows = append(batch.Rows, warehouse.Row{ID: last.ID.Hex(), JSON: row})
+    }
+    return batch, last.UpdatedAt, last.ID, cursor.Err()
+}
+
+// omitWarehouseFields drops the fields WAREHOUSE_OMIT keeps out of the
+// warehouse, given as table.field, e.g. patients.contactNo.
+func omitWarehouseFields(table string, row json.RawMessage) (json.RawMessage, error) {
+    var omit []string
+    for field := range config.WarehouseOmit {
+        if name, ok := strings.CutPrefix(field, table+"."); ok {
+            omit = append(omit, name)
+        }
+    }
+    if len(omit) == 0 {
+        return row, nil
+    }
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(row, &fields); err != nil {
+        return nil, err
+    }
+    for _, name := range omit {
+        delete(fields, name)
+    }
+    return json.Marshal(fields)
+}
+
+// warehouseLease is how long an instance may export a table before others
+// take over, renewed after each batch.
+func warehouseLease() time.Duration {
+    return max(config.WarehouseInterval, 5*time.Minute)
+}
+
+// claimWarehouseMark takes the lease of a table, creating its mark on the
+// first run. It reports false while another instance holds the lease.
+func claimWarehouseMark(ctx context.Context, name string) (*WarehouseMark, bool, error) {
+    now := time.Now()
+    var mark WarehouseMark
+    err := warehouseMarkCollection.FindOneAndUpdate(ctx,
+        bson.M{"_id": name, "$or": bson.A{bson.M{"leaseUntil": nil}, bson.M{"leaseUntil": bson.M{"$lte": now}}}},
+        bson.M{"$set": bson.M{"leaseUntil": now.Add(warehouseLease())}},
+        options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+    ).Decode(&mark)
+    if mongo.IsDuplicateKeyError(err) {
+        // The mark exists and is leased
+        return nil, false, nil
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    return &mark, true, nil
+}
+
+// warehouseStats counts what this instance shipped, for /metrics.
+type warehouseStats struct {
+    mu     sync.Mutex
+    tables map[string]*warehouseTableStats
+}
+
+type warehouseTableStats struct {
+    rows     uint64
+    failures uint64
+    through  time.Time
+}
+
+func (s *warehouseStats) table(name string) *warehouseTableStats {
+    t, ok := s.tables[name]
+    if !ok {
+        t = &warehouseTableStats{}
+        s.tables[name] = t
+    }
+    return t
+}
+
+func (s *warehouseStats) shipped(name string, rows int, through time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    t := s.table(name)
+    t.rows += uint64(rows)
+    t.through = through
+}
+
+func (s *warehouseStats) failed(name string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.table(name).failures++
+}
+
+// writeWarehouseMetrics writes the warehouse export counters in the
+// Prometheus text format.
+func writeWarehouseMetrics(w io.Writer) {
+    if warehouseWriter == nil {
+        return
+    }
+    warehouseCounters.mu.Lock()
+    defer warehouseCounters.mu.Unlock()
+
+    names := make([]string, 0, len(warehouseCounters.tables))
+    for name := range warehouseCounters.tables {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    fmt.Fprintln(w, "# HELP warehouse_rows_exported_total Documents shipped to the warehouse by this instance.")
+    fmt.Fprintln(w, "# TYPE warehouse_rows_exported_total counter")
+    for _, name := range names {
+        fmt.Fprintf(w, "warehouse_rows_exported_total{table=%q} %d\n", name, warehouseCounters.tables[name].rows)
+    }
+    fmt.Fprintln(w, "# HELP warehouse_write_failures_total Batches the warehouse writer failed to ship.")
+    fmt.Fprintln(w, "# TYPE warehouse_write_failures_total counter")
+    for _, name := range names {
+        fmt.Fprintf(w, "warehouse_write_failures_total{table=%q} %d\n", name, warehouseCounters.tables[name].failures)
+    }
+    fmt.Fprintln(w, "# HELP warehouse_high_water_mark_seconds updatedAt of the last document shipped by this instance, as a Unix time.")
+    fmt.Fprintln(w, "# TYPE warehouse_high_water_mark_seconds gauge")
+    for _, name := range names {
+        if through := warehouseCounters.tables[name].through; !through.IsZero() {
+            fmt.Fprintf(w, "warehouse_high_water_mark_seconds{table=%q} %d\n", name, through.Unix())
+        }
+    }
+}
+
+// WarehouseStatus is the export target and the marks of its tables.
+type WarehouseStatus struct {
+    Target string          `json:"target"`
+    Marks  []WarehouseMark `json:"marks"`
+}
+
+// adminWarehouse reports the export and runs it now:
+// GET /admin/warehouse, POST /admin/warehouse
+func adminWarehouse(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        getWarehouseStatus(w, r)
+    case http.MethodPost:
+        runWarehouseNow(w, r)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func getWarehouseStatus(w http.ResponseWriter, r *http.Request) {
+    if warehouseWriter == nil {
+        writeError(w, r, http.StatusNotFound, errWarehouseNotConfigured)
+        return
+    }
+
+    ctx := r.Context()
+
+    cursor, err := warehouseMarkCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    status := WarehouseStatus{Target: warehouseWriter.Name(), Marks: []WarehouseMark{}}
+    if err := cursor.All(ctx, &status.Marks); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
+
+func runWarehouseNow(w http.ResponseWriter, r *http.Request) {
+    exported, err := runWarehouseExport(r.Context())
+    if errors.Is(err, errWarehouseNotConfigured) {
+        writeError(w, r, http.StatusNotFound, err)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"exported": exported})
+}
+
+// resetWarehouseMark drops the mark of a table, so the next run ships it
+// from the start: DELETE /admin/warehouse/{table}
+func resetWarehouseMark(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if warehouseWriter == nil {
+        writeError(w, r, http.StatusNotFound, errWarehouseNotConfigured)
+        return
+    }
+    name := r.PathValue("table")
+    if _, ok := warehouseTables[name]; !ok {
+        localizedError(w, r, http.StatusNotFound, "unknown_warehouse_table", name)
+        return
+    }
+
+    ctx := r.Context()
+
+    result, err := warehouseMarkCollection.DeleteOne(ctx, bson.M{
+        "_id": name,
+        "$or": bson.A{bson.M{"leaseUntil": nil}, bson.M{"leaseUntil": bson.M{"$lte": time.Now()}}},
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if result.DeletedCount == 0 {
+        if n, _ := warehouseMarkCollection.CountDocuments(ctx, bson.M{"_id": name}); n > 0 {
+            localizedError(w, r, http.StatusConflict, "warehouse_export_running")
+            return
+        }
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
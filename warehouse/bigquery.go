@@ -0,0 +1,148 @@
+package warehouse
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+
+    "golang.org/x/oauth2"
+    "golang.org/x/oauth2/jwt"
+)
+
+// bigQueryChunk is the rows sent per insertAll request, the size BigQuery
+// recommends.
+const bigQueryChunk = 500
+
+// BigQuery streams batches into the tables of a dataset, named after the
+// batch tables, with the insertAll API. The tables must exist; fields of
+// rows they have no column for are ignored. Rows carry their id as insert
+// id, which BigQuery uses to drop rows it receives twice in a short time.
+type BigQuery struct {
+    Project string
+    Dataset string
+
+    client *http.Client
+}
+
+// serviceAccount is what BigQuery needs of a service account key file.
+type serviceAccount struct {
+    ClientEmail  string `json:"client_email"`
+    PrivateKey   string `json:"private_key"`
+    PrivateKeyID string `json:"private_key_id"`
+    TokenURI     string `json:"token_uri"`
+}
+
+// NewBigQuery returns a BigQuery writer authenticated with the JSON key of
+// a service account, making its requests through client, or
+// http.DefaultClient if nil.
+func NewBigQuery(project, dataset string, key []byte, client *http.Client) (*BigQuery, error) {
+    if client == nil {
+        client = http.DefaultClient
+    }
+    var account serviceAccount
+    if err := json.Unmarshal(key, &account); err != nil {
+        return nil, fmt.Errorf("bigquery: service account key: %w", err)
+    }
+    if account.ClientEmail == "" || account.PrivateKey == "" {
+        return nil, fmt.Errorf("bigquery: service account key without client_email or private_key")
+    }
+    if account.TokenURI == "" {
+        account.TokenURI = "https://oauth2.googleapis.com/token"
+    }
+    conf := &jwt.Config{
+        Email:        account.ClientEmail,
+        PrivateKey:   []byte(account.PrivateKey),
+        PrivateKeyID: account.PrivateKeyID,
+        TokenURL:     account.TokenURI,
+        Scopes:       []string{"https://www.googleapis.com/auth/bigquery.insertdata"},
+    }
+    ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+    return &BigQuery{Project: project, Dataset: dataset, client: conf.Client(ctx)}, nil
+}
+
+func (b *BigQuery) Name() string { return "bigquery" }
+
+type insertRow struct {
+    InsertID string          `json:"insertId"`
+    JSON     json.RawMessage `json:"json"`
+}
+
+type insertResponse struct {
+    InsertErrors []struct {
+        Index  int `json:"index"`
+        Errors []struct {
+            Reason  string `json:"reason"`
+            Message string `json:"message"`
+        } `json:"errors"`
+    } `json:"insertErrors"`
+}
+
+func (b *BigQuery) Write(ctx context.Context, batch Batch) error {
+    for start := 0; start < len(batch.Rows); start += bigQueryChunk {
+        end := min(start+bigQueryChunk, len(batch.Rows))
+        if err := b.insert(ctx, batch.Table, batch.Rows[start:end]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (b *BigQuery) insert(ctx context.Context, table string, rows []Row) error {
+    body := struct {
+        IgnoreUnknownValues bool        `json:"ignoreUnknownValues"`
+        Rows                []insertRow `json:"rows"`
+    }{IgnoreUnknownValues: true}
+    for _, row := range rows {
+        body.Rows = append(body.Rows, insertRow{InsertID: row.ID, JSON: row.JSON})
+    }
+    data, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+
+    endpoint := fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+        url.PathEscape(b.Project), url.PathEscape(b.Dataset), url.PathEscape(table))
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := b.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        var apiErr struct {
+            Error struct {
+                Message string `json:"message"`
+            } `json:"error"`
+        }
+        json.NewDecoder(resp.Body).Decode(&apiErr)
+        return fmt.Errorf("bigquery: %s: %d %s", table, resp.StatusCode, apiErr.Error.Message)
+    }
+    var result insertResponse
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return err
+    }
+    if len(result.InsertErrors) > 0 {
+        var messages []string
+        for _, e := range result.InsertErrors {
+            id := fmt.Sprint(e.Index)
+            if e.Index >= 0 && e.Index < len(rows) {
+                id = rows[e.Index].ID
+            }
+            for _, detail := range e.Errors {
+                messages = append(messages, fmt.Sprintf("row %s: %s", id, detail.Message))
+            }
+        }
+        return fmt.Errorf("bigquery: %s: %d rows rejected: %s", table, len(result.InsertErrors), strings.Join(messages, "; "))
+    }
+    return nil
+}
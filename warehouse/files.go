@@ -0,0 +1,52 @@
+package warehouse
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "fmt"
+    "path"
+
+    "new/backup"
+)
+
+// Files writes batches as gzipped newline delimited JSON files to a
+// directory or S3 bucket, partitioned by table and day:
+//
+//	<prefix>/<table>/dt=2006-01-02/20060102T150405.000000000Z-<first id>.ndjson.gz
+//
+// BigQuery, Athena, Redshift Spectrum and Snowflake load such files as
+// external tables or with their bulk loaders. They are not Parquet, which
+// would take an encoder this module does not depend on; the loaders
+// convert them when analysts need columnar files.
+type Files struct {
+    Store  backup.Store
+    Prefix string
+}
+
+func NewFiles(store backup.Store, prefix string) *Files {
+    return &Files{Store: store, Prefix: prefix}
+}
+
+func (f *Files) Name() string { return "files:" + f.Store.Name() }
+
+func (f *Files) Write(ctx context.Context, batch Batch) error {
+    if len(batch.Rows) == 0 {
+        return nil
+    }
+
+    var buf bytes.Buffer
+    gz := gzip.NewWriter(&buf)
+    for _, row := range batch.Rows {
+        gz.Write(row.JSON)
+        gz.Write([]byte{'\n'})
+    }
+    if err := gz.Close(); err != nil {
+        return err
+    }
+
+    at := batch.ExportedAt.UTC()
+    key := path.Join(f.Prefix, batch.Table, "dt="+at.Format("2006-01-02"),
+        fmt.Sprintf("%s-%s.ndjson.gz", at.Format("20060102T150405.000000000Z"), batch.Rows[0].ID))
+    return f.Store.Put(ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+}
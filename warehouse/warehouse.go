@@ -0,0 +1,34 @@
+// Package warehouse ships changed documents to an analytics warehouse
+// through pluggable writers.
+//
+// Rows are the JSON of documents as the API returns them, one batch per
+// table at a time. A batch may be shipped again after a failure, so rows
+// are deduplicated downstream on their id, keeping the latest updatedAt.
+package warehouse
+
+import (
+    "context"
+    "encoding/json"
+    "time"
+)
+
+// Row is a document of a table.
+type Row struct {
+    ID   string
+    JSON json.RawMessage
+}
+
+// Batch is the rows of a table changed since the previous batch, in the
+// order they changed.
+type Batch struct {
+    Table      string
+    Rows       []Row
+    ExportedAt time.Time
+}
+
+// Writer ships batches to a warehouse target. Write returns once the batch
+// is durably stored; a batch that fails is written again.
+type Writer interface {
+    Name() string
+    Write(ctx context.Context, batch Batch) error
+}
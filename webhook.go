@@ -0,0 +1,73 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+
+    "new/events"
+)
+
+// publishEvent records an event about an entity in the outbox, from which
+// relayOutbox posts it to WEBHOOK_URL as an events.Event. Its ID stays the
+// same across delivery attempts so receivers can drop duplicates. Called
+// with the context of withTransaction, the event is only recorded if the
+// transaction commits. Without a webhook URL events are dropped.
+func publishEvent(ctx context.Context, eventType string, entityID primitive.ObjectID, data interface{}) error {
+    if config.WebhookURL == "" {
+        return nil
+    }
+
+    event, err := events.New(eventType, data)
+    if err != nil {
+        return err
+    }
+    id := primitive.NewObjectID()
+    now := time.Now()
+    event.ID = id.Hex()
+    event.OccurredAt = now
+    event.Actor = actorFromContext(ctx)
+    event.EntityID = entityID.Hex()
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    return enqueueEvent(ctx, OutboxEvent{ID: id, Sink: SinkWebhook, Type: eventType, OccurredAt: now, Payload: payload})
+}
+
+// deliverEvent posts the body of an event to WEBHOOK_URL. Requests carry
+// an X-Signature header with the hex HMAC-SHA256 of the body under
+// WEBHOOK_SECRET so receivers can authenticate them, and the event id in
+// X-Event-ID.
+func deliverEvent(ctx context.Context, id, eventType string, body []byte) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.WebhookURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Event-ID", id)
+    if config.WebhookSecret != "" {
+        mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+        mac.Write(body)
+        req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+
+    resp, err := webhookClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook %s returned %s", eventType, resp.Status)
+    }
+    return nil
+}